@@ -0,0 +1,299 @@
+// Package audit keeps a trail of rate limit decisions: who was throttled,
+// when, by which policy and for how long. An Auditor is a core.Observer
+// that queues a Record for every denied grant, or every grant with All, and
+// writes them to a Sink in the background so a slow sink never holds up a
+// limiter. When the queue is full records are dropped and counted.
+//
+//	sink, err := audit.NewFileSink(audit.FileOptions{Path: "/var/log/throttle/audit.jsonl"})
+//	auditor := audit.NewAuditor(sink, audit.Options{})
+//	defer auditor.Close()
+//	limiter := core.NewLimiterWithOptions(backend, strategy, config, core.LimiterOptions{
+//		Policy:    "login",
+//		Observers: []core.Observer{auditor},
+//	})
+//
+// Sinks are provided for rotating JSON Lines files (FileSink) and Redis
+// Streams (RedisSink); anything else implements Sink.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// Auditor defaults
+const (
+	defaultBufferSize    = 10000
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultWriteTimeout  = 5 * time.Second
+)
+
+// Record is one audited decision
+type Record struct {
+	Time       time.Time      // When the decision was made
+	Key        string         // Who the decision was about
+	Policy     string         // LimiterOptions.Policy of the limiter
+	Operation  core.Operation // OpGrant or OpGrantMulti
+	Cost       int64          // Tokens asked for
+	Allowed    bool
+	Remaining  int64
+	RetryAfter time.Duration // How long the client was told to wait, if denied
+	Fallback   bool          // Decided locally because the usual decider was unreachable
+}
+
+// recordJSON is how a Record is encoded: retry-after in whole milliseconds,
+// rounded up, as clients are told
+type recordJSON struct {
+	Time         time.Time      `json:"time"`
+	Key          string         `json:"key"`
+	Policy       string         `json:"policy,omitempty"`
+	Operation    core.Operation `json:"operation"`
+	Cost         int64          `json:"cost"`
+	Allowed      bool           `json:"allowed"`
+	Remaining    int64          `json:"remaining"`
+	RetryAfterMS int64          `json:"retry_after_ms,omitempty"`
+	Fallback     bool           `json:"fallback,omitempty"`
+}
+
+// MarshalJSON encodes r as one object with snake_case fields
+func (r Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(recordJSON{
+		Time:         r.Time,
+		Key:          r.Key,
+		Policy:       r.Policy,
+		Operation:    r.Operation,
+		Cost:         r.Cost,
+		Allowed:      r.Allowed,
+		Remaining:    r.Remaining,
+		RetryAfterMS: core.CeilMillis(r.RetryAfter),
+		Fallback:     r.Fallback,
+	})
+}
+
+// UnmarshalJSON decodes a record encoded by MarshalJSON
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var v recordJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = Record{
+		Time:       v.Time,
+		Key:        v.Key,
+		Policy:     v.Policy,
+		Operation:  v.Operation,
+		Cost:       v.Cost,
+		Allowed:    v.Allowed,
+		Remaining:  v.Remaining,
+		RetryAfter: time.Duration(v.RetryAfterMS) * time.Millisecond,
+		Fallback:   v.Fallback,
+	}
+	return nil
+}
+
+// Sink stores audit records. An Auditor calls Write from a single
+// goroutine, with records in the order they were observed.
+type Sink interface {
+	// Write stores a batch of records
+	Write(ctx context.Context, records []Record) error
+
+	// Close releases the sink's resources once the auditor is done with it
+	Close() error
+}
+
+// Options configures an Auditor
+type Options struct {
+	All           bool          // Record allowed grants too, not only denials
+	BufferSize    int           // Records queued for the sink before new ones are dropped (default 10000)
+	BatchSize     int           // Most records written to the sink at once (default 100)
+	FlushInterval time.Duration // Longest a record waits for its batch to fill (default 1s)
+	WriteTimeout  time.Duration // Bound on each write to the sink (default 5s)
+
+	// OnError is called with a batch the sink failed to write. The batch is
+	// not retried; its records are counted as failed.
+	OnError func(err error, records []Record)
+}
+
+// Stats counts what became of observed records
+type Stats struct {
+	Written uint64 // Accepted by the sink
+	Dropped uint64 // Discarded because the queue was full or the auditor closed
+	Failed  uint64 // In batches the sink failed to write
+}
+
+// Auditor implements core.Observer by writing records of grant decisions
+// to a Sink
+type Auditor struct {
+	sink  Sink
+	opts  Options
+	queue chan Record
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+
+	// mu orders Observe's sends before Close, so drain sees every record
+	// that was queued
+	mu     sync.RWMutex
+	closed bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+}
+
+// NewAuditor creates an auditor and starts writing to sink
+func NewAuditor(sink Sink, opts Options) *Auditor {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultWriteTimeout
+	}
+
+	a := &Auditor{
+		sink:  sink,
+		opts:  opts,
+		queue: make(chan Record, opts.BufferSize),
+		done:  make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+// Observe queues a record of a denied grant, or of any grant with All.
+// It never blocks: when the queue is full the record is dropped.
+func (a *Auditor) Observe(ctx context.Context, event core.Event) {
+	if event.Err != nil || (event.Operation != core.OpGrant && event.Operation != core.OpGrantMulti) {
+		return
+	}
+	if event.Decision.Allowed && !a.opts.All {
+		return
+	}
+
+	record := Record{
+		Time:       event.Time,
+		Key:        event.Key,
+		Policy:     event.Policy,
+		Operation:  event.Operation,
+		Cost:       event.Cost,
+		Allowed:    event.Decision.Allowed,
+		Remaining:  event.Decision.Remaining,
+		RetryAfter: event.Decision.RetryAfter,
+		Fallback:   event.Fallback,
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		a.dropped.Add(1)
+		return
+	}
+	select {
+	case a.queue <- record:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// Stats returns how many records were written, dropped and failed so far
+func (a *Auditor) Stats() Stats {
+	return Stats{
+		Written: a.written.Load(),
+		Dropped: a.dropped.Load(),
+		Failed:  a.failed.Load(),
+	}
+}
+
+// Close writes the records still queued, stops and closes the sink
+func (a *Auditor) Close() error {
+	a.closeOnce.Do(func() {
+		a.mu.Lock()
+		a.closed = true
+		a.mu.Unlock()
+
+		close(a.done)
+		a.wg.Wait()
+		a.closeErr = a.sink.Close()
+	})
+	return a.closeErr
+}
+
+// run collects queued records into batches and writes them
+func (a *Auditor) run() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, a.opts.BatchSize)
+	for {
+		select {
+		case record := <-a.queue:
+			batch = append(batch, record)
+			if len(batch) == a.opts.BatchSize {
+				a.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				a.write(batch)
+				batch = batch[:0]
+			}
+		case <-a.done:
+			a.drain(batch)
+			return
+		}
+	}
+}
+
+// drain writes the partial batch and whatever was queued before Close
+func (a *Auditor) drain(batch []Record) {
+	for {
+		select {
+		case record := <-a.queue:
+			batch = append(batch, record)
+			if len(batch) == a.opts.BatchSize {
+				a.write(batch)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				a.write(batch)
+			}
+			return
+		}
+	}
+}
+
+// write passes a batch to the sink and accounts for the outcome
+func (a *Auditor) write(batch []Record) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.opts.WriteTimeout)
+	defer cancel()
+
+	if err := a.sink.Write(ctx, batch); err != nil {
+		a.failed.Add(uint64(len(batch)))
+		if a.opts.OnError != nil {
+			a.opts.OnError(err, append([]Record(nil), batch...))
+		}
+		return
+	}
+	a.written.Add(uint64(len(batch)))
+}
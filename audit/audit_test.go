@@ -0,0 +1,234 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// memorySink collects written records, optionally failing or blocking
+type memorySink struct {
+	mu      sync.Mutex
+	records []Record
+	batches int
+	err     error
+	block   chan struct{} // Write waits for it to close, if set
+	closed  bool
+}
+
+func (s *memorySink) Write(ctx context.Context, records []Record) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.records = append(s.records, records...)
+	s.batches++
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *memorySink) written() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Record(nil), s.records...)
+}
+
+func TestAuditor_RecordsDenials(t *testing.T) {
+	config := core.Config{Limit: 2, Interval: time.Hour, Burst: 2}
+	sink := &memorySink{}
+	auditor := NewAuditor(sink, Options{})
+	limiter := core.NewLimiterWithOptions(memory.NewBackend(), tokenbucket.NewStrategy(config), config, core.LimiterOptions{
+		Policy:    "login",
+		Observers: []core.Observer{auditor},
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := limiter.Grant(ctx, "user-1")
+		require.NoError(t, err)
+	}
+	_, err := limiter.Preview(ctx, "user-1")
+	require.NoError(t, err)
+	require.NoError(t, auditor.Close())
+
+	// Only the three denials, not the allowed grants or the preview
+	records := sink.written()
+	require.Len(t, records, 3)
+	for _, record := range records {
+		assert.Equal(t, "user-1", record.Key)
+		assert.Equal(t, "login", record.Policy)
+		assert.Equal(t, core.OpGrant, record.Operation)
+		assert.Equal(t, int64(1), record.Cost)
+		assert.False(t, record.Allowed)
+		assert.Positive(t, record.RetryAfter)
+		assert.WithinDuration(t, time.Now(), record.Time, time.Minute)
+	}
+	assert.True(t, sink.closed)
+	assert.Equal(t, Stats{Written: 3}, auditor.Stats())
+}
+
+func TestAuditor_All(t *testing.T) {
+	sink := &memorySink{}
+	auditor := NewAuditor(sink, Options{All: true})
+
+	ctx := context.Background()
+	auditor.Observe(ctx, core.Event{Operation: core.OpGrant, Key: "a", Decision: core.Decision{Allowed: true, Remaining: 4}})
+	auditor.Observe(ctx, core.Event{Operation: core.OpGrantMulti, Key: "b", Decision: core.Decision{RetryAfter: time.Second}})
+	auditor.Observe(ctx, core.Event{Operation: core.OpGrant, Key: "c", Err: errors.New("backend down")})
+	auditor.Observe(ctx, core.Event{Operation: core.OpClear, Key: "d"})
+	require.NoError(t, auditor.Close())
+
+	records := sink.written()
+	require.Len(t, records, 2)
+	assert.Equal(t, "a", records[0].Key)
+	assert.True(t, records[0].Allowed)
+	assert.Equal(t, int64(4), records[0].Remaining)
+	assert.Equal(t, "b", records[1].Key)
+	assert.Equal(t, core.OpGrantMulti, records[1].Operation)
+}
+
+func TestAuditor_Batches(t *testing.T) {
+	sink := &memorySink{}
+	auditor := NewAuditor(sink, Options{BatchSize: 10, FlushInterval: time.Hour})
+
+	for i := 0; i < 25; i++ {
+		auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "k"})
+	}
+
+	// Full batches go out without waiting for the interval
+	assert.Eventually(t, func() bool { return len(sink.written()) == 20 }, time.Second, time.Millisecond)
+
+	// Close writes the partial batch
+	require.NoError(t, auditor.Close())
+	assert.Len(t, sink.written(), 25)
+	assert.Equal(t, 3, sink.batches)
+}
+
+func TestAuditor_FlushInterval(t *testing.T) {
+	sink := &memorySink{}
+	auditor := NewAuditor(sink, Options{FlushInterval: 10 * time.Millisecond})
+	defer auditor.Close()
+
+	auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "k"})
+	assert.Eventually(t, func() bool { return len(sink.written()) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestAuditor_DropsWhenFull(t *testing.T) {
+	sink := &memorySink{block: make(chan struct{})}
+	auditor := NewAuditor(sink, Options{BufferSize: 5, BatchSize: 1})
+
+	// The first record is taken by the blocked write, the next five fill
+	// the queue and the rest are dropped without blocking
+	auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "k"})
+	assert.Eventually(t, func() bool { return len(auditor.queue) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 10; i++ {
+		auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "k"})
+	}
+	assert.Equal(t, uint64(5), auditor.Stats().Dropped)
+
+	close(sink.block)
+	require.NoError(t, auditor.Close())
+	assert.Equal(t, Stats{Written: 6, Dropped: 5}, auditor.Stats())
+
+	// Records observed after Close are dropped too
+	auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "k"})
+	assert.Equal(t, uint64(6), auditor.Stats().Dropped)
+}
+
+func TestAuditor_CloseAccountsForEveryRecord(t *testing.T) {
+	sink := &memorySink{}
+	auditor := NewAuditor(sink, Options{BufferSize: 100000})
+
+	// Observing races with Close; every record is either written or dropped
+	const observers, perObserver = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < observers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perObserver; j++ {
+				auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "k"})
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	require.NoError(t, auditor.Close())
+	wg.Wait()
+
+	stats := auditor.Stats()
+	assert.Equal(t, uint64(observers*perObserver), stats.Written+stats.Dropped)
+	assert.Len(t, sink.written(), int(stats.Written))
+}
+
+func TestAuditor_SinkErrors(t *testing.T) {
+	errFull := errors.New("disk full")
+	sink := &memorySink{err: errFull}
+
+	var mu sync.Mutex
+	var failed []Record
+	auditor := NewAuditor(sink, Options{OnError: func(err error, records []Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.ErrorIs(t, err, errFull)
+		failed = append(failed, records...)
+	}})
+
+	auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "a"})
+	auditor.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "b"})
+	require.NoError(t, auditor.Close())
+
+	assert.Equal(t, Stats{Failed: 2}, auditor.Stats())
+	require.Len(t, failed, 2)
+	assert.Equal(t, "a", failed[0].Key)
+}
+
+func TestRecord_JSON(t *testing.T) {
+	record := Record{
+		Time:       time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+		Key:        "user-1",
+		Policy:     "login",
+		Operation:  core.OpGrant,
+		Cost:       1,
+		RetryAfter: 1500 * time.Microsecond,
+		Fallback:   true,
+	}
+
+	data, err := json.Marshal(record)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"time": "2026-01-02T15:04:05Z",
+		"key": "user-1",
+		"policy": "login",
+		"operation": "grant",
+		"cost": 1,
+		"allowed": false,
+		"remaining": 0,
+		"retry_after_ms": 2,
+		"fallback": true
+	}`, string(data))
+
+	// Retry-after is rounded up to what clients are told
+	var decoded Record
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	record.RetryAfter = 2 * time.Millisecond
+	assert.Equal(t, record, decoded)
+}
@@ -0,0 +1,217 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File sink defaults
+const defaultMaxSize = 100 << 20
+
+// rotatedTimeFormat stamps rotated files; it sorts chronologically
+const rotatedTimeFormat = "20060102T150405.000000000Z"
+
+// FileOptions configures a FileSink
+type FileOptions struct {
+	Path       string // The file records are appended to, one JSON object per line
+	MaxSize    int64  // Bytes after which the file is rotated (default 100 MiB)
+	MaxBackups int    // Rotated files kept, the oldest removed first (default 0: all)
+	Sync       bool   // Whether every write is synced to disk before it counts as written
+}
+
+// FileSink implements Sink by appending JSON Lines to a file. When the file
+// would grow past MaxSize it is renamed with the time of rotation inserted
+// before its extension, such as audit-20260102T150405.000000000Z.jsonl, and
+// a new file is started.
+type FileSink struct {
+	opts FileOptions
+	now  func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink opens the file, creating it and its directory if needed
+func NewFileSink(opts FileOptions) (*FileSink, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("audit: file path is required")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxSize
+	}
+
+	s := &FileSink{opts: opts, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create audit directory: %w", err)
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write appends records, rotating between them when the file is full. A
+// single record larger than MaxSize still gets a file of its own.
+func (s *FileSink) Write(ctx context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("audit: file sink is closed")
+	}
+
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit record: %w", err)
+		}
+		line = append(line, '\n')
+
+		if s.size+int64(buf.Len()+len(line)) > s.opts.MaxSize && s.size+int64(buf.Len()) > 0 {
+			if err := s.flush(&buf); err != nil {
+				return err
+			}
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		buf.Write(line)
+	}
+	return s.flush(&buf)
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// open opens the file for appending; the caller holds mu
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// flush writes buf to the file and empties it; the caller holds mu
+func (s *FileSink) flush(buf *bytes.Buffer) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+	buf.Reset()
+	if err != nil {
+		return fmt.Errorf("failed to write audit file: %w", err)
+	}
+	if s.opts.Sync {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync audit file: %w", err)
+		}
+	}
+	return nil
+}
+
+// rotate renames the full file, starts a new one and removes the backups
+// beyond MaxBackups. If the rename fails, the full file is reopened so
+// later writes still land in it. The caller holds mu.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit file: %w", err)
+	}
+	s.file = nil
+
+	ext := filepath.Ext(s.opts.Path)
+	rotated := strings.TrimSuffix(s.opts.Path, ext) + "-" + s.now().UTC().Format(rotatedTimeFormat) + ext
+	if err := os.Rename(s.opts.Path, rotated); err != nil {
+		// Keep appending to the full file rather than closing the sink
+		if openErr := s.open(); openErr != nil {
+			return errors.Join(fmt.Errorf("failed to rotate audit file: %w", err), openErr)
+		}
+		return fmt.Errorf("failed to rotate audit file: %w", err)
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if s.opts.MaxBackups > 0 {
+		backups, err := Backups(s.opts.Path)
+		if err != nil {
+			return err
+		}
+		for len(backups) > s.opts.MaxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// Backups returns the files a FileSink writing to path has rotated, oldest
+// first
+func Backups(path string) ([]string, error) {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list audit files: %w", err)
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() || !strings.HasSuffix(rest, ext) {
+			continue
+		}
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimSuffix(rest, ext)); err == nil {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// Files returns the rotated backups of path, oldest first, followed by path
+// itself if it exists: every file a FileSink writing to path has filled
+func Files(path string) ([]string, error) {
+	files, err := Backups(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/core"
+)
+
+// testRecords returns n denials of key, a second apart
+func testRecords(key string, n int, start time.Time) []Record {
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = Record{
+			Time:       start.Add(time.Duration(i) * time.Second),
+			Key:        key,
+			Operation:  core.OpGrant,
+			Cost:       1,
+			RetryAfter: time.Second,
+		}
+	}
+	return records
+}
+
+func TestFileSink_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "audit.jsonl")
+	sink, err := NewFileSink(FileOptions{Path: path})
+	require.NoError(t, err)
+
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	require.NoError(t, sink.Write(context.Background(), testRecords("a", 2, start)))
+	require.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"time":"2026-01-02T15:00:00Z","key":"a","operation":"grant","cost":1,"allowed":false,"remaining":0,"retry_after_ms":1000}`, lines[0])
+
+	// Reopening appends
+	sink, err = NewFileSink(FileOptions{Path: path})
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), testRecords("b", 1, start)))
+	require.NoError(t, sink.Close())
+
+	var keys []string
+	require.NoError(t, ReadFiles([]string{path}, Query{}, func(r Record) error {
+		keys = append(keys, r.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "a", "b"}, keys)
+
+	assert.Error(t, sink.Write(context.Background(), testRecords("c", 1, start)))
+}
+
+func TestFileSink_Rotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	line, err := testRecords("k", 1, time.Unix(1700000000, 0).UTC())[0].MarshalJSON()
+	require.NoError(t, err)
+
+	// Room for three records per file
+	sink, err := NewFileSink(FileOptions{Path: path, MaxSize: int64(3*(len(line)+1) + 1), MaxBackups: 2})
+	require.NoError(t, err)
+	now := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	// Ten records fill three files and start a fourth; the oldest is removed
+	records := testRecords("k", 10, time.Unix(1700000000, 0).UTC())
+	require.NoError(t, sink.Write(context.Background(), records[:4]))
+	require.NoError(t, sink.Write(context.Background(), records[4:]))
+	require.NoError(t, sink.Close())
+
+	files, err := Files(path)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	assert.Equal(t, filepath.Join(dir, "audit-20260102T150000.002000000Z.jsonl"), files[0])
+	assert.Equal(t, filepath.Join(dir, "audit-20260102T150000.003000000Z.jsonl"), files[1])
+	assert.Equal(t, path, files[2])
+
+	var times []time.Time
+	require.NoError(t, ReadFiles(files, Query{}, func(r Record) error {
+		times = append(times, r.Time)
+		return nil
+	}))
+	require.Len(t, times, 7)
+	for i, tm := range times {
+		assert.True(t, records[i+3].Time.Equal(tm))
+	}
+}
+
+func TestFileSink_RotateFailureKeepsWriting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	line, err := testRecords("k", 1, time.Unix(1700000000, 0).UTC())[0].MarshalJSON()
+	require.NoError(t, err)
+
+	sink, err := NewFileSink(FileOptions{Path: path, MaxSize: int64(len(line) + 2)})
+	require.NoError(t, err)
+	now := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+
+	// A directory in the way of the rotated name makes the rename fail
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "audit-20260102T150000.000000000Z.jsonl"), 0o750))
+
+	records := testRecords("k", 3, time.Unix(1700000000, 0).UTC())
+	require.NoError(t, sink.Write(context.Background(), records[:1]))
+	assert.ErrorContains(t, sink.Write(context.Background(), records[1:2]), "failed to rotate audit file")
+
+	// The sink is still open and appends to the full file
+	require.NoError(t, os.Remove(filepath.Join(dir, "audit-20260102T150000.000000000Z.jsonl")))
+	require.NoError(t, sink.Write(context.Background(), records[2:]))
+	require.NoError(t, sink.Close())
+
+	files, err := Files(path)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestBackups_IgnoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"audit-20260102T150000.000000000Z.jsonl",
+		"audit-old.jsonl",
+		"audit-20260102T150000.000000000Z.txt",
+		"other-20260102T150000.000000000Z.jsonl",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o600))
+	}
+
+	backups, err := Backups(filepath.Join(dir, "audit.jsonl"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "audit-20260102T150000.000000000Z.jsonl")}, backups)
+
+	files, err := Files(filepath.Join(dir, "missing", "audit.jsonl"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,185 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// ErrStop can be returned by the callback of Read and ReadFiles to stop
+// reading without an error
+var ErrStop = errors.New("audit: stop reading")
+
+// maxLineSize bounds a line of an audit file
+const maxLineSize = 1 << 20
+
+// Query selects audit records. The zero Query matches every record.
+type Query struct {
+	Key        string    // Glob matched against keys with the syntax of core.Match; empty matches any key
+	Policy     string    // Exact policy; empty matches any
+	Since      time.Time // Records at or after this time, if set
+	Until      time.Time // Records before this time, if set
+	DeniedOnly bool      // Skip allowed decisions, recorded with Options.All
+}
+
+// Matches reports whether record is selected by q
+func (q Query) Matches(record Record) bool {
+	switch {
+	case q.Key != "" && !core.Match(q.Key, record.Key):
+		return false
+	case q.Policy != "" && record.Policy != q.Policy:
+		return false
+	case !q.Since.IsZero() && record.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !record.Time.Before(q.Until):
+		return false
+	case q.DeniedOnly && record.Allowed:
+		return false
+	}
+	return true
+}
+
+// maxReportedLines bounds the line numbers a MalformedError lists
+const maxReportedLines = 10
+
+// MalformedError reports the lines Read skipped because they didn't hold a
+// record, such as a line torn by a crash mid-write. The records on every
+// other line were still read.
+type MalformedError struct {
+	Path  string // File the lines are in, set by ReadFiles
+	Lines []int  // Numbers of the first skipped lines
+	Count int    // Number of skipped lines
+}
+
+func (e *MalformedError) Error() string {
+	msg := fmt.Sprintf("skipped %d malformed audit lines (first on lines %v)", e.Count, e.Lines)
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	return msg
+}
+
+// add records a skipped line
+func (e *MalformedError) add(line int) {
+	e.Count++
+	if len(e.Lines) < maxReportedLines {
+		e.Lines = append(e.Lines, line)
+	}
+}
+
+// Read decodes JSON Lines records from r and calls fn with those matching
+// q, in order. Blank lines are skipped. Lines that don't decode, or are
+// longer than 1 MiB, are skipped too and reported once reading is done with
+// a *MalformedError.
+func Read(r io.Reader, q Query, fn func(Record) error) error {
+	reader := bufio.NewReaderSize(r, 64<<10)
+	malformed := &MalformedError{}
+
+	for line := 1; ; line++ {
+		data, tooLong, err := readLine(reader)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read audit records: %w", err)
+		}
+
+		switch {
+		case tooLong:
+			malformed.add(line)
+		case len(data) > 0:
+			var record Record
+			if err := json.Unmarshal(data, &record); err != nil {
+				malformed.add(line)
+				break
+			}
+			if !q.Matches(record) {
+				break
+			}
+			if err := fn(record); err != nil {
+				if errors.Is(err, ErrStop) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if malformed.Count > 0 {
+		return malformed
+	}
+	return nil
+}
+
+// readLine returns the next line without its line ending. A line longer
+// than maxLineSize is consumed and reported as tooLong.
+func readLine(reader *bufio.Reader) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > maxLineSize+1 {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return bytes.TrimRight(line, "\r\n"), tooLong, err
+	}
+}
+
+// ReadFiles is Read over each file in turn. Pass the result of Files to
+// read a FileSink's trail in the order it was written. Malformed lines
+// don't stop it; the MalformedErrors of all files are returned joined.
+func ReadFiles(paths []string, q Query, fn func(Record) error) error {
+	stopped := false
+	stop := func(record Record) error {
+		err := fn(record)
+		if errors.Is(err, ErrStop) {
+			stopped = true
+		}
+		return err
+	}
+
+	var malformed []error
+	for _, path := range paths {
+		err := readFile(path, q, stop)
+		var m *MalformedError
+		if errors.As(err, &m) {
+			m.Path = path
+			malformed = append(malformed, m)
+		} else if err != nil {
+			return err
+		}
+		if stopped {
+			break
+		}
+	}
+	return errors.Join(malformed...)
+}
+
+// readFile is Read over one file
+func readFile(path string, q Query, fn func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	defer file.Close()
+
+	err = Read(file, q, fn)
+	var malformed *MalformedError
+	if err != nil && !errors.As(err, &malformed) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return err
+}
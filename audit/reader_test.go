@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/core"
+)
+
+func TestQuery_Matches(t *testing.T) {
+	at := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	record := Record{Time: at, Key: "user:42", Policy: "login", Operation: core.OpGrant}
+
+	tests := []struct {
+		name  string
+		query Query
+		want  bool
+	}{
+		{"zero", Query{}, true},
+		{"exact key", Query{Key: "user:42"}, true},
+		{"key glob", Query{Key: "user:*"}, true},
+		{"other key", Query{Key: "user:43"}, false},
+		{"policy", Query{Policy: "login"}, true},
+		{"other policy", Query{Policy: "api"}, false},
+		{"since is inclusive", Query{Since: at}, true},
+		{"after since", Query{Since: at.Add(time.Second)}, false},
+		{"until is exclusive", Query{Until: at}, false},
+		{"before until", Query{Until: at.Add(time.Second)}, true},
+		{"denied only", Query{DeniedOnly: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.query.Matches(record))
+		})
+	}
+
+	record.Allowed = true
+	assert.False(t, Query{DeniedOnly: true}.Matches(record))
+}
+
+func TestRead(t *testing.T) {
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	var input strings.Builder
+	for i, record := range append(testRecords("user:1", 3, start), testRecords("user:2", 3, start)...) {
+		data, err := record.MarshalJSON()
+		require.NoError(t, err)
+		input.Write(data)
+		input.WriteString("\n")
+		if i == 2 {
+			input.WriteString("\n")
+		}
+	}
+
+	var got []string
+	err := Read(strings.NewReader(input.String()), Query{Key: "user:?", Since: start.Add(time.Second)}, func(r Record) error {
+		got = append(got, fmt.Sprintf("%s@%d", r.Key, r.Time.Sub(start)/time.Second))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user:1@1", "user:1@2", "user:2@1", "user:2@2"}, got)
+
+	// ErrStop ends reading early without an error
+	got = nil
+	err = Read(strings.NewReader(input.String()), Query{Key: "user:2"}, func(r Record) error {
+		got = append(got, r.Key)
+		return ErrStop
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user:2"}, got)
+}
+
+func TestRead_Malformed(t *testing.T) {
+	input := `{"time":"2026-01-02T15:00:00Z","key":"a","operation":"grant"}` + "\n" +
+		"not json\n" +
+		`{"time":"2026-01-02T15:00:01Z","key":"b","operation":"grant"}` + "\n" +
+		`{"time":"2026-01-02T15:00:02Z","key":"c","op` // Torn by a crash
+
+	var got []string
+	err := Read(strings.NewReader(input), Query{}, func(r Record) error {
+		got = append(got, r.Key)
+		return nil
+	})
+	assert.Equal(t, []string{"a", "b"}, got)
+
+	var malformed *MalformedError
+	require.ErrorAs(t, err, &malformed)
+	assert.Equal(t, []int{2, 4}, malformed.Lines)
+	assert.Equal(t, 2, malformed.Count)
+}
+
+func TestRead_LongLine(t *testing.T) {
+	input := strings.Repeat("x", maxLineSize+10) + "\n" +
+		`{"time":"2026-01-02T15:00:00Z","key":"a","operation":"grant"}` + "\n"
+
+	var got []string
+	err := Read(strings.NewReader(input), Query{}, func(r Record) error {
+		got = append(got, r.Key)
+		return nil
+	})
+	assert.Equal(t, []string{"a"}, got)
+
+	var malformed *MalformedError
+	require.ErrorAs(t, err, &malformed)
+	assert.Equal(t, []int{1}, malformed.Lines)
+}
+
+func TestReadFiles_Malformed(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "audit-1.jsonl")
+	second := filepath.Join(dir, "audit-2.jsonl")
+	require.NoError(t, os.WriteFile(first, []byte("not json\n"), 0o600))
+	require.NoError(t, os.WriteFile(second, []byte(`{"time":"2026-01-02T15:00:00Z","key":"a","operation":"grant"}`+"\n"), 0o600))
+
+	var got []string
+	err := ReadFiles([]string{first, second}, Query{}, func(r Record) error {
+		got = append(got, r.Key)
+		return nil
+	})
+	assert.Equal(t, []string{"a"}, got)
+
+	var malformed *MalformedError
+	require.ErrorAs(t, err, &malformed)
+	assert.Equal(t, first, malformed.Path)
+	assert.ErrorContains(t, err, first)
+}
+
+func TestReadFiles_Missing(t *testing.T) {
+	err := ReadFiles([]string{"/nonexistent/audit.jsonl"}, Query{}, func(Record) error { return nil })
+	assert.ErrorContains(t, err, "failed to open audit file")
+}
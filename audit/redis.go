@@ -0,0 +1,85 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/throttle/core"
+)
+
+// Redis sink defaults
+const defaultStream = "throttle:audit"
+
+// RedisOptions configures a RedisSink
+type RedisOptions struct {
+	Stream string // Key of the stream records are added to (default "throttle:audit")
+	MaxLen int64  // Approximate number of entries kept, trimming the oldest (default 0: unbounded)
+}
+
+// RedisSink implements Sink by adding records to a Redis Stream, one entry
+// per record with the fields of its JSON encoding. Entry IDs are assigned
+// by Redis, so consumers can read the trail with XRANGE or XREAD and keep
+// their place in it. Share the connections of a Redis backend with
+//
+//	sink := audit.NewRedisSink(backend.Client(), audit.RedisOptions{})
+type RedisSink struct {
+	client redis.UniversalClient
+	opts   RedisOptions
+}
+
+// NewRedisSink creates a sink adding to a stream through client. Closing
+// the sink leaves the client open.
+func NewRedisSink(client redis.UniversalClient, opts RedisOptions) *RedisSink {
+	if opts.Stream == "" {
+		opts.Stream = defaultStream
+	}
+	return &RedisSink{client: client, opts: opts}
+}
+
+// Write adds records to the stream in one pipeline
+func (s *RedisSink) Write(ctx context.Context, records []Record) error {
+	pipe := s.client.Pipeline()
+	for _, record := range records {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.opts.Stream,
+			MaxLen: s.opts.MaxLen,
+			Approx: s.opts.MaxLen > 0,
+			Values: streamValues(record),
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to add audit records to stream: %w", err)
+	}
+	return nil
+}
+
+// Close does nothing: the client belongs to the caller
+func (s *RedisSink) Close() error {
+	return nil
+}
+
+// streamValues returns the fields of a stream entry for record, named and
+// formatted like its JSON encoding
+func streamValues(record Record) []string {
+	values := []string{
+		"time", record.Time.UTC().Format(time.RFC3339Nano),
+		"key", record.Key,
+		"operation", string(record.Operation),
+		"cost", strconv.FormatInt(record.Cost, 10),
+		"allowed", strconv.FormatBool(record.Allowed),
+		"remaining", strconv.FormatInt(record.Remaining, 10),
+	}
+	if record.Policy != "" {
+		values = append(values, "policy", record.Policy)
+	}
+	if record.RetryAfter > 0 {
+		values = append(values, "retry_after_ms", strconv.FormatInt(core.CeilMillis(record.RetryAfter), 10))
+	}
+	if record.Fallback {
+		values = append(values, "fallback", "true")
+	}
+	return values
+}
@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	throttleredis "github.com/throttle/backend/redis"
+	"github.com/throttle/backend/redis/redistest"
+	"github.com/throttle/core"
+)
+
+func TestRedisSink_Write(t *testing.T) {
+	srv := redistest.Start(t)
+	backend := throttleredis.NewBackend(redis.NewClient(&redis.Options{Addr: srv.Addr()}), "test")
+	defer backend.Close()
+
+	sink := NewRedisSink(backend.Client(), RedisOptions{})
+	records := []Record{
+		{
+			Time:       time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+			Key:        "user-1",
+			Policy:     "login",
+			Operation:  core.OpGrant,
+			Cost:       1,
+			RetryAfter: 1500 * time.Millisecond,
+		},
+		{
+			Time:      time.Date(2026, 1, 2, 15, 4, 6, 0, time.UTC),
+			Key:       "user-2",
+			Operation: core.OpGrantMulti,
+			Cost:      1,
+			Allowed:   true,
+			Remaining: 3,
+			Fallback:  true,
+		},
+	}
+	require.NoError(t, sink.Write(context.Background(), records))
+	require.NoError(t, sink.Close())
+
+	// Closing the sink leaves the backend's client usable
+	entries, err := backend.Client().XRange(context.Background(), "throttle:audit", "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, map[string]interface{}{
+		"time":           "2026-01-02T15:04:05Z",
+		"key":            "user-1",
+		"policy":         "login",
+		"operation":      "grant",
+		"cost":           "1",
+		"allowed":        "false",
+		"remaining":      "0",
+		"retry_after_ms": "1500",
+	}, entries[0].Values)
+	assert.Equal(t, map[string]interface{}{
+		"time":      "2026-01-02T15:04:06Z",
+		"key":       "user-2",
+		"operation": "grant_multi",
+		"cost":      "1",
+		"allowed":   "true",
+		"remaining": "3",
+		"fallback":  "true",
+	}, entries[1].Values)
+}
+
+func TestRedisSink_MaxLen(t *testing.T) {
+	srv := redistest.Start(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+
+	sink := NewRedisSink(client, RedisOptions{Stream: "audit", MaxLen: 5})
+	require.NoError(t, sink.Write(context.Background(), testRecords("k", 12, time.Now())))
+
+	// Trimming is approximate on a real Redis, exact on the stand-in
+	n, err := client.XLen(context.Background(), "audit").Result()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, n, int64(5))
+	assert.Less(t, n, int64(12))
+}
+
+func TestRedisSink_Unreachable(t *testing.T) {
+	srv := redistest.Start(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr(), MaxRetries: -1})
+	defer client.Close()
+	require.NoError(t, srv.Close())
+
+	sink := NewRedisSink(client, RedisOptions{})
+	assert.Error(t, sink.Write(context.Background(), testRecords("k", 1, time.Now())))
+}
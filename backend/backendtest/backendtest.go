@@ -0,0 +1,571 @@
+// Package backendtest provides a conformance suite that every core.Backend
+// implementation runs from its own tests, so behaviour that callers rely on
+// (nil for missing keys, copy semantics, context handling...) is checked the
+// same way everywhere:
+//
+//	func TestBackend_Conformance(t *testing.T) {
+//		backendtest.RunConformance(t, func(t *testing.T) core.Backend {
+//			return NewBackend()
+//		})
+//	}
+package backendtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/core"
+)
+
+// Factory returns a new, empty backend. It is called once per subtest; the
+// suite closes the backend when the subtest ends.
+type Factory func(t *testing.T) core.Backend
+
+// Option enables optional parts of the suite
+type Option func(*suite)
+
+// WithExpiry runs the expiry tests. Backends from the factory must drop keys
+// that haven't been written for ttl, and advance must move the clock of
+// backend forward by d (by sleeping if the backend uses the wall clock).
+// States written by the suite have LastUpdate set to the wall clock plus
+// everything advanced so far.
+func WithExpiry(ttl time.Duration, advance func(backend core.Backend, d time.Duration)) Option {
+	return func(s *suite) {
+		s.ttl = ttl
+		s.advance = advance
+	}
+}
+
+// WithNormalize is for backends that don't store states verbatim, such as
+// counters that report their current window. normalize turns a state that
+// was written into the state Get is expected to return, or nil if Get is
+// expected to report the key as missing.
+func WithNormalize(normalize func(state *core.State) *core.State) Option {
+	return func(s *suite) {
+		s.normalize = normalize
+	}
+}
+
+// WithGrowOnly is for backends whose counts only grow until the key is
+// deleted, such as replicated counters: Overwrite only writes larger counts
+func WithGrowOnly() Option {
+	return func(s *suite) {
+		s.growOnly = true
+	}
+}
+
+type suite struct {
+	factory   Factory
+	ttl       time.Duration
+	advance   func(backend core.Backend, d time.Duration)
+	normalize func(state *core.State) *core.State
+	growOnly  bool
+}
+
+// RunConformance runs the conformance suite against backends created by
+// factory. Atomic updates, batch operations, key iteration, pings and
+// statistics are tested too when the backends implement core.Updater,
+// core.BatchBackend, core.Iterator, core.Pinger or core.StatsProvider.
+func RunConformance(t *testing.T, factory Factory, opts ...Option) {
+	s := &suite{
+		factory:   factory,
+		normalize: func(state *core.State) *core.State { return state },
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	t.Run("MissingKey", s.testMissingKey)
+	t.Run("SetGet", s.testSetGet)
+	t.Run("Overwrite", s.testOverwrite)
+	t.Run("Delete", s.testDelete)
+	t.Run("KeyIsolation", s.testKeyIsolation)
+	t.Run("CopySemantics", s.testCopySemantics)
+	t.Run("Concurrency", s.testConcurrency)
+	t.Run("ContextCancellation", s.testContextCancellation)
+	t.Run("Close", s.testClose)
+	t.Run("Expiry", s.testExpiry)
+	t.Run("Update", s.testUpdate)
+	t.Run("Batch", s.testBatch)
+	t.Run("Iterate", s.testIterate)
+	t.Run("Ping", s.testPing)
+	t.Run("Stats", s.testStats)
+}
+
+// backend creates a backend that is closed when the subtest ends
+func (s *suite) backend(t *testing.T) core.Backend {
+	backend := s.factory(t)
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+// state returns a state written now with the given tokens
+func (s *suite) state(tokens float64, offset time.Duration) *core.State {
+	now := time.Now().Add(offset)
+	return &core.State{
+		Tokens:     tokens,
+		LastUpdate: now,
+		Created:    now.Add(-time.Minute),
+	}
+}
+
+// assertState checks that Get returned what was written
+func (s *suite) assertState(t *testing.T, written, got *core.State) {
+	t.Helper()
+
+	want := s.normalize(copyState(written))
+	if want == nil {
+		assert.Nil(t, got)
+		return
+	}
+	if !assert.NotNil(t, got) {
+		return
+	}
+	assert.Equal(t, want.Tokens, got.Tokens)
+	assert.True(t, want.LastUpdate.Equal(got.LastUpdate), "LastUpdate: want %v, got %v", want.LastUpdate, got.LastUpdate)
+	assert.True(t, want.Created.Equal(got.Created), "Created: want %v, got %v", want.Created, got.Created)
+}
+
+func (s *suite) testMissingKey(t *testing.T) {
+	backend := s.backend(t)
+	ctx := context.Background()
+
+	state, err := backend.Get(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, state, "Get must return nil, not an empty state, for a missing key")
+
+	assert.NoError(t, backend.Delete(ctx, "missing"), "deleting a missing key is not an error")
+}
+
+func (s *suite) testSetGet(t *testing.T) {
+	backend := s.backend(t)
+	ctx := context.Background()
+
+	for _, tokens := range []float64{0, 1, 7.25, 1e6} {
+		key := fmt.Sprintf("tokens-%v", tokens)
+		written := s.state(tokens, 0)
+		require.NoError(t, backend.Set(ctx, key, written))
+
+		got, err := backend.Get(ctx, key)
+		require.NoError(t, err)
+		s.assertState(t, written, got)
+	}
+}
+
+func (s *suite) testOverwrite(t *testing.T) {
+	backend := s.backend(t)
+	ctx := context.Background()
+
+	require.NoError(t, backend.Set(ctx, "key", s.state(10, 0)))
+
+	overwrites := []float64{3, 12}
+	if s.growOnly {
+		overwrites = []float64{12, 15}
+	}
+	for _, tokens := range overwrites {
+		written := s.state(tokens, 0)
+		require.NoError(t, backend.Set(ctx, "key", written))
+
+		got, err := backend.Get(ctx, "key")
+		require.NoError(t, err)
+		s.assertState(t, written, got)
+	}
+}
+
+func (s *suite) testDelete(t *testing.T) {
+	backend := s.backend(t)
+	ctx := context.Background()
+
+	require.NoError(t, backend.Set(ctx, "key", s.state(5, 0)))
+	require.NoError(t, backend.Set(ctx, "other", s.state(6, 0)))
+	require.NoError(t, backend.Delete(ctx, "key"))
+
+	got, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Deleting twice is fine, other keys are untouched
+	assert.NoError(t, backend.Delete(ctx, "key"))
+	got, err = backend.Get(ctx, "other")
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+
+	// A deleted key can be written again
+	written := s.state(2, 0)
+	require.NoError(t, backend.Set(ctx, "key", written))
+	got, err = backend.Get(ctx, "key")
+	require.NoError(t, err)
+	s.assertState(t, written, got)
+}
+
+func (s *suite) testKeyIsolation(t *testing.T) {
+	backend := s.backend(t)
+	ctx := context.Background()
+
+	// Keys that a careless encoding might make collide or break
+	keys := []string{
+		"key", "Key", "key ", " key", "key:1", "key:{1}", "{key}", "key*", "key?",
+		"user@example.com", "192.168.0.1", "2001:db8::1", "ключ", "🔑", "a/b\\c",
+		"with\nnewline", strings.Repeat("long", 100), "",
+	}
+
+	written := make([]*core.State, len(keys))
+	for i, key := range keys {
+		written[i] = s.state(float64(i+1), 0)
+		require.NoError(t, backend.Set(ctx, key, written[i]), "key %q", key)
+	}
+	for i, key := range keys {
+		got, err := backend.Get(ctx, key)
+		require.NoError(t, err, "key %q", key)
+		s.assertState(t, written[i], got)
+	}
+}
+
+func (s *suite) testCopySemantics(t *testing.T) {
+	backend := s.backend(t)
+	ctx := context.Background()
+
+	written := s.state(5, 0)
+	stored := copyState(written)
+	require.NoError(t, backend.Set(ctx, "key", written))
+
+	// Changing the state after Set doesn't change what is stored
+	written.Tokens = 100
+	written.LastUpdate = written.LastUpdate.Add(time.Hour)
+
+	got, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	s.assertState(t, stored, got)
+
+	// Neither does changing what Get returned
+	got.Tokens = 200
+	got, err = backend.Get(ctx, "key")
+	require.NoError(t, err)
+	s.assertState(t, stored, got)
+}
+
+func (s *suite) testConcurrency(t *testing.T) {
+	backend := s.backend(t)
+	ctx := context.Background()
+
+	const (
+		workers    = 16
+		iterations = 25
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			own := fmt.Sprintf("worker-%d", w)
+			for i := 0; i < iterations; i++ {
+				// A key only this worker writes reads back its own value
+				written := s.state(float64(w*iterations+i+1), 0)
+				if !assert.NoError(t, backend.Set(ctx, own, written)) {
+					return
+				}
+				got, err := backend.Get(ctx, own)
+				if !assert.NoError(t, err) {
+					return
+				}
+				s.assertState(t, written, got)
+
+				// A key every worker writes never errors
+				assert.NoError(t, backend.Set(ctx, "shared", s.state(float64(w+1), 0)))
+				_, err = backend.Get(ctx, "shared")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := backend.Get(ctx, "shared")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.GreaterOrEqual(t, got.Tokens, 1.0)
+	assert.LessOrEqual(t, got.Tokens, float64(workers))
+}
+
+func (s *suite) testContextCancellation(t *testing.T) {
+	backend := s.backend(t)
+
+	require.NoError(t, backend.Set(context.Background(), "key", s.state(5, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := backend.Get(ctx, "key")
+	assert.ErrorIs(t, err, context.Canceled, "Get")
+	assert.ErrorIs(t, backend.Set(ctx, "key", s.state(6, 0)), context.Canceled, "Set")
+	assert.ErrorIs(t, backend.Delete(ctx, "key"), context.Canceled, "Delete")
+
+	// Nothing was changed by the cancelled calls
+	got, err := backend.Get(context.Background(), "key")
+	require.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, s.normalize(s.state(5, 0)).Tokens, got.Tokens)
+	}
+}
+
+func (s *suite) testClose(t *testing.T) {
+	backend := s.factory(t)
+
+	require.NoError(t, backend.Set(context.Background(), "key", s.state(5, 0)))
+	assert.NoError(t, backend.Close())
+
+	// Closing again may report an error but must not panic
+	assert.NotPanics(t, func() { backend.Close() })
+}
+
+func (s *suite) testExpiry(t *testing.T) {
+	if s.advance == nil {
+		t.Skip("backend does not expire keys")
+	}
+
+	backend := s.backend(t)
+	ctx := context.Background()
+	var elapsed time.Duration
+	advance := func(d time.Duration) {
+		s.advance(backend, d)
+		elapsed += d
+	}
+
+	require.NoError(t, backend.Set(ctx, "idle", s.state(5, elapsed)))
+	require.NoError(t, backend.Set(ctx, "active", s.state(5, elapsed)))
+
+	// Still there before the TTL
+	advance(s.ttl / 2)
+	got, err := backend.Get(ctx, "idle")
+	require.NoError(t, err)
+	assert.NotNil(t, got, "key expired before its TTL")
+
+	// Writing restarts the TTL
+	written := s.state(6, elapsed)
+	require.NoError(t, backend.Set(ctx, "active", written))
+
+	advance(s.ttl/2 + s.ttl/4)
+	got, err = backend.Get(ctx, "idle")
+	require.NoError(t, err)
+	assert.Nil(t, got, "key outlived its TTL")
+
+	got, err = backend.Get(ctx, "active")
+	require.NoError(t, err)
+	s.assertState(t, written, got)
+}
+
+func (s *suite) testUpdate(t *testing.T) {
+	backend := s.backend(t)
+	updater, ok := backend.(core.Updater)
+	if !ok {
+		t.Skip("backend does not implement core.Updater")
+	}
+	ctx := context.Background()
+
+	// Missing keys are passed as nil
+	written := s.state(3, 0)
+	err := updater.Update(ctx, "key", func(state *core.State) (*core.State, error) {
+		assert.Nil(t, state)
+		return copyState(written), nil
+	})
+	require.NoError(t, err)
+	got, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	s.assertState(t, written, got)
+
+	// An error from fn aborts the update
+	errAbort := errors.New("abort")
+	err = updater.Update(ctx, "key", func(state *core.State) (*core.State, error) {
+		state.Tokens = 100
+		return state, errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+	got, err = backend.Get(ctx, "key")
+	require.NoError(t, err)
+	s.assertState(t, written, got)
+
+	// Concurrent increments are never lost
+	const workers = 16
+	var succeeded atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := updater.Update(ctx, "counter", func(state *core.State) (*core.State, error) {
+				if state == nil {
+					state = s.state(0, 0)
+				}
+				state.Tokens++
+				return state, nil
+			})
+			if err == nil {
+				succeeded.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Greater(t, succeeded.Load(), int64(0))
+	got, err = backend.Get(ctx, "counter")
+	require.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, float64(succeeded.Load()), got.Tokens)
+	}
+
+	// Cancelled contexts are honoured
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = updater.Update(cancelled, "key", func(state *core.State) (*core.State, error) {
+		return state, nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func (s *suite) testBatch(t *testing.T) {
+	backend := s.backend(t)
+	batch, ok := backend.(core.BatchBackend)
+	if !ok {
+		t.Skip("backend does not implement core.BatchBackend")
+	}
+	ctx := context.Background()
+
+	keys := []string{"a", "b", "c"}
+	written := []*core.State{s.state(1, 0), s.state(2, 0), s.state(3, 0)}
+	require.NoError(t, batch.SetMulti(ctx, keys, written))
+
+	// Results follow the requested order, with nil for missing keys
+	got, err := batch.GetMulti(ctx, []string{"c", "missing", "a", "c"})
+	require.NoError(t, err)
+	require.Len(t, got, 4)
+	s.assertState(t, written[2], got[0])
+	assert.Nil(t, got[1])
+	s.assertState(t, written[0], got[2])
+	s.assertState(t, written[2], got[3])
+
+	// Batched writes are visible to Get
+	single, err := backend.Get(ctx, "b")
+	require.NoError(t, err)
+	s.assertState(t, written[1], single)
+
+	assert.Error(t, batch.SetMulti(ctx, keys, written[:1]), "mismatched lengths")
+}
+
+func (s *suite) testIterate(t *testing.T) {
+	backend := s.backend(t)
+	it, ok := backend.(core.Iterator)
+	if !ok {
+		t.Skip("backend does not implement core.Iterator")
+	}
+	ctx := context.Background()
+
+	written := make(map[string]*core.State)
+	keys := []string{
+		"tenant-a:1", "tenant-a:2", "tenant-a:3", "tenant-a:4", "tenant-a:5",
+		"tenant-b:1", "tenant-b:2", "tenant-b:3",
+		"glob*1", "globx1", "under_1", "underx1", "other",
+	}
+	for i, key := range keys {
+		written[key] = s.state(float64(i+1), 0)
+		require.NoError(t, backend.Set(ctx, key, written[key]))
+	}
+
+	// collect returns how often each key was seen
+	collect := func(filter core.Filter) map[string]int {
+		t.Helper()
+		scanner := core.NewScanner(it, filter, "")
+		seen := make(map[string]int)
+		for key, state := range scanner.All(ctx) {
+			seen[key]++
+			s.assertState(t, written[key], state)
+		}
+		require.NoError(t, scanner.Err())
+		return seen
+	}
+	once := func(keys ...string) map[string]int {
+		seen := make(map[string]int)
+		for _, key := range keys {
+			seen[key] = 1
+		}
+		return seen
+	}
+
+	assert.Equal(t, once(keys...), collect(core.Filter{}))
+	assert.Equal(t, once(keys...), collect(core.Filter{Count: 2}), "paging must not skip or repeat keys")
+	assert.Equal(t, once("tenant-a:1", "tenant-a:2", "tenant-a:3", "tenant-a:4", "tenant-a:5"),
+		collect(core.Filter{Prefix: "tenant-a:", Count: 2}))
+	assert.Equal(t, once("tenant-a:1", "tenant-b:1"), collect(core.Filter{Pattern: "tenant-?:1"}))
+	assert.Equal(t, once("tenant-b:2", "tenant-b:3"), collect(core.Filter{Pattern: "tenant-b:[23]"}))
+
+	// Prefixes are literal, even with glob or LIKE wildcards in them
+	assert.Equal(t, once("glob*1"), collect(core.Filter{Prefix: "glob*"}))
+	assert.Equal(t, once("under_1"), collect(core.Filter{Prefix: "under_"}))
+
+	// Deleting keys while iterating doesn't skip the others
+	scanner := core.NewScanner(it, core.Filter{Count: 3}, "")
+	seen := make(map[string]int)
+	for key := range scanner.All(ctx) {
+		seen[key]++
+		require.NoError(t, backend.Delete(ctx, key))
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, once(keys...), seen)
+	assert.Empty(t, collect(core.Filter{}))
+
+	// Cancelled contexts are honoured
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err := it.Scan(cancelled, core.Filter{}, "")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func (s *suite) testPing(t *testing.T) {
+	backend := s.backend(t)
+	pinger, ok := backend.(core.Pinger)
+	if !ok {
+		t.Skip("backend does not implement core.Pinger")
+	}
+	ctx := context.Background()
+
+	assert.NoError(t, pinger.Ping(ctx))
+
+	health := core.CheckBackend(ctx, backend)
+	assert.True(t, health.Healthy)
+	assert.NoError(t, health.Err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, pinger.Ping(cancelled), context.Canceled)
+}
+
+func (s *suite) testStats(t *testing.T) {
+	backend := s.backend(t)
+	provider, ok := backend.(core.StatsProvider)
+	if !ok {
+		t.Skip("backend does not implement core.StatsProvider")
+	}
+
+	require.NoError(t, backend.Set(context.Background(), "key", s.state(1, 0)))
+
+	stats := provider.Stats()
+	require.NotNil(t, stats)
+	for key := range stats {
+		assert.Regexp(t, `^[a-z][a-z0-9_]*$`, key, "stats keys are snake_case")
+	}
+	_, err := json.Marshal(stats)
+	assert.NoError(t, err, "stats must encode as JSON")
+}
+
+func copyState(state *core.State) *core.State {
+	copied := *state
+	return &copied
+}
@@ -0,0 +1,333 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// Options configures a caching backend
+type Options struct {
+	// Staleness is how long a state read from or written to the wrapped
+	// backend may be served by Get locally. Zero (the default) disables the
+	// state cache, since serving a stale state lets other instances' updates
+	// go unnoticed; only denials are cached then. Atomic updates of a
+	// core.Updater backend always go to the wrapped backend.
+	Staleness time.Duration
+
+	// MaxDenyTTL caps how long a denial is cached. Zero caches it for the
+	// full RetryAfter of the decision.
+	MaxDenyTTL time.Duration
+
+	// MaxEntries bounds the number of cached states and denials each
+	// (default 10000); the least recently used are dropped beyond it
+	MaxEntries int
+}
+
+// Backend is a core.Backend decorator that keeps a short-lived local copy of
+// another backend's data. Its main job is the deny cache: once the Limiter
+// reports that a key was denied with a RetryAfter, further requests for it
+// are denied locally until that time passes, without a call to the wrapped
+// backend. Deleting a key invalidates both caches.
+//
+// A denial cached here is not lifted early when another instance clears the
+// key; MaxDenyTTL bounds how long that can last.
+type Backend struct {
+	backend core.Backend
+	opts    Options
+
+	mu     sync.Mutex
+	states *lru[cachedState]
+	denied *lru[cachedDenial]
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	denyHits   atomic.Int64
+	denyMisses atomic.Int64
+}
+
+type cachedState struct {
+	state   core.State
+	expires time.Time
+}
+
+type cachedDenial struct {
+	resetTime time.Time
+	until     time.Time
+}
+
+// NewBackend wraps backend with a local cache
+func NewBackend(backend core.Backend, opts Options) *Backend {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 10000
+	}
+
+	return &Backend{
+		backend: backend,
+		opts:    opts,
+		states:  newLRU[cachedState](opts.MaxEntries),
+		denied:  newLRU[cachedDenial](opts.MaxEntries),
+	}
+}
+
+// Get returns the cached state for a key if it is fresh enough, otherwise
+// the state from the wrapped backend
+func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if b.opts.Staleness > 0 {
+		b.mu.Lock()
+		cached, ok := b.states.get(key)
+		b.mu.Unlock()
+
+		if ok && time.Now().Before(cached.expires) {
+			b.hits.Add(1)
+			state := cached.state
+			return &state, nil
+		}
+		b.misses.Add(1)
+	}
+
+	state, err := b.backend.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	b.store(key, state)
+	return state, nil
+}
+
+// Set stores the state for a key in the wrapped backend and the cache
+func (b *Backend) Set(ctx context.Context, key string, state *core.State) error {
+	if err := b.backend.Set(ctx, key, state); err != nil {
+		return err
+	}
+	b.store(key, state)
+	return nil
+}
+
+// Update applies fn through the wrapped backend, atomically if it is a
+// core.Updater, and caches the result
+func (b *Backend) Update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	updater, ok := b.backend.(core.Updater)
+	if !ok {
+		state, err := b.backend.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if state, err = fn(state); err != nil {
+			return err
+		}
+		return b.Set(ctx, key, state)
+	}
+
+	var updated *core.State
+	err := updater.Update(ctx, key, func(state *core.State) (*core.State, error) {
+		var err error
+		updated, err = fn(state)
+		return updated, err
+	})
+	if err != nil {
+		return err
+	}
+	b.store(key, updated)
+	return nil
+}
+
+// GetMulti retrieves several keys, from the cache where possible and with
+// one batched call for the rest when the wrapped backend supports it
+func (b *Backend) GetMulti(ctx context.Context, keys []string) ([]*core.State, error) {
+	batch, ok := b.backend.(core.BatchBackend)
+	if !ok {
+		states := make([]*core.State, len(keys))
+		for i, key := range keys {
+			state, err := b.Get(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			states[i] = state
+		}
+		return states, nil
+	}
+
+	states := make([]*core.State, len(keys))
+	var missing []string
+	var slots []int
+	now := time.Now()
+
+	b.mu.Lock()
+	for i, key := range keys {
+		if cached, ok := b.states.get(key); ok && now.Before(cached.expires) {
+			state := cached.state
+			states[i] = &state
+			continue
+		}
+		missing = append(missing, key)
+		slots = append(slots, i)
+	}
+	b.mu.Unlock()
+
+	if b.opts.Staleness > 0 {
+		b.hits.Add(int64(len(keys) - len(missing)))
+		b.misses.Add(int64(len(missing)))
+	}
+	if len(missing) == 0 {
+		return states, nil
+	}
+
+	fetched, err := batch.GetMulti(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for i, slot := range slots {
+		states[slot] = fetched[i]
+		b.store(missing[i], fetched[i])
+	}
+	return states, nil
+}
+
+// SetMulti stores several keys in the wrapped backend and the cache
+func (b *Backend) SetMulti(ctx context.Context, keys []string, states []*core.State) error {
+	if len(keys) != len(states) {
+		return fmt.Errorf("SetMulti got %d keys but %d states", len(keys), len(states))
+	}
+
+	if batch, ok := b.backend.(core.BatchBackend); ok {
+		if err := batch.SetMulti(ctx, keys, states); err != nil {
+			return err
+		}
+		for i, key := range keys {
+			b.store(key, states[i])
+		}
+		return nil
+	}
+
+	for i, key := range keys {
+		if err := b.Set(ctx, key, states[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the state for a key from the wrapped backend and both caches
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.states.remove(key)
+	b.denied.remove(key)
+	b.mu.Unlock()
+
+	return b.backend.Delete(ctx, key)
+}
+
+// Scan lists keys from the wrapped backend, which holds the authoritative
+// states, and fails with core.ErrNotIterable if it can't enumerate them
+func (b *Backend) Scan(ctx context.Context, filter core.Filter, cursor string) ([]core.Entry, string, error) {
+	it, ok := b.backend.(core.Iterator)
+	if !ok {
+		return nil, "", core.ErrNotIterable
+	}
+	return it.Scan(ctx, filter, cursor)
+}
+
+// Ping checks the wrapped backend if it is a core.Pinger
+func (b *Backend) Ping(ctx context.Context) error {
+	if pinger, ok := b.backend.(core.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return ctx.Err()
+}
+
+// Close drops the cache and closes the wrapped backend
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	b.states = newLRU[cachedState](b.opts.MaxEntries)
+	b.denied = newLRU[cachedDenial](b.opts.MaxEntries)
+	b.mu.Unlock()
+
+	return b.backend.Close()
+}
+
+// Denied returns the cached denial for key if it is still in effect at now
+func (b *Backend) Denied(key string, now time.Time) (core.Decision, bool) {
+	b.mu.Lock()
+	cached, ok := b.denied.get(key)
+	if ok && !now.Before(cached.until) {
+		b.denied.remove(key)
+		ok = false
+	}
+	b.mu.Unlock()
+
+	if !ok {
+		b.denyMisses.Add(1)
+		return core.Decision{}, false
+	}
+
+	b.denyHits.Add(1)
+	return core.Decision{
+		Allowed:    false,
+		Remaining:  0,
+		ResetTime:  cached.resetTime,
+		RetryAfter: cached.until.Sub(now),
+	}, true
+}
+
+// RecordDecision caches denials until their RetryAfter has passed and
+// forgets them once a request is allowed again
+func (b *Backend) RecordDecision(key string, decision core.Decision, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if decision.Allowed || decision.RetryAfter <= 0 {
+		b.denied.remove(key)
+		return
+	}
+
+	ttl := decision.RetryAfter
+	if b.opts.MaxDenyTTL > 0 && ttl > b.opts.MaxDenyTTL {
+		ttl = b.opts.MaxDenyTTL
+	}
+	b.denied.put(key, cachedDenial{resetTime: decision.ResetTime, until: now.Add(ttl)})
+}
+
+// Stats returns cache hit and miss counters and entry counts
+func (b *Backend) Stats() map[string]interface{} {
+	b.mu.Lock()
+	states, denied := b.states.len(), b.denied.len()
+	b.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"hits":              b.hits.Load(),
+		"misses":            b.misses.Load(),
+		"deny_hits":         b.denyHits.Load(),
+		"deny_misses":       b.denyMisses.Load(),
+		"cached_states":     states,
+		"cached_denials":    denied,
+		"cache_staleness":   b.opts.Staleness.String(),
+		"max_cache_entries": b.opts.MaxEntries,
+	}
+	if provider, ok := b.backend.(core.StatsProvider); ok {
+		stats["backend"] = provider.Stats()
+	}
+	return stats
+}
+
+// store caches a copy of state if the state cache is enabled
+func (b *Backend) store(key string, state *core.State) {
+	if b.opts.Staleness <= 0 || state == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.states.put(key, cachedState{state: *state, expires: time.Now().Add(b.opts.Staleness)})
+}
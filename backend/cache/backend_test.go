@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/backendtest"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// countingBackend records how often the remote backend is called
+type countingBackend struct {
+	*memory.Backend
+	mu    sync.Mutex
+	calls int
+}
+
+func newCountingBackend() *countingBackend {
+	return &countingBackend{Backend: memory.NewBackend()}
+}
+
+func (b *countingBackend) count() {
+	b.mu.Lock()
+	b.calls++
+	b.mu.Unlock()
+}
+
+func (b *countingBackend) Calls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls
+}
+
+func (b *countingBackend) Get(ctx context.Context, key string) (*core.State, error) {
+	b.count()
+	return b.Backend.Get(ctx, key)
+}
+
+func (b *countingBackend) Set(ctx context.Context, key string, state *core.State) error {
+	b.count()
+	return b.Backend.Set(ctx, key, state)
+}
+
+// updaterBackend adds atomic updates to countingBackend
+type updaterBackend struct {
+	*countingBackend
+	updates int
+}
+
+func (b *updaterBackend) Update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	b.updates++
+	state, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if state, err = fn(state); err != nil {
+		return err
+	}
+	return b.Set(ctx, key, state)
+}
+
+// atomicBackend is a memory backend with a locked Update, so the cache's
+// Update can be checked for lost writes
+type atomicBackend struct {
+	*memory.Backend
+	mu sync.Mutex
+}
+
+func (b *atomicBackend) Update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if state, err = fn(state); err != nil {
+		return err
+	}
+	return b.Set(ctx, key, state)
+}
+
+func TestBackend_Conformance(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"DenyCacheOnly": {},
+		"StateCache":    {Staleness: time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			backendtest.RunConformance(t, func(t *testing.T) core.Backend {
+				return NewBackend(&atomicBackend{Backend: memory.NewBackend()}, opts)
+			})
+		})
+	}
+}
+
+func TestBackend_DenyCacheShortCircuits(t *testing.T) {
+	remote := newCountingBackend()
+	backend := NewBackend(remote, Options{})
+	config := core.Config{Limit: 1, Interval: time.Hour, Burst: 1}
+	limiter := core.NewLimiter(backend, tokenbucket.NewStrategy(config), config, nil)
+	ctx := context.Background()
+
+	decision, err := limiter.Grant(ctx, "abuser")
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	decision, err = limiter.Grant(ctx, "abuser")
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	calls := remote.Calls()
+
+	// The flood is answered locally
+	for i := 0; i < 1000; i++ {
+		decision, err = limiter.Grant(ctx, "abuser")
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Greater(t, decision.RetryAfter, time.Duration(0))
+		assert.LessOrEqual(t, decision.RetryAfter, time.Hour)
+	}
+	assert.Equal(t, calls, remote.Calls())
+	assert.Equal(t, int64(1000), backend.Stats()["deny_hits"])
+
+	// Other keys are unaffected
+	decision, err = limiter.Grant(ctx, "someone-else")
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	// Clearing the key lifts the cached denial
+	require.NoError(t, limiter.Clear(ctx, "abuser"))
+	decision, err = limiter.Grant(ctx, "abuser")
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+}
+
+func TestBackend_DenyCacheGrantMulti(t *testing.T) {
+	remote := newCountingBackend()
+	backend := NewBackend(remote, Options{})
+	config := core.Config{Limit: 1, Interval: time.Hour, Burst: 1}
+	limiter := core.NewLimiter(backend, tokenbucket.NewStrategy(config), config, nil)
+	ctx := context.Background()
+
+	decisions, err := limiter.GrantMulti(ctx, []string{"ip", "ip"})
+	require.NoError(t, err)
+	assert.True(t, decisions[0].Allowed)
+	assert.False(t, decisions[1].Allowed)
+
+	// "ip" is now answered from the cache, "user" still goes to the backend
+	calls := remote.Calls()
+	decisions, err = limiter.GrantMulti(ctx, []string{"ip", "user"})
+	require.NoError(t, err)
+	assert.False(t, decisions[0].Allowed)
+	assert.True(t, decisions[1].Allowed)
+	assert.Equal(t, calls+2, remote.Calls())
+}
+
+func TestBackend_DenialExpires(t *testing.T) {
+	backend := NewBackend(memory.NewBackend(), Options{MaxDenyTTL: time.Second})
+	now := time.Now()
+
+	backend.RecordDecision("key", core.Decision{Allowed: false, RetryAfter: time.Minute}, now)
+
+	decision, denied := backend.Denied("key", now.Add(500*time.Millisecond))
+	assert.True(t, denied)
+	assert.Equal(t, 500*time.Millisecond, decision.RetryAfter)
+
+	// MaxDenyTTL caps the minute-long RetryAfter
+	_, denied = backend.Denied("key", now.Add(time.Second))
+	assert.False(t, denied)
+
+	// Allowed decisions and denials without RetryAfter are not cached
+	backend.RecordDecision("key", core.Decision{Allowed: false, RetryAfter: time.Minute}, now)
+	backend.RecordDecision("key", core.Decision{Allowed: true}, now)
+	_, denied = backend.Denied("key", now)
+	assert.False(t, denied)
+
+	backend.RecordDecision("key", core.Decision{Allowed: false}, now)
+	_, denied = backend.Denied("key", now)
+	assert.False(t, denied)
+}
+
+func TestBackend_StateCache(t *testing.T) {
+	remote := newCountingBackend()
+	backend := NewBackend(remote, Options{Staleness: time.Hour})
+	ctx := context.Background()
+	now := time.Now()
+
+	require.NoError(t, backend.Set(ctx, "key", &core.State{Tokens: 5, LastUpdate: now, Created: now}))
+
+	// Served from the cache
+	state, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, state.Tokens)
+	assert.Equal(t, 1, remote.Calls())
+
+	// Callers get copies
+	state.Tokens = 100
+	state, err = backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, state.Tokens)
+
+	// Missing keys are looked up every time
+	state, err = backend.Get(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	stats := backend.Stats()
+	assert.Equal(t, int64(2), stats["hits"])
+	assert.Equal(t, int64(1), stats["misses"])
+
+	// Delete invalidates the cached state
+	require.NoError(t, backend.Delete(ctx, "key"))
+	state, err = backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestBackend_StateCacheDisabledByDefault(t *testing.T) {
+	remote := newCountingBackend()
+	backend := NewBackend(remote, Options{})
+	ctx := context.Background()
+	now := time.Now()
+
+	require.NoError(t, backend.Set(ctx, "key", &core.State{Tokens: 5, LastUpdate: now, Created: now}))
+	_, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	_, err = backend.Get(ctx, "key")
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, remote.Calls())
+	assert.Equal(t, 0, backend.Stats()["cached_states"])
+}
+
+func TestBackend_UpdateUsesWrappedUpdater(t *testing.T) {
+	remote := &updaterBackend{countingBackend: newCountingBackend()}
+	backend := NewBackend(remote, Options{Staleness: time.Hour})
+	ctx := context.Background()
+
+	err := backend.Update(ctx, "key", func(state *core.State) (*core.State, error) {
+		assert.Nil(t, state)
+		now := time.Now()
+		return &core.State{Tokens: 7, LastUpdate: now, Created: now}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, remote.updates)
+
+	// The result is cached
+	calls := remote.Calls()
+	state, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, state.Tokens)
+	assert.Equal(t, calls, remote.Calls())
+}
+
+func TestBackend_MaxEntries(t *testing.T) {
+	backend := NewBackend(memory.NewBackend(), Options{Staleness: time.Hour, MaxEntries: 10})
+	ctx := context.Background()
+	now := time.Now()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		require.NoError(t, backend.Set(ctx, key, &core.State{Tokens: 1, LastUpdate: now, Created: now}))
+		backend.RecordDecision(key, core.Decision{Allowed: false, RetryAfter: time.Minute}, now)
+	}
+
+	stats := backend.Stats()
+	assert.Equal(t, 10, stats["cached_states"])
+	assert.Equal(t, 10, stats["cached_denials"])
+}
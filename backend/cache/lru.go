@@ -0,0 +1,63 @@
+package cache
+
+import "container/list"
+
+// lru is a map holding at most max entries, dropping the least recently
+// used one to make room. It is not safe for concurrent use.
+type lru[V any] struct {
+	max     int
+	entries map[string]*list.Element
+	recency *list.List // Of *lruEntry[V], most recently used first
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRU[V any](max int) *lru[V] {
+	return &lru[V]{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		recency: list.New(),
+	}
+}
+
+// get returns the value for key and marks it as recently used
+func (c *lru[V]) get(key string) (V, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.recency.MoveToFront(elem)
+	return elem.Value.(*lruEntry[V]).value, true
+}
+
+// put stores value for key, evicting the least recently used entry if the
+// map is full
+func (c *lru[V]) put(key string, value V) {
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruEntry[V]).value = value
+		c.recency.MoveToFront(elem)
+		return
+	}
+
+	if len(c.entries) >= c.max {
+		c.remove(c.recency.Back().Value.(*lruEntry[V]).key)
+	}
+	c.entries[key] = c.recency.PushFront(&lruEntry[V]{key: key, value: value})
+}
+
+// remove forgets key
+func (c *lru[V]) remove(key string) {
+	if elem, ok := c.entries[key]; ok {
+		c.recency.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// len returns the number of entries
+func (c *lru[V]) len() int {
+	return len(c.entries)
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRU[int](3)
+	c.put("a", 1)
+	c.put("b", 2)
+	c.put("c", 3)
+
+	// Reading a makes b the least recently used
+	_, ok := c.get("a")
+	assert.True(t, ok)
+	c.put("d", 4)
+
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	for key, want := range map[string]int{"a": 1, "c": 3, "d": 4} {
+		value, ok := c.get(key)
+		assert.True(t, ok)
+		assert.Equal(t, want, value)
+	}
+	assert.Equal(t, 3, c.len())
+}
+
+func TestLRU_PutReplacesAndRemove(t *testing.T) {
+	c := newLRU[int](2)
+	c.put("a", 1)
+	c.put("a", 2)
+	assert.Equal(t, 1, c.len())
+
+	value, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+
+	c.remove("a")
+	c.remove("missing")
+	assert.Equal(t, 0, c.len())
+
+	for i := 0; i < 100; i++ {
+		c.put(fmt.Sprintf("key-%d", i), i)
+	}
+	assert.Equal(t, 2, c.len())
+	assert.Equal(t, 2, c.recency.Len())
+}
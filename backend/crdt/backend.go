@@ -0,0 +1,383 @@
+// Package crdt implements an eventually consistent backend for limiting
+// across regions without a synchronous round-trip per decision.
+//
+// Every node keeps, per key and fixed window, a grow-only counter per node
+// (a G-counter) plus a max-register recording how much of the total has been
+// cleared by Delete. Nodes only ever increment their own counter, and merging
+// takes the maximum of every component, so merges are commutative,
+// associative and idempotent: all nodes converge on the same totals however
+// gossip messages are delayed, duplicated or reordered. Decisions are made by
+// the local strategy on the merged view.
+//
+// The backend stores request counts, so it is meant for
+// strategy/fixedwindow with a matching Interval. A state's window is the one
+// containing its LastUpdate; Get returns the count for the current window.
+//
+// Because a node doesn't see requests admitted elsewhere until they are
+// gossiped, a window can admit more than Limit requests. With N nodes the
+// overshoot per key and window is at most (N−1)·Limit, even during a
+// partition; while gossip flows it is at most what the other nodes admit
+// for the key within one gossip round trip. The observed overshoot is
+// reported by Stats.
+//
+// Each gossip round only carries the counters that changed since the peer
+// last received a round, split into bounded messages. Gossip is accepted
+// from anyone who can reach Handler: serve it on a trusted network only, or
+// set Secret so messages are authenticated.
+package crdt
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// Options configures a CRDT backend
+type Options struct {
+	NodeID         string        // Unique name of this node (required)
+	Peers          []string      // Base URLs the other nodes serve Handler under
+	Window         time.Duration // Window length, the strategy's Interval (required)
+	Limit          int64         // The strategy's Limit, for overshoot accounting
+	GossipInterval time.Duration // How often state is pushed to peers (default 1s)
+	Retention      int           // Windows kept, including the current one (default 2)
+	Client         *http.Client  // Sends gossip (default: 2s timeout)
+	Secret         string        // Key for HMAC-SHA256 signatures of gossip, shared by all nodes
+}
+
+// Backend implements core.Backend with replicated counters
+type Backend struct {
+	opts   Options
+	client *http.Client
+	now    func() time.Time
+
+	mu       sync.Mutex
+	index    core.ScanIndex
+	counters map[string]map[int64]*counter
+	expired  int64             // Window up to which expire last ran
+	version  uint64            // Bumped by every change, see counter.version
+	acked    map[string]uint64 // Per peer, the version it has every change up to
+
+	overshootMax    float64
+	gossipSent      int64
+	gossipFailed    int64
+	gossipOversized int64
+	merged          int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// counter is the replicated count of one key in one window
+type counter struct {
+	counts  map[string]float64 // Per-node grow-only counts
+	cleared float64            // Max-register: part of the total removed by Delete
+	version uint64             // Backend version of its last change
+}
+
+// total returns the sum of all nodes' counts
+func (c *counter) total() float64 {
+	var total float64
+	for _, n := range c.counts {
+		total += n
+	}
+	return total
+}
+
+// value returns the effective count
+func (c *counter) value() float64 {
+	return math.Max(c.total()-c.cleared, 0)
+}
+
+// NewBackend creates a CRDT backend and starts gossiping to its peers
+func NewBackend(opts Options) (*Backend, error) {
+	if opts.NodeID == "" {
+		return nil, errors.New("crdt: NodeID must be set")
+	}
+	if opts.Window <= 0 {
+		return nil, errors.New("crdt: Window must be positive")
+	}
+	if opts.GossipInterval <= 0 {
+		opts.GossipInterval = time.Second
+	}
+	if opts.Retention <= 0 {
+		opts.Retention = 2
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Second}
+	}
+
+	b := &Backend{
+		opts:     opts,
+		client:   client,
+		now:      time.Now,
+		counters: make(map[string]map[int64]*counter),
+		acked:    make(map[string]uint64),
+		done:     make(chan struct{}),
+	}
+
+	if len(opts.Peers) > 0 {
+		b.wg.Add(1)
+		go b.gossipLoop()
+	}
+
+	return b, nil
+}
+
+// Get returns the merged count of the current window, or nil if it is empty
+func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current(key), nil
+}
+
+// Set records the count in state for the window containing its LastUpdate:
+// the increase over the current count is added to this node's counter. A
+// lower count is ignored, since it may have been read before increments
+// from other nodes were merged; only Delete clears a key.
+func (b *Backend) Set(ctx context.Context, key string, state *core.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.record(key, state)
+	return nil
+}
+
+// Update applies fn to the count of the current window and records the
+// result like Set. It holds the backend's lock throughout, so no merge can
+// land between the read and the write.
+func (b *Backend) Update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := fn(b.current(key))
+	if err != nil {
+		return err
+	}
+	b.record(key, state)
+	return nil
+}
+
+// Delete clears the key's count in every window. Clearing is replicated
+// like increments, so it wins over any increment it has already seen.
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range b.counters[key] {
+		if total := c.total(); total > c.cleared {
+			c.cleared = total
+			b.touch(c)
+		}
+	}
+	return nil
+}
+
+// Scan returns a page of the keys after cursor in sorted order whose count
+// in the current window is not zero, as Get sees them. Count keys are
+// examined per page, all remaining keys if it is zero. Keys are sorted once
+// per scan, see core.ScanIndex.
+func (b *Backend) Scan(ctx context.Context, filter core.Filter, cursor string) ([]core.Entry, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	window := b.window(b.now())
+	start := b.windowStart(window)
+
+	keys, next := b.index.Page(cursor, filter.Count, b.keys)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []core.Entry
+	for _, key := range keys {
+		c := b.counters[key][window]
+		if c == nil || c.value() == 0 || !filter.Matches(key) {
+			continue
+		}
+		entries = append(entries, core.Entry{
+			Key: key,
+			State: &core.State{
+				Tokens:     c.value(),
+				LastUpdate: start,
+				Created:    start,
+			},
+		})
+	}
+
+	return entries, next, nil
+}
+
+// keys lists the keys with counters in any retained window
+func (b *Backend) keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := make([]string, 0, len(b.counters))
+	for key := range b.counters {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close stops gossiping
+func (b *Backend) Close() error {
+	b.closeOnce.Do(func() { close(b.done) })
+	b.wg.Wait()
+	return nil
+}
+
+// OvershootBound returns the worst-case overshoot per key and window: every
+// other node admitting a full window without hearing from this one
+func (b *Backend) OvershootBound() float64 {
+	return float64(len(b.opts.Peers)) * float64(b.opts.Limit)
+}
+
+// Stats returns counter, gossip and overshoot statistics
+func (b *Backend) Stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var windows int
+	var overshoot float64
+	for _, byWindow := range b.counters {
+		windows += len(byWindow)
+		for _, c := range byWindow {
+			overshoot += b.overshoot(c)
+		}
+	}
+
+	return map[string]interface{}{
+		"keys_count":        len(b.counters),
+		"windows_count":     windows,
+		"gossip_sent":       b.gossipSent,
+		"gossip_failed":     b.gossipFailed,
+		"gossip_oversized":  b.gossipOversized,
+		"gossip_merged":     b.merged,
+		"overshoot_current": overshoot,
+		"overshoot_max":     b.overshootMax,
+		"overshoot_bound":   b.OvershootBound(),
+	}
+}
+
+// current returns the count of key in the current window, or nil if it is
+// empty; the caller holds mu
+func (b *Backend) current(key string) *core.State {
+	window := b.window(b.now())
+	c := b.counters[key][window]
+	if c == nil || c.value() == 0 {
+		return nil
+	}
+
+	start := b.windowStart(window)
+	return &core.State{
+		Tokens:     c.value(),
+		LastUpdate: start,
+		Created:    start,
+	}
+}
+
+// record adds the increase of state's count over the current one to this
+// node's counter; the caller holds mu
+func (b *Backend) record(key string, state *core.State) {
+	c := b.counter(key, b.window(state.LastUpdate))
+	if increase := state.Tokens - c.value(); increase > 0 {
+		c.counts[b.opts.NodeID] += increase
+		b.touch(c)
+		b.observe(c)
+	}
+	b.expire()
+}
+
+// touch marks c as changed, so the next gossip round sends it; the caller
+// holds mu
+func (b *Backend) touch(c *counter) {
+	b.version++
+	c.version = b.version
+}
+
+// counter returns the counter for key and window, creating it if needed;
+// the caller holds mu
+func (b *Backend) counter(key string, window int64) *counter {
+	byWindow, ok := b.counters[key]
+	if !ok {
+		byWindow = make(map[int64]*counter)
+		b.counters[key] = byWindow
+	}
+
+	c, ok := byWindow[window]
+	if !ok {
+		c = &counter{counts: make(map[string]float64)}
+		byWindow[window] = c
+	}
+	return c
+}
+
+// overshoot returns how far c exceeds the limit
+func (b *Backend) overshoot(c *counter) float64 {
+	if b.opts.Limit <= 0 {
+		return 0
+	}
+	return math.Max(c.value()-float64(b.opts.Limit), 0)
+}
+
+// observe updates the overshoot high-water mark; the caller holds mu
+func (b *Backend) observe(c *counter) {
+	b.overshootMax = math.Max(b.overshootMax, b.overshoot(c))
+}
+
+// expire drops windows that fell out of retention once per window; the
+// caller holds mu
+func (b *Backend) expire() {
+	current := b.window(b.now())
+	if current <= b.expired {
+		return
+	}
+	b.expired = current
+
+	oldest := current - int64(b.opts.Retention) + 1
+	for key, byWindow := range b.counters {
+		for window := range byWindow {
+			if window < oldest {
+				delete(byWindow, window)
+			}
+		}
+		if len(byWindow) == 0 {
+			delete(b.counters, key)
+		}
+	}
+}
+
+// window returns the index of the window containing t
+func (b *Backend) window(t time.Time) int64 {
+	return t.UnixNano() / int64(b.opts.Window)
+}
+
+// windowStart returns the start of a window
+func (b *Backend) windowStart(window int64) time.Time {
+	return time.Unix(0, window*int64(b.opts.Window))
+}
@@ -0,0 +1,459 @@
+package crdt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/backendtest"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/fixedwindow"
+)
+
+var testConfig = core.Config{Limit: 10, Interval: time.Hour}
+
+// node is one region of a loopback test cluster
+type node struct {
+	backend *Backend
+	limiter *core.Limiter
+}
+
+// startNodes starts n nodes gossiping to each other over loopback HTTP.
+// With a zero interval nothing is gossiped until Gossip is called.
+func startNodes(t *testing.T, n int, interval time.Duration) []*node {
+	nodes := make([]*node, n)
+	urls := make([]string, n)
+
+	var mu sync.RWMutex
+	for i := range nodes {
+		nodes[i] = &node{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.RLock()
+			backend := nodes[i].backend
+			mu.RUnlock()
+			backend.Handler().ServeHTTP(w, r)
+		}))
+		t.Cleanup(server.Close)
+		urls[i] = server.URL
+	}
+
+	for i, nd := range nodes {
+		var peers []string
+		for j, url := range urls {
+			if j != i {
+				peers = append(peers, url)
+			}
+		}
+
+		opts := Options{
+			NodeID:         string(rune('a' + i)),
+			Peers:          peers,
+			Window:         testConfig.Interval,
+			Limit:          testConfig.Limit,
+			GossipInterval: interval,
+		}
+		if interval == 0 {
+			// Only gossip when the test says so
+			opts.GossipInterval = time.Hour
+		}
+		backend, err := NewBackend(opts)
+		require.NoError(t, err)
+		t.Cleanup(func() { backend.Close() })
+
+		mu.Lock()
+		nd.backend = backend
+		mu.Unlock()
+		nd.limiter = core.NewLimiter(backend, fixedwindow.NewStrategy(testConfig), testConfig, nil)
+	}
+	return nodes
+}
+
+// gossipAll runs one full gossip round
+func gossipAll(t *testing.T, nodes []*node) {
+	for _, nd := range nodes {
+		require.NoError(t, nd.backend.Gossip(context.Background()))
+	}
+}
+
+func grant(t *testing.T, nd *node, key string, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		decision, err := nd.limiter.Grant(context.Background(), key)
+		require.NoError(t, err)
+		if decision.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func count(t *testing.T, nd *node, key string) float64 {
+	state, err := nd.backend.Get(context.Background(), key)
+	require.NoError(t, err)
+	if state == nil {
+		return 0
+	}
+	return state.Tokens
+}
+
+// snapshot copies every retained counter into a gossip message
+func (b *Backend) snapshot() gossipMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	entries, _ := b.changes(0)
+	return gossipMessage{Node: b.opts.NodeID, Entries: entries}
+}
+
+func TestBackend_Conformance(t *testing.T) {
+	factory := func(t *testing.T) core.Backend {
+		backend, err := NewBackend(Options{NodeID: "a", Window: testConfig.Interval})
+		require.NoError(t, err)
+		return backend
+	}
+
+	// Get reports the count of the current window, stamped with its start;
+	// an empty window is a missing key
+	strategy := fixedwindow.NewStrategy(testConfig)
+	normalize := func(state *core.State) *core.State {
+		if state.Tokens == 0 {
+			return nil
+		}
+		start := strategy.WindowStart(state.LastUpdate)
+		return &core.State{Tokens: state.Tokens, LastUpdate: start, Created: start}
+	}
+
+	backendtest.RunConformance(t, factory, backendtest.WithNormalize(normalize), backendtest.WithGrowOnly())
+}
+
+func TestBackend_Converges(t *testing.T) {
+	nodes := startNodes(t, 3, 0)
+
+	for _, nd := range nodes {
+		assert.Equal(t, 2, grant(t, nd, "key", 2))
+	}
+	assert.Equal(t, 2.0, count(t, nodes[0], "key"))
+
+	gossipAll(t, nodes)
+	for _, nd := range nodes {
+		assert.Equal(t, 6.0, count(t, nd, "key"))
+	}
+
+	// Decisions use the merged view
+	assert.Equal(t, 4, grant(t, nodes[1], "key", 10))
+	gossipAll(t, nodes)
+	assert.Equal(t, 0, grant(t, nodes[0], "key", 1))
+	assert.Equal(t, 0, grant(t, nodes[2], "key", 1))
+}
+
+func TestBackend_OvershootBounded(t *testing.T) {
+	nodes := startNodes(t, 3, 0)
+
+	// Partitioned: every node admits a full window on its own
+	for _, nd := range nodes {
+		assert.Equal(t, int(testConfig.Limit), grant(t, nd, "key", 15))
+	}
+
+	gossipAll(t, nodes)
+	for _, nd := range nodes {
+		assert.Equal(t, 30.0, count(t, nd, "key"))
+
+		stats := nd.backend.Stats()
+		assert.Equal(t, 20.0, stats["overshoot_current"])
+		assert.Equal(t, 20.0, stats["overshoot_max"])
+		assert.LessOrEqual(t, stats["overshoot_max"], nd.backend.OvershootBound())
+	}
+
+	// Once merged, the window is closed everywhere
+	for _, nd := range nodes {
+		assert.Equal(t, 0, grant(t, nd, "key", 1))
+	}
+}
+
+func TestBackend_OvershootWithGossip(t *testing.T) {
+	nodes := startNodes(t, 3, 0)
+
+	// Gossiping after every request keeps the overshoot at what the others
+	// admit in one round: at most one request each here
+	admitted := 0
+	for i := 0; i < 30; i++ {
+		admitted += grant(t, nodes[i%3], "key", 1)
+		if i%3 == 2 {
+			gossipAll(t, nodes)
+		}
+	}
+
+	assert.LessOrEqual(t, admitted, int(testConfig.Limit)+2)
+	assert.LessOrEqual(t, nodes[0].backend.Stats()["overshoot_max"], 2.0)
+}
+
+func TestBackend_MergeIsIdempotentAndCommutative(t *testing.T) {
+	newNode := func(id string) *Backend {
+		backend, err := NewBackend(Options{NodeID: id, Window: time.Hour})
+		require.NoError(t, err)
+		return backend
+	}
+	ctx := context.Background()
+	now := time.Now()
+
+	a, b := newNode("a"), newNode("b")
+	require.NoError(t, a.Set(ctx, "key", &core.State{Tokens: 3, LastUpdate: now}))
+	require.NoError(t, b.Set(ctx, "key", &core.State{Tokens: 4, LastUpdate: now}))
+	fromA, fromB := a.snapshot(), b.snapshot()
+
+	x, y := newNode("x"), newNode("y")
+	x.merge(fromA)
+	x.merge(fromB)
+	x.merge(fromA)
+	y.merge(fromB)
+	y.merge(fromA)
+
+	assert.Equal(t, x.snapshot().Entries, y.snapshot().Entries)
+	state, err := x.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, state.Tokens)
+}
+
+func TestBackend_SetNeverClears(t *testing.T) {
+	backend, err := NewBackend(Options{NodeID: "a", Window: time.Hour})
+	require.NoError(t, err)
+	ctx := context.Background()
+	now := time.Now()
+
+	// A count read before a merge is written back after it
+	require.NoError(t, backend.Set(ctx, "key", &core.State{Tokens: 2, LastUpdate: now}))
+	backend.merge(gossipMessage{Node: "b", Entries: []gossipEntry{{Key: "key", Window: backend.window(now), Counts: map[string]float64{"b": 5}}}})
+	require.NoError(t, backend.Set(ctx, "key", &core.State{Tokens: 3, LastUpdate: now}))
+
+	state, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, state.Tokens)
+}
+
+func TestBackend_UpdateWithConcurrentMerges(t *testing.T) {
+	backend, err := NewBackend(Options{NodeID: "a", Window: time.Hour})
+	require.NoError(t, err)
+	ctx := context.Background()
+	window := backend.window(time.Now())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			backend.merge(gossipMessage{Node: "b", Entries: []gossipEntry{{Key: "key", Window: window, Counts: map[string]float64{"b": float64(i)}}}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			err := backend.Update(ctx, "key", func(state *core.State) (*core.State, error) {
+				if state == nil {
+					state = &core.State{LastUpdate: time.Now()}
+				}
+				state.Tokens++
+				return state, nil
+			})
+			assert.NoError(t, err)
+		}
+	}()
+	wg.Wait()
+
+	// Neither side's increments are lost
+	state, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 200.0, state.Tokens)
+}
+
+// gossipRecorder serves a backend's Handler and counts the entries received
+type gossipRecorder struct {
+	mu       sync.Mutex
+	messages int
+	entries  int
+}
+
+func (r *gossipRecorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err == nil {
+			var msg gossipMessage
+			if json.Unmarshal(body, &msg) == nil {
+				r.mu.Lock()
+				r.messages++
+				r.entries += len(msg.Entries)
+				r.mu.Unlock()
+			}
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *gossipRecorder) reset() (messages, entries int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	messages, entries = r.messages, r.entries
+	r.messages, r.entries = 0, 0
+	return messages, entries
+}
+
+func TestBackend_GossipSendsChanges(t *testing.T) {
+	receiver, err := NewBackend(Options{NodeID: "b", Window: time.Hour, Secret: "s3cret"})
+	require.NoError(t, err)
+	recorder := &gossipRecorder{}
+	server := httptest.NewServer(recorder.wrap(receiver.Handler()))
+	defer server.Close()
+
+	sender, err := NewBackend(Options{NodeID: "a", Window: time.Hour, Peers: []string{server.URL}, GossipInterval: time.Hour, Secret: "s3cret"})
+	require.NoError(t, err)
+	defer sender.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	// The first round is split into bounded messages
+	for i := 0; i < 2500; i++ {
+		require.NoError(t, sender.Set(ctx, fmt.Sprintf("key-%d", i), &core.State{Tokens: 1, LastUpdate: now}))
+	}
+	require.NoError(t, sender.Gossip(ctx))
+	messages, entries := recorder.reset()
+	assert.Equal(t, 3, messages)
+	assert.Equal(t, 2500, entries)
+	assert.Equal(t, 2500, receiver.Stats()["keys_count"])
+
+	// Later rounds only carry what changed
+	require.NoError(t, sender.Gossip(ctx))
+	_, entries = recorder.reset()
+	assert.Equal(t, 0, entries)
+
+	require.NoError(t, sender.Set(ctx, "key-7", &core.State{Tokens: 2, LastUpdate: now}))
+	require.NoError(t, sender.Gossip(ctx))
+	_, entries = recorder.reset()
+	assert.Equal(t, 1, entries)
+
+	// A failed round is followed by a full one
+	server.Close()
+	require.NoError(t, sender.Set(ctx, "key-7", &core.State{Tokens: 3, LastUpdate: now}))
+	assert.Error(t, sender.Gossip(ctx))
+	assert.Equal(t, int64(1), sender.Stats()["gossip_failed"])
+	sender.mu.Lock()
+	pending, _ := sender.changes(sender.acked[server.URL])
+	sender.mu.Unlock()
+	assert.Len(t, pending, 2500)
+}
+
+func TestBackend_GossipOversized(t *testing.T) {
+	receiver, err := NewBackend(Options{NodeID: "b", Window: time.Hour})
+	require.NoError(t, err)
+	server := httptest.NewServer(receiver.Handler())
+	defer server.Close()
+
+	sender, err := NewBackend(Options{NodeID: "a", Window: time.Hour, Peers: []string{server.URL}, GossipInterval: time.Hour})
+	require.NoError(t, err)
+	defer sender.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	huge := strings.Repeat("k", maxGossipBody)
+	require.NoError(t, sender.Set(ctx, huge, &core.State{Tokens: 1, LastUpdate: now}))
+	require.NoError(t, sender.Set(ctx, "small", &core.State{Tokens: 1, LastUpdate: now}))
+
+	// The oversized counter is reported, the rest still arrives
+	err = sender.Gossip(ctx)
+	assert.ErrorContains(t, err, "exceeds the")
+	assert.Equal(t, int64(1), sender.Stats()["gossip_oversized"])
+	assert.Equal(t, 1.0, count(t, &node{backend: receiver}, "small"))
+}
+
+func TestBackend_DeleteReplicates(t *testing.T) {
+	nodes := startNodes(t, 2, 0)
+
+	grant(t, nodes[0], "key", 3)
+	grant(t, nodes[1], "key", 3)
+	gossipAll(t, nodes)
+
+	require.NoError(t, nodes[0].limiter.Clear(context.Background(), "key"))
+
+	// An increment the clear hasn't seen survives it
+	grant(t, nodes[1], "key", 1)
+
+	gossipAll(t, nodes)
+	for _, nd := range nodes {
+		assert.Equal(t, 1.0, count(t, nd, "key"))
+	}
+}
+
+func TestBackend_GossipLoop(t *testing.T) {
+	nodes := startNodes(t, 3, 10*time.Millisecond)
+
+	grant(t, nodes[0], "key", 4)
+	grant(t, nodes[2], "key", 1)
+
+	assert.Eventually(t, func() bool {
+		return count(t, nodes[1], "key") == 5
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Greater(t, nodes[0].backend.Stats()["gossip_sent"], int64(0))
+}
+
+func TestBackend_ExpiresOldWindows(t *testing.T) {
+	backend, err := NewBackend(Options{NodeID: "a", Window: time.Minute})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	now := time.Now()
+	backend.now = func() time.Time { return now }
+	require.NoError(t, backend.Set(ctx, "key", &core.State{Tokens: 1, LastUpdate: now}))
+
+	// The previous window is kept, older ones are dropped
+	backend.now = func() time.Time { return now.Add(time.Minute) }
+	require.NoError(t, backend.Set(ctx, "other", &core.State{Tokens: 1, LastUpdate: now.Add(time.Minute)}))
+	assert.Equal(t, 2, backend.Stats()["keys_count"])
+
+	backend.now = func() time.Time { return now.Add(2 * time.Minute) }
+	require.NoError(t, backend.Set(ctx, "other", &core.State{Tokens: 1, LastUpdate: now.Add(2 * time.Minute)}))
+	assert.Equal(t, 1, backend.Stats()["keys_count"])
+
+	// Gossip about dropped windows is ignored
+	backend.merge(gossipMessage{Node: "b", Entries: []gossipEntry{{Key: "key", Window: backend.window(now), Counts: map[string]float64{"b": 5}}}})
+	assert.Equal(t, 1, backend.Stats()["keys_count"])
+}
+
+func TestBackend_RejectsInvalidGossip(t *testing.T) {
+	backend, err := NewBackend(Options{NodeID: "a", Window: time.Minute})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	backend.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/gossip", strings.NewReader("{")))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	backend.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/gossip", strings.NewReader(strings.Repeat(" ", maxGossipBody+1))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	// With a secret, unsigned and wrongly signed gossip is refused
+	signed, err := NewBackend(Options{NodeID: "a", Window: time.Minute, Secret: "s3cret"})
+	require.NoError(t, err)
+	body := `{"node":"b","entries":[]}`
+	for _, signature := range []string{"", "sha256=00"} {
+		req := httptest.NewRequest(http.MethodPost, "/gossip", strings.NewReader(body))
+		req.Header.Set(SignatureHeader, signature)
+		recorder = httptest.NewRecorder()
+		signed.Handler().ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	}
+
+	_, err = NewBackend(Options{Window: time.Minute})
+	assert.Error(t, err)
+	_, err = NewBackend(Options{NodeID: "a"})
+	assert.Error(t, err)
+}
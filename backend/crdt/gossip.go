@@ -0,0 +1,269 @@
+package crdt
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Gossip message bounds: messages carry at most maxGossipEntries counters
+// and are split further if their body would exceed maxGossipBody, which is
+// also the largest body Handler accepts
+const (
+	maxGossipEntries = 1000
+	maxGossipBody    = 4 << 20
+)
+
+// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of a gossip
+// body when Secret is set
+const SignatureHeader = "X-Throttle-Gossip-Signature"
+
+// gossipMessage carries a node's view of the counters that changed
+type gossipMessage struct {
+	Node    string        `json:"node"`
+	Entries []gossipEntry `json:"entries"`
+}
+
+type gossipEntry struct {
+	Key     string             `json:"key"`
+	Window  int64              `json:"window"`
+	Counts  map[string]float64 `json:"counts"`
+	Cleared float64            `json:"cleared"`
+}
+
+// Gossip pushes the counters that changed since each peer's last successful
+// round to every peer once. After a failed round the next one sends
+// everything again, so a peer that restarted meanwhile catches up.
+func (b *Backend) Gossip(ctx context.Context) error {
+	errs := make([]error, len(b.opts.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range b.opts.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = b.gossipTo(ctx, peer)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Handler receives gossip from peers at /gossip
+func (b *Backend) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /gossip", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGossipBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "gossip message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "failed to read gossip message", http.StatusBadRequest)
+			return
+		}
+
+		if b.opts.Secret != "" && !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(b.sign(body))) {
+			http.Error(w, "invalid gossip signature", http.StatusUnauthorized)
+			return
+		}
+
+		var msg gossipMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			http.Error(w, "invalid gossip message", http.StatusBadRequest)
+			return
+		}
+		b.merge(msg)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// gossipTo sends peer the counters it hasn't received yet
+func (b *Backend) gossipTo(ctx context.Context, peer string) error {
+	b.mu.Lock()
+	b.expire()
+	entries, version := b.changes(b.acked[peer])
+	b.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var errs []error
+	failed := false
+	for start := 0; start < len(entries); start += maxGossipEntries {
+		chunk := entries[start:min(start+maxGossipEntries, len(entries))]
+		if err := b.send(ctx, peer, chunk); err != nil {
+			var oversized *oversizedError
+			errs = append(errs, err)
+			if !errors.As(err, &oversized) {
+				failed = true
+				break
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if failed {
+		b.acked[peer] = 0
+		b.gossipFailed++
+	} else {
+		b.acked[peer] = version
+		b.gossipSent++
+	}
+	return errors.Join(errs...)
+}
+
+// oversizedError reports a counter whose message alone exceeds
+// maxGossipBody, e.g. because of a huge key; it can never be gossiped
+type oversizedError struct {
+	key  string
+	size int
+}
+
+func (e *oversizedError) Error() string {
+	return fmt.Sprintf("failed to gossip key %q: message of %d bytes exceeds the %d byte limit", e.key, e.size, maxGossipBody)
+}
+
+// send pushes entries to peer, halving the message while its body is too
+// large. Counters too large to send on their own are skipped and reported.
+func (b *Backend) send(ctx context.Context, peer string, entries []gossipEntry) error {
+	body, err := json.Marshal(gossipMessage{Node: b.opts.NodeID, Entries: entries})
+	if err != nil {
+		return fmt.Errorf("failed to encode gossip: %w", err)
+	}
+
+	if len(body) <= maxGossipBody {
+		return b.push(ctx, peer, body)
+	}
+	if len(entries) == 1 {
+		b.mu.Lock()
+		b.gossipOversized++
+		b.mu.Unlock()
+		return &oversizedError{key: entries[0].Key, size: len(body)}
+	}
+
+	half := len(entries) / 2
+	first := b.send(ctx, peer, entries[:half])
+	var oversized *oversizedError
+	if first != nil && !errors.As(first, &oversized) {
+		return first
+	}
+	return errors.Join(first, b.send(ctx, peer, entries[half:]))
+}
+
+// push sends an encoded message to one peer
+func (b *Backend) push(ctx context.Context, peer string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/gossip", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create gossip request for %s: %w", peer, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.opts.Secret != "" {
+		req.Header.Set(SignatureHeader, b.sign(body))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to gossip to %s: %w", peer, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to gossip to %s: status %d", peer, resp.StatusCode)
+	}
+	return nil
+}
+
+// sign returns the signature header value of a gossip body. Merges are
+// idempotent, so replayed messages are harmless and no timestamp is signed.
+func (b *Backend) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(b.opts.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// changes copies the counters changed after version since, and returns the
+// current version; the caller holds mu
+func (b *Backend) changes(since uint64) ([]gossipEntry, uint64) {
+	var entries []gossipEntry
+	for key, byWindow := range b.counters {
+		for window, c := range byWindow {
+			if c.version <= since {
+				continue
+			}
+			counts := make(map[string]float64, len(c.counts))
+			for node, n := range c.counts {
+				counts[node] = n
+			}
+			entries = append(entries, gossipEntry{Key: key, Window: window, Counts: counts, Cleared: c.cleared})
+		}
+	}
+	return entries, b.version
+}
+
+// merge folds a peer's view into ours by taking the maximum of every
+// component. Windows we have already dropped are ignored. Counters that
+// changed are gossiped on to the other peers.
+func (b *Backend) merge(msg gossipMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	oldest := b.window(b.now()) - int64(b.opts.Retention) + 1
+	for _, entry := range msg.Entries {
+		if entry.Window < oldest {
+			continue
+		}
+
+		c := b.counter(entry.Key, entry.Window)
+		changed := false
+		for node, n := range entry.Counts {
+			if n > c.counts[node] {
+				c.counts[node] = n
+				changed = true
+			}
+		}
+		if entry.Cleared > c.cleared {
+			c.cleared = entry.Cleared
+			changed = true
+		}
+		if changed {
+			b.touch(c)
+			b.observe(c)
+		}
+	}
+	b.merged++
+}
+
+// gossipLoop pushes changes to peers every GossipInterval
+func (b *Backend) gossipLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.opts.GossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), b.opts.GossipInterval)
+			// Failures are counted in Stats; the next round retries
+			b.Gossip(ctx)
+			cancel()
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// ErrClosed is returned by operations on a closed backend
+var ErrClosed = errors.New("file backend is closed")
+
+// SyncPolicy controls when writes are flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the log after every write
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs the log periodically from a background goroutine
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+// Options configures the file backend
+type Options struct {
+	Sync            SyncPolicy    // When to fsync the log (default SyncAlways)
+	SyncInterval    time.Duration // Flush period for SyncInterval (default 1s)
+	TTL             time.Duration // Drop keys not updated for this long (0 keeps them forever)
+	CompactInterval time.Duration // Run Compact periodically (0 disables the background loop)
+	CompactRatio    float64       // Compact on write once log records exceed live keys by this factor (0 disables)
+}
+
+// record is a single entry in the append-only log
+type record struct {
+	Op         string  `json:"op"`
+	Key        string  `json:"key"`
+	Tokens     float64 `json:"tokens,omitempty"`
+	LastUpdate int64   `json:"last_update,omitempty"`
+	Created    int64   `json:"created,omitempty"`
+}
+
+const (
+	opSet    = "set"
+	opDelete = "del"
+)
+
+// Backend implements a persistent storage backend on local disk. State is
+// kept in memory and every change is appended to a log file that is replayed
+// on open and periodically rewritten by Compact.
+type Backend struct {
+	path    string
+	opts    Options
+	file    *os.File
+	store   map[string]*core.State
+	records int
+	dirty   bool
+	closed  bool
+	now     func() time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	index   core.ScanIndex
+
+	compactFailures int   // Compactions on write that failed
+	compactErr      error // Why the last of them failed
+}
+
+// NewBackend opens (or creates) the log at path and replays it
+func NewBackend(path string, opts Options) (*Backend, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+
+	b := &Backend{
+		path:  path,
+		opts:  opts,
+		store: make(map[string]*core.State),
+		now:   time.Now,
+		done:  make(chan struct{}),
+	}
+
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		b.wg.Add(1)
+		go b.loop(opts.SyncInterval, b.syncDirty)
+	}
+	if opts.CompactInterval > 0 {
+		b.wg.Add(1)
+		go b.loop(opts.CompactInterval, func() { b.Compact() })
+	}
+
+	return b, nil
+}
+
+// Get retrieves the current state for a key
+func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	state, exists := b.store[key]
+	if !exists || b.expired(state, b.now()) {
+		return nil, nil
+	}
+
+	// Return a copy to prevent external modifications
+	return &core.State{
+		Tokens:     state.Tokens,
+		LastUpdate: state.LastUpdate,
+		Created:    state.Created,
+	}, nil
+}
+
+// Set stores the state for a key
+func (b *Backend) Set(ctx context.Context, key string, state *core.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	err := b.append(record{
+		Op:         opSet,
+		Key:        key,
+		Tokens:     state.Tokens,
+		LastUpdate: state.LastUpdate.UnixNano(),
+		Created:    state.Created.UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Store a copy to prevent external modifications
+	b.store[key] = &core.State{
+		Tokens:     state.Tokens,
+		LastUpdate: state.LastUpdate,
+		Created:    state.Created,
+	}
+
+	b.maybeCompact()
+	return nil
+}
+
+// Delete removes the state for a key
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	if _, exists := b.store[key]; !exists {
+		return nil
+	}
+
+	if err := b.append(record{Op: opDelete, Key: key}); err != nil {
+		return err
+	}
+	delete(b.store, key)
+
+	b.maybeCompact()
+	return nil
+}
+
+// Scan returns a page of the live keys after cursor in sorted order. Count
+// keys are examined per page, all remaining keys if it is zero. Keys are
+// sorted once per scan, see core.ScanIndex.
+func (b *Backend) Scan(ctx context.Context, filter core.Filter, cursor string) ([]core.Entry, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	keys, next := b.index.Page(cursor, filter.Count, b.keys)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, "", ErrClosed
+	}
+
+	now := b.now()
+	var entries []core.Entry
+	for _, key := range keys {
+		state, ok := b.store[key]
+		if !ok || !filter.Matches(key) || b.expired(state, now) {
+			continue
+		}
+		entries = append(entries, core.Entry{
+			Key: key,
+			State: &core.State{
+				Tokens:     state.Tokens,
+				LastUpdate: state.LastUpdate,
+				Created:    state.Created,
+			},
+		})
+	}
+
+	return entries, next, nil
+}
+
+// keys lists the stored keys
+func (b *Backend) keys() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	keys := make([]string, 0, len(b.store))
+	for key := range b.store {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close stops background work, flushes the log and closes the file
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	b.mu.Unlock()
+
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opts.Sync != SyncNever {
+		if err := b.file.Sync(); err != nil {
+			b.file.Close()
+			return fmt.Errorf("failed to sync %s: %w", b.path, err)
+		}
+	}
+	return b.file.Close()
+}
+
+// Compact rewrites the log so that it holds exactly one record per live key,
+// dropping deleted and expired entries
+func (b *Backend) Compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	return b.compact()
+}
+
+// Ping reports whether the backend is still open
+func (b *Backend) Ping(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	return ctx.Err()
+}
+
+// Stats returns statistics about the backend
+func (b *Backend) Stats() map[string]interface{} {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := map[string]interface{}{
+		"keys_count":       len(b.store),
+		"log_records":      b.records,
+		"compact_failures": b.compactFailures,
+	}
+	if b.compactErr != nil {
+		stats["last_compact_error"] = b.compactErr.Error()
+	}
+	return stats
+}
+
+// load replays the log into memory, truncating a torn or corrupt tail left
+// behind by a crash
+func (b *Backend) load() error {
+	f, err := os.OpenFile(b.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", b.path, err)
+	}
+
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to read %s: %w", b.path, err)
+		}
+
+		rec, ok := decodeRecord(line)
+		if !ok {
+			break
+		}
+		b.apply(rec)
+		b.records++
+		offset += int64(len(line))
+	}
+
+	// Anything past the last good record is an incomplete write
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to truncate %s: %w", b.path, err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to seek %s: %w", b.path, err)
+	}
+
+	b.file = f
+	return nil
+}
+
+// apply replays a single record into the in-memory store
+func (b *Backend) apply(rec record) {
+	switch rec.Op {
+	case opSet:
+		b.store[rec.Key] = &core.State{
+			Tokens:     rec.Tokens,
+			LastUpdate: time.Unix(0, rec.LastUpdate),
+			Created:    time.Unix(0, rec.Created),
+		}
+	case opDelete:
+		delete(b.store, rec.Key)
+	}
+}
+
+// append writes a record to the log, honouring the sync policy
+func (b *Backend) append(rec record) error {
+	line, err := encodeRecord(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode record for key %s: %w", rec.Key, err)
+	}
+
+	if _, err := b.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write key %s to %s: %w", rec.Key, b.path, err)
+	}
+	b.records++
+
+	switch b.opts.Sync {
+	case SyncAlways:
+		if err := b.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", b.path, err)
+		}
+	case SyncInterval:
+		b.dirty = true
+	}
+
+	return nil
+}
+
+// maybeCompact compacts once the log has grown well past the live key
+// count. The write that triggered it has already succeeded and the log is
+// still correct, so a failure is only reported in Stats; the next write
+// tries again.
+func (b *Backend) maybeCompact() {
+	if b.opts.CompactRatio <= 0 {
+		return
+	}
+
+	live := len(b.store)
+	if live < 1 {
+		live = 1
+	}
+	if float64(b.records) < float64(live)*b.opts.CompactRatio {
+		return
+	}
+	if err := b.compact(); err != nil {
+		b.compactFailures++
+		b.compactErr = err
+	}
+}
+
+// compact writes the live set to a temporary file and atomically swaps it in
+func (b *Backend) compact() error {
+	now := b.now()
+	tmpPath := b.path + ".compact"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+
+	var buf bytes.Buffer
+	records := 0
+	for key, state := range b.store {
+		if b.expired(state, now) {
+			delete(b.store, key)
+			continue
+		}
+
+		line, err := encodeRecord(record{
+			Op:         opSet,
+			Key:        key,
+			Tokens:     state.Tokens,
+			LastUpdate: state.LastUpdate.UnixNano(),
+			Created:    state.Created.UnixNano(),
+		})
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to encode record for key %s: %w", key, err)
+		}
+		buf.Write(line)
+		records++
+	}
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace %s: %w", b.path, err)
+	}
+	syncDir(filepath.Dir(b.path))
+
+	b.file.Close()
+	b.file = tmp
+	b.records = records
+	b.dirty = false
+
+	return nil
+}
+
+// syncDirty flushes pending writes for the SyncInterval policy
+func (b *Backend) syncDirty() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed || !b.dirty {
+		return
+	}
+	if err := b.file.Sync(); err == nil {
+		b.dirty = false
+	}
+}
+
+// loop runs fn every interval until the backend is closed
+func (b *Backend) loop(interval time.Duration, fn func()) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// expired reports whether state has outlived the configured TTL
+func (b *Backend) expired(state *core.State, now time.Time) bool {
+	return b.opts.TTL > 0 && now.Sub(state.LastUpdate) > b.opts.TTL
+}
+
+// encodeRecord renders a record as "<crc32> <json>\n"
+func encodeRecord(rec record) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	line := make([]byte, 0, len(data)+10)
+	line = strconv.AppendUint(line, uint64(crc32.ChecksumIEEE(data)), 16)
+	line = append(line, ' ')
+	line = append(line, data...)
+	return append(line, '\n'), nil
+}
+
+// decodeRecord parses a log line, rejecting it if the checksum doesn't match
+func decodeRecord(line []byte) (record, bool) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+
+	sum, data, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return record{}, false
+	}
+
+	expected, err := strconv.ParseUint(string(sum), 16, 32)
+	if err != nil || uint32(expected) != crc32.ChecksumIEEE(data) {
+		return record{}, false
+	}
+
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return record{}, false
+	}
+	return rec, true
+}
+
+// syncDir fsyncs a directory so a rename within it is durable
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,292 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/backendtest"
+	"github.com/throttle/core"
+)
+
+// newTestBackend opens a backend in a fresh temporary directory
+func newTestBackend(t *testing.T, opts Options) (*Backend, string) {
+	path := filepath.Join(t.TempDir(), "throttle.log")
+	backend, err := NewBackend(path, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { backend.Close() })
+	return backend, path
+}
+
+func TestBackend_Conformance(t *testing.T) {
+	factory := func(t *testing.T) core.Backend {
+		backend, err := NewBackend(filepath.Join(t.TempDir(), "throttle.log"), Options{TTL: time.Minute})
+		require.NoError(t, err)
+		return backend
+	}
+	advance := func(backend core.Backend, d time.Duration) {
+		b := backend.(*Backend)
+		now := b.now().Add(d)
+		b.now = func() time.Time { return now }
+	}
+
+	backendtest.RunConformance(t, factory, backendtest.WithExpiry(time.Minute, advance))
+}
+
+func TestBackend_GetSet(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	now := time.Now()
+	state := &core.State{
+		Tokens:     5.0,
+		LastUpdate: now,
+		Created:    now,
+	}
+
+	err := backend.Set(ctx, "test-key", state)
+	assert.NoError(t, err)
+
+	retrieved, err := backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+	assert.Equal(t, state.Tokens, retrieved.Tokens)
+	assert.Equal(t, state.LastUpdate, retrieved.LastUpdate)
+	assert.Equal(t, state.Created, retrieved.Created)
+}
+
+func TestBackend_GetNonExistent(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	retrieved, err := backend.Get(ctx, "non-existent")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func TestBackend_Delete(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	state := &core.State{
+		Tokens:     10.0,
+		LastUpdate: time.Now(),
+		Created:    time.Now(),
+	}
+
+	err := backend.Set(ctx, "test-key", state)
+	assert.NoError(t, err)
+
+	err = backend.Delete(ctx, "test-key")
+	assert.NoError(t, err)
+
+	retrieved, err := backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func TestBackend_Concurrency(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	done := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		go func(id int) {
+			key := fmt.Sprintf("key-%d", id)
+			state := &core.State{
+				Tokens:     float64(id),
+				LastUpdate: time.Now(),
+				Created:    time.Now(),
+			}
+
+			err := backend.Set(ctx, key, state)
+			assert.NoError(t, err)
+
+			retrieved, err := backend.Get(ctx, key)
+			assert.NoError(t, err)
+			assert.NotNil(t, retrieved)
+
+			done <- true
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	stats := backend.Stats()
+	assert.Equal(t, 10, stats["keys_count"])
+}
+
+func TestBackend_PersistsAcrossReopen(t *testing.T) {
+	backend, path := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		state := &core.State{Tokens: float64(i), LastUpdate: now, Created: now}
+		assert.NoError(t, backend.Set(ctx, fmt.Sprintf("key-%d", i), state))
+	}
+	assert.NoError(t, backend.Delete(ctx, "key-0"))
+	assert.NoError(t, backend.Close())
+
+	reopened, err := NewBackend(path, Options{})
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	retrieved, err := reopened.Get(ctx, "key-0")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+
+	retrieved, err = reopened.Get(ctx, "key-3")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+	assert.Equal(t, 3.0, retrieved.Tokens)
+	assert.True(t, now.Equal(retrieved.LastUpdate))
+	assert.Equal(t, 4, reopened.Stats()["keys_count"])
+}
+
+func TestBackend_TornTailIsTruncated(t *testing.T) {
+	backend, path := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	now := time.Now()
+	assert.NoError(t, backend.Set(ctx, "good", &core.State{Tokens: 1, LastUpdate: now, Created: now}))
+	assert.NoError(t, backend.Close())
+
+	// Simulate a crash halfway through appending a record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`1234abcd {"op":"set","key":"torn","tok`)
+	require.NoError(t, err)
+	f.Close()
+
+	reopened, err := NewBackend(path, Options{})
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	retrieved, err := reopened.Get(ctx, "good")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+
+	retrieved, err = reopened.Get(ctx, "torn")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+
+	// New writes land after the last good record
+	assert.NoError(t, reopened.Set(ctx, "after", &core.State{Tokens: 2, LastUpdate: now, Created: now}))
+	assert.Equal(t, 2, reopened.Stats()["log_records"])
+}
+
+func TestBackend_Expiry(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{TTL: time.Minute})
+	ctx := context.Background()
+
+	now := time.Now()
+	clock := now
+	backend.now = func() time.Time { return clock }
+
+	assert.NoError(t, backend.Set(ctx, "stale", &core.State{Tokens: 1, LastUpdate: now, Created: now}))
+
+	clock = now.Add(30 * time.Second)
+	retrieved, err := backend.Get(ctx, "stale")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+
+	clock = now.Add(2 * time.Minute)
+	retrieved, err = backend.Get(ctx, "stale")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+
+	// Compaction drops expired keys for good
+	assert.NoError(t, backend.Compact())
+	assert.Equal(t, 0, backend.Stats()["keys_count"])
+}
+
+func TestBackend_Compact(t *testing.T) {
+	backend, path := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		state := &core.State{Tokens: float64(i), LastUpdate: now, Created: now}
+		assert.NoError(t, backend.Set(ctx, fmt.Sprintf("key-%d", i%3), state))
+	}
+	assert.Equal(t, 100, backend.Stats()["log_records"])
+
+	assert.NoError(t, backend.Compact())
+	assert.Equal(t, 3, backend.Stats()["log_records"])
+
+	// The compacted log remains writable and replays correctly
+	assert.NoError(t, backend.Set(ctx, "key-0", &core.State{Tokens: 42, LastUpdate: now, Created: now}))
+	assert.NoError(t, backend.Close())
+
+	reopened, err := NewBackend(path, Options{})
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	retrieved, err := reopened.Get(ctx, "key-0")
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, retrieved.Tokens)
+	assert.Equal(t, 3, reopened.Stats()["keys_count"])
+}
+
+func TestBackend_CompactRatio(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{CompactRatio: 4})
+	ctx := context.Background()
+
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		state := &core.State{Tokens: float64(i), LastUpdate: now, Created: now}
+		assert.NoError(t, backend.Set(ctx, "hot-key", state))
+	}
+
+	assert.Less(t, backend.Stats()["log_records"], 4)
+}
+
+func TestBackend_CompactRatioFailure(t *testing.T) {
+	backend, path := newTestBackend(t, Options{CompactRatio: 4})
+	ctx := context.Background()
+
+	// A directory in the way of the temporary file makes compaction fail
+	require.NoError(t, os.Mkdir(path+".compact", 0o755))
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		state := &core.State{Tokens: float64(i), LastUpdate: now, Created: now}
+		require.NoError(t, backend.Set(ctx, "hot-key", state), "the write itself succeeded")
+	}
+	stats := backend.Stats()
+	assert.Positive(t, stats["compact_failures"])
+	assert.Contains(t, stats["last_compact_error"], ".compact")
+	assert.Equal(t, 10, stats["log_records"])
+
+	// The next write tries again
+	require.NoError(t, os.Remove(path+".compact"))
+	require.NoError(t, backend.Delete(ctx, "hot-key"))
+	assert.Less(t, backend.Stats()["log_records"], 4)
+
+	state, err := backend.Get(ctx, "hot-key")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestBackend_Close(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	err := backend.Close()
+	assert.NoError(t, err)
+
+	// Closing twice is harmless, other operations fail
+	assert.NoError(t, backend.Close())
+	_, err = backend.Get(ctx, "test-key")
+	assert.ErrorIs(t, err, ErrClosed)
+	err = backend.Set(ctx, "test-key", &core.State{})
+	assert.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,261 @@
+package memcached
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// maxCASAttempts bounds how often Update retries after losing a CAS race
+const maxCASAttempts = 16
+
+// maxRelativeExpiry is the largest exptime memcached treats as relative;
+// anything longer must be sent as an absolute unix timestamp
+const maxRelativeExpiry = 30 * 24 * time.Hour
+
+// ErrContention is returned by Update when it keeps losing CAS races
+var ErrContention = errors.New("memcached: too much contention on key")
+
+// Options configures the memcached backend
+type Options struct {
+	Servers      []string      // host:port of every server in the pool
+	Prefix       string        // Key prefix (default "throttle")
+	Config       core.Config   // Rate limit the keys are used with, to derive expiry
+	TTL          time.Duration // Fixed expiry overriding the one derived from Config
+	Timeout      time.Duration // Dial and I/O timeout per operation (default 1s)
+	MaxIdleConns int           // Idle connections kept per server (default 4)
+}
+
+// Backend implements the core.Backend interface using memcached
+type Backend struct {
+	servers []*server
+	ring    *ring
+	prefix  string
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// NewBackend creates a new memcached backend
+func NewBackend(opts Options) (*Backend, error) {
+	if len(opts.Servers) == 0 {
+		return nil, errors.New("memcached: no servers configured")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "throttle"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = 4
+	}
+
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = TTLForConfig(opts.Config)
+	}
+
+	servers := make([]*server, len(opts.Servers))
+	for i, addr := range opts.Servers {
+		servers[i] = newServer(addr, opts.Timeout, opts.MaxIdleConns)
+	}
+
+	return &Backend{
+		servers: servers,
+		ring:    newRing(servers),
+		prefix:  opts.Prefix,
+		ttl:     ttl,
+		now:     time.Now,
+	}, nil
+}
+
+// TTLForConfig returns how long a key must live for the given limit: the
+// time an empty bucket takes to refill completely, plus one interval of
+// margin. After that its state is indistinguishable from a fresh key.
+func TTLForConfig(config core.Config) time.Duration {
+	if config.Limit <= 0 || config.Interval <= 0 {
+		return 24 * time.Hour
+	}
+
+	burst := config.Burst
+	if burst < config.Limit {
+		burst = config.Limit
+	}
+	refill := time.Duration(float64(burst) / float64(config.Limit) * float64(config.Interval))
+	return refill + config.Interval
+}
+
+// Get retrieves the state for a key from memcached
+func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	state, _, err := b.gets(ctx, key)
+	return state, err
+}
+
+// Set stores the state for a key in memcached
+func (b *Backend) Set(ctx context.Context, key string, state *core.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state for key %s: %w", key, err)
+	}
+
+	mcKey := b.makeKey(key)
+	if err := b.ring.pick(mcKey).store(ctx, "set", mcKey, data, b.exptime(), 0); err != nil {
+		return fmt.Errorf("failed to set key %s in memcached: %w", key, err)
+	}
+	return nil
+}
+
+// Update atomically applies fn to the state for a key using gets/cas, or add
+// for keys that don't exist yet, retrying when another writer got there first
+func (b *Backend) Update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	mcKey := b.makeKey(key)
+	srv := b.ring.pick(mcKey)
+
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		state, casID, err := b.gets(ctx, key)
+		if err != nil {
+			return err
+		}
+		exists := state != nil
+
+		state, err = fn(state)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to marshal state for key %s: %w", key, err)
+		}
+
+		if exists {
+			err = srv.store(ctx, "cas", mcKey, data, b.exptime(), casID)
+		} else {
+			err = srv.store(ctx, "add", mcKey, data, b.exptime(), 0)
+		}
+
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, errExists), errors.Is(err, errNotStored), errors.Is(err, errNotFound):
+			// Lost the race (or the key expired in between), try again
+			continue
+		default:
+			return fmt.Errorf("failed to update key %s in memcached: %w", key, err)
+		}
+	}
+
+	return fmt.Errorf("failed to update key %s: %w", key, ErrContention)
+}
+
+// Delete removes the state for a key from memcached
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mcKey := b.makeKey(key)
+	if err := b.ring.pick(mcKey).delete(ctx, mcKey); err != nil {
+		return fmt.Errorf("failed to delete key %s from memcached: %w", key, err)
+	}
+	return nil
+}
+
+// Close closes all idle connections
+func (b *Backend) Close() error {
+	for _, s := range b.servers {
+		s.close()
+	}
+	return nil
+}
+
+// Ping asks every server for its version and reports those that don't
+// answer, since each holds a share of the keys
+func (b *Backend) Ping(ctx context.Context) error {
+	var errs []error
+	for _, s := range b.servers {
+		if _, err := s.version(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to ping memcached server %s: %w", s.addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns statistics about the backend
+func (b *Backend) Stats() map[string]interface{} {
+	idle := 0
+	for _, s := range b.servers {
+		idle += len(s.idle)
+	}
+	return map[string]interface{}{
+		"servers":          len(b.servers),
+		"idle_connections": idle,
+		"ttl_seconds":      int64(b.ttl / time.Second),
+	}
+}
+
+// gets fetches and decodes a state with its CAS token; a missing key yields nil
+func (b *Backend) gets(ctx context.Context, key string) (*core.State, uint64, error) {
+	mcKey := b.makeKey(key)
+
+	data, casID, err := b.ring.pick(mcKey).gets(ctx, mcKey)
+	if errors.Is(err, errNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get key %s from memcached: %w", key, err)
+	}
+
+	var state core.State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal state for key %s: %w", key, err)
+	}
+	return &state, casID, nil
+}
+
+// exptime converts the TTL to memcached's exptime, which is a relative number
+// of seconds up to 30 days and an absolute unix time beyond that
+func (b *Backend) exptime() int64 {
+	seconds := int64((b.ttl + time.Second - 1) / time.Second)
+	if b.ttl > maxRelativeExpiry {
+		return b.now().Unix() + seconds
+	}
+	return seconds
+}
+
+// makeKey creates a memcached key with the configured prefix. Keys that
+// memcached can't store verbatim (too long, whitespace or control
+// characters) are replaced by their SHA-1.
+func (b *Backend) makeKey(key string) string {
+	mcKey := b.prefix + ":" + key
+	if len(mcKey) <= 250 && validKey(mcKey) {
+		return mcKey
+	}
+
+	sum := sha1.Sum([]byte(key))
+	return b.prefix + ":sha1:" + hex.EncodeToString(sum[:])
+}
+
+// validKey reports whether key can be sent as-is over the text protocol
+func validKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,275 @@
+package memcached
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/backendtest"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// newTestBackend returns a backend talking to the given fake servers
+func newTestBackend(t *testing.T, opts Options, servers ...*fakeServer) *Backend {
+	for _, s := range servers {
+		opts.Servers = append(opts.Servers, s.addr())
+	}
+	backend, err := NewBackend(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+func TestBackend_Conformance(t *testing.T) {
+	servers := make(map[core.Backend]*fakeServer)
+	factory := func(t *testing.T) core.Backend {
+		srv := startFakeServer(t)
+		backend := newTestBackend(t, Options{TTL: time.Minute}, srv)
+		servers[backend] = srv
+		return backend
+	}
+	advance := func(backend core.Backend, d time.Duration) {
+		servers[backend].advance(d)
+	}
+
+	backendtest.RunConformance(t, factory, backendtest.WithExpiry(time.Minute, advance))
+}
+
+func TestNewBackend_NoServers(t *testing.T) {
+	_, err := NewBackend(Options{})
+	assert.Error(t, err)
+}
+
+func TestTTLForConfig(t *testing.T) {
+	// 15 tokens at 10/min refill in 90s, plus a minute of margin
+	ttl := TTLForConfig(core.Config{Limit: 10, Interval: time.Minute, Burst: 15})
+	assert.Equal(t, 150*time.Second, ttl)
+
+	// Monthly quotas outlive memcached's 30 day relative expiry limit
+	month := 30 * 24 * time.Hour
+	ttl = TTLForConfig(core.Config{Limit: 1000, Interval: month, Burst: 1000})
+	assert.Equal(t, 2*month, ttl)
+
+	assert.Equal(t, 24*time.Hour, TTLForConfig(core.Config{}))
+}
+
+func TestBackend_Exptime(t *testing.T) {
+	srv := startFakeServer(t)
+	backend := newTestBackend(t, Options{TTL: 90 * time.Second}, srv)
+	assert.Equal(t, int64(90), backend.exptime())
+
+	month := 60 * 24 * time.Hour
+	backend = newTestBackend(t, Options{TTL: month}, srv)
+	now := time.Now()
+	backend.now = func() time.Time { return now }
+	assert.Equal(t, now.Unix()+int64(month/time.Second), backend.exptime())
+}
+
+func TestBackend_GetSet(t *testing.T) {
+	backend := newTestBackend(t, Options{}, startFakeServer(t))
+	ctx := context.Background()
+
+	now := time.Now()
+	state := &core.State{
+		Tokens:     5.5,
+		LastUpdate: now,
+		Created:    now,
+	}
+
+	err := backend.Set(ctx, "test-key", state)
+	assert.NoError(t, err)
+
+	retrieved, err := backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+	assert.Equal(t, state.Tokens, retrieved.Tokens)
+	assert.True(t, state.LastUpdate.Equal(retrieved.LastUpdate))
+	assert.True(t, state.Created.Equal(retrieved.Created))
+}
+
+func TestBackend_GetNonExistent(t *testing.T) {
+	backend := newTestBackend(t, Options{}, startFakeServer(t))
+	ctx := context.Background()
+
+	retrieved, err := backend.Get(ctx, "non-existent")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func TestBackend_Delete(t *testing.T) {
+	backend := newTestBackend(t, Options{}, startFakeServer(t))
+	ctx := context.Background()
+
+	state := &core.State{Tokens: 10, LastUpdate: time.Now(), Created: time.Now()}
+	assert.NoError(t, backend.Set(ctx, "test-key", state))
+
+	assert.NoError(t, backend.Delete(ctx, "test-key"))
+	assert.NoError(t, backend.Delete(ctx, "test-key"))
+
+	retrieved, err := backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func TestBackend_Expiry(t *testing.T) {
+	srv := startFakeServer(t)
+	config := core.Config{Limit: 10, Interval: time.Minute, Burst: 10}
+	backend := newTestBackend(t, Options{Config: config}, srv)
+	ctx := context.Background()
+
+	state := &core.State{Tokens: 1, LastUpdate: time.Now(), Created: time.Now()}
+	assert.NoError(t, backend.Set(ctx, "test-key", state))
+
+	srv.advance(time.Minute)
+	retrieved, err := backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+
+	srv.advance(2 * time.Minute)
+	retrieved, err = backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func TestBackend_UpdateIsAtomic(t *testing.T) {
+	backend := newTestBackend(t, Options{MaxIdleConns: 8}, startFakeServer(t))
+	ctx := context.Background()
+
+	const workers = 8
+	const increments = 25
+
+	var succeeded atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				err := backend.Update(ctx, "counter", func(state *core.State) (*core.State, error) {
+					if state == nil {
+						state = &core.State{LastUpdate: time.Now(), Created: time.Now()}
+					}
+					state.Tokens++
+					return state, nil
+				})
+				if err == nil {
+					succeeded.Add(1)
+				} else if !assert.ErrorIs(t, err, ErrContention) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, err := backend.Get(ctx, "counter")
+	require.NoError(t, err)
+	// Every successful CAS adds exactly one, none are lost
+	assert.Equal(t, float64(succeeded.Load()), state.Tokens)
+	assert.Greater(t, succeeded.Load(), int64(0))
+}
+
+func TestBackend_UpdateSerialIsExact(t *testing.T) {
+	backend := newTestBackend(t, Options{}, startFakeServer(t))
+	config := core.Config{Limit: 5, Interval: time.Hour, Burst: 5}
+	limiter := core.NewLimiter(backend, tokenbucket.NewStrategy(config), config, nil)
+	ctx := context.Background()
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		decision, err := limiter.Grant(ctx, "user")
+		require.NoError(t, err)
+		if decision.Allowed {
+			allowed++
+		}
+	}
+	assert.Equal(t, 5, allowed)
+}
+
+func TestBackend_ConsistentHashing(t *testing.T) {
+	srv1, srv2, srv3 := startFakeServer(t), startFakeServer(t), startFakeServer(t)
+	backend := newTestBackend(t, Options{}, srv1, srv2, srv3)
+	ctx := context.Background()
+
+	const keys = 300
+	for i := 0; i < keys; i++ {
+		state := &core.State{Tokens: float64(i), LastUpdate: time.Now(), Created: time.Now()}
+		require.NoError(t, backend.Set(ctx, fmt.Sprintf("key-%d", i), state))
+	}
+
+	// Every server holds a reasonable share
+	for _, srv := range []*fakeServer{srv1, srv2, srv3} {
+		assert.Greater(t, srv.keys(), keys/10)
+	}
+
+	// Dropping a server only remaps the keys it owned
+	smaller := newTestBackend(t, Options{}, srv1, srv2)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := backend.makeKey(fmt.Sprintf("key-%d", i))
+		before := backend.ring.pick(key).addr
+		after := smaller.ring.pick(key).addr
+		if before != srv3.addr() && before != after {
+			moved++
+		}
+	}
+	assert.Equal(t, 0, moved)
+}
+
+func TestBackend_MakeKey(t *testing.T) {
+	backend := newTestBackend(t, Options{Prefix: "rl"}, startFakeServer(t))
+
+	assert.Equal(t, "rl:user-1", backend.makeKey("user-1"))
+
+	hashed := backend.makeKey("has space")
+	assert.True(t, strings.HasPrefix(hashed, "rl:sha1:"))
+
+	long := backend.makeKey(strings.Repeat("x", 300))
+	assert.LessOrEqual(t, len(long), 250)
+	assert.NotEqual(t, long, backend.makeKey(strings.Repeat("y", 300)))
+}
+
+func TestBackend_ContextCancelled(t *testing.T) {
+	backend := newTestBackend(t, Options{}, startFakeServer(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := backend.Get(ctx, "test-key")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBackend_Close(t *testing.T) {
+	backend := newTestBackend(t, Options{}, startFakeServer(t))
+	ctx := context.Background()
+
+	_, err := backend.Get(ctx, "warm-up")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, backend.Stats()["idle_connections"])
+
+	assert.NoError(t, backend.Close())
+	assert.Equal(t, 0, backend.Stats()["idle_connections"])
+}
+
+func TestBackend_PingReportsDownServers(t *testing.T) {
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := ln.Addr().String()
+	ln.Close()
+
+	backend, err := NewBackend(Options{Servers: []string{startFakeServer(t).addr(), down}, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	err = backend.Ping(context.Background())
+	assert.ErrorContains(t, err, down)
+}
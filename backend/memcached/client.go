@@ -0,0 +1,258 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNotFound and errExists report the protocol's NOT_FOUND and EXISTS replies
+var (
+	errNotFound  = errors.New("memcached: not found")
+	errExists    = errors.New("memcached: cas conflict")
+	errNotStored = errors.New("memcached: not stored")
+)
+
+// server is a connection pool to a single memcached server speaking the
+// text protocol
+type server struct {
+	addr    string
+	timeout time.Duration
+	idle    chan *conn
+}
+
+// conn is one pooled connection
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+// newServer creates a pool for addr keeping up to maxIdle idle connections
+func newServer(addr string, timeout time.Duration, maxIdle int) *server {
+	return &server{
+		addr:    addr,
+		timeout: timeout,
+		idle:    make(chan *conn, maxIdle),
+	}
+}
+
+// gets fetches a value and its CAS token
+func (s *server) gets(ctx context.Context, key string) ([]byte, uint64, error) {
+	var value []byte
+	var casID uint64
+
+	err := s.do(ctx, func(c *conn) error {
+		if _, err := fmt.Fprintf(c.rw, "gets %s\r\n", key); err != nil {
+			return err
+		}
+		if err := c.rw.Flush(); err != nil {
+			return err
+		}
+
+		found := false
+		for {
+			line, err := readLine(c.rw.Reader)
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				break
+			}
+
+			// VALUE <key> <flags> <bytes> <cas unique>
+			fields := strings.Fields(line)
+			if len(fields) != 5 || fields[0] != "VALUE" {
+				return protocolError(line)
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return protocolError(line)
+			}
+			casID, err = strconv.ParseUint(fields[4], 10, 64)
+			if err != nil {
+				return protocolError(line)
+			}
+
+			value = make([]byte, size+2)
+			if _, err := io.ReadFull(c.rw, value); err != nil {
+				return err
+			}
+			value = value[:size]
+			found = true
+		}
+
+		if !found {
+			return errNotFound
+		}
+		return nil
+	})
+
+	return value, casID, err
+}
+
+// store issues a storage command (set, add or cas). casID is only sent for cas.
+func (s *server) store(ctx context.Context, cmd, key string, value []byte, exptime int64, casID uint64) error {
+	return s.do(ctx, func(c *conn) error {
+		if cmd == "cas" {
+			fmt.Fprintf(c.rw, "cas %s 0 %d %d %d\r\n", key, exptime, len(value), casID)
+		} else {
+			fmt.Fprintf(c.rw, "%s %s 0 %d %d\r\n", cmd, key, exptime, len(value))
+		}
+		c.rw.Write(value)
+		c.rw.WriteString("\r\n")
+		if err := c.rw.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readLine(c.rw.Reader)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			return nil
+		case "NOT_STORED":
+			return errNotStored
+		case "EXISTS":
+			return errExists
+		case "NOT_FOUND":
+			return errNotFound
+		}
+		return protocolError(line)
+	})
+}
+
+// delete removes a key; a missing key is not an error
+func (s *server) delete(ctx context.Context, key string) error {
+	return s.do(ctx, func(c *conn) error {
+		if _, err := fmt.Fprintf(c.rw, "delete %s\r\n", key); err != nil {
+			return err
+		}
+		if err := c.rw.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readLine(c.rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return protocolError(line)
+		}
+		return nil
+	})
+}
+
+// version asks the server for its version, which doubles as a ping
+func (s *server) version(ctx context.Context) (string, error) {
+	var version string
+	err := s.do(ctx, func(c *conn) error {
+		if _, err := c.rw.WriteString("version\r\n"); err != nil {
+			return err
+		}
+		if err := c.rw.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readLine(c.rw.Reader)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "VERSION ") {
+			return protocolError(line)
+		}
+		version = strings.TrimPrefix(line, "VERSION ")
+		return nil
+	})
+	return version, err
+}
+
+// do runs fn on a pooled connection. The connection is returned to the pool
+// only if fn succeeded or failed with a protocol-level reply, since any other
+// error may leave unread data on the wire.
+func (s *server) do(ctx context.Context, fn func(c *conn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c, err := s.get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to memcached %s: %w", s.addr, err)
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.nc.SetDeadline(deadline)
+
+	err = fn(c)
+	switch {
+	case err == nil, errors.Is(err, errNotFound), errors.Is(err, errExists), errors.Is(err, errNotStored):
+		s.put(c)
+	default:
+		c.nc.Close()
+	}
+	return err
+}
+
+// get takes an idle connection or dials a new one
+func (s *server) get(ctx context.Context) (*conn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: s.timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		nc: nc,
+		rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+	}, nil
+}
+
+// put returns a connection to the pool, closing it if the pool is full
+func (s *server) put(c *conn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.nc.Close()
+	}
+}
+
+// close closes all idle connections
+func (s *server) close() {
+	for {
+		select {
+		case c := <-s.idle:
+			c.nc.Close()
+		default:
+			return
+		}
+	}
+}
+
+// readLine reads a CRLF terminated line without the terminator
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(line, []byte("\r\n"))), nil
+}
+
+// protocolError wraps an unexpected server reply
+func protocolError(line string) error {
+	return fmt.Errorf("memcached: unexpected reply %q", line)
+}
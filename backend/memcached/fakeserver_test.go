@@ -0,0 +1,194 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is an in-process memcached speaking the subset of the text
+// protocol the backend uses: get/gets, set/add/cas, delete and version
+type fakeServer struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	items   map[string]fakeItem
+	nextCAS uint64
+	now     time.Time
+}
+
+type fakeItem struct {
+	value   []byte
+	cas     uint64
+	expires time.Time
+}
+
+// startFakeServer listens on a loopback port until the test ends
+func startFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	s := &fakeServer{
+		listener: listener,
+		items:    make(map[string]fakeItem),
+		now:      time.Now(),
+	}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return s
+}
+
+// addr returns the host:port the server listens on
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// advance moves the server clock forward to exercise expiry
+func (s *fakeServer) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+// keys returns the number of live items
+func (s *fakeServer) keys() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+func (s *fakeServer) serve() {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(nc)
+	}
+}
+
+func (s *fakeServer) handle(nc net.Conn) {
+	defer nc.Close()
+
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if item, ok := s.lookup(key); ok {
+					if fields[0] == "gets" {
+						fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n", key, len(item.value), item.cas)
+					} else {
+						fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(item.value))
+					}
+					w.Write(item.value)
+					w.WriteString("\r\n")
+				}
+			}
+			w.WriteString("END\r\n")
+
+		case "set", "add", "cas":
+			size, _ := strconv.Atoi(fields[4])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+			var casID uint64
+			if fields[0] == "cas" {
+				casID, _ = strconv.ParseUint(fields[5], 10, 64)
+			}
+			w.WriteString(s.store(fields[0], fields[1], data[:size], exptime, casID) + "\r\n")
+
+		case "delete":
+			s.mu.Lock()
+			if _, ok := s.items[fields[1]]; ok {
+				delete(s.items, fields[1])
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+			s.mu.Unlock()
+
+		case "version":
+			w.WriteString("VERSION fake-1.0\r\n")
+
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// lookup returns a live item, dropping it if it has expired
+func (s *fakeServer) lookup(key string) (fakeItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if ok && !item.expires.IsZero() && !s.now.Before(item.expires) {
+		delete(s.items, key)
+		return fakeItem{}, false
+	}
+	return item, ok
+}
+
+// store implements set, add and cas with memcached's reply codes
+func (s *fakeServer) store(cmd, key string, value []byte, exptime int64, casID uint64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, exists := s.items[key]
+	if exists && !item.expires.IsZero() && !s.now.Before(item.expires) {
+		delete(s.items, key)
+		exists = false
+	}
+
+	switch cmd {
+	case "add":
+		if exists {
+			return "NOT_STORED"
+		}
+	case "cas":
+		if !exists {
+			return "NOT_FOUND"
+		}
+		if item.cas != casID {
+			return "EXISTS"
+		}
+	}
+
+	var expires time.Time
+	switch {
+	case exptime > int64(maxRelativeExpiry/time.Second):
+		expires = time.Unix(exptime, 0)
+	case exptime > 0:
+		expires = s.now.Add(time.Duration(exptime) * time.Second)
+	}
+
+	s.nextCAS++
+	s.items[key] = fakeItem{value: append([]byte(nil), value...), cas: s.nextCAS, expires: expires}
+	return "STORED"
+}
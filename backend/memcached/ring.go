@@ -0,0 +1,44 @@
+package memcached
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// pointsPerServer is the number of virtual nodes each server gets on the
+// ring, which keeps the key distribution even with few servers
+const pointsPerServer = 160
+
+// ring maps keys to servers by consistent hashing, so adding or removing a
+// server only moves the keys that hashed to it
+type ring struct {
+	points  []uint32
+	servers map[uint32]*server
+}
+
+// newRing builds a ring over the given servers
+func newRing(servers []*server) *ring {
+	r := &ring{servers: make(map[uint32]*server, len(servers)*pointsPerServer)}
+
+	for _, s := range servers {
+		for i := 0; i < pointsPerServer; i++ {
+			point := crc32.ChecksumIEEE([]byte(s.addr + "-" + strconv.Itoa(i)))
+			r.points = append(r.points, point)
+			r.servers[point] = s
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return r
+}
+
+// pick returns the server owning key
+func (r *ring) pick(key string) *server {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.servers[r.points[i]]
+}
@@ -11,6 +11,7 @@ import (
 type Backend struct {
 	store map[string]*core.State
 	mu    sync.RWMutex
+	index core.ScanIndex
 }
 
 // NewBackend creates a new in-memory backend
@@ -22,6 +23,10 @@ func NewBackend() *Backend {
 
 // Get retrieves the current state for a key
 func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
@@ -40,6 +45,10 @@ func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
 
 // Set stores the state for a key
 func (b *Backend) Set(ctx context.Context, key string, state *core.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -55,6 +64,10 @@ func (b *Backend) Set(ctx context.Context, key string, state *core.State) error
 
 // Delete removes the state for a key
 func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -62,6 +75,50 @@ func (b *Backend) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// Scan returns a page of the keys after cursor in sorted order. Count
+// keys are examined per page, all remaining keys if it is zero. Keys are
+// sorted once per scan, see core.ScanIndex.
+func (b *Backend) Scan(ctx context.Context, filter core.Filter, cursor string) ([]core.Entry, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	keys, next := b.index.Page(cursor, filter.Count, b.keys)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var entries []core.Entry
+	for _, key := range keys {
+		state, ok := b.store[key]
+		if !ok || !filter.Matches(key) {
+			continue
+		}
+		entries = append(entries, core.Entry{
+			Key: key,
+			State: &core.State{
+				Tokens:     state.Tokens,
+				LastUpdate: state.LastUpdate,
+				Created:    state.Created,
+			},
+		})
+	}
+
+	return entries, next, nil
+}
+
+// keys lists the stored keys
+func (b *Backend) keys() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	keys := make([]string, 0, len(b.store))
+	for key := range b.store {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // Close performs any necessary cleanup
 func (b *Backend) Close() error {
 	b.mu.Lock()
@@ -7,9 +7,16 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/throttle/backend/backendtest"
 	"github.com/throttle/core"
 )
 
+func TestBackend_Conformance(t *testing.T) {
+	backendtest.RunConformance(t, func(t *testing.T) core.Backend {
+		return NewBackend()
+	})
+}
+
 func TestBackend_GetSet(t *testing.T) {
 	backend := NewBackend()
 	ctx := context.Background()
@@ -0,0 +1,399 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/throttle/core"
+)
+
+// ErrBatcherClosed is returned by a Batcher after Close
+var ErrBatcherClosed = errors.New("redis batcher is closed")
+
+// GetMulti retrieves the states for several keys in one pipelined
+// round-trip, with nil for missing keys. Pipelining (rather than MGET) keeps
+// it working on Cluster, where the keys usually live in different slots.
+func (b *Backend) GetMulti(ctx context.Context, keys []string) ([]*core.State, error) {
+	pipe := b.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, b.makeKey(key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get %d keys from Redis: %w", len(keys), err)
+	}
+
+	states := make([]*core.State, len(keys))
+	for i, cmd := range cmds {
+		state, err := b.decodeReply(keys[i], cmd)
+		if err != nil {
+			return nil, err
+		}
+		states[i] = state
+	}
+	if err := b.fillLegacy(ctx, keys, states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// fillLegacy reads the keys whose state is nil from their legacy names, in
+// one pipelined round-trip, when fallback is on
+func (b *Backend) fillLegacy(ctx context.Context, keys []string, states []*core.State) error {
+	if !b.fallback() {
+		return nil
+	}
+
+	pipe := b.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		if states[i] == nil && b.fallbackKey(key) {
+			cmds[i] = pipe.Get(ctx, b.legacyKey(key))
+		}
+	}
+	if pipe.Len() == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to get %d legacy keys from Redis: %w", pipe.Len(), err)
+	}
+
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		state, err := b.decodeReply(keys[i], cmd)
+		if err != nil {
+			return err
+		}
+		states[i] = state
+	}
+	return nil
+}
+
+// SetMulti stores states[i] for keys[i] in one pipelined round-trip
+func (b *Backend) SetMulti(ctx context.Context, keys []string, states []*core.State) error {
+	if len(keys) != len(states) {
+		return fmt.Errorf("SetMulti got %d keys but %d states", len(keys), len(states))
+	}
+
+	pipe := b.client.Pipeline()
+	for i, key := range keys {
+		data, err := b.codec.Encode(states[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode state for key %s: %w", key, err)
+		}
+		pipe.Set(ctx, b.makeKey(key), data, b.expiry(states[i]))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to set %d keys in Redis: %w", len(keys), err)
+	}
+	return nil
+}
+
+// decodeReply turns a GET reply into a state, with nil for a missing key
+func (b *Backend) decodeReply(key string, cmd *redis.StringCmd) (*core.State, error) {
+	data, err := cmd.Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key %s from Redis: %w", key, err)
+	}
+
+	state, err := b.codec.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode state for key %s: %w", key, err)
+	}
+	return state, nil
+}
+
+// BatcherOptions configures client-side micro-batching
+type BatcherOptions struct {
+	Window   time.Duration // How long to wait for more operations after the first (default 200µs)
+	MaxBatch int           // Flush as soon as this many operations are queued (default 128)
+
+	// Timeout bounds a pipeline when one of its callers set no deadline
+	// (default: none, the client's timeouts apply). Otherwise a pipeline
+	// runs until the latest deadline of its callers. Redis clients only
+	// apply deadlines to their connections with ContextTimeoutEnabled.
+	Timeout time.Duration
+}
+
+// Batcher is a core.Backend that coalesces Get and Set calls made by many
+// goroutines within a short window into a single Redis pipeline. Each call
+// still blocks until its own result is known, so a Limiter using a Batcher
+// behaves exactly as with the Backend, but under concurrency it makes far
+// fewer round-trips at the cost of up to Window extra latency.
+type Batcher struct {
+	backend *Backend
+	opts    BatcherOptions
+	ops     chan *batchOp
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+// batchOp is one queued Get (state == nil) or Set
+type batchOp struct {
+	ctx    context.Context
+	key    string
+	state  *core.State
+	result chan batchResult
+}
+
+type batchResult struct {
+	state *core.State
+	err   error
+}
+
+// NewBatcher starts a micro-batching front end for backend
+func NewBatcher(backend *Backend, opts BatcherOptions) *Batcher {
+	if opts.Window <= 0 {
+		opts.Window = 200 * time.Microsecond
+	}
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = 128
+	}
+
+	bt := &Batcher{
+		backend: backend,
+		opts:    opts,
+		ops:     make(chan *batchOp, opts.MaxBatch),
+		done:    make(chan struct{}),
+	}
+	bt.wg.Add(1)
+	go bt.loop()
+
+	return bt
+}
+
+// Get retrieves the state for a key as part of the next pipeline
+func (bt *Batcher) Get(ctx context.Context, key string) (*core.State, error) {
+	res := bt.submit(ctx, &batchOp{ctx: ctx, key: key})
+	return res.state, res.err
+}
+
+// Set stores the state for a key as part of the next pipeline
+func (bt *Batcher) Set(ctx context.Context, key string, state *core.State) error {
+	return bt.submit(ctx, &batchOp{ctx: ctx, key: key, state: state}).err
+}
+
+// Delete removes the state for a key directly
+func (bt *Batcher) Delete(ctx context.Context, key string) error {
+	return bt.backend.Delete(ctx, key)
+}
+
+// GetMulti passes explicit batches straight to the backend
+func (bt *Batcher) GetMulti(ctx context.Context, keys []string) ([]*core.State, error) {
+	return bt.backend.GetMulti(ctx, keys)
+}
+
+// SetMulti passes explicit batches straight to the backend
+func (bt *Batcher) SetMulti(ctx context.Context, keys []string, states []*core.State) error {
+	return bt.backend.SetMulti(ctx, keys, states)
+}
+
+// Ping checks that Redis answers
+func (bt *Batcher) Ping(ctx context.Context) error {
+	return bt.backend.Ping(ctx)
+}
+
+// Stats returns the backend's connection pool statistics
+func (bt *Batcher) Stats() map[string]interface{} {
+	return bt.backend.Stats()
+}
+
+// Close flushes queued operations, stops batching and closes the backend
+func (bt *Batcher) Close() error {
+	bt.once.Do(func() { close(bt.done) })
+	bt.wg.Wait()
+	return bt.backend.Close()
+}
+
+// submit queues an operation and waits for its result
+func (bt *Batcher) submit(ctx context.Context, op *batchOp) batchResult {
+	if err := ctx.Err(); err != nil {
+		return batchResult{err: err}
+	}
+	op.result = make(chan batchResult, 1)
+
+	select {
+	case bt.ops <- op:
+	case <-bt.done:
+		return batchResult{err: ErrBatcherClosed}
+	case <-ctx.Done():
+		return batchResult{err: ctx.Err()}
+	}
+
+	select {
+	case res := <-op.result:
+		return res
+	case <-bt.done:
+		// The loop drains what was queued before it stopped; an op queued
+		// after that is never flushed
+		bt.wg.Wait()
+		select {
+		case res := <-op.result:
+			return res
+		default:
+			return batchResult{err: ErrBatcherClosed}
+		}
+	case <-ctx.Done():
+		return batchResult{err: ctx.Err()}
+	}
+}
+
+// loop collects operations into batches and flushes them
+func (bt *Batcher) loop() {
+	defer bt.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		var batch []*batchOp
+
+		select {
+		case op := <-bt.ops:
+			batch = append(batch, op)
+		case <-bt.done:
+			bt.drain()
+			return
+		}
+
+		timer.Reset(bt.opts.Window)
+	collect:
+		for len(batch) < bt.opts.MaxBatch {
+			select {
+			case op := <-bt.ops:
+				batch = append(batch, op)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		bt.flush(batch)
+	}
+}
+
+// drain flushes whatever was queued before Close
+func (bt *Batcher) drain() {
+	for {
+		select {
+		case op := <-bt.ops:
+			bt.flush([]*batchOp{op})
+		default:
+			return
+		}
+	}
+}
+
+// flush runs a batch as one pipeline, preserving submission order
+func (bt *Batcher) flush(batch []*batchOp) {
+	b := bt.backend
+	pipe := b.client.Pipeline()
+
+	ctx, cancel := bt.flushContext(batch)
+	defer cancel()
+
+	// Operations whose caller already gave up don't need to run
+	gets := make([]*redis.StringCmd, len(batch))
+	sets := make([]*redis.StatusCmd, len(batch))
+	for i, op := range batch {
+		if op.ctx.Err() != nil {
+			continue
+		}
+		if op.state == nil {
+			gets[i] = pipe.Get(ctx, b.makeKey(op.key))
+			continue
+		}
+
+		data, err := b.codec.Encode(op.state)
+		if err != nil {
+			op.result <- batchResult{err: fmt.Errorf("failed to encode state for key %s: %w", op.key, err)}
+			continue
+		}
+		sets[i] = pipe.Set(ctx, b.makeKey(op.key), data, b.expiry(op.state))
+	}
+
+	// A pipeline that failed as a whole, such as on a timeout, may leave
+	// its commands without an error of their own
+	_, execErr := pipe.Exec(ctx)
+	var redisErr redis.Error
+	if execErr == redis.Nil || errors.As(execErr, &redisErr) {
+		execErr = nil
+	}
+
+	// Misses are read again under their legacy names in a second pipeline
+	results := make([]batchResult, len(batch))
+	var missKeys []string
+	var missIdx []int
+	for i, op := range batch {
+		if gets[i] == nil {
+			continue
+		}
+		if execErr != nil {
+			results[i] = batchResult{err: fmt.Errorf("failed to get key %s from Redis: %w", op.key, execErr)}
+			continue
+		}
+		state, err := b.decodeReply(op.key, gets[i])
+		results[i] = batchResult{state: state, err: err}
+		if state == nil && err == nil {
+			missKeys = append(missKeys, op.key)
+			missIdx = append(missIdx, i)
+		}
+	}
+	if len(missKeys) > 0 {
+		states := make([]*core.State, len(missKeys))
+		err := b.fillLegacy(ctx, missKeys, states)
+		for j, i := range missIdx {
+			results[i] = batchResult{state: states[j], err: err}
+		}
+	}
+
+	for i, op := range batch {
+		switch {
+		case gets[i] != nil:
+			op.result <- results[i]
+		case sets[i] != nil:
+			err := sets[i].Err()
+			if err == nil {
+				err = execErr
+			}
+			if err != nil {
+				op.result <- batchResult{err: fmt.Errorf("failed to set key %s in Redis: %w", op.key, err)}
+			} else {
+				op.result <- batchResult{}
+			}
+		}
+	}
+}
+
+// flushContext returns the context a batch runs with: it ends at the latest
+// deadline of the callers still waiting, or Timeout after now if one of
+// them set none
+func (bt *Batcher) flushContext(batch []*batchOp) (context.Context, context.CancelFunc) {
+	var latest time.Time
+	for _, op := range batch {
+		if op.ctx.Err() != nil {
+			continue
+		}
+		deadline, ok := op.ctx.Deadline()
+		if !ok {
+			if bt.opts.Timeout <= 0 {
+				return context.WithCancel(context.Background())
+			}
+			deadline = time.Now().Add(bt.opts.Timeout)
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return context.WithDeadline(context.Background(), latest)
+}
@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/backendtest"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+func TestBackend_GetMultiSetMulti(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	backend := NewBackend(client, "test")
+	ctx := context.Background()
+	now := time.Now()
+
+	keys := []string{"a", "b", "c"}
+	states := []*core.State{
+		{Tokens: 1, LastUpdate: now, Created: now},
+		{Tokens: 2, LastUpdate: now, Created: now},
+		{Tokens: 3, LastUpdate: now, Created: now},
+	}
+	require.NoError(t, backend.SetMulti(ctx, keys, states))
+
+	retrieved, err := backend.GetMulti(ctx, []string{"c", "missing", "a"})
+	require.NoError(t, err)
+	require.Len(t, retrieved, 3)
+	assert.Equal(t, 3.0, retrieved[0].Tokens)
+	assert.Nil(t, retrieved[1])
+	assert.Equal(t, 1.0, retrieved[2].Tokens)
+
+	assert.Error(t, backend.SetMulti(ctx, keys, states[:1]))
+}
+
+func TestLimiter_GrantMultiWithRedis(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	config := core.Config{Limit: 2, Interval: time.Hour, Burst: 2}
+	backend := NewBackend(client, "test")
+	limiter := core.NewLimiter(backend, tokenbucket.NewStrategy(config), config, nil)
+	ctx := context.Background()
+
+	decisions, err := limiter.GrantMulti(ctx, []string{"ip", "user", "ip", "ip"})
+	require.NoError(t, err)
+	assert.True(t, decisions[0].Allowed)
+	assert.True(t, decisions[1].Allowed)
+	assert.True(t, decisions[2].Allowed)
+	assert.False(t, decisions[3].Allowed)
+}
+
+func TestBatcher_CoalescesConcurrentCalls(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	batcher := NewBatcher(NewBackend(client, "test"), BatcherOptions{Window: 5 * time.Millisecond})
+	defer batcher.Close()
+	ctx := context.Background()
+
+	const workers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			key := fmt.Sprintf("batched-%d", id)
+			now := time.Now()
+
+			assert.NoError(t, batcher.Set(ctx, key, &core.State{Tokens: float64(id), LastUpdate: now, Created: now}))
+
+			state, err := batcher.Get(ctx, key)
+			assert.NoError(t, err)
+			if assert.NotNil(t, state) {
+				assert.Equal(t, float64(id), state.Tokens)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := batcher.Get(ctx, "never-set")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestBatcher_Closed(t *testing.T) {
+	client := setupTestRedis(t)
+
+	batcher := NewBatcher(NewBackend(client, "test"), BatcherOptions{})
+	assert.NoError(t, batcher.Close())
+
+	_, err := batcher.Get(context.Background(), "key")
+	assert.ErrorIs(t, err, ErrBatcherClosed)
+}
+
+func TestBatcher_Conformance(t *testing.T) {
+	backendtest.RunConformance(t, func(t *testing.T) core.Backend {
+		return NewBatcher(NewBackend(setupTestRedis(t), "test"), BatcherOptions{})
+	})
+}
+
+func TestBatcher_ContextCancelled(t *testing.T) {
+	client := setupTestRedis(t)
+
+	batcher := NewBatcher(NewBackend(client, "test"), BatcherOptions{})
+	defer batcher.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := batcher.Get(ctx, "key")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBatcher_StalledPipelineTimesOut(t *testing.T) {
+	// A server that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{
+		Addr:                  ln.Addr().String(),
+		ReadTimeout:           -1,
+		ContextTimeoutEnabled: true,
+	})
+	batcher := NewBatcher(NewBackend(client, "test"), BatcherOptions{Timeout: 50 * time.Millisecond})
+	defer batcher.Close()
+
+	// Callers without a deadline are bounded by Timeout
+	start := time.Now()
+	_, err = batcher.Get(context.Background(), "key")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Callers with one are bounded by the latest among them
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	assert.Error(t, batcher.Set(ctx, "key", &core.State{Tokens: 1}))
+	_, err = batcher.Get(context.Background(), "key")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func BenchmarkBackend_GetMulti(b *testing.B) {
+	client := setupTestRedis(b)
+	defer client.Close()
+
+	backend := NewBackend(client, "benchmark")
+	ctx := context.Background()
+	keys := []string{"ip", "user", "apikey", "route"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := backend.GetMulti(ctx, keys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
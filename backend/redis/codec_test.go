@@ -0,0 +1,218 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/core"
+)
+
+func TestBinaryCodec_RoundTrip(t *testing.T) {
+	codec := BinaryCodec{}
+	now := time.Now()
+
+	states := []*core.State{
+		{Tokens: 14.25, LastUpdate: now, Created: now.Add(-time.Hour)},
+		{Tokens: 0, LastUpdate: now, Created: now},
+		{Tokens: -3.5, LastUpdate: time.Unix(0, 1), Created: time.Unix(0, 1)},
+		{Tokens: 1e9, LastUpdate: now},
+		{},
+	}
+
+	for _, state := range states {
+		data, err := codec.Encode(state)
+		require.NoError(t, err)
+		assert.True(t, codec.Current(data))
+
+		decoded, err := codec.Decode(data)
+		require.NoError(t, err)
+		assert.Equal(t, state.Tokens, decoded.Tokens)
+		assert.True(t, state.LastUpdate.Equal(decoded.LastUpdate))
+		assert.True(t, state.Created.Equal(decoded.Created))
+		assert.Equal(t, state.Created.IsZero(), decoded.Created.IsZero())
+	}
+}
+
+func TestBinaryCodec_IsCompact(t *testing.T) {
+	now := time.Now()
+	state := &core.State{Tokens: 14.25, LastUpdate: now, Created: now.Add(-time.Minute)}
+
+	binaryData, err := BinaryCodec{}.Encode(state)
+	require.NoError(t, err)
+	jsonData, err := JSONCodec{}.Encode(state)
+	require.NoError(t, err)
+
+	assert.LessOrEqual(t, len(binaryData), 24)
+	assert.Less(t, len(binaryData)*4, len(jsonData))
+}
+
+func TestCodecs_DecodeEachOther(t *testing.T) {
+	now := time.Now()
+	state := &core.State{Tokens: 7, LastUpdate: now, Created: now.Add(-time.Second)}
+
+	// Legacy values written by json.Marshal before codecs existed
+	legacy, err := json.Marshal(state)
+	require.NoError(t, err)
+
+	binaryData, err := BinaryCodec{}.Encode(state)
+	require.NoError(t, err)
+
+	for _, codec := range []Codec{BinaryCodec{}, JSONCodec{}} {
+		for _, data := range [][]byte{legacy, binaryData} {
+			decoded, err := codec.Decode(data)
+			require.NoError(t, err)
+			assert.Equal(t, state.Tokens, decoded.Tokens)
+			assert.True(t, state.LastUpdate.Equal(decoded.LastUpdate))
+		}
+	}
+
+	assert.False(t, BinaryCodec{}.Current(legacy))
+	assert.True(t, JSONCodec{}.Current(legacy))
+	assert.False(t, JSONCodec{}.Current(binaryData))
+}
+
+func TestCodec_RejectsUnknownAndCorrupt(t *testing.T) {
+	codec := BinaryCodec{}
+
+	_, err := codec.Decode(nil)
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	_, err = codec.Decode([]byte{0x7f, 1, 2, 3})
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	data, err := codec.Encode(&core.State{Tokens: 1, LastUpdate: time.Now()})
+	require.NoError(t, err)
+	_, err = codec.Decode(data[:len(data)-1])
+	assert.Error(t, err)
+}
+
+func TestBackend_MigrateCodec(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	// Write a mix of legacy JSON and binary keys, plus a foreign key
+	legacy := NewBackend(client, "migrate", WithCodec(JSONCodec{}))
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, legacy.Set(ctx, key, &core.State{Tokens: 3, LastUpdate: now, Created: now}))
+	}
+	backend := NewBackend(client, "migrate", WithTTL(time.Hour))
+	require.NoError(t, backend.Set(ctx, "d", &core.State{Tokens: 4, LastUpdate: now, Created: now}))
+	require.NoError(t, client.Set(ctx, "unrelated", "{}", 0).Err())
+
+	// A key from before hash tags were used in key names
+	old, err := json.Marshal(&core.State{Tokens: 9, LastUpdate: now, Created: now})
+	require.NoError(t, err)
+	require.NoError(t, client.Set(ctx, "migrate:e", old, time.Hour).Err())
+
+	stats, err := backend.MigrateCodec(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), stats.Scanned)
+	assert.Equal(t, int64(3), stats.Migrated)
+	assert.Equal(t, int64(1), stats.Renamed)
+	assert.Equal(t, int64(1), stats.Skipped)
+
+	state, err := backend.Get(ctx, "e")
+	require.NoError(t, err)
+	assert.Equal(t, 9.0, state.Tokens)
+	assert.Equal(t, int64(0), client.Exists(ctx, "migrate:e").Val())
+
+	data, err := client.Get(ctx, backend.makeKey("a")).Bytes()
+	require.NoError(t, err)
+	assert.True(t, BinaryCodec{}.Current(data))
+
+	// TTLs survive the rewrite
+	ttl, err := client.TTL(ctx, backend.makeKey("a")).Result()
+	require.NoError(t, err)
+	assert.Greater(t, ttl, time.Hour)
+
+	state, err = backend.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, state.Tokens)
+
+	// A second run has nothing left to do
+	stats, err = backend.MigrateCodec(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Migrated)
+}
+
+func TestBackend_MigrateCodecLegacyKeys(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	backend := NewBackend(client, "legacy", WithTTL(time.Hour))
+
+	// An upgraded instance already wrote the new name, seeded from the old
+	require.NoError(t, backend.Set(ctx, "a", &core.State{Tokens: 1, LastUpdate: now, Created: now}))
+	old, err := json.Marshal(&core.State{Tokens: 9, LastUpdate: now, Created: now})
+	require.NoError(t, err)
+	require.NoError(t, client.Set(ctx, "legacy:a", old, time.Hour).Err())
+
+	// A legacy key without expiry
+	require.NoError(t, client.Set(ctx, "legacy:b", old, 0).Err())
+
+	stats, err := backend.MigrateCodec(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Renamed)
+
+	// The newer state wins and the old key is left to expire
+	state, err := backend.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, state.Tokens)
+	assert.Equal(t, int64(1), client.Exists(ctx, "legacy:a").Val())
+
+	state, err = backend.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, 9.0, state.Tokens)
+	assert.Equal(t, time.Duration(-1), client.TTL(ctx, backend.makeKey("b")).Val())
+	assert.Equal(t, int64(0), client.Exists(ctx, "legacy:b").Val())
+
+	// With WithLegacyKeys the old names are re-encoded in place
+	legacy := NewBackend(client, "legacy", WithLegacyKeys())
+	stats, err = legacy.MigrateCodec(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Renamed)
+	data, err := client.Get(ctx, "legacy:a").Bytes()
+	require.NoError(t, err)
+	assert.True(t, BinaryCodec{}.Current(data))
+}
+
+func TestBackend_MigrateCodecBraceKeys(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	old, err := json.Marshal(&core.State{Tokens: 4, LastUpdate: now, Created: now})
+	require.NoError(t, err)
+
+	// The old name of "{odd" can't be a hash-tagged name, so it is renamed;
+	// that of "{foo}" is the new name of "foo" and stays where it is
+	require.NoError(t, client.Set(ctx, "brace:{odd", old, time.Hour).Err())
+	require.NoError(t, client.Set(ctx, "brace:{foo}", old, time.Hour).Err())
+
+	backend := NewBackend(client, "brace")
+	stats, err := backend.MigrateCodec(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Renamed)
+	assert.Equal(t, int64(1), stats.Migrated)
+
+	assert.Equal(t, int64(0), client.Exists(ctx, "brace:{odd").Val())
+	state, err := backend.Get(ctx, "{odd")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 4.0, state.Tokens)
+
+	state, err = backend.Get(ctx, "foo")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 4.0, state.Tokens)
+}
@@ -0,0 +1,186 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MigrationStats summarises a MigrateCodec run
+type MigrationStats struct {
+	Scanned  int64 // Keys visited
+	Migrated int64 // Keys rewritten in the current codec's format
+	Renamed  int64 // Keys moved from the pre-hash-tag "<prefix>:<key>" layout
+	Skipped  int64 // Keys already current, expired or concurrently rewritten
+}
+
+// MigrateCodec rewrites every key of this backend that isn't stored in the
+// configured codec's format, preserving TTLs. Keys still named in the layout
+// used before hash tags were introduced ("<prefix>:<key>") are moved to
+// "<prefix>:{<key>}" unless that already exists, in which case the old key
+// is left to expire; with WithLegacyKeys they are only re-encoded. The old
+// name of a key starting with "{" and containing "}" can't be told apart
+// from a new one, so it is only re-encoded. Run it
+// once no instance writes the old names any more. It is safe to run while
+// limiters are serving traffic: each key is rewritten under WATCH, and keys
+// updated concurrently are skipped since the writer already used the current
+// codec. Values that don't decode as a state are left alone. Because every
+// codec reads every format, migrating is optional; untouched keys are
+// converted the next time they are written.
+//
+// A typical rollout deploys the new release with WithCodec(JSONCodec{}) and
+// WithLegacyKeys so old and new instances share keys, then drops both
+// options once every instance is upgraded and finally runs MigrateCodec.
+func (b *Backend) MigrateCodec(ctx context.Context) (MigrationStats, error) {
+	var scanned, migrated, renamed, skipped atomic.Int64
+
+	err := b.scanKeys(ctx, escapeGlob(b.prefix)+":*", 0, func(ctx context.Context, client redis.UniversalClient, keys []string) error {
+		for _, key := range keys {
+			scanned.Add(1)
+
+			// Names that may be hash-tagged are current, as for fallback
+			if !b.legacyKeys && !hashTagged(strings.TrimPrefix(key, b.prefix+":")) {
+				moved, err := b.migrateLegacyKey(ctx, client, key)
+				if err != nil {
+					return err
+				}
+				if moved {
+					renamed.Add(1)
+				} else {
+					skipped.Add(1)
+				}
+				continue
+			}
+
+			rewritten, err := b.migrateKey(ctx, client, key)
+			if err != nil {
+				return err
+			}
+			if rewritten {
+				migrated.Add(1)
+			} else {
+				skipped.Add(1)
+			}
+		}
+		return nil
+	})
+
+	stats := MigrationStats{
+		Scanned:  scanned.Load(),
+		Migrated: migrated.Load(),
+		Renamed:  renamed.Load(),
+		Skipped:  skipped.Load(),
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to migrate keys: %w", err)
+	}
+	return stats, nil
+}
+
+// migrateKey re-encodes a single key if needed and reports whether it did
+func (b *Backend) migrateKey(ctx context.Context, client redis.UniversalClient, key string) (bool, error) {
+	rewritten := false
+
+	err := client.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b.codec.Current(data) {
+			return nil
+		}
+
+		state, err := b.codec.Decode(data)
+		if err != nil {
+			return nil
+		}
+		encoded, err := b.codec.Encode(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", key, err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, encoded, redis.SetArgs{KeepTTL: true})
+			return nil
+		})
+		if err == nil {
+			rewritten = true
+		}
+		return err
+	}, key)
+
+	if errors.Is(err, redis.TxFailedErr) {
+		return false, nil
+	}
+	return rewritten, err
+}
+
+// migrateLegacyKey moves a "<prefix>:<key>" entry to its hash-tagged name.
+// The two names may live on different Cluster nodes, so this can't be one
+// transaction. The new key is only created if absent: one that exists was
+// written by an upgraded instance, which read the old key first, so it is
+// newer and the old key is left to expire. The old key is deleted under
+// WATCH, so it is kept if anything wrote it after it was copied.
+func (b *Backend) migrateLegacyKey(ctx context.Context, node redis.UniversalClient, oldKey string) (bool, error) {
+	moved := false
+
+	err := node.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, oldKey).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		state, err := b.codec.Decode(data)
+		if err != nil {
+			// Not one of ours, e.g. another application sharing the prefix
+			return nil
+		}
+		encoded, err := b.codec.Encode(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", oldKey, err)
+		}
+
+		// go-redis passes PTTL's -2 (expired since it was read) and -1 (no
+		// expiry) through unscaled; SetNX takes 0 for no expiry
+		ttl, err := tx.PTTL(ctx, oldKey).Result()
+		if err != nil {
+			return err
+		}
+		switch ttl {
+		case -2:
+			return nil
+		case -1:
+			ttl = 0
+		}
+
+		newKey := b.makeKey(strings.TrimPrefix(oldKey, b.prefix+":"))
+		created, err := b.client.SetNX(ctx, newKey, encoded, ttl).Result()
+		if err != nil || !created {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, oldKey)
+			return nil
+		})
+		if err == nil {
+			moved = true
+		}
+		return err
+	}, oldKey)
+
+	if errors.Is(err, redis.TxFailedErr) {
+		return false, nil
+	}
+	return moved, err
+}
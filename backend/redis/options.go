@@ -0,0 +1,70 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// defaultTTL is used when neither a fixed TTL nor an expirer is configured
+const defaultTTL = 24 * time.Hour
+
+// defaultTTLMargin is added to expirer-derived TTLs to absorb clock skew
+// between limiter instances
+const defaultTTLMargin = time.Second
+
+// Option configures optional Backend behaviour
+type Option func(*Backend)
+
+// WithTTL sets a fixed expiry for every key, overriding any expirer
+func WithTTL(ttl time.Duration) Option {
+	return func(b *Backend) {
+		b.ttl = ttl
+	}
+}
+
+// WithExpirer derives each key's expiry from the strategy: the time until
+// the stored state is equivalent to a fresh one, plus a margin. Strategies
+// in this module implement core.Expirer, so the strategy passed to
+// core.NewLimiter can be given here directly.
+func WithExpirer(expirer core.Expirer) Option {
+	return func(b *Backend) {
+		b.expirer = expirer
+	}
+}
+
+// WithTTLMargin sets the slack added to expirer-derived TTLs (default 1s)
+func WithTTLMargin(margin time.Duration) Option {
+	return func(b *Backend) {
+		b.ttlMargin = margin
+	}
+}
+
+// WithCodec sets the encoding used for stored states (default BinaryCodec).
+// Every codec decodes all formats, so changing it never strands old keys.
+func WithCodec(codec Codec) Option {
+	return func(b *Backend) {
+		b.codec = codec
+	}
+}
+
+// WithLegacyKeys names keys "<prefix>:<key>" like releases before hash tags
+// were introduced, so old and new instances share keys during a rolling
+// deploy. Without hash tags the Redis keys of one logical key may land on
+// different Cluster slots or Ring shards.
+func WithLegacyKeys() Option {
+	return func(b *Backend) {
+		b.legacyKeys = true
+	}
+}
+
+// WithLegacyFallback sets whether a key missing under its hash-tagged name
+// is read from its legacy "<prefix>:<key>" name (default true), so limits
+// carry over an upgrade. Disable it once MigrateCodec has renamed the legacy
+// keys or they have expired, to save a GET on every miss and let Scan
+// examine only hash-tagged names.
+func WithLegacyFallback(enabled bool) Option {
+	return func(b *Backend) {
+		b.legacyFallback = enabled
+	}
+}
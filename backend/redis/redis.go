@@ -2,102 +2,262 @@ package redis
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/throttle/core"
 )
 
-// Backend implements the core.Backend interface using Redis
+// maxTxAttempts bounds how often UpdateTx retries an optimistic transaction
+const maxTxAttempts = 16
+
+// ErrContention is returned by UpdateTx when its transaction keeps being
+// invalidated by concurrent writers
+var ErrContention = errors.New("redis: too much contention on key")
+
+// errMissing aborts an UpdateTx transaction that found no state, so the
+// legacy name can be read outside it
+var errMissing = errors.New("redis: key is missing")
+
+// Backend implements the core.Backend interface using Redis. It works with
+// any redis.UniversalClient: a single node, Sentinel failover, Cluster or Ring.
 type Backend struct {
-	client *redis.Client
-	prefix string
+	client    redis.UniversalClient
+	prefix    string
+	ttl       time.Duration
+	expirer   core.Expirer
+	ttlMargin time.Duration
+	codec     Codec
+
+	legacyKeys     bool // Name keys without hash tags, see WithLegacyKeys
+	legacyFallback bool // Read legacy names on a miss, see WithLegacyFallback
 }
 
 // NewBackend creates a new Redis backend
-func NewBackend(client *redis.Client, prefix string) *Backend {
+func NewBackend(client redis.UniversalClient, prefix string, opts ...Option) *Backend {
 	if prefix == "" {
 		prefix = "throttle"
 	}
-	return &Backend{
-		client: client,
-		prefix: prefix,
+	b := &Backend{
+		client:         client,
+		prefix:         prefix,
+		ttlMargin:      defaultTTLMargin,
+		codec:          BinaryCodec{},
+		legacyFallback: true,
+	}
+	for _, opt := range opts {
+		opt(b)
 	}
+	return b
 }
 
 // NewBackendFromURL creates a new Redis backend from a connection URL
-func NewBackendFromURL(url, prefix string) (*Backend, error) {
-	opts, err := redis.ParseURL(url)
+func NewBackendFromURL(url, prefix string, opts ...Option) (*Backend, error) {
+	clientOpts, err := redis.ParseURL(url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
 	}
 
-	client := redis.NewClient(opts)
+	return connect(redis.NewClient(clientOpts), prefix, opts...)
+}
+
+// NewClusterBackend creates a new Redis backend on a Redis Cluster
+func NewClusterBackend(clientOpts *redis.ClusterOptions, prefix string, opts ...Option) (*Backend, error) {
+	return connect(redis.NewClusterClient(clientOpts), prefix, opts...)
+}
+
+// NewClusterBackendFromURL creates a new Redis Cluster backend from a URL
+// such as redis://host1:6379?addr=host2:6379&addr=host3:6379
+func NewClusterBackendFromURL(url, prefix string, opts ...Option) (*Backend, error) {
+	clientOpts, err := redis.ParseClusterURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis Cluster URL: %w", err)
+	}
+
+	return NewClusterBackend(clientOpts, prefix, opts...)
+}
+
+// NewSentinelBackend creates a new Redis backend that follows the master
+// elected by Sentinel
+func NewSentinelBackend(clientOpts *redis.FailoverOptions, prefix string, opts ...Option) (*Backend, error) {
+	return connect(redis.NewFailoverClient(clientOpts), prefix, opts...)
+}
+
+// NewSentinelBackendFromURL creates a new Sentinel backend from a URL such
+// as redis://sentinel1:26379?master_name=mymaster&addr=sentinel2:26379
+func NewSentinelBackendFromURL(url, prefix string, opts ...Option) (*Backend, error) {
+	clientOpts, err := redis.ParseFailoverURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis Sentinel URL: %w", err)
+	}
+
+	return NewSentinelBackend(clientOpts, prefix, opts...)
+}
+
+// NewRingBackend creates a new Redis backend sharding keys over independent
+// nodes with client-side consistent hashing
+func NewRingBackend(clientOpts *redis.RingOptions, prefix string, opts ...Option) (*Backend, error) {
+	return connect(redis.NewRing(clientOpts), prefix, opts...)
+}
 
+// connect verifies the client can reach Redis and wraps it in a backend
+func connect(client redis.UniversalClient, prefix string, opts ...Option) (*Backend, error) {
 	// Test the connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return NewBackend(client, prefix), nil
+	return NewBackend(client, prefix, opts...), nil
 }
 
 // Get retrieves the state for a key from Redis
 func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	redisKey := b.makeKey(key)
 
 	data, err := b.client.Get(ctx, redisKey).Bytes()
 	if err != nil {
 		if err == redis.Nil {
-			// Key doesn't exist, return empty state
-			now := time.Now()
-			return &core.State{
-				Tokens:     0,
-				LastUpdate: now,
-				Created:    now,
-			}, nil
+			// Key doesn't exist, the limiter creates a fresh state unless
+			// an earlier release left one under the legacy name
+			return b.getLegacy(ctx, key)
 		}
 		return nil, fmt.Errorf("failed to get key %s from Redis: %w", key, err)
 	}
 
-	var state core.State
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal state for key %s: %w", key, err)
+	state, err := b.codec.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode state for key %s: %w", key, err)
 	}
 
-	return &state, nil
+	return state, nil
 }
 
 // Set stores the state for a key in Redis
 func (b *Backend) Set(ctx context.Context, key string, state *core.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	redisKey := b.makeKey(key)
 
-	data, err := json.Marshal(state)
+	data, err := b.codec.Encode(state)
 	if err != nil {
-		return fmt.Errorf("failed to marshal state for key %s: %w", key, err)
+		return fmt.Errorf("failed to encode state for key %s: %w", key, err)
 	}
 
 	// Store with expiration to prevent memory leaks
-	// Use a reasonable TTL based on the rate limit window
-	ttl := 24 * time.Hour // Default TTL, can be made configurable
-
-	if err := b.client.Set(ctx, redisKey, data, ttl).Err(); err != nil {
+	if err := b.client.Set(ctx, redisKey, data, b.expiry(state)).Err(); err != nil {
 		return fmt.Errorf("failed to set key %s in Redis: %w", key, err)
 	}
 
 	return nil
 }
 
+// UpdateTx atomically applies fn to the state for a key inside a WATCH/MULTI
+// transaction, retrying when another writer modified the key in between.
+// It is deliberately not core.Updater's Update: core.Limiter would then run
+// every Grant as a transaction, costing extra round-trips and retries under
+// contention. Callers that need atomicity, like lease.Limiter, use it
+// explicitly.
+func (b *Backend) UpdateTx(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	redisKey := b.makeKey(key)
+
+	// The legacy state seeding a missing key, once it has been read
+	var seed *core.State
+	seeded := false
+
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, redisKey).Bytes()
+		var state *core.State
+		switch {
+		case err == redis.Nil:
+			// Missing key: fn creates a fresh state unless an earlier
+			// release left one under the legacy name. That name may be on
+			// another node, so it is read outside the transaction.
+			if b.fallbackKey(key) && !seeded {
+				return errMissing
+			}
+			if seed != nil {
+				copied := *seed
+				state = &copied
+			}
+		case err != nil:
+			return fmt.Errorf("failed to get key %s from Redis: %w", key, err)
+		default:
+			if state, err = b.codec.Decode(data); err != nil {
+				return fmt.Errorf("failed to decode state for key %s: %w", key, err)
+			}
+		}
+
+		state, err = fn(state)
+		if err != nil {
+			return err
+		}
+
+		data, err = b.codec.Encode(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode state for key %s: %w", key, err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, redisKey, data, b.expiry(state))
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		err := b.client.Watch(ctx, txf, redisKey)
+		if errors.Is(err, errMissing) {
+			if seed, err = b.getLegacy(ctx, key); err != nil {
+				return err
+			}
+			seeded = true
+			continue
+		}
+		if errors.Is(err, redis.TxFailedErr) {
+			// Lost the race, try again
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("failed to update key %s: %w", key, ErrContention)
+}
+
 // Delete removes the state for a key from Redis
 func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	redisKey := b.makeKey(key)
 
-	if err := b.client.Del(ctx, redisKey).Err(); err != nil {
+	// The legacy name goes too, or a fallback read would bring it back. The
+	// names may be on different Cluster slots, so they can't share a DEL.
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisKey)
+		if b.fallbackKey(key) {
+			pipe.Del(ctx, b.legacyKey(key))
+		}
+		return nil
+	})
+	if err != nil {
 		return fmt.Errorf("failed to delete key %s from Redis: %w", key, err)
 	}
 
@@ -109,17 +269,106 @@ func (b *Backend) Close() error {
 	return b.client.Close()
 }
 
-// makeKey creates a Redis key with the configured prefix
-func (b *Backend) makeKey(key string) string {
-	return fmt.Sprintf("%s:%s", b.prefix, key)
+// Client returns the client the backend uses, so other components such as
+// audit sinks can share its connections
+func (b *Backend) Client() redis.UniversalClient {
+	return b.client
 }
 
-// GetStats returns Redis connection statistics
-func (b *Backend) GetStats() map[string]interface{} {
+// expiry returns the TTL for a state being written now: the fixed TTL if one
+// is configured, otherwise the time until the strategy considers the state
+// fresh plus a margin. Redis receives it with millisecond precision (PX), so
+// idle keys disappear as soon as dropping them no longer changes a decision.
+func (b *Backend) expiry(state *core.State) time.Duration {
+	if b.ttl > 0 {
+		return b.ttl
+	}
+	if b.expirer == nil {
+		return defaultTTL
+	}
+
+	ttl := b.expirer.TTL(state) - time.Since(state.LastUpdate) + b.ttlMargin
+
+	// Round up to whole milliseconds, never below one
+	ttl = (ttl + time.Millisecond - 1).Truncate(time.Millisecond)
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	return ttl
+}
+
+// makeKey creates a Redis key with the configured prefix. The logical key is
+// wrapped in a hash tag so that every Redis key derived from it (the state
+// plus any suffixed auxiliary keys) hashes to the same Cluster slot or Ring
+// shard, which keeps multi-key commands and transactions on one node.
+func (b *Backend) makeKey(key string, suffix ...string) string {
+	redisKey := fmt.Sprintf("%s:{%s}", b.prefix, key)
+	if b.legacyKeys {
+		redisKey = b.legacyKey(key)
+	}
+	for _, s := range suffix {
+		redisKey += ":" + s
+	}
+	return redisKey
+}
+
+// legacyKey returns the name releases before hash tags gave key
+func (b *Backend) legacyKey(key string) string {
+	return b.prefix + ":" + key
+}
+
+// fallback reports whether keys missing under their current name are read
+// from their legacy name
+func (b *Backend) fallback() bool {
+	return b.legacyFallback && !b.legacyKeys
+}
+
+// fallbackKey reports whether key is read from its legacy name when it is
+// missing. The legacy name of a key like "{a}" is the hash-tagged name of
+// "a", so it is never read or deleted as a legacy name.
+func (b *Backend) fallbackKey(key string) bool {
+	return b.fallback() && !hashTagged(key)
+}
+
+// hashTagged reports whether name, a Redis key without the prefix and its
+// colon, may be a hash-tagged name rather than a legacy one
+func hashTagged(name string) bool {
+	return strings.HasPrefix(name, "{") && strings.Contains(name, "}")
+}
+
+// getLegacy reads the state of a key missing under its current name from
+// its legacy name, returning nil if there is none or fallback is off
+func (b *Backend) getLegacy(ctx context.Context, key string) (*core.State, error) {
+	if !b.fallbackKey(key) {
+		return nil, nil
+	}
+	return b.decodeReply(key, b.client.Get(ctx, b.legacyKey(key)))
+}
+
+// Ping checks that Redis answers
+func (b *Backend) Ping(ctx context.Context) error {
+	if err := b.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to ping Redis: %w", err)
+	}
+	return nil
+}
+
+// Stats returns Redis connection pool statistics
+func (b *Backend) Stats() map[string]interface{} {
 	stats := b.client.PoolStats()
 	return map[string]interface{}{
 		"total_connections": stats.TotalConns,
 		"idle_connections":  stats.IdleConns,
 		"stale_connections": stats.StaleConns,
+		"hits":              stats.Hits,
+		"misses":            stats.Misses,
+		"timeouts":          stats.Timeouts,
 	}
 }
+
+// GetStats returns Redis connection statistics
+//
+// Deprecated: use Stats, which every backend implements.
+func (b *Backend) GetStats() map[string]interface{} {
+	return b.Stats()
+}
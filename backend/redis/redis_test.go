@@ -3,56 +3,49 @@ package redis
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/backendtest"
+	"github.com/throttle/backend/redis/redistest"
 	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
 )
 
-// setupTestRedis creates a test Redis client
-func setupTestRedis(t *testing.T) *redis.Client {
-	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       15, // Use DB 15 for testing to avoid conflicts
-	})
-
-	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := client.Ping(ctx).Err(); err != nil {
-		t.Skipf("Redis not available: %v", err)
-	}
-
-	// Clean up test database
-	client.FlushDB(ctx)
-
+// setupTestRedis returns a client for DB 15 of the local Redis server, or of
+// an in-process stand-in when no server is running
+func setupTestRedis(tb testing.TB) *redis.Client {
+	client, _ := setupTestServer(tb)
 	return client
 }
 
-// setupBenchmarkRedis creates a Redis client for benchmarks
-func setupBenchmarkRedis() *redis.Client {
+// setupTestServer is like setupTestRedis and also returns the stand-in, or
+// nil when testing against a real Redis
+func setupTestServer(tb testing.TB) (*redis.Client, *redistest.Server) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     "localhost:6379",
 		Password: "",
-		DB:       15,
+		DB:       15, // Use DB 15 for testing to avoid conflicts
 	})
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := client.Ping(ctx).Err(); err != nil {
-		return nil // Benchmarks will skip if Redis is not available
+	if err := client.Ping(ctx).Err(); err == nil {
+		// Clean up test database
+		client.FlushDB(ctx)
+		return client, nil
 	}
+	client.Close()
 
-	// Clean up test database
-	client.FlushDB(ctx)
-
-	return client
+	srv := redistest.Start(tb)
+	return redis.NewClient(&redis.Options{Addr: srv.Addr(), DB: 15}), srv
 }
 
 func TestNewBackend(t *testing.T) {
@@ -62,14 +55,18 @@ func TestNewBackend(t *testing.T) {
 	backend := NewBackend(client, "test-prefix")
 	assert.NotNil(t, backend)
 	assert.Equal(t, "test-prefix", backend.prefix)
+	assert.Same(t, client, backend.Client())
 }
 
 func TestNewBackendFromURL(t *testing.T) {
-	// Test with valid URL
-	backend, err := NewBackendFromURL("redis://localhost:6379/15", "test-prefix")
-	if err != nil {
-		t.Skipf("Redis not available: %v", err)
+	url := "redis://localhost:6379/15"
+	if _, srv := setupTestServer(t); srv != nil {
+		url = "redis://" + srv.Addr() + "/15"
 	}
+
+	// Test with valid URL
+	backend, err := NewBackendFromURL(url, "test-prefix")
+	require.NoError(t, err)
 	defer backend.Close()
 
 	assert.NotNil(t, backend)
@@ -80,6 +77,249 @@ func TestNewBackendFromURL(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestBackend_MakeKey(t *testing.T) {
+	backend := NewBackend(redis.NewClient(&redis.Options{Addr: "localhost:6379"}), "throttle")
+	defer backend.Close()
+
+	assert.Equal(t, "throttle:{user-1}", backend.makeKey("user-1"))
+	assert.Equal(t, "throttle:{user-1}:lease", backend.makeKey("user-1", "lease"))
+
+	legacy := NewBackend(redis.NewClient(&redis.Options{Addr: "localhost:6379"}), "throttle", WithLegacyKeys())
+	defer legacy.Close()
+	assert.Equal(t, "throttle:user-1", legacy.makeKey("user-1"))
+}
+
+func TestBackend_LegacyKeys(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	// An instance of the earlier release and one upgraded with
+	// WithLegacyKeys share keys during a rolling deploy
+	backend := NewBackend(client, "legacy", WithLegacyKeys())
+	now := time.Now()
+	require.NoError(t, backend.Set(ctx, "user-1", &core.State{Tokens: 4, LastUpdate: now, Created: now}))
+	assert.Equal(t, int64(1), client.Exists(ctx, "legacy:user-1").Val())
+
+	var keys []string
+	for key := range core.NewScanner(backend, core.Filter{Prefix: "user-"}, "").All(ctx) {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"user-1"}, keys)
+}
+
+func TestBackend_LegacyFallback(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	data, err := BinaryCodec{}.Encode(&core.State{Tokens: 2, LastUpdate: now, Created: now})
+	require.NoError(t, err)
+	for _, key := range []string{"fb:user-1", "fb:user-2", "fb:user-3"} {
+		require.NoError(t, client.Set(ctx, key, data, time.Hour).Err())
+	}
+
+	// Keys left by an earlier release are read until they are rewritten
+	backend := NewBackend(client, "fb")
+	state, err := backend.Get(ctx, "user-1")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 2.0, state.Tokens)
+
+	states, err := backend.GetMulti(ctx, []string{"user-2", "missing"})
+	require.NoError(t, err)
+	require.NotNil(t, states[0])
+	assert.Equal(t, 2.0, states[0].Tokens)
+	assert.Nil(t, states[1])
+
+	require.NoError(t, backend.UpdateTx(ctx, "user-3", func(state *core.State) (*core.State, error) {
+		require.NotNil(t, state)
+		state.Tokens--
+		return state, nil
+	}))
+	state, err = backend.Get(ctx, "user-3")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, state.Tokens)
+
+	// Deleting removes both names, so a cleared key stays cleared
+	require.NoError(t, backend.Delete(ctx, "user-1"))
+	state, err = backend.Get(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+	assert.Equal(t, int64(0), client.Exists(ctx, "fb:user-1").Val())
+
+	noFallback := NewBackend(client, "fb", WithLegacyFallback(false))
+	state, err = noFallback.Get(ctx, "user-2")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestBackend_LegacyFallbackHashTaggedKey(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	backend := NewBackend(client, "fb")
+	require.NoError(t, backend.Set(ctx, "foo", &core.State{Tokens: 2, LastUpdate: now, Created: now}))
+
+	// The legacy name of "{foo}" is the current name of "foo", so it is
+	// neither read nor deleted as a legacy name
+	state, err := backend.Get(ctx, "{foo}")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	states, err := backend.GetMulti(ctx, []string{"{foo}"})
+	require.NoError(t, err)
+	assert.Nil(t, states[0])
+
+	require.NoError(t, backend.Delete(ctx, "{foo}"))
+	state, err = backend.Get(ctx, "foo")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 2.0, state.Tokens)
+}
+
+func TestBackend_ScanLegacyKeys(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	old, err := BinaryCodec{}.Encode(&core.State{Tokens: 1, LastUpdate: now, Created: now})
+	require.NoError(t, err)
+	require.NoError(t, client.Set(ctx, "sl:user-1", old, time.Hour).Err())
+	require.NoError(t, client.Set(ctx, "sl:user-3", old, time.Hour).Err())
+
+	backend := NewBackend(client, "sl")
+	require.NoError(t, backend.Set(ctx, "user-2", &core.State{Tokens: 2, LastUpdate: now, Created: now}))
+	require.NoError(t, backend.Set(ctx, "user-3", &core.State{Tokens: 3, LastUpdate: now, Created: now}))
+
+	// Keys only under their legacy name are found; a current name shadows
+	// the legacy one
+	tokens := map[string]float64{}
+	cursor := ""
+	for {
+		entries, next, err := backend.Scan(ctx, core.Filter{Prefix: "user-"}, cursor)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			_, seen := tokens[entry.Key]
+			assert.False(t, seen, entry.Key)
+			tokens[entry.Key] = entry.State.Tokens
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, map[string]float64{"user-1": 1, "user-2": 2, "user-3": 3}, tokens)
+
+	// So clearing doesn't leave a legacy state to be read back
+	config := core.Config{Limit: 10, Interval: time.Minute}
+	limiter := core.NewLimiter(backend, tokenbucket.NewStrategy(config), config, nil)
+	cleared, err := limiter.ClearPrefix(ctx, "user-")
+	require.NoError(t, err)
+	assert.Equal(t, 3, cleared)
+	for _, key := range []string{"user-1", "user-2", "user-3"} {
+		state, err := backend.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Nil(t, state, key)
+	}
+}
+
+func TestNewBackend_UniversalClients(t *testing.T) {
+	// Clients are lazy, so no server is needed to construct them
+	clients := []redis.UniversalClient{
+		redis.NewClient(&redis.Options{Addr: "localhost:6379"}),
+		redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"localhost:7000"}}),
+		redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"a": "localhost:6379"}}),
+		redis.NewFailoverClient(&redis.FailoverOptions{MasterName: "mymaster", SentinelAddrs: []string{"localhost:26379"}}),
+	}
+
+	for _, client := range clients {
+		backend := NewBackend(client, "")
+		assert.Equal(t, "throttle", backend.prefix)
+		assert.NoError(t, backend.Close())
+	}
+}
+
+func TestNewClusterBackendFromURL_Invalid(t *testing.T) {
+	_, err := NewClusterBackendFromURL("invalid-url", "test-prefix")
+	assert.Error(t, err)
+
+	_, err = NewSentinelBackendFromURL("invalid-url", "test-prefix")
+	assert.Error(t, err)
+}
+
+func TestBackend_Expiry(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer client.Close()
+
+	config := core.Config{Limit: 10, Interval: time.Minute, Burst: 15}
+	strategy := tokenbucket.NewStrategy(config)
+	now := time.Now()
+
+	// Without options the historical one day TTL applies
+	backend := NewBackend(client, "test")
+	assert.Equal(t, 24*time.Hour, backend.expiry(&core.State{LastUpdate: now}))
+
+	// An empty bucket takes 90s to refill, plus the margin
+	backend = NewBackend(client, "test", WithExpirer(strategy), WithTTLMargin(0))
+	ttl := backend.expiry(&core.State{Tokens: 0, LastUpdate: now})
+	assert.InDelta(t, float64(90*time.Second), float64(ttl), float64(50*time.Millisecond))
+	assert.Equal(t, time.Duration(0), ttl%time.Millisecond)
+
+	// A full bucket is already equivalent to a fresh key
+	ttl = backend.expiry(&core.State{Tokens: 15, LastUpdate: now})
+	assert.Equal(t, time.Millisecond, ttl)
+
+	// Time already elapsed since the update counts towards the refill
+	ttl = backend.expiry(&core.State{Tokens: 0, LastUpdate: now.Add(-time.Minute)})
+	assert.InDelta(t, float64(30*time.Second), float64(ttl), float64(50*time.Millisecond))
+
+	// A fixed TTL overrides the expirer
+	backend = NewBackend(client, "test", WithExpirer(strategy), WithTTL(time.Hour))
+	assert.Equal(t, time.Hour, backend.expiry(&core.State{LastUpdate: now}))
+}
+
+func TestBackend_SetUsesPolicyTTL(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	config := core.Config{Limit: 10, Interval: time.Minute, Burst: 15}
+	backend := NewBackend(client, "test", WithExpirer(tokenbucket.NewStrategy(config)))
+	ctx := context.Background()
+
+	state := &core.State{Tokens: 10, LastUpdate: time.Now(), Created: time.Now()}
+	assert.NoError(t, backend.Set(ctx, "ttl-key", state))
+
+	pttl, err := client.PTTL(ctx, backend.makeKey("ttl-key")).Result()
+	assert.NoError(t, err)
+	assert.Greater(t, pttl, 29*time.Second)
+	assert.LessOrEqual(t, pttl, 31*time.Second)
+}
+
+func TestBackend_Conformance(t *testing.T) {
+	const ttl = 500 * time.Millisecond
+	servers := make(map[core.Backend]*redistest.Server)
+	factory := func(t *testing.T) core.Backend {
+		client, srv := setupTestServer(t)
+		backend := NewBackend(client, "test", WithTTL(ttl))
+		servers[backend] = srv
+		return backend
+	}
+	advance := func(backend core.Backend, d time.Duration) {
+		if srv := servers[backend]; srv != nil {
+			srv.FastForward(d)
+			return
+		}
+		time.Sleep(d)
+	}
+
+	backendtest.RunConformance(t, factory, backendtest.WithExpiry(ttl, advance))
+}
+
 func TestBackend_Get_NonExistentKey(t *testing.T) {
 	client := setupTestRedis(t)
 	defer client.Close()
@@ -89,10 +329,7 @@ func TestBackend_Get_NonExistentKey(t *testing.T) {
 
 	state, err := backend.Get(ctx, "non-existent")
 	assert.NoError(t, err)
-	assert.NotNil(t, state)
-	assert.Equal(t, float64(0), state.Tokens)
-	assert.WithinDuration(t, time.Now(), state.Created, 2*time.Second)
-	assert.WithinDuration(t, time.Now(), state.LastUpdate, 2*time.Second)
+	assert.Nil(t, state)
 }
 
 func TestBackend_SetAndGet(t *testing.T) {
@@ -119,8 +356,8 @@ func TestBackend_SetAndGet(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, retrievedState)
 	assert.Equal(t, state.Tokens, retrievedState.Tokens)
-	assert.Equal(t, state.LastUpdate, retrievedState.LastUpdate)
-	assert.Equal(t, state.Created, retrievedState.Created)
+	assert.True(t, state.LastUpdate.Equal(retrievedState.LastUpdate))
+	assert.True(t, state.Created.Equal(retrievedState.Created))
 }
 
 func TestBackend_Delete(t *testing.T) {
@@ -148,10 +385,51 @@ func TestBackend_Delete(t *testing.T) {
 	err = backend.Delete(ctx, "test-key")
 	assert.NoError(t, err)
 
-	// Verify it's gone (should return empty state)
+	// Verify it's gone
 	retrievedState, err = backend.Get(ctx, "test-key")
 	assert.NoError(t, err)
-	assert.Equal(t, float64(0), retrievedState.Tokens)
+	assert.Nil(t, retrievedState)
+}
+
+func TestBackend_UpdateConcurrent(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	backend := NewBackend(client, "test")
+	ctx := context.Background()
+
+	// Transactions are opt-in; core.Limiter keeps its plain Get/Set path
+	_, ok := interface{}(backend).(core.Updater)
+	assert.False(t, ok)
+
+	const workers = 20
+	var succeeded atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := backend.UpdateTx(ctx, "update-key", func(state *core.State) (*core.State, error) {
+				if state == nil {
+					now := time.Now()
+					state = &core.State{LastUpdate: now, Created: now}
+				}
+				state.Tokens++
+				return state, nil
+			})
+			if err == nil {
+				succeeded.Add(1)
+			} else {
+				assert.ErrorIs(t, err, ErrContention)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every update that succeeded is reflected exactly once
+	state, err := backend.Get(ctx, "update-key")
+	require.NoError(t, err)
+	assert.Equal(t, float64(succeeded.Load()), state.Tokens)
 }
 
 func TestBackend_KeyPrefixing(t *testing.T) {
@@ -222,17 +500,31 @@ func TestBackend_ConcurrentAccess(t *testing.T) {
 	}
 }
 
-func TestBackend_GetStats(t *testing.T) {
+func TestBackend_Stats(t *testing.T) {
 	client := setupTestRedis(t)
 	defer client.Close()
 
 	backend := NewBackend(client, "test")
 
-	stats := backend.GetStats()
+	stats := backend.Stats()
 	assert.NotNil(t, stats)
 	assert.Contains(t, stats, "total_connections")
 	assert.Contains(t, stats, "idle_connections")
 	assert.Contains(t, stats, "stale_connections")
+	assert.Equal(t, stats, backend.GetStats())
+}
+
+func TestBackend_PingUnreachable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	backend := NewBackend(client, "test")
+	defer backend.Close()
+
+	assert.ErrorContains(t, backend.Ping(context.Background()), "failed to ping Redis")
+
+	health := core.CheckBackend(context.Background(), backend)
+	assert.False(t, health.Healthy)
+	assert.Error(t, health.Err)
+	assert.Contains(t, health.Stats, "total_connections")
 }
 
 func TestBackend_Close(t *testing.T) {
@@ -247,10 +539,7 @@ func TestBackend_Close(t *testing.T) {
 }
 
 func BenchmarkBackend_Set(b *testing.B) {
-	client := setupBenchmarkRedis()
-	if client == nil {
-		b.Skip("Redis not available")
-	}
+	client := setupTestRedis(b)
 	defer client.Close()
 
 	backend := NewBackend(client, "benchmark")
@@ -273,10 +562,7 @@ func BenchmarkBackend_Set(b *testing.B) {
 }
 
 func BenchmarkBackend_Get(b *testing.B) {
-	client := setupBenchmarkRedis()
-	if client == nil {
-		b.Skip("Redis not available")
-	}
+	client := setupTestRedis(b)
 	defer client.Close()
 
 	backend := NewBackend(client, "benchmark")
@@ -0,0 +1,623 @@
+package redistest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+const (
+	errSyntax    = "ERR syntax error"
+	errNotInt    = "ERR value is not an integer or out of range"
+	errNoScript  = "NOSCRIPT No matching script. Please use EVAL."
+	errWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+)
+
+// client is the state of one connection
+type client struct {
+	server *Server
+	w      writer
+	db     int
+
+	watched []watchedKey
+	multi   bool
+	dirty   bool // A command queued in MULTI was rejected
+	queued  [][][]byte
+}
+
+type watchedKey struct {
+	db      int
+	key     string
+	version uint64
+}
+
+// command is a handler with its arity counted like Redis does, including
+// the command name: positive for exactly that many arguments, negative for
+// at least that many
+type command struct {
+	arity int
+	fn    func(c *client, args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":     {-1, cmdPing},
+		"echo":     {2, cmdEcho},
+		"quit":     {1, func(c *client, args []string) { c.w.status("OK") }},
+		"select":   {2, cmdSelect},
+		"client":   {-2, cmdClient},
+		"time":     {1, cmdTime},
+		"dbsize":   {1, cmdDBSize},
+		"flushdb":  {-1, cmdFlushDB},
+		"flushall": {-1, cmdFlushAll},
+		"get":      {2, cmdGet},
+		"set":      {-3, cmdSet},
+		"setnx":    {3, cmdSetNX},
+		"del":      {-2, cmdDel},
+		"unlink":   {-2, cmdDel},
+		"exists":   {-2, cmdExists},
+		"type":     {2, cmdType},
+		"expire":   {3, cmdExpire(time.Second)},
+		"pexpire":  {3, cmdExpire(time.Millisecond)},
+		"persist":  {2, cmdPersist},
+		"ttl":      {2, cmdTTL(time.Second)},
+		"pttl":     {2, cmdTTL(time.Millisecond)},
+		"keys":     {2, cmdKeys},
+		"scan":     {-2, cmdScan},
+		"watch":    {-2, cmdWatch},
+		"unwatch":  {1, cmdUnwatch},
+		"multi":    {1, cmdMulti},
+		"exec":     {1, cmdExec},
+		"discard":  {1, cmdDiscard},
+		"eval":     {-3, cmdEval},
+		"evalsha":  {-3, cmdEvalSHA},
+		"script":   {-2, cmdScript},
+		"xadd":     {-5, cmdXAdd},
+		"xlen":     {2, cmdXLen},
+		"xrange":   {-4, cmdXRange},
+	}
+}
+
+// run executes one command and reports whether the connection should close
+func (c *client) run(raw [][]byte) bool {
+	args := make([]string, len(raw))
+	for i, arg := range raw {
+		args[i] = string(arg)
+	}
+	name := strings.ToLower(args[0])
+
+	cmd, ok := commands[name]
+	if !ok {
+		c.reject(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.reject(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+
+	if c.multi {
+		switch name {
+		case "exec", "discard", "multi", "watch", "quit":
+		default:
+			c.queued = append(c.queued, raw)
+			c.w.status("QUEUED")
+			return false
+		}
+	}
+
+	c.server.mu.Lock()
+	cmd.fn(c, args[1:])
+	c.server.mu.Unlock()
+
+	return name == "quit"
+}
+
+// reject replies with an error, failing the transaction in progress
+func (c *client) reject(msg string) {
+	if c.multi {
+		c.dirty = true
+	}
+	c.w.error(msg)
+}
+
+// current returns the selected database; the caller holds the server lock
+func (c *client) current() *DB {
+	return c.server.dbs[c.db]
+}
+
+// unwatch forgets the watched keys; the caller holds the server lock
+func (c *client) unwatch() {
+	if len(c.watched) == 0 {
+		return
+	}
+	c.watched = nil
+
+	s := c.server
+	s.watching--
+	if s.watching == 0 {
+		for _, db := range s.dbs {
+			clear(db.tombstones)
+		}
+	}
+}
+
+func cmdPing(c *client, args []string) {
+	switch len(args) {
+	case 0:
+		c.w.status("PONG")
+	case 1:
+		c.w.bulk([]byte(args[0]))
+	default:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func cmdEcho(c *client, args []string) {
+	c.w.bulk([]byte(args[0]))
+}
+
+func cmdSelect(c *client, args []string) {
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		c.w.error(errNotInt)
+		return
+	}
+	if n < 0 || n >= numDatabases {
+		c.w.error("ERR DB index is out of range")
+		return
+	}
+	c.db = n
+	c.w.status("OK")
+}
+
+// cmdClient accepts the connection metadata go-redis sends on connect
+func cmdClient(c *client, args []string) {
+	switch strings.ToLower(args[0]) {
+	case "setname", "setinfo":
+		c.w.status("OK")
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+	}
+}
+
+func cmdTime(c *client, args []string) {
+	now := c.server.now()
+	c.w.array(2)
+	c.w.bulk([]byte(strconv.FormatInt(now.Unix(), 10)))
+	c.w.bulk([]byte(strconv.Itoa(now.Nanosecond() / 1000)))
+}
+
+func cmdDBSize(c *client, args []string) {
+	c.w.integer(int64(len(c.current().keys("*"))))
+}
+
+func cmdFlushDB(c *client, args []string) {
+	c.current().flush()
+	c.w.status("OK")
+}
+
+func cmdFlushAll(c *client, args []string) {
+	for _, db := range c.server.dbs {
+		db.flush()
+	}
+	c.w.status("OK")
+}
+
+func cmdGet(c *client, args []string) {
+	it := c.current().lookup(args[0])
+	switch {
+	case it == nil:
+		c.w.null()
+	case it.stream != nil:
+		c.w.error(errWrongType)
+	default:
+		c.w.bulk(it.value)
+	}
+}
+
+func cmdSet(c *client, args []string) {
+	db := c.current()
+	key, value := args[0], []byte(args[1])
+
+	var expires time.Time
+	var nx, xx, keepTTL, get bool
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "GET":
+			get = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 == len(args) || !expires.IsZero() {
+				c.w.error(errSyntax)
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				c.w.error(errNotInt)
+				return
+			}
+			if n <= 0 {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			switch opt {
+			case "EX":
+				expires = db.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				expires = db.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				expires = time.Unix(n, 0)
+			case "PXAT":
+				expires = time.UnixMilli(n)
+			}
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+	if (nx && xx) || (keepTTL && !expires.IsZero()) {
+		c.w.error(errSyntax)
+		return
+	}
+
+	old := db.lookup(key)
+	if (nx && old != nil) || (xx && old == nil) {
+		if get && old != nil {
+			c.w.bulk(old.value)
+		} else {
+			c.w.null()
+		}
+		return
+	}
+
+	if keepTTL && old != nil {
+		expires = old.expires
+	}
+	db.store(key, value, expires)
+
+	switch {
+	case !get:
+		c.w.status("OK")
+	case old != nil:
+		c.w.bulk(old.value)
+	default:
+		c.w.null()
+	}
+}
+
+func cmdSetNX(c *client, args []string) {
+	db := c.current()
+	if db.lookup(args[0]) != nil {
+		c.w.integer(0)
+		return
+	}
+	db.store(args[0], []byte(args[1]), time.Time{})
+	c.w.integer(1)
+}
+
+func cmdDel(c *client, args []string) {
+	var n int64
+	for _, key := range args {
+		if c.current().Delete(key) {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+func cmdExists(c *client, args []string) {
+	var n int64
+	for _, key := range args {
+		if c.current().lookup(key) != nil {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+func cmdType(c *client, args []string) {
+	it := c.current().lookup(args[0])
+	if it == nil {
+		c.w.status("none")
+		return
+	}
+	c.w.status(it.kind())
+}
+
+func cmdExpire(unit time.Duration) func(c *client, args []string) {
+	return func(c *client, args []string) {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			c.w.error(errNotInt)
+			return
+		}
+
+		db := c.current()
+		it := db.lookup(args[0])
+		if it == nil {
+			c.w.integer(0)
+			return
+		}
+		if n <= 0 {
+			db.remove(args[0])
+		} else {
+			it.expires = db.Now().Add(time.Duration(n) * unit)
+			db.touch(it)
+		}
+		c.w.integer(1)
+	}
+}
+
+func cmdPersist(c *client, args []string) {
+	db := c.current()
+	it := db.lookup(args[0])
+	if it == nil || it.expires.IsZero() {
+		c.w.integer(0)
+		return
+	}
+	it.expires = time.Time{}
+	db.touch(it)
+	c.w.integer(1)
+}
+
+func cmdTTL(unit time.Duration) func(c *client, args []string) {
+	return func(c *client, args []string) {
+		ttl := c.current().TTL(args[0])
+		if ttl < 0 {
+			c.w.integer(int64(ttl))
+			return
+		}
+		// Round up like Redis, so a key that still exists never reports 0
+		c.w.integer(int64((ttl + unit - 1) / unit))
+	}
+}
+
+func cmdKeys(c *client, args []string) {
+	c.w.value(c.current().keys(args[0]))
+}
+
+// cmdScan iterates keys in the order of their hash. The cursor is the hash
+// to resume from, so keys that exist for the whole scan are returned exactly
+// once however others are added or removed in between.
+func cmdScan(c *client, args []string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+
+	pattern, count, typ := "*", 10, ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.error(errSyntax)
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.w.error(errSyntax)
+				return
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+
+	type hashed struct {
+		hash uint64
+		key  string
+	}
+	var candidates []hashed
+	for _, key := range c.current().keys("*") {
+		if h := keyHash(key); h >= cursor {
+			candidates = append(candidates, hashed{h, key})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].hash != candidates[j].hash {
+			return candidates[i].hash < candidates[j].hash
+		}
+		return candidates[i].key < candidates[j].key
+	})
+
+	var keys []string
+	var next uint64
+	for i, cand := range candidates {
+		// Never split keys with the same hash across calls
+		if i >= count && cand.hash != candidates[i-1].hash {
+			next = cand.hash
+			break
+		}
+		if core.Match(pattern, cand.key) && (typ == "" || typ == c.current().lookup(cand.key).kind()) {
+			keys = append(keys, cand.key)
+		}
+	}
+
+	c.w.array(2)
+	c.w.bulk([]byte(strconv.FormatUint(next, 10)))
+	c.w.value(keys)
+}
+
+// keyHash orders keys for SCAN
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func cmdWatch(c *client, args []string) {
+	if c.multi {
+		c.w.error("ERR WATCH inside MULTI is not allowed")
+		return
+	}
+
+	if len(c.watched) == 0 {
+		c.server.watching++
+	}
+	db := c.current()
+	for _, key := range args {
+		c.watched = append(c.watched, watchedKey{db: c.db, key: key, version: db.version(key)})
+	}
+	c.w.status("OK")
+}
+
+func cmdUnwatch(c *client, args []string) {
+	c.unwatch()
+	c.w.status("OK")
+}
+
+func cmdMulti(c *client, args []string) {
+	if c.multi {
+		c.w.error("ERR MULTI calls can not be nested")
+		return
+	}
+	c.multi = true
+	c.w.status("OK")
+}
+
+func cmdDiscard(c *client, args []string) {
+	if !c.multi {
+		c.w.error("ERR DISCARD without MULTI")
+		return
+	}
+	c.multi, c.dirty, c.queued = false, false, nil
+	c.unwatch()
+	c.w.status("OK")
+}
+
+// cmdExec runs the queued commands unless a watched key changed since WATCH
+func cmdExec(c *client, args []string) {
+	if !c.multi {
+		c.w.error("ERR EXEC without MULTI")
+		return
+	}
+	queued, dirty := c.queued, c.dirty
+	c.multi, c.dirty, c.queued = false, false, nil
+
+	changed := false
+	for _, w := range c.watched {
+		if c.server.dbs[w.db].version(w.key) != w.version {
+			changed = true
+			break
+		}
+	}
+	c.unwatch()
+
+	switch {
+	case dirty:
+		c.w.error("EXECABORT Transaction discarded because of previous errors.")
+	case changed:
+		c.w.nullArray()
+	default:
+		c.w.array(len(queued))
+		for _, raw := range queued {
+			args := make([]string, len(raw))
+			for i, arg := range raw {
+				args[i] = string(arg)
+			}
+			commands[strings.ToLower(args[0])].fn(c, args[1:])
+		}
+	}
+}
+
+func cmdEval(c *client, args []string) {
+	sha := scriptSHA(args[0])
+	if _, ok := c.server.scripts[sha]; !ok {
+		c.w.error("ERR redistest: script not registered: " + sha)
+		return
+	}
+	c.runScript(sha, args[1:])
+}
+
+func cmdEvalSHA(c *client, args []string) {
+	sha := strings.ToLower(args[0])
+	if _, ok := c.server.scripts[sha]; !ok {
+		c.w.error(errNoScript)
+		return
+	}
+	c.runScript(sha, args[1:])
+}
+
+// runScript calls a registered script with "numkeys key... arg..."
+func (c *client) runScript(sha string, args []string) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		c.w.error(errNotInt)
+		return
+	}
+	if numKeys < 0 || numKeys > len(args)-1 {
+		c.w.error("ERR Number of keys can't be greater than number of args")
+		return
+	}
+
+	keys, argv := args[1:1+numKeys], args[1+numKeys:]
+	result, err := c.server.scripts[sha](c.current(), keys, argv)
+	if err != nil {
+		c.w.error(scriptError(err))
+		return
+	}
+	c.w.value(result)
+}
+
+// scriptError formats a script's error as a reply. Messages that start with
+// an upper-case code such as "WRONGTYPE" are sent as they are, others get
+// the generic "ERR" code.
+func scriptError(err error) string {
+	msg := err.Error()
+	code, _, _ := strings.Cut(msg, " ")
+	if code != "" && strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+		return msg
+	}
+	return "ERR " + msg
+}
+
+func cmdScript(c *client, args []string) {
+	switch strings.ToLower(args[0]) {
+	case "load":
+		if len(args) != 2 {
+			c.w.error("ERR wrong number of arguments for 'script|load' command")
+			return
+		}
+		sha := scriptSHA(args[1])
+		if _, ok := c.server.scripts[sha]; !ok {
+			c.w.error("ERR redistest: script not registered: " + sha)
+			return
+		}
+		c.w.bulk([]byte(sha))
+	case "exists":
+		c.w.array(len(args) - 1)
+		for _, sha := range args[1:] {
+			if _, ok := c.server.scripts[strings.ToLower(sha)]; ok {
+				c.w.integer(1)
+			} else {
+				c.w.integer(0)
+			}
+		}
+	case "flush":
+		// Registered scripts are part of the server, not its cache
+		c.w.status("OK")
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+	}
+}
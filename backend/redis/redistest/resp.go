@@ -0,0 +1,146 @@
+package redistest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	maxArgs     = 1 << 20   // Elements in one command
+	maxBulkSize = 512 << 20 // Bytes in one argument, as in Redis
+)
+
+// errProtocol is returned for input that isn't valid RESP
+var errProtocol = errors.New("Protocol error")
+
+// readCommand reads one command, either a RESP array of bulk strings as sent
+// by clients or an inline command as typed into telnet
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, line)
+		}
+
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string not terminated", errProtocol)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// readLine reads a line without its terminator
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// writer encodes RESP2 replies
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) status(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) error(msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w writer) nullArray() {
+	w.WriteString("*-1\r\n")
+}
+
+// value encodes a script result the way Redis converts Lua values: strings
+// become bulk strings, integers and booleans integers (false is nil) and
+// slices arrays
+func (w writer) value(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.null()
+	case error:
+		w.error(v.Error())
+	case string:
+		w.bulk([]byte(v))
+	case []byte:
+		w.bulk(v)
+	case int:
+		w.integer(int64(v))
+	case int64:
+		w.integer(v)
+	case bool:
+		if v {
+			w.integer(1)
+		} else {
+			w.null()
+		}
+	case []string:
+		w.array(len(v))
+		for _, s := range v {
+			w.bulk([]byte(s))
+		}
+	case []interface{}:
+		w.array(len(v))
+		for _, elem := range v {
+			w.value(elem)
+		}
+	default:
+		w.error(fmt.Sprintf("ERR redistest: unsupported script result %T", v))
+	}
+}
@@ -0,0 +1,427 @@
+// Package redistest provides an in-process stand-in for Redis, so the Redis
+// backend can be tested (and demoed) without a server. It speaks RESP2 and
+// implements the string, key, transaction and scripting commands the
+// backend uses: GET, SET (EX/PX/NX/XX/KEEPTTL/GET), SETNX, DEL, EXISTS,
+// EXPIRE, TTL, PTTL, SCAN, KEYS, TIME, WATCH/MULTI/EXEC, EVAL and EVALSHA,
+// plus the connection commands go-redis sends (SELECT, CLIENT, PING) and
+// the stream commands the audit sink uses (XADD, XLEN, XRANGE).
+//
+// Keys expire on the server's own clock, which tests can move forward with
+// FastForward instead of sleeping. There is no Lua interpreter: scripts are
+// Go functions registered with RegisterScript under their Lua source, so
+// EVAL and EVALSHA of that source run the function atomically.
+package redistest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// numDatabases is the number of logical databases, as in a default Redis
+const numDatabases = 16
+
+// ScriptFunc implements a Lua script. It runs atomically with the server
+// locked and receives the script's KEYS and ARGV. The result is converted
+// like a Lua value: nil, string, []byte, int, int64, bool, []string,
+// []interface{} or an error.
+type ScriptFunc func(db *DB, keys, args []string) (interface{}, error)
+
+// Server is an in-process Redis server
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	dbs      [numDatabases]*DB
+	offset   time.Duration // Added to the wall clock by FastForward
+	version  uint64        // Last version given to a write
+	watching int           // Connections with watched keys
+	scripts  map[string]ScriptFunc
+	conns    map[net.Conn]struct{}
+	closed   bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer starts a server listening on addr, such as "127.0.0.1:0" for a
+// random port
+func NewServer(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s := &Server{
+		listener: listener,
+		scripts:  make(map[string]ScriptFunc),
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	for i := range s.dbs {
+		s.dbs[i] = newDB(s)
+	}
+
+	s.wg.Add(2)
+	go s.serve()
+	go s.expireLoop()
+
+	return s, nil
+}
+
+// Start starts a server on a random local port that is closed when the test
+// finishes
+func Start(tb testing.TB) *Server {
+	tb.Helper()
+
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("redistest: %v", err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and drops all connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.listener.Close()
+	for nc := range s.conns {
+		nc.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Now returns the server clock
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now()
+}
+
+// FastForward moves the server clock forward by d, expiring keys whose TTL
+// ran out as if d had passed
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offset += d
+	s.expireAll()
+}
+
+// RegisterScript makes EVAL and EVALSHA of the Lua source src run fn, and
+// returns the SHA1 the script is known by
+func (s *Server) RegisterScript(src string, fn ScriptFunc) string {
+	sha := scriptSHA(src)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scripts[sha] = fn
+	return sha
+}
+
+// FlushAll removes every key from every database
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, db := range s.dbs {
+		db.flush()
+	}
+}
+
+// Keys returns the sorted live keys of database n
+func (s *Server) Keys(n int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dbs[n].keys("*")
+}
+
+// now returns the server clock; the caller holds mu
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// nextVersion returns a new write version; the caller holds mu
+func (s *Server) nextVersion() uint64 {
+	s.version++
+	return s.version
+}
+
+// serve accepts connections until the server is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[nc] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(nc)
+	}
+}
+
+// handle runs the commands of one connection. Replies are flushed once no
+// more pipelined commands are buffered.
+func (s *Server) handle(nc net.Conn) {
+	defer s.wg.Done()
+
+	c := &client{
+		server: s,
+		w:      writer{bufio.NewWriter(nc)},
+	}
+	defer func() {
+		s.mu.Lock()
+		c.unwatch()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+
+	r := bufio.NewReader(nc)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.w.error("ERR " + err.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := c.run(args)
+		if r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// expireLoop removes expired keys once a second so idle keys don't pile up
+func (s *Server) expireLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.expireAll()
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// expireAll removes expired keys from every database; the caller holds mu
+func (s *Server) expireAll() {
+	now := s.now()
+	for _, db := range s.dbs {
+		for key, it := range db.items {
+			if it.expired(now) {
+				db.remove(key)
+			}
+		}
+	}
+}
+
+// DB is one logical database. Its methods are only valid inside a
+// ScriptFunc, which runs with the server locked.
+type DB struct {
+	server *Server
+	items  map[string]*item
+
+	// Versions of deleted keys, kept while any connection watches keys so
+	// EXEC notices a watched key being deleted
+	tombstones map[string]uint64
+}
+
+type item struct {
+	value   []byte
+	stream  *stream   // Set instead of value for a stream
+	expires time.Time // Zero if the key doesn't expire
+	version uint64
+}
+
+// kind returns the type of the item as TYPE names it
+func (it *item) kind() string {
+	if it.stream != nil {
+		return "stream"
+	}
+	return "string"
+}
+
+func (it *item) expired(now time.Time) bool {
+	return !it.expires.IsZero() && !now.Before(it.expires)
+}
+
+func newDB(s *Server) *DB {
+	return &DB{
+		server:     s,
+		items:      make(map[string]*item),
+		tombstones: make(map[string]uint64),
+	}
+}
+
+// Now returns the server clock
+func (db *DB) Now() time.Time {
+	return db.server.now()
+}
+
+// Get returns the value of key and whether it exists
+func (db *DB) Get(key string) ([]byte, bool) {
+	it := db.lookup(key)
+	if it == nil {
+		return nil, false
+	}
+	return it.value, true
+}
+
+// Set stores value under key, expiring after ttl if it is positive
+func (db *DB) Set(key string, value []byte, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = db.Now().Add(ttl)
+	}
+	db.store(key, value, expires)
+}
+
+// Delete removes key and reports whether it existed
+func (db *DB) Delete(key string) bool {
+	if db.lookup(key) == nil {
+		return false
+	}
+	db.remove(key)
+	return true
+}
+
+// TTL returns the time left before key expires, -1 if it doesn't expire
+// and -2 if it doesn't exist, like PTTL
+func (db *DB) TTL(key string) time.Duration {
+	it := db.lookup(key)
+	switch {
+	case it == nil:
+		return -2
+	case it.expires.IsZero():
+		return -1
+	default:
+		return it.expires.Sub(db.Now())
+	}
+}
+
+// lookup returns the live item for key, removing it if it has expired
+func (db *DB) lookup(key string) *item {
+	it, ok := db.items[key]
+	if !ok {
+		return nil
+	}
+	if it.expired(db.Now()) {
+		db.remove(key)
+		return nil
+	}
+	return it
+}
+
+// store writes a new version of key
+func (db *DB) store(key string, value []byte, expires time.Time) {
+	db.items[key] = &item{
+		value:   append([]byte(nil), value...),
+		expires: expires,
+		version: db.server.nextVersion(),
+	}
+	delete(db.tombstones, key)
+}
+
+// remove deletes key, leaving a tombstone for watchers
+func (db *DB) remove(key string) {
+	delete(db.items, key)
+	if db.server.watching > 0 {
+		db.tombstones[key] = db.server.nextVersion()
+	}
+}
+
+// touch records a change of key's metadata, such as its TTL
+func (db *DB) touch(it *item) {
+	it.version = db.server.nextVersion()
+}
+
+// version returns the version WATCH compares: that of the live item, of
+// its tombstone or 0 for a key that was never seen
+func (db *DB) version(key string) uint64 {
+	if it := db.lookup(key); it != nil {
+		return it.version
+	}
+	return db.tombstones[key]
+}
+
+// flush removes every key
+func (db *DB) flush() {
+	for key := range db.items {
+		db.remove(key)
+	}
+}
+
+// keys returns the sorted live keys matching a glob pattern
+func (db *DB) keys(pattern string) []string {
+	now := db.Now()
+	var keys []string
+	for key, it := range db.items {
+		if !it.expired(now) && core.Match(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scriptSHA returns the SHA1 Redis identifies a script by
+func scriptSHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,319 @@
+package redistest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClient(t *testing.T, s *Server, db int) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: s.Addr(), DB: db})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestServer_GetSetDel(t *testing.T) {
+	s := Start(t)
+	client := newClient(t, s, 0)
+	ctx := context.Background()
+
+	require.NoError(t, client.Ping(ctx).Err())
+
+	_, err := client.Get(ctx, "key").Result()
+	assert.Equal(t, redis.Nil, err)
+
+	require.NoError(t, client.Set(ctx, "key", []byte{0, 1, '\r', '\n'}, 0).Err())
+	value, err := client.Get(ctx, "key").Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, '\r', '\n'}, value)
+
+	n, err := client.Exists(ctx, "key", "missing").Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	n, err = client.Del(ctx, "key", "missing").Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, int64(0), client.Exists(ctx, "key").Val())
+}
+
+func TestServer_SetOptions(t *testing.T) {
+	s := Start(t)
+	client := newClient(t, s, 0)
+	ctx := context.Background()
+
+	ok, err := client.SetNX(ctx, "key", "a", time.Minute).Result()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = client.SetNX(ctx, "key", "b", time.Minute).Result()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = client.SetNX(ctx, "plain", "a", 0).Result()
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// KEEPTTL overwrites the value only
+	require.NoError(t, client.SetArgs(ctx, "key", "c", redis.SetArgs{KeepTTL: true}).Err())
+	assert.Equal(t, "c", client.Get(ctx, "key").Val())
+	assert.Greater(t, client.PTTL(ctx, "key").Val(), 59*time.Second)
+
+	// A plain SET clears the TTL
+	require.NoError(t, client.Set(ctx, "key", "d", 0).Err())
+	assert.Equal(t, time.Duration(-1), client.PTTL(ctx, "key").Val())
+	assert.Equal(t, time.Duration(-2), client.PTTL(ctx, "missing").Val())
+
+	old, err := client.SetArgs(ctx, "key", "e", redis.SetArgs{Get: true}).Result()
+	require.NoError(t, err)
+	assert.Equal(t, "d", old)
+
+	assert.Error(t, client.Do(ctx, "SET", "key", "f", "PX", "0").Err())
+	assert.Error(t, client.Do(ctx, "SET", "key", "f", "NX", "XX").Err())
+}
+
+func TestServer_FastForwardExpiresKeys(t *testing.T) {
+	s := Start(t)
+	client := newClient(t, s, 0)
+	ctx := context.Background()
+
+	require.NoError(t, client.Set(ctx, "short", "1", 1500*time.Millisecond).Err())
+	require.NoError(t, client.Set(ctx, "long", "1", time.Hour).Err())
+	assert.Equal(t, 2*time.Second, client.TTL(ctx, "short").Val())
+
+	s.FastForward(time.Second)
+	assert.Equal(t, int64(1), client.Exists(ctx, "short").Val())
+	assert.LessOrEqual(t, client.PTTL(ctx, "short").Val(), 500*time.Millisecond)
+
+	s.FastForward(time.Second)
+	assert.Equal(t, int64(0), client.Exists(ctx, "short").Val())
+	assert.Equal(t, int64(1), client.Exists(ctx, "long").Val())
+	assert.Equal(t, []string{"long"}, s.Keys(0))
+
+	// TIME follows the server clock
+	now, err := client.Time(ctx).Result()
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), now, time.Second)
+}
+
+func TestServer_Databases(t *testing.T) {
+	s := Start(t)
+	ctx := context.Background()
+
+	db0, db15 := newClient(t, s, 0), newClient(t, s, 15)
+	require.NoError(t, db15.Set(ctx, "key", "15", 0).Err())
+
+	assert.Equal(t, redis.Nil, db0.Get(ctx, "key").Err())
+	assert.Equal(t, "15", db15.Get(ctx, "key").Val())
+
+	require.NoError(t, db0.Set(ctx, "key", "0", 0).Err())
+	require.NoError(t, db15.FlushDB(ctx).Err())
+	assert.Equal(t, "0", db0.Get(ctx, "key").Val())
+	assert.Equal(t, int64(0), db15.DBSize(ctx).Val())
+
+	assert.Error(t, db0.Do(ctx, "SELECT", "16").Err())
+}
+
+func TestServer_WatchMulti(t *testing.T) {
+	s := Start(t)
+	client := newClient(t, s, 0)
+	ctx := context.Background()
+
+	increment := func(interfere func()) error {
+		return client.Watch(ctx, func(tx *redis.Tx) error {
+			n, err := tx.Get(ctx, "counter").Int()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if interfere != nil {
+				interfere()
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, "counter", n+1, 0)
+				return nil
+			})
+			return err
+		}, "counter")
+	}
+
+	require.NoError(t, increment(nil))
+	assert.Equal(t, "1", client.Get(ctx, "counter").Val())
+
+	// A write from another connection between WATCH and EXEC aborts it
+	other := newClient(t, s, 0)
+	err := increment(func() { other.Set(ctx, "counter", 10, 0) })
+	assert.ErrorIs(t, err, redis.TxFailedErr)
+	assert.Equal(t, "10", client.Get(ctx, "counter").Val())
+
+	// So does deleting or expiring the key
+	err = increment(func() { other.Del(ctx, "counter") })
+	assert.ErrorIs(t, err, redis.TxFailedErr)
+
+	require.NoError(t, client.Set(ctx, "counter", 1, time.Second).Err())
+	err = increment(func() { s.FastForward(2 * time.Second) })
+	assert.ErrorIs(t, err, redis.TxFailedErr)
+
+	// Errors while queueing abort the whole transaction
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "a", 1, 0)
+		pipe.Do(ctx, "NOSUCHCOMMAND")
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, redis.Nil, client.Get(ctx, "a").Err())
+}
+
+func TestServer_Scripts(t *testing.T) {
+	s := Start(t)
+	client := newClient(t, s, 0)
+	ctx := context.Background()
+
+	const src = `return redis.call('INCRBY', KEYS[1], ARGV[1])`
+	sha := s.RegisterScript(src, func(db *DB, keys, args []string) (interface{}, error) {
+		by, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		value, _ := db.Get(keys[0])
+		n, _ := strconv.ParseInt(string(value), 10, 64)
+		db.Set(keys[0], []byte(strconv.FormatInt(n+by, 10)), db.TTL(keys[0]))
+		return n + by, nil
+	})
+
+	// Script.Run tries EVALSHA and falls back to EVAL
+	script := redis.NewScript(src)
+	assert.Equal(t, sha, script.Hash())
+	n, err := script.Run(ctx, client, []string{"key"}, 5).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	n, err = client.EvalSha(ctx, sha, []string{"key"}, 2).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), n)
+
+	err = client.EvalSha(ctx, "0000000000000000000000000000000000000000", nil).Err()
+	assert.ErrorContains(t, err, "NOSCRIPT")
+	assert.ErrorContains(t, client.Eval(ctx, "return 1", nil).Err(), "not registered")
+	assert.ErrorContains(t, client.Eval(ctx, src, []string{"key"}, "x").Err(), "ERR")
+
+	exists, err := client.ScriptExists(ctx, sha, "missing").Result()
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false}, exists)
+}
+
+func TestServer_Scan(t *testing.T) {
+	s := Start(t)
+	client := newClient(t, s, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, client.Set(ctx, fmt.Sprintf("app:{user-%d}", i), "x", 0).Err())
+	}
+	require.NoError(t, client.Set(ctx, "other", "x", 0).Err())
+
+	// Keys present for the whole scan are returned exactly once, even while
+	// others come and go
+	seen := make(map[string]int)
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, `app:\{*`, 7).Result()
+		require.NoError(t, err)
+		for _, key := range keys {
+			seen[key]++
+		}
+		client.Set(ctx, fmt.Sprintf("app:{new-%d}", cursor), "x", 0)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 1, seen[fmt.Sprintf("app:{user-%d}", i)])
+	}
+	assert.NotContains(t, seen, "other")
+
+	keys, err := client.Keys(ctx, "app:{user-1?}").Result()
+	require.NoError(t, err)
+	assert.Len(t, keys, 10)
+
+	// Patterns are matched in linear time, like core.Match
+	require.NoError(t, client.Set(ctx, strings.Repeat("a", 200), "x", 0).Err())
+	keys, err = client.Keys(ctx, strings.Repeat("*a", 20)+"*b").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestServer_Streams(t *testing.T) {
+	s := Start(t)
+	client := newClient(t, s, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.XAdd(ctx, &redis.XAddArgs{
+			Stream: "events",
+			MaxLen: 3,
+			Approx: true,
+			Values: []string{"n", strconv.Itoa(i)},
+		}).Result()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(3), client.XLen(ctx, "events").Val())
+	assert.Equal(t, "stream", client.Type(ctx, "events").Val())
+
+	entries, err := client.XRange(ctx, "events", "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for i, entry := range entries {
+		assert.Equal(t, map[string]interface{}{"n": strconv.Itoa(i + 2)}, entry.Values)
+	}
+
+	// IDs keep increasing within the same millisecond
+	assert.Less(t, entries[0].ID, entries[1].ID)
+
+	entries, err = client.XRangeN(ctx, "events", entries[1].ID, "+", 1).Result()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "3", entries[0].Values["n"])
+
+	_, err = client.XAdd(ctx, &redis.XAddArgs{Stream: "events", ID: "1-1", Values: []string{"n", "old"}}).Result()
+	assert.ErrorContains(t, err, "equal or smaller")
+
+	assert.ErrorContains(t, client.Get(ctx, "events").Err(), "WRONGTYPE")
+	require.NoError(t, client.Set(ctx, "plain", "x", 0).Err())
+	assert.ErrorContains(t, client.XAdd(ctx, &redis.XAddArgs{Stream: "plain", Values: []string{"n", "1"}}).Err(), "WRONGTYPE")
+}
+
+func TestServer_InlineCommands(t *testing.T) {
+	s := Start(t)
+
+	nc, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+
+	fmt.Fprint(nc, "SET greeting hello\r\nGET greeting\r\nQUIT\r\n")
+	for _, want := range []string{"+OK\r\n", "$5\r\n", "hello\r\n", "+OK\r\n"} {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, want, line)
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	require.NoError(t, err)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	require.NoError(t, client.Ping(context.Background()).Err())
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+	assert.Error(t, client.Ping(context.Background()).Err())
+}
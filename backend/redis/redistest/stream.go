@@ -0,0 +1,219 @@
+package redistest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stream is the value of a stream key: entries in ascending ID order
+type stream struct {
+	entries []streamEntry
+	last    streamID // Highest ID ever added, even if trimmed since
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string // Alternating names and values
+}
+
+// streamID is an entry ID, written as "<ms>-<seq>"
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// parseStreamID parses a full or partial ID; a missing sequence is seq
+func parseStreamID(s string, seq uint64) (streamID, bool) {
+	msPart, seqPart, full := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	if full {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return streamID{}, false
+		}
+	}
+	return streamID{ms, seq}, true
+}
+
+// cmdXAdd supports NOMKSTREAM, MAXLEN (exact or ~, which trims exactly
+// here) and explicit or * IDs
+func cmdXAdd(c *client, args []string) {
+	db := c.current()
+	key := args[0]
+
+	var noMkStream bool
+	maxLen := int64(-1)
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NOMKSTREAM":
+			noMkStream = true
+		case "MAXLEN":
+			i++
+			if i < len(args) && (args[i] == "~" || args[i] == "=") {
+				i++
+			}
+			if i == len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n < 0 {
+				c.w.error(errNotInt)
+				return
+			}
+			maxLen = n
+		case "LIMIT":
+			// Only bounds the work of approximate trimming
+			i++
+		default:
+			break options
+		}
+	}
+	if i >= len(args) || (len(args)-i-1)%2 != 0 || len(args)-i-1 == 0 {
+		c.w.error("ERR wrong number of arguments for 'xadd' command")
+		return
+	}
+
+	it := db.lookup(key)
+	if it != nil && it.stream == nil {
+		c.w.error(errWrongType)
+		return
+	}
+	if it == nil && noMkStream {
+		c.w.null()
+		return
+	}
+
+	var last streamID
+	if it != nil {
+		last = it.stream.last
+	}
+
+	var id streamID
+	if args[i] == "*" {
+		id = streamID{ms: uint64(db.Now().UnixMilli())}
+		if !last.less(id) {
+			id = streamID{last.ms, last.seq + 1}
+		}
+	} else {
+		var ok bool
+		if id, ok = parseStreamID(args[i], 0); !ok {
+			c.w.error("ERR Invalid stream ID specified as stream command argument")
+			return
+		}
+		if id == (streamID{}) {
+			c.w.error("ERR The ID specified in XADD must be greater than 0-0")
+			return
+		}
+		if !last.less(id) {
+			c.w.error("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			return
+		}
+	}
+
+	if it == nil {
+		db.items[key] = &item{stream: &stream{}, version: db.server.nextVersion()}
+		delete(db.tombstones, key)
+		it = db.items[key]
+	} else {
+		db.touch(it)
+	}
+
+	s := it.stream
+	s.entries = append(s.entries, streamEntry{id: id, fields: append([]string(nil), args[i+1:]...)})
+	s.last = id
+	if maxLen >= 0 && int64(len(s.entries)) > maxLen {
+		s.entries = append([]streamEntry(nil), s.entries[int64(len(s.entries))-maxLen:]...)
+	}
+
+	c.w.bulk([]byte(id.String()))
+}
+
+func cmdXLen(c *client, args []string) {
+	it := c.current().lookup(args[0])
+	switch {
+	case it == nil:
+		c.w.integer(0)
+	case it.stream == nil:
+		c.w.error(errWrongType)
+	default:
+		c.w.integer(int64(len(it.stream.entries)))
+	}
+}
+
+// cmdXRange supports - and +, full and partial IDs and COUNT
+func cmdXRange(c *client, args []string) {
+	start, ok := streamBound(args[1], 0)
+	if !ok {
+		c.w.error("ERR Invalid stream ID specified as stream command argument")
+		return
+	}
+	end, ok := streamBound(args[2], ^uint64(0))
+	if !ok {
+		c.w.error("ERR Invalid stream ID specified as stream command argument")
+		return
+	}
+
+	count := -1
+	if len(args) > 3 {
+		if len(args) != 5 || strings.ToUpper(args[3]) != "COUNT" {
+			c.w.error(errSyntax)
+			return
+		}
+		n, err := strconv.Atoi(args[4])
+		if err != nil {
+			c.w.error(errNotInt)
+			return
+		}
+		count = n
+	}
+
+	it := c.current().lookup(args[0])
+	if it != nil && it.stream == nil {
+		c.w.error(errWrongType)
+		return
+	}
+
+	var entries []streamEntry
+	if it != nil {
+		for _, e := range it.stream.entries {
+			if count >= 0 && len(entries) == count {
+				break
+			}
+			if !e.id.less(start) && !end.less(e.id) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	c.w.array(len(entries))
+	for _, e := range entries {
+		c.w.array(2)
+		c.w.bulk([]byte(e.id.String()))
+		c.w.value(e.fields)
+	}
+}
+
+// streamBound parses an XRANGE bound: - and + or an ID whose missing
+// sequence is seq
+func streamBound(s string, seq uint64) (streamID, bool) {
+	switch s {
+	case "-":
+		return streamID{}, true
+	case "+":
+		return streamID{^uint64(0), ^uint64(0)}, true
+	}
+	return parseStreamID(s, seq)
+}
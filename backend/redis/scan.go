@@ -0,0 +1,282 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/throttle/core"
+)
+
+// defaultScanCount is the COUNT hint passed to SCAN
+const defaultScanCount = 500
+
+// scanKeys walks every key matching the glob pattern with SCAN, calling fn
+// with each batch. Cluster and Ring clients are scanned node by node (in
+// parallel), and fn receives the client of the node that holds the keys so
+// it can run single-node commands such as WATCH against them.
+func (b *Backend) scanKeys(ctx context.Context, match string, count int64, fn func(ctx context.Context, client redis.UniversalClient, keys []string) error) error {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	scan := func(ctx context.Context, client redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(ctx, cursor, match, count).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err := fn(ctx, client, keys); err != nil {
+					return err
+				}
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+
+	switch client := b.client.(type) {
+	case *redis.ClusterClient:
+		return client.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scan(ctx, node)
+		})
+	case *redis.Ring:
+		return client.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+			return scan(ctx, shard)
+		})
+	default:
+		return scan(ctx, b.client)
+	}
+}
+
+// Scan returns a page of the keys matching filter using SCAN, so Redis is
+// never blocked for long. Count is the COUNT hint, the number of keys
+// examined per page. Cluster and Ring nodes are scanned one after the
+// other; the cursor records the node and its SCAN cursor, so it is only
+// valid while the topology doesn't change.
+func (b *Backend) Scan(ctx context.Context, filter core.Filter, cursor string) ([]core.Entry, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	node, pos, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nodes, err := b.nodes(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list Redis nodes: %w", err)
+	}
+	if node >= len(nodes) {
+		return nil, "", nil
+	}
+
+	count := int64(filter.Count)
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	client := nodes[node]
+	keys, next, err := client.Scan(ctx, pos, b.filterPattern(filter), count).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to scan Redis keys: %w", err)
+	}
+
+	entries, err := b.fetch(ctx, client, keys, filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case next != 0:
+		cursor = fmt.Sprintf("%d:%d", node, next)
+	case node+1 < len(nodes):
+		cursor = fmt.Sprintf("%d:0", node+1)
+	default:
+		cursor = ""
+	}
+	return entries, cursor, nil
+}
+
+// fetch reads the states of Redis keys returned by SCAN on client. Keys
+// that expired meanwhile or don't hold a state are skipped, and so are
+// legacy names shadowed by a current one.
+func (b *Backend) fetch(ctx context.Context, client redis.UniversalClient, redisKeys []string, filter core.Filter) ([]core.Entry, error) {
+	var keys []string
+	var cmds []*redis.StringCmd
+	var shadows []*redis.IntCmd
+	pipe := client.Pipeline()
+	// The current name of a legacy key may be on another node
+	current := b.client.Pipeline()
+	for _, redisKey := range redisKeys {
+		key, legacy, ok := b.logicalKey(redisKey)
+		if !ok || !filter.Matches(key) {
+			continue
+		}
+		var shadow *redis.IntCmd
+		if legacy {
+			shadow = current.Exists(ctx, b.makeKey(key))
+		}
+		keys = append(keys, key)
+		cmds = append(cmds, pipe.Get(ctx, redisKey))
+		shadows = append(shadows, shadow)
+	}
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get %d keys from Redis: %w", len(cmds), err)
+	}
+	if current.Len() > 0 {
+		if _, err := current.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to check %d legacy keys in Redis: %w", current.Len(), err)
+		}
+	}
+
+	entries := make([]core.Entry, 0, len(cmds))
+	for i, cmd := range cmds {
+		if shadows[i] != nil && shadows[i].Val() > 0 {
+			continue
+		}
+		data, err := cmd.Bytes()
+		if err != nil {
+			continue
+		}
+		state, err := b.codec.Decode(data)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, core.Entry{Key: keys[i], State: state})
+	}
+	return entries, nil
+}
+
+// nodes returns the clients Scan walks: the masters of a Cluster or the
+// shards of a Ring ordered by address, or the backend's own client
+func (b *Backend) nodes(ctx context.Context) ([]redis.UniversalClient, error) {
+	var mu sync.Mutex
+	var nodes []*redis.Client
+	collect := func(ctx context.Context, node *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes = append(nodes, node)
+		return nil
+	}
+
+	var err error
+	switch client := b.client.(type) {
+	case *redis.ClusterClient:
+		err = client.ForEachMaster(ctx, collect)
+	case *redis.Ring:
+		err = client.ForEachShard(ctx, collect)
+	default:
+		return []redis.UniversalClient{b.client}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Options().Addr < nodes[j].Options().Addr
+	})
+	clients := make([]redis.UniversalClient, len(nodes))
+	for i, node := range nodes {
+		clients[i] = node
+	}
+	return clients, nil
+}
+
+// filterPattern returns the SCAN pattern for the keys of this backend that
+// may pass filter. The pattern is applied by Redis; a prefix is escaped.
+// With fallback on, legacy names hold keys too, and one pattern can't match
+// both layouts, so every key of the backend is scanned and filtered here.
+func (b *Backend) filterPattern(filter core.Filter) string {
+	switch {
+	case b.fallback():
+		return escapeGlob(b.prefix) + ":*"
+	case filter.Pattern != "":
+		return b.keyGlob(filter.Pattern)
+	case filter.Prefix != "":
+		return b.keyGlob(escapeGlob(filter.Prefix) + "*")
+	default:
+		return b.keyPattern()
+	}
+}
+
+// keyGlob returns the SCAN pattern for the Redis keys of the logical keys
+// matching glob
+func (b *Backend) keyGlob(glob string) string {
+	if b.legacyKeys {
+		return escapeGlob(b.prefix) + ":" + glob
+	}
+	return escapeGlob(b.prefix) + ":{" + glob + "}"
+}
+
+// logicalKey extracts the logical key from one of this backend's Redis keys
+// and reports whether the key was under its legacy name
+func (b *Backend) logicalKey(redisKey string) (key string, legacy, ok bool) {
+	name, ok := strings.CutPrefix(redisKey, b.prefix+":")
+	switch {
+	case !ok:
+		return "", false, false
+	case b.legacyKeys:
+		return name, false, true
+	case hashTagged(name):
+		if !strings.HasSuffix(name, "}") {
+			return "", false, false
+		}
+		return name[1 : len(name)-1], false, true
+	case b.fallback():
+		return name, true, true
+	default:
+		return "", false, false
+	}
+}
+
+// parseCursor splits a Scan cursor into a node index and a SCAN cursor
+func parseCursor(cursor string) (int, uint64, error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+
+	node, pos, found := strings.Cut(cursor, ":")
+	n, err := strconv.Atoi(node)
+	if !found || err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("invalid scan cursor %q", cursor)
+	}
+	p, err := strconv.ParseUint(pos, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid scan cursor %q", cursor)
+	}
+	return n, p, nil
+}
+
+// keyPattern returns the SCAN pattern matching every key of this backend
+func (b *Backend) keyPattern() string {
+	if b.legacyKeys {
+		return escapeGlob(b.prefix) + ":*"
+	}
+	return escapeGlob(b.prefix) + ":{*"
+}
+
+// escapeGlob escapes the characters Redis treats specially in MATCH patterns
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,318 @@
+package sql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// maxUpdateAttempts bounds the retries Update makes when two writers race to
+// create the same row
+const maxUpdateAttempts = 3
+
+// maxKeyLength is the longest key stored verbatim, in bytes; the key_name
+// column holds up to 255 characters (bytes on MySQL)
+const maxKeyLength = 255
+
+// defaultScanCount is the number of rows Scan reads per page by default
+const defaultScanCount = 500
+
+// Options configures the SQL backend
+type Options struct {
+	Dialect Dialect       // SQL flavour of the database (default Postgres)
+	Table   string        // Table holding the state rows (default "throttle_state")
+	TTL     time.Duration // Rows not updated for this long are expired (0 keeps them forever)
+}
+
+// Backend implements the core.Backend interface on top of database/sql
+type Backend struct {
+	db      *sql.DB
+	opts    Options
+	queries queries
+	now     func() time.Time
+}
+
+// NewBackend creates a new SQL backend using an already opened database.
+// Call Migrate (or apply Schema with your own tooling) before first use.
+func NewBackend(db *sql.DB, opts Options) (*Backend, error) {
+	if opts.Table == "" {
+		opts.Table = "throttle_state"
+	}
+	if !validTable(opts.Table) {
+		return nil, fmt.Errorf("invalid table name %q", opts.Table)
+	}
+
+	return &Backend{
+		db:      db,
+		opts:    opts,
+		queries: buildQueries(opts.Dialect, opts.Table),
+		now:     time.Now,
+	}, nil
+}
+
+// Schema returns the DDL statements that create the backend's table and
+// indexes, for use with external migration tools
+func (b *Backend) Schema() []string {
+	schema := make([]string, len(b.queries.schema))
+	copy(schema, b.queries.schema)
+	return schema
+}
+
+// Migrate creates the table and indexes if they don't already exist
+func (b *Backend) Migrate(ctx context.Context) error {
+	for _, stmt := range b.queries.schema {
+		if _, err := b.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to migrate table %s: %w", b.opts.Table, err)
+		}
+	}
+	return nil
+}
+
+// Get retrieves the current state for a key
+func (b *Backend) Get(ctx context.Context, key string) (*core.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	state, _, err := b.scan(b.db.QueryRowContext(ctx, b.queries.get, storedKey(key)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key %s: %w", key, err)
+	}
+	return state, nil
+}
+
+// Set stores the state for a key
+func (b *Backend) Set(ctx context.Context, key string, state *core.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := b.db.ExecContext(ctx, b.queries.upsert, b.args(key, state)...); err != nil {
+		return fmt.Errorf("failed to set key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Update atomically applies fn to the state for a key. The row is locked
+// with SELECT ... FOR UPDATE for the duration of a transaction so concurrent
+// limiters sharing the database can't lose each other's writes.
+func (b *Backend) Update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var retry bool
+		retry, err = b.update(ctx, key, fn)
+		if !retry {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update key %s: %w", key, err)
+	}
+	return nil
+}
+
+// update runs a single Update transaction. It reports retry when inserting
+// a new row failed because another writer created it first.
+func (b *Backend) update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) (bool, error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	state, exists, err := b.scan(tx.QueryRowContext(ctx, b.queries.getForLock, storedKey(key)))
+	if err != nil {
+		return false, err
+	}
+
+	state, err = fn(state)
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		_, err = tx.ExecContext(ctx, b.queries.upsert, b.args(key, state)...)
+	} else {
+		// Nothing to lock yet, so a plain insert detects a racing creator
+		if _, err := tx.ExecContext(ctx, b.queries.insert, b.args(key, state)...); err != nil {
+			tx.Rollback()
+			return b.raced(ctx, key), err
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return false, tx.Commit()
+}
+
+// raced reports whether inserting key failed because another writer created
+// the row first, the one failure retrying fixes. Drivers report duplicate
+// keys differently, so it checks whether the row exists now.
+func (b *Backend) raced(ctx context.Context, key string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	_, exists, err := b.scan(b.db.QueryRowContext(ctx, b.queries.get, storedKey(key)))
+	return err == nil && exists
+}
+
+// Delete removes the state for a key
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := b.db.ExecContext(ctx, b.queries.delete, storedKey(key)); err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Scan returns a page of the live keys after cursor in key order. The
+// prefix is matched by the database and the pattern in Go, so Count rows
+// are read per page but fewer may be returned. Keys longer than 255 bytes
+// are listed as stored, by their hash.
+func (b *Backend) Scan(ctx context.Context, filter core.Filter, cursor string) ([]core.Entry, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	count := filter.Count
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	rows, err := b.db.QueryContext(ctx, b.queries.scan, cursor, likePrefix(filter.Prefix), count)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to scan %s: %w", b.opts.Table, err)
+	}
+	defer rows.Close()
+
+	now := b.now().UnixNano()
+	var entries []core.Entry
+	var last string
+	read := 0
+	for rows.Next() {
+		var key string
+		var tokens float64
+		var lastUpdate, created, expiresAt int64
+		if err := rows.Scan(&key, &tokens, &lastUpdate, &created, &expiresAt); err != nil {
+			return nil, "", fmt.Errorf("failed to scan %s: %w", b.opts.Table, err)
+		}
+		last = key
+		read++
+
+		if (expiresAt > 0 && expiresAt <= now) || !filter.Matches(key) {
+			continue
+		}
+		entries = append(entries, core.Entry{
+			Key: key,
+			State: &core.State{
+				Tokens:     tokens,
+				LastUpdate: time.Unix(0, lastUpdate),
+				Created:    time.Unix(0, created),
+			},
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to scan %s: %w", b.opts.Table, err)
+	}
+
+	// A short page is the last one
+	if read < count {
+		last = ""
+	}
+	return entries, last, nil
+}
+
+// DeleteExpired removes rows whose TTL has passed and returns how many were
+// deleted. Expired rows are already invisible to Get; this reclaims space.
+func (b *Backend) DeleteExpired(ctx context.Context) (int64, error) {
+	result, err := b.db.ExecContext(ctx, b.queries.cleanup, b.now().UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired rows from %s: %w", b.opts.Table, err)
+	}
+	return result.RowsAffected()
+}
+
+// Close is a no-op; the caller owns the *sql.DB and closes it
+func (b *Backend) Close() error {
+	return nil
+}
+
+// Ping checks that the database answers
+func (b *Backend) Ping(ctx context.Context) error {
+	if err := b.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+	return nil
+}
+
+// Stats returns database connection pool statistics
+func (b *Backend) Stats() map[string]interface{} {
+	stats := b.db.Stats()
+	return map[string]interface{}{
+		"total_connections": stats.OpenConnections,
+		"idle_connections":  stats.Idle,
+		"in_use":            stats.InUse,
+		"wait_count":        stats.WaitCount,
+	}
+}
+
+// scan reads a state row. A missing or expired row yields a nil state;
+// exists reports whether a row was present at all.
+func (b *Backend) scan(row *sql.Row) (*core.State, bool, error) {
+	var tokens float64
+	var lastUpdate, created, expiresAt int64
+
+	err := row.Scan(&tokens, &lastUpdate, &created, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if expiresAt > 0 && expiresAt <= b.now().UnixNano() {
+		return nil, true, nil
+	}
+
+	return &core.State{
+		Tokens:     tokens,
+		LastUpdate: time.Unix(0, lastUpdate),
+		Created:    time.Unix(0, created),
+	}, true, nil
+}
+
+// args returns the column values for an insert or upsert, in column order
+func (b *Backend) args(key string, state *core.State) []interface{} {
+	var expiresAt int64
+	if b.opts.TTL > 0 {
+		expiresAt = state.LastUpdate.Add(b.opts.TTL).UnixNano()
+	}
+
+	return []interface{}{
+		storedKey(key),
+		state.Tokens,
+		state.LastUpdate.UnixNano(),
+		state.Created.UnixNano(),
+		expiresAt,
+	}
+}
+
+// storedKey returns the key_name of key: the key itself, or "sha256:" and
+// its hex SHA-256 when it is too long for the column
+func storedKey(key string) string {
+	if len(key) <= maxKeyLength {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
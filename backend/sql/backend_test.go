@@ -0,0 +1,282 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/backendtest"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// newTestBackend returns a migrated backend on a fresh fake database
+func newTestBackend(t *testing.T, opts Options) (*Backend, *fakeDB) {
+	db, fdb := openFakeDB(t.Name())
+	t.Cleanup(func() { db.Close() })
+
+	backend, err := NewBackend(db, opts)
+	require.NoError(t, err)
+	require.NoError(t, backend.Migrate(context.Background()))
+	return backend, fdb
+}
+
+func TestBackend_Conformance(t *testing.T) {
+	factory := func(t *testing.T) core.Backend {
+		backend, _ := newTestBackend(t, Options{TTL: time.Minute})
+		return backend
+	}
+	advance := func(backend core.Backend, d time.Duration) {
+		b := backend.(*Backend)
+		now := b.now().Add(d)
+		b.now = func() time.Time { return now }
+	}
+
+	backendtest.RunConformance(t, factory, backendtest.WithExpiry(time.Minute, advance))
+}
+
+func TestNewBackend_InvalidTable(t *testing.T) {
+	db, _ := openFakeDB(t.Name())
+	defer db.Close()
+
+	for _, table := range []string{"bad name", "x;DROP TABLE y", "1abc", "a..b"} {
+		_, err := NewBackend(db, Options{Table: table})
+		assert.Error(t, err, table)
+	}
+
+	backend, err := NewBackend(db, Options{Table: "limits.throttle_v2"})
+	assert.NoError(t, err)
+	assert.Contains(t, backend.Schema()[0], "limits.throttle_v2")
+}
+
+func TestBackend_Schema(t *testing.T) {
+	_, fdb := newTestBackend(t, Options{Table: "rate_limits"})
+	require.Len(t, fdb.ddl, 2)
+	assert.Contains(t, fdb.ddl[0], "CREATE TABLE IF NOT EXISTS rate_limits")
+	assert.Contains(t, fdb.ddl[1], "rate_limits_expires_at_idx")
+
+	db, _ := openFakeDB(t.Name() + "-mysql")
+	defer db.Close()
+	backend, err := NewBackend(db, Options{Dialect: MySQL})
+	require.NoError(t, err)
+	require.Len(t, backend.Schema(), 1)
+	assert.Contains(t, backend.Schema()[0], "INDEX throttle_state_expires_at_idx")
+	assert.Contains(t, backend.Schema()[0], "key_name VARBINARY(255)")
+}
+
+func TestBuildQueries_Dialects(t *testing.T) {
+	pg := buildQueries(Postgres, "t")
+	assert.Contains(t, pg.get, "key_name = $1")
+	assert.Contains(t, pg.getForLock, "FOR UPDATE")
+	assert.Contains(t, pg.upsert, "ON CONFLICT (key_name)")
+
+	my := buildQueries(MySQL, "t")
+	assert.Contains(t, my.get, "key_name = ?")
+	assert.Contains(t, my.upsert, "ON DUPLICATE KEY UPDATE")
+
+	lite := buildQueries(SQLite, "t")
+	assert.NotContains(t, lite.getForLock, "FOR UPDATE")
+	assert.Contains(t, lite.schema[0], "REAL")
+}
+
+func TestBackend_GetSet(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	now := time.Now()
+	state := &core.State{
+		Tokens:     5.5,
+		LastUpdate: now,
+		Created:    now.Add(-time.Minute),
+	}
+
+	err := backend.Set(ctx, "test-key", state)
+	assert.NoError(t, err)
+
+	retrieved, err := backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+	assert.Equal(t, state.Tokens, retrieved.Tokens)
+	assert.True(t, state.LastUpdate.Equal(retrieved.LastUpdate))
+	assert.True(t, state.Created.Equal(retrieved.Created))
+}
+
+func TestBackend_LongKeys(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	long := strings.Repeat("k", 300)
+	longer := long + "x"
+	require.NoError(t, backend.Set(ctx, long, &core.State{Tokens: 1, LastUpdate: time.Now(), Created: time.Now()}))
+	require.NoError(t, backend.Set(ctx, longer, &core.State{Tokens: 2, LastUpdate: time.Now(), Created: time.Now()}))
+
+	state, err := backend.Get(ctx, long)
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 1.0, state.Tokens)
+
+	assert.Len(t, storedKey(long), len("sha256:")+64)
+	assert.NotEqual(t, storedKey(long), storedKey(longer))
+	assert.Equal(t, "short", storedKey("short"))
+
+	require.NoError(t, backend.Delete(ctx, long))
+	state, err = backend.Get(ctx, long)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestBackend_GetNonExistent(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	retrieved, err := backend.Get(ctx, "non-existent")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func TestBackend_Delete(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	state := &core.State{Tokens: 10, LastUpdate: time.Now(), Created: time.Now()}
+	assert.NoError(t, backend.Set(ctx, "test-key", state))
+
+	assert.NoError(t, backend.Delete(ctx, "test-key"))
+
+	retrieved, err := backend.Get(ctx, "test-key")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func TestBackend_ExpiryAndCleanup(t *testing.T) {
+	backend, fdb := newTestBackend(t, Options{TTL: time.Minute})
+	ctx := context.Background()
+
+	now := time.Now()
+	clock := now
+	backend.now = func() time.Time { return clock }
+
+	assert.NoError(t, backend.Set(ctx, "old", &core.State{Tokens: 1, LastUpdate: now, Created: now}))
+	assert.NoError(t, backend.Set(ctx, "new", &core.State{Tokens: 1, LastUpdate: now.Add(time.Hour), Created: now}))
+
+	clock = now.Add(2 * time.Minute)
+	retrieved, err := backend.Get(ctx, "old")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+
+	deleted, err := backend.DeleteExpired(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Len(t, fdb.rows, 1)
+}
+
+func TestBackend_UpdateIsAtomic(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := backend.Update(ctx, "counter", func(state *core.State) (*core.State, error) {
+				if state == nil {
+					now := time.Now()
+					state = &core.State{LastUpdate: now, Created: now}
+				}
+				state.Tokens++
+				return state, nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	state, err := backend.Get(ctx, "counter")
+	require.NoError(t, err)
+	assert.Equal(t, float64(workers), state.Tokens)
+}
+
+func TestBackend_UpdateRollsBackOnError(t *testing.T) {
+	backend, fdb := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	now := time.Now()
+	assert.NoError(t, backend.Set(ctx, "key", &core.State{Tokens: 3, LastUpdate: now, Created: now}))
+
+	fdb.failOn = "INSERT"
+	err := backend.Update(ctx, "key", func(state *core.State) (*core.State, error) {
+		state.Tokens = 0
+		return state, nil
+	})
+	assert.Error(t, err)
+	fdb.failOn = ""
+
+	state, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, state.Tokens)
+}
+
+func TestBackend_UpdateRetriesOnlyRacingInserts(t *testing.T) {
+	backend, fdb := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	create := func(state *core.State) (*core.State, error) {
+		now := time.Now()
+		return &core.State{Tokens: 1, LastUpdate: now, Created: now}, nil
+	}
+
+	// An insert failing for another reason than a racing creator isn't
+	// retried; TestBackend_UpdateIsAtomic covers racing creators
+	fdb.failOn = "INSERT"
+	assert.ErrorContains(t, backend.Update(ctx, "key", create), "injected failure")
+	assert.Equal(t, 1, fdb.failed)
+}
+
+func TestBackend_WithLimiter(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	config := core.Config{Limit: 5, Interval: time.Hour, Burst: 5}
+	limiter := core.NewLimiter(backend, tokenbucket.NewStrategy(config), config, nil)
+	ctx := context.Background()
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		decision, err := limiter.Grant(ctx, "user")
+		require.NoError(t, err)
+		if decision.Allowed {
+			allowed++
+		}
+	}
+	assert.Equal(t, 5, allowed)
+}
+
+func TestBackend_Concurrency(t *testing.T) {
+	backend, _ := newTestBackend(t, Options{})
+	ctx := context.Background()
+
+	done := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		go func(id int) {
+			key := fmt.Sprintf("key-%d", id)
+			state := &core.State{Tokens: float64(id), LastUpdate: time.Now(), Created: time.Now()}
+
+			assert.NoError(t, backend.Set(ctx, key, state))
+
+			retrieved, err := backend.Get(ctx, key)
+			assert.NoError(t, err)
+			assert.NotNil(t, retrieved)
+
+			done <- true
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,144 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect selects the SQL flavour used for placeholders, upserts and DDL
+type Dialect int
+
+const (
+	// Postgres targets PostgreSQL (and CockroachDB)
+	Postgres Dialect = iota
+	// MySQL targets MySQL and MariaDB
+	MySQL
+	// SQLite targets SQLite 3.24 or newer
+	SQLite
+)
+
+// String returns the dialect name
+func (d Dialect) String() string {
+	switch d {
+	case Postgres:
+		return "postgres"
+	case MySQL:
+		return "mysql"
+	case SQLite:
+		return "sqlite"
+	default:
+		return fmt.Sprintf("dialect(%d)", int(d))
+	}
+}
+
+// queries holds the statements a backend issues, rendered once for its
+// dialect and table
+type queries struct {
+	get        string
+	getForLock string
+	insert     string
+	upsert     string
+	delete     string
+	cleanup    string
+	scan       string
+	schema     []string
+}
+
+// buildQueries renders every statement for the given dialect and table
+func buildQueries(d Dialect, table string) queries {
+	p := func(n int) string {
+		if d == Postgres {
+			return fmt.Sprintf("$%d", n)
+		}
+		return "?"
+	}
+
+	columns := "key_name, tokens, last_update, created, expires_at"
+	values := strings.Join([]string{p(1), p(2), p(3), p(4), p(5)}, ", ")
+	selectRow := fmt.Sprintf("SELECT tokens, last_update, created, expires_at FROM %s WHERE key_name = %s", table, p(1))
+
+	q := queries{
+		get:     selectRow,
+		insert:  fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, columns, values),
+		delete:  fmt.Sprintf("DELETE FROM %s WHERE key_name = %s", table, p(1)),
+		cleanup: fmt.Sprintf("DELETE FROM %s WHERE expires_at > 0 AND expires_at <= %s", table, p(1)),
+		scan: fmt.Sprintf("SELECT %s FROM %s WHERE key_name > %s AND key_name LIKE %s ESCAPE '!' ORDER BY key_name LIMIT %s",
+			columns, table, p(1), p(2), p(3)),
+	}
+
+	// SQLite serialises writers on its own and has no row locks
+	q.getForLock = selectRow
+	if d != SQLite {
+		q.getForLock = selectRow + " FOR UPDATE"
+	}
+
+	switch d {
+	case MySQL:
+		q.upsert = q.insert + " ON DUPLICATE KEY UPDATE tokens = VALUES(tokens), last_update = VALUES(last_update), " +
+			"created = VALUES(created), expires_at = VALUES(expires_at)"
+		// VARBINARY compares bytes: the default collation would fold case
+		// and accents, so User1 and user1 would share a bucket
+		q.schema = []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n"+
+				"\tkey_name VARBINARY(255) NOT NULL PRIMARY KEY,\n"+
+				"\ttokens DOUBLE NOT NULL,\n"+
+				"\tlast_update BIGINT NOT NULL,\n"+
+				"\tcreated BIGINT NOT NULL,\n"+
+				"\texpires_at BIGINT NOT NULL DEFAULT 0,\n"+
+				"\tINDEX %s (expires_at)\n"+
+				")", table, indexName(table)),
+		}
+	default:
+		floatType := "DOUBLE PRECISION"
+		if d == SQLite {
+			floatType = "REAL"
+		}
+		q.upsert = q.insert + " ON CONFLICT (key_name) DO UPDATE SET tokens = excluded.tokens, " +
+			"last_update = excluded.last_update, created = excluded.created, expires_at = excluded.expires_at"
+		q.schema = []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n"+
+				"\tkey_name VARCHAR(255) NOT NULL PRIMARY KEY,\n"+
+				"\ttokens %s NOT NULL,\n"+
+				"\tlast_update BIGINT NOT NULL,\n"+
+				"\tcreated BIGINT NOT NULL,\n"+
+				"\texpires_at BIGINT NOT NULL DEFAULT 0\n"+
+				")", table, floatType),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (expires_at)", indexName(table), table),
+		}
+	}
+
+	return q
+}
+
+// likePrefix returns a LIKE pattern matching keys that start with prefix,
+// escaping wildcards with '!'
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return r.Replace(prefix) + "%"
+}
+
+// indexName derives the expiry index name from a possibly schema-qualified table
+func indexName(table string) string {
+	return strings.ReplaceAll(table, ".", "_") + "_expires_at_idx"
+}
+
+// validTable reports whether name is safe to interpolate as a table name
+func validTable(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return false
+		}
+		for i, r := range part {
+			switch {
+			case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			case r >= '0' && r <= '9' && i > 0:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,237 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeDriver is an in-process database/sql driver that understands exactly
+// the statements the backend issues. Each DSN names a separate database.
+// Transactions take an exclusive lock, which is enough to model row locks.
+type fakeDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeDB
+}
+
+var driverInstance = &fakeDriver{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("throttlefake", driverInstance)
+}
+
+type fakeRow struct {
+	tokens     float64
+	lastUpdate int64
+	created    int64
+	expiresAt  int64
+}
+
+type fakeDB struct {
+	txMu   sync.Mutex
+	mu     sync.Mutex
+	rows   map[string]fakeRow
+	ddl    []string
+	failOn string
+	failed int // Statements failed because of failOn
+}
+
+// openFakeDB returns a fresh database and a handle to inspect it
+func openFakeDB(name string) (*sql.DB, *fakeDB) {
+	driverInstance.mu.Lock()
+	fdb := &fakeDB{rows: make(map[string]fakeRow)}
+	driverInstance.dbs[name] = fdb
+	driverInstance.mu.Unlock()
+
+	db, _ := sql.Open("throttlefake", name)
+	return db, fdb
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fdb, ok := d.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake database %q", name)
+	}
+	return &fakeConn{db: fdb}, nil
+}
+
+type fakeConn struct {
+	db       *fakeDB
+	snapshot map[string]fakeRow
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.db.txMu.Lock()
+
+	c.db.mu.Lock()
+	c.snapshot = make(map[string]fakeRow, len(c.db.rows))
+	for k, v := range c.db.rows {
+		c.snapshot[k] = v
+	}
+	c.db.mu.Unlock()
+
+	return &fakeTx{conn: c}, nil
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (t *fakeTx) Commit() error {
+	t.conn.snapshot = nil
+	t.conn.db.txMu.Unlock()
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.conn.db.mu.Lock()
+	t.conn.db.rows = t.conn.snapshot
+	t.conn.db.mu.Unlock()
+
+	t.conn.snapshot = nil
+	t.conn.db.txMu.Unlock()
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.failOn != "" && strings.HasPrefix(s.query, db.failOn) {
+		db.failed++
+		return nil, errors.New("injected failure")
+	}
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE"):
+		db.ddl = append(db.ddl, s.query)
+		return driver.RowsAffected(0), nil
+
+	case strings.HasPrefix(s.query, "INSERT"):
+		key := args[0].(string)
+		upsert := strings.Contains(s.query, "ON CONFLICT") || strings.Contains(s.query, "ON DUPLICATE KEY")
+		if _, exists := db.rows[key]; exists && !upsert {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+		db.rows[key] = fakeRow{
+			tokens:     args[1].(float64),
+			lastUpdate: args[2].(int64),
+			created:    args[3].(int64),
+			expiresAt:  args[4].(int64),
+		}
+		return driver.RowsAffected(1), nil
+
+	case strings.HasPrefix(s.query, "DELETE") && strings.Contains(s.query, "expires_at"):
+		now := args[0].(int64)
+		var n int64
+		for k, row := range db.rows {
+			if row.expiresAt > 0 && row.expiresAt <= now {
+				delete(db.rows, k)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+
+	case strings.HasPrefix(s.query, "DELETE"):
+		key := args[0].(string)
+		if _, exists := db.rows[key]; !exists {
+			return driver.RowsAffected(0), nil
+		}
+		delete(db.rows, key)
+		return driver.RowsAffected(1), nil
+	}
+
+	return nil, fmt.Errorf("fake driver can't exec %q", s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !strings.HasPrefix(s.query, "SELECT") {
+		return nil, fmt.Errorf("fake driver can't query %q", s.query)
+	}
+
+	if strings.Contains(s.query, "ORDER BY key_name") {
+		return db.scan(args[0].(string), args[1].(string), int(args[2].(int64))), nil
+	}
+
+	rows := &fakeRows{columns: []string{"tokens", "last_update", "created", "expires_at"}}
+	if row, exists := db.rows[args[0].(string)]; exists {
+		rows.values = [][]driver.Value{{row.tokens, row.lastUpdate, row.created, row.expiresAt}}
+	}
+	return rows, nil
+}
+
+// scan returns up to limit rows after cursor in key order whose key starts
+// with the literal prefix of a LIKE pattern ending in '%'
+func (db *fakeDB) scan(cursor, like string, limit int) *fakeRows {
+	prefix := strings.NewReplacer("!!", "!", "!%", "%", "!_", "_").Replace(strings.TrimSuffix(like, "%"))
+
+	var keys []string
+	for key := range db.rows {
+		if key > cursor && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	rows := &fakeRows{columns: []string{"key_name", "tokens", "last_update", "created", "expires_at"}}
+	for _, key := range keys {
+		row := db.rows[key]
+		rows.values = append(rows.values, []driver.Value{key, row.tokens, row.lastUpdate, row.created, row.expiresAt})
+	}
+	return rows
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
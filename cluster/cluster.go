@@ -0,0 +1,416 @@
+// Package cluster spreads rate limiting over a group of peers without shared
+// storage. Every key is owned by one peer, chosen by rendezvous hashing over
+// the healthy members; other peers forward Grant, Preview and Clear for the
+// key to its owner over HTTP/JSON. Each peer serves its share of the keys
+// from an ordinary local limiter and exposes it to the others with Handler.
+//
+// When an owner can't be reached it is taken out of the hash for a cooldown
+// period, so its keys move to the remaining peers (starting from a fresh
+// state there). If no owner answers within MaxAttempts, the request is
+// either decided by the local limiter or fails, depending on LocalFallback.
+// A Grant is only sent to another owner when the first can't have counted
+// it: the connection failed or the owner's local limiter returned an error.
+// One that timed out, lost its answer or got a 5xx from a proxy fails
+// instead, so it isn't charged twice.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-rendezvous"
+	"github.com/throttle/core"
+)
+
+// ErrNoPeers is returned when a peer list doesn't contain any peer
+var ErrNoPeers = errors.New("cluster: no peers configured")
+
+// Options configures a cluster Limiter
+type Options struct {
+	// Self is this peer's address exactly as it appears in the peer list
+	Self string
+
+	// Peers are the base URLs the peers serve Handler under, e.g.
+	// "http://10.0.0.1:8080/throttle". Self is added if missing.
+	Peers []string
+
+	// PeersFile, if set, is read for the peer list instead of Peers: one
+	// URL per line, blank lines and lines starting with # are ignored. It is
+	// re-read every ReloadInterval (default 10s) when it changes.
+	PeersFile      string
+	ReloadInterval time.Duration
+
+	// Client sends forwarded requests (default: 1s timeout)
+	Client *http.Client
+
+	// MaxAttempts is how many owners are tried before giving up (default 2)
+	MaxAttempts int
+
+	// Cooldown is how long an unreachable peer is left out of the hash
+	// (default 5s)
+	Cooldown time.Duration
+
+	// LocalFallback decides requests with the local limiter when no owner
+	// could be reached, instead of returning an error
+	LocalFallback bool
+
+	// Observer, if set, receives a core.OpReload event with PeersFile as
+	// its key every time the peer list is reloaded
+	Observer core.Observer
+}
+
+// Limiter implements core.RateLimiter by routing each key to its owner
+type Limiter struct {
+	local  core.RateLimiter
+	opts   Options
+	client *http.Client
+	now    func() time.Time
+
+	mu         sync.RWMutex
+	peers      []string
+	down       map[string]time.Time
+	nextRevive time.Time
+	ring       *rendezvous.Rendezvous
+	fileStamp  time.Time
+
+	forwarded atomic.Int64
+	served    atomic.Int64
+	failures  atomic.Int64
+	fallbacks atomic.Int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewLimiter creates a cluster limiter deciding owned keys with local
+func NewLimiter(local core.RateLimiter, opts Options) (*Limiter, error) {
+	if opts.Self == "" {
+		return nil, fmt.Errorf("cluster: Self must be set")
+	}
+	opts.Self = strings.TrimRight(opts.Self, "/")
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = 10 * time.Second
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 2
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 5 * time.Second
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Second}
+	}
+
+	l := &Limiter{
+		local:  local,
+		opts:   opts,
+		client: client,
+		now:    time.Now,
+		down:   make(map[string]time.Time),
+		done:   make(chan struct{}),
+	}
+
+	if opts.PeersFile != "" {
+		if err := l.Reload(); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(opts.PeersFile); err == nil {
+			l.fileStamp = info.ModTime()
+		}
+		l.wg.Add(1)
+		go l.reloadLoop()
+	} else {
+		l.setPeers(opts.Peers)
+	}
+
+	return l, nil
+}
+
+// Grant determines whether a request should be allowed now, on the owner
+// of the key
+func (l *Limiter) Grant(ctx context.Context, key string) (core.Decision, error) {
+	return l.route(ctx, opGrant, key, l.local.Grant)
+}
+
+// Preview returns the current usage state from the owner of the key
+func (l *Limiter) Preview(ctx context.Context, key string) (core.Decision, error) {
+	return l.route(ctx, opPreview, key, l.local.Preview)
+}
+
+// Clear resets the key on its owner
+func (l *Limiter) Clear(ctx context.Context, key string) error {
+	_, err := l.route(ctx, opClear, key, func(ctx context.Context, key string) (core.Decision, error) {
+		return core.Decision{}, l.local.Clear(ctx, key)
+	})
+	return err
+}
+
+// Owner returns the peer currently responsible for key
+func (l *Limiter) Owner(key string) string {
+	l.revive()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.ring.Lookup(key)
+}
+
+// Peers returns the configured peers and whether each is considered healthy
+func (l *Limiter) Peers() map[string]bool {
+	l.revive()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	peers := make(map[string]bool, len(l.peers))
+	for _, peer := range l.peers {
+		_, down := l.down[peer]
+		peers[peer] = !down
+	}
+	return peers
+}
+
+// Stats returns routing counters and membership
+func (l *Limiter) Stats() map[string]interface{} {
+	peers := l.Peers()
+	healthy := 0
+	for _, ok := range peers {
+		if ok {
+			healthy++
+		}
+	}
+
+	return map[string]interface{}{
+		"peers":         len(peers),
+		"healthy_peers": healthy,
+		"forwarded":     l.forwarded.Load(),
+		"served":        l.served.Load(),
+		"peer_failures": l.failures.Load(),
+		"fallbacks":     l.fallbacks.Load(),
+	}
+}
+
+// Health checks the local limiter if it is a core.HealthChecker. The stats
+// are the cluster's, with the local backend's under "backend".
+func (l *Limiter) Health(ctx context.Context) core.Health {
+	health := core.Health{Healthy: true}
+	if checker, ok := l.local.(core.HealthChecker); ok {
+		health = checker.Health(ctx)
+	}
+
+	stats := l.Stats()
+	if health.Stats != nil {
+		stats["backend"] = health.Stats
+	}
+	health.Stats = stats
+	return health
+}
+
+// Reload re-reads the peer list from PeersFile
+func (l *Limiter) Reload() (err error) {
+	if l.opts.Observer != nil {
+		start := l.now()
+		defer func() {
+			l.opts.Observer.Observe(context.Background(), core.Event{
+				Operation: core.OpReload,
+				Key:       l.opts.PeersFile,
+				Err:       err,
+				Time:      start,
+				Duration:  l.now().Sub(start),
+			})
+		}()
+	}
+
+	peers, err := readPeersFile(l.opts.PeersFile)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return fmt.Errorf("failed to load %s: %w", l.opts.PeersFile, ErrNoPeers)
+	}
+	l.setPeers(peers)
+	return nil
+}
+
+// Close stops watching the peer file. The local limiter is left alone.
+func (l *Limiter) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	l.wg.Wait()
+	return nil
+}
+
+// route runs op on the owner of key, rehashing when the owner is down
+func (l *Limiter) route(ctx context.Context, op, key string, local func(ctx context.Context, key string) (core.Decision, error)) (core.Decision, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < l.opts.MaxAttempts; attempt++ {
+		owner := l.Owner(key)
+		if owner == l.opts.Self {
+			l.served.Add(1)
+			return local(ctx, key)
+		}
+
+		decision, err := l.forward(ctx, owner, op, key)
+		if err == nil {
+			l.forwarded.Add(1)
+			return decision, nil
+		}
+		if ctx.Err() != nil {
+			return core.Decision{}, ctx.Err()
+		}
+
+		var status *statusError
+		if errors.As(err, &status) && status.code < http.StatusInternalServerError {
+			// The peer is up but rejected the request; another one won't do better
+			return core.Decision{}, err
+		}
+
+		l.failures.Add(1)
+		l.markDown(owner)
+		lastErr = err
+
+		if op == opGrant && !undelivered(err) {
+			// The owner may have counted the request before failing to
+			// answer; deciding it anywhere else would charge it twice
+			return core.Decision{}, fmt.Errorf("failed to get an answer from the owner of key %s: %w", key, err)
+		}
+	}
+
+	if l.opts.LocalFallback {
+		l.fallbacks.Add(1)
+		return local(core.WithFallback(ctx), key)
+	}
+	return core.Decision{}, fmt.Errorf("failed to reach the owner of key %s: %w", key, lastErr)
+}
+
+// setPeers replaces the membership, keeping the health of known peers
+func (l *Limiter) setPeers(peers []string) {
+	seen := make(map[string]bool, len(peers)+1)
+	members := make([]string, 0, len(peers)+1)
+	for _, peer := range append(peers[:len(peers):len(peers)], l.opts.Self) {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer != "" && !seen[peer] {
+			seen[peer] = true
+			members = append(members, peer)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.peers = members
+	for peer := range l.down {
+		if !seen[peer] {
+			delete(l.down, peer)
+		}
+	}
+	l.rebuild()
+}
+
+// markDown takes peer out of the hash for the cooldown period
+func (l *Limiter) markDown(peer string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until := l.now().Add(l.opts.Cooldown)
+	l.down[peer] = until
+	if l.nextRevive.IsZero() || until.Before(l.nextRevive) {
+		l.nextRevive = until
+	}
+	l.rebuild()
+}
+
+// revive puts peers whose cooldown has passed back into the hash
+func (l *Limiter) revive() {
+	now := l.now()
+
+	l.mu.RLock()
+	due := !l.nextRevive.IsZero() && !now.Before(l.nextRevive)
+	l.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.nextRevive = time.Time{}
+	for peer, until := range l.down {
+		if !now.Before(until) {
+			delete(l.down, peer)
+		} else if l.nextRevive.IsZero() || until.Before(l.nextRevive) {
+			l.nextRevive = until
+		}
+	}
+	l.rebuild()
+}
+
+// rebuild recomputes the hash over healthy peers; the caller holds mu
+func (l *Limiter) rebuild() {
+	healthy := make([]string, 0, len(l.peers))
+	for _, peer := range l.peers {
+		if _, down := l.down[peer]; !down || peer == l.opts.Self {
+			healthy = append(healthy, peer)
+		}
+	}
+	l.ring = rendezvous.New(healthy, xxhash.Sum64String)
+}
+
+// reloadLoop re-reads PeersFile whenever its modification time changes
+func (l *Limiter) reloadLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.opts.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(l.opts.PeersFile)
+			if err != nil {
+				continue
+			}
+
+			l.mu.RLock()
+			changed := !info.ModTime().Equal(l.fileStamp)
+			l.mu.RUnlock()
+
+			// Keep the last good list if the file is broken
+			if changed && l.Reload() == nil {
+				l.mu.Lock()
+				l.fileStamp = info.ModTime()
+				l.mu.Unlock()
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// readPeersFile parses a peer list file
+func readPeersFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peers file: %w", err)
+	}
+
+	var peers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	return peers, nil
+}
@@ -0,0 +1,382 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+var testConfig = core.Config{Limit: 5, Interval: time.Hour, Burst: 5}
+
+// node is one peer of a test cluster
+type node struct {
+	server  *httptest.Server
+	local   *core.Limiter
+	mu      sync.RWMutex
+	limiter *Limiter
+}
+
+func newLocalLimiter() *core.Limiter {
+	return core.NewLimiter(memory.NewBackend(), tokenbucket.NewStrategy(testConfig), testConfig, nil)
+}
+
+// startCluster starts n peers that know about each other
+func startCluster(t *testing.T, n int, opts Options) []*node {
+	nodes := make([]*node, n)
+	peers := make([]string, n)
+	for i := range nodes {
+		nd := &node{local: newLocalLimiter()}
+		nd.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nd.mu.RLock()
+			handler := nd.limiter.Handler()
+			nd.mu.RUnlock()
+			http.StripPrefix("/throttle", handler).ServeHTTP(w, r)
+		}))
+		t.Cleanup(nd.server.Close)
+
+		nodes[i] = nd
+		peers[i] = nd.server.URL + "/throttle"
+	}
+
+	for i, nd := range nodes {
+		nodeOpts := opts
+		nodeOpts.Self = peers[i]
+		nodeOpts.Peers = peers
+		limiter, err := NewLimiter(nd.local, nodeOpts)
+		require.NoError(t, err)
+		t.Cleanup(func() { limiter.Close() })
+
+		nd.mu.Lock()
+		nd.limiter = limiter
+		nd.mu.Unlock()
+	}
+	return nodes
+}
+
+// keyOwnedBy finds a key that the given peer owns
+func keyOwnedBy(t *testing.T, limiter *Limiter, owner string) string {
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if limiter.Owner(key) == owner {
+			return key
+		}
+	}
+	t.Fatalf("no key owned by %s", owner)
+	return ""
+}
+
+func TestLimiter_ForwardsToOwner(t *testing.T) {
+	nodes := startCluster(t, 3, Options{})
+	ctx := context.Background()
+
+	key := keyOwnedBy(t, nodes[0].limiter, nodes[2].limiter.opts.Self)
+
+	// All peers agree on the owner
+	for _, nd := range nodes {
+		assert.Equal(t, nodes[2].limiter.opts.Self, nd.limiter.Owner(key))
+	}
+
+	// The limit holds across peers because every Grant ends up on the owner
+	allowed := 0
+	for i := 0; i < 9; i++ {
+		decision, err := nodes[i%3].limiter.Grant(ctx, key)
+		require.NoError(t, err)
+		if decision.Allowed {
+			allowed++
+		}
+	}
+	assert.Equal(t, int(testConfig.Burst), allowed)
+
+	// Only the owner has state for the key
+	preview, err := nodes[2].local.Preview(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), preview.Remaining)
+	preview, err = nodes[0].local.Preview(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, testConfig.Burst, preview.Remaining)
+
+	// Denials carry RetryAfter across the wire
+	decision, err := nodes[0].limiter.Grant(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Greater(t, decision.RetryAfter, time.Duration(0))
+
+	// Preview and Clear are routed too
+	decision, err = nodes[1].limiter.Preview(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), decision.Remaining)
+
+	require.NoError(t, nodes[1].limiter.Clear(ctx, key))
+	decision, err = nodes[0].limiter.Grant(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	assert.Greater(t, nodes[0].limiter.Stats()["forwarded"], int64(0))
+}
+
+func TestLimiter_RehashesAroundFailedPeer(t *testing.T) {
+	nodes := startCluster(t, 3, Options{Cooldown: time.Minute})
+	ctx := context.Background()
+
+	dead := nodes[2].limiter.opts.Self
+	key := keyOwnedBy(t, nodes[0].limiter, dead)
+	nodes[2].server.Close()
+
+	// The first Grant finds the owner down and retries on the next one
+	decision, err := nodes[0].limiter.Grant(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	assert.False(t, nodes[0].limiter.Peers()[dead])
+	assert.NotEqual(t, dead, nodes[0].limiter.Owner(key))
+	assert.Equal(t, int64(1), nodes[0].limiter.Stats()["peer_failures"])
+
+	// Rendezvous hashing only moves the dead peer's keys
+	other := keyOwnedBy(t, nodes[1].limiter, nodes[1].limiter.opts.Self)
+	assert.Equal(t, nodes[1].limiter.opts.Self, nodes[0].limiter.Owner(other))
+
+	// The peer rejoins once its cooldown has passed
+	nodes[0].limiter.mu.Lock()
+	nodes[0].limiter.now = func() time.Time { return time.Now().Add(time.Hour) }
+	nodes[0].limiter.mu.Unlock()
+	assert.True(t, nodes[0].limiter.Peers()[dead])
+	assert.Equal(t, dead, nodes[0].limiter.Owner(key))
+}
+
+func TestLimiter_LocalFallback(t *testing.T) {
+	self := "http://self.invalid"
+	unreachable := []string{"http://127.0.0.1:1", "http://127.0.0.1:2"}
+	ctx := context.Background()
+
+	var fallbacks []bool
+	local := core.NewLimiterWithOptions(memory.NewBackend(), tokenbucket.NewStrategy(testConfig), testConfig, core.LimiterOptions{
+		Observers: []core.Observer{core.ObserverFunc(func(ctx context.Context, event core.Event) {
+			fallbacks = append(fallbacks, event.Fallback)
+		})},
+	})
+	limiter, err := NewLimiter(local, Options{
+		Self:        self,
+		Peers:       unreachable,
+		MaxAttempts: 1,
+	})
+	require.NoError(t, err)
+	defer limiter.Close()
+
+	key := keyOwnedBy(t, limiter, unreachable[0])
+
+	// Without fallback the failure is reported
+	_, err = limiter.Grant(ctx, key)
+	assert.Error(t, err)
+
+	limiter.opts.LocalFallback = true
+	key = keyOwnedBy(t, limiter, unreachable[1])
+	decision, err := limiter.Grant(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, int64(1), limiter.Stats()["fallbacks"])
+
+	// The local limiter's observers can tell fallback decisions apart
+	assert.Equal(t, []bool{true}, fallbacks)
+}
+
+func TestLimiter_PeerErrorsAreNotRetried(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusBadRequest, response{Error: "invalid request body"})
+	}))
+	defer server.Close()
+
+	limiter, err := NewLimiter(newLocalLimiter(), Options{Self: "http://self.invalid", Peers: []string{server.URL}})
+	require.NoError(t, err)
+	defer limiter.Close()
+
+	key := keyOwnedBy(t, limiter, server.URL)
+	_, err = limiter.Grant(context.Background(), key)
+	assert.ErrorContains(t, err, "invalid request body")
+	assert.True(t, limiter.Peers()[server.URL])
+}
+
+func TestLimiter_TimedOutGrantIsNotRetried(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	local := newLocalLimiter()
+	limiter, err := NewLimiter(local, Options{
+		Self:          "http://self.invalid",
+		Peers:         []string{slow.URL},
+		Client:        &http.Client{Timeout: 50 * time.Millisecond},
+		LocalFallback: true,
+	})
+	require.NoError(t, err)
+	defer limiter.Close()
+
+	// The slow owner may have counted the request, so neither another
+	// owner nor the fallback decides it again
+	key := keyOwnedBy(t, limiter, slow.URL)
+	_, err = limiter.Grant(context.Background(), key)
+	assert.ErrorContains(t, err, "failed to get an answer")
+	assert.False(t, limiter.Peers()[slow.URL])
+	assert.Equal(t, int64(0), limiter.Stats()["fallbacks"])
+
+	decision, err := local.Preview(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, testConfig.Burst, decision.Remaining)
+
+	// Its keys move to the remaining peers meanwhile
+	decision, err = limiter.Grant(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+}
+
+func TestLimiter_ProxyErrorIsNotRetried(t *testing.T) {
+	// A gateway error says nothing about whether the owner counted the grant
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+
+	local := newLocalLimiter()
+	limiter, err := NewLimiter(local, Options{Self: "http://self.invalid", Peers: []string{proxy.URL}, LocalFallback: true})
+	require.NoError(t, err)
+	defer limiter.Close()
+
+	key := keyOwnedBy(t, limiter, proxy.URL)
+	_, err = limiter.Grant(context.Background(), key)
+	assert.ErrorContains(t, err, "failed to get an answer")
+	assert.Equal(t, int64(0), limiter.Stats()["fallbacks"])
+
+	decision, err := local.Preview(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, testConfig.Burst, decision.Remaining)
+}
+
+func TestLimiter_FailedOwnerIsRetried(t *testing.T) {
+	// The owner's Handler reports that its local limiter failed, so nothing
+	// was counted and the next owner decides
+	var owner *Limiter
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner.serve(func(ctx context.Context, key string) (core.Decision, error) {
+			return core.Decision{}, fmt.Errorf("backend unavailable")
+		})(w, r)
+	}))
+	defer failing.Close()
+
+	limiter, err := NewLimiter(newLocalLimiter(), Options{Self: "http://self.invalid", Peers: []string{failing.URL}})
+	require.NoError(t, err)
+	defer limiter.Close()
+	owner = limiter
+
+	key := keyOwnedBy(t, limiter, failing.URL)
+	decision, err := limiter.Grant(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.False(t, limiter.Peers()[failing.URL])
+}
+
+func TestLimiter_ForwardsSubMillisecondRetryAfter(t *testing.T) {
+	var owner *Limiter
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner.serve(func(ctx context.Context, key string) (core.Decision, error) {
+			return core.Decision{RetryAfter: 300 * time.Microsecond}, nil
+		})(w, r)
+	}))
+	defer server.Close()
+
+	limiter, err := NewLimiter(newLocalLimiter(), Options{Self: "http://self.invalid", Peers: []string{server.URL}})
+	require.NoError(t, err)
+	defer limiter.Close()
+	owner = limiter
+
+	// A denial never arrives as one without a wait
+	decision, err := limiter.Grant(context.Background(), keyOwnedBy(t, limiter, server.URL))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Millisecond, decision.RetryAfter)
+}
+
+func TestLimiter_PeersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	write := func(peers ...string) {
+		require.NoError(t, os.WriteFile(path, []byte("# peers\n\n"+strings.Join(peers, "\n")+"\n"), 0o644))
+	}
+	write("http://a", "http://b")
+
+	var mu sync.Mutex
+	var reloads []core.Event
+	limiter, err := NewLimiter(newLocalLimiter(), Options{
+		Self:           "http://a",
+		PeersFile:      path,
+		ReloadInterval: 10 * time.Millisecond,
+		Observer: core.ObserverFunc(func(ctx context.Context, event core.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			reloads = append(reloads, event)
+		}),
+	})
+	require.NoError(t, err)
+	defer limiter.Close()
+
+	assert.Equal(t, map[string]bool{"http://a": true, "http://b": true}, limiter.Peers())
+
+	// Changes are picked up by the reload loop
+	write("http://a", "http://b", "http://c/")
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	assert.Eventually(t, func() bool { return len(limiter.Peers()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Contains(t, limiter.Peers(), "http://c")
+
+	// An empty list is rejected and the previous one kept
+	write()
+	assert.ErrorIs(t, limiter.Reload(), ErrNoPeers)
+	assert.Len(t, limiter.Peers(), 3)
+
+	// Every reload is reported, failed ones with their error
+	limiter.Close()
+	require.GreaterOrEqual(t, len(reloads), 3)
+	assert.Equal(t, core.OpReload, reloads[0].Operation)
+	assert.Equal(t, path, reloads[0].Key)
+	assert.NoError(t, reloads[0].Err)
+	assert.ErrorIs(t, reloads[len(reloads)-1].Err, ErrNoPeers)
+
+	_, err = NewLimiter(newLocalLimiter(), Options{Self: "http://a", PeersFile: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestHandler_RejectsBadRequests(t *testing.T) {
+	limiter, err := NewLimiter(newLocalLimiter(), Options{Self: "http://self"})
+	require.NoError(t, err)
+	defer limiter.Close()
+
+	recorder := httptest.NewRecorder()
+	limiter.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/grant", strings.NewReader("not json")))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	limiter.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/grant", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestLimiter_Health(t *testing.T) {
+	nodes := startCluster(t, 2, Options{})
+
+	health := nodes[0].limiter.Health(context.Background())
+	assert.True(t, health.Healthy)
+	assert.Equal(t, 2, health.Stats["peers"])
+	assert.Equal(t, map[string]interface{}{"keys_count": 0}, health.Stats["backend"])
+}
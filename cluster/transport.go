@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// Operations forwarded between peers, also the Handler paths
+const (
+	opGrant   = "grant"
+	opPreview = "preview"
+	opClear   = "clear"
+)
+
+// maxRequestBody bounds the size of a forwarded request
+const maxRequestBody = 64 << 10
+
+// request is the body of a forwarded operation
+type request struct {
+	Key string `json:"key"`
+}
+
+// response is a peer's answer to a forwarded operation
+type response struct {
+	Allowed      bool      `json:"allowed"`
+	Remaining    int64     `json:"remaining"`
+	ResetTime    time.Time `json:"reset_time"`
+	RetryAfterMs int64     `json:"retry_after_ms"`
+	Error        string    `json:"error,omitempty"`
+	Failed       bool      `json:"failed,omitempty"` // The local limiter returned Error, so nothing was counted
+}
+
+// statusError is a non-2xx answer from a peer, or from a proxy in front of it
+type statusError struct {
+	peer    string
+	code    int
+	message string
+	failed  bool // Set by the peer's Handler when its local limiter failed
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("peer %s answered %d: %s", e.peer, e.code, e.message)
+}
+
+// undelivered reports whether a forward failed without the peer deciding
+// anything: the connection couldn't be made, or the peer's local limiter
+// returned an error. A 5xx from a proxy or load balancer doesn't count, as
+// the peer may have decided before it was sent.
+func undelivered(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.failed
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// forward runs op for key on peer
+func (l *Limiter) forward(ctx context.Context, peer, op, key string) (core.Decision, error) {
+	body, err := json.Marshal(request{Key: key})
+	if err != nil {
+		return core.Decision{}, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/"+op, bytes.NewReader(body))
+	if err != nil {
+		return core.Decision{}, fmt.Errorf("failed to create request for peer %s: %w", peer, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return core.Decision{}, fmt.Errorf("failed to forward to peer %s: %w", peer, err)
+	}
+	defer resp.Body.Close()
+
+	var decoded response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRequestBody)).Decode(&decoded); err != nil && resp.StatusCode == http.StatusOK {
+		return core.Decision{}, fmt.Errorf("failed to decode response from peer %s: %w", peer, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return core.Decision{}, &statusError{peer: peer, code: resp.StatusCode, message: decoded.Error, failed: decoded.Failed}
+	}
+
+	return core.Decision{
+		Allowed:    decoded.Allowed,
+		Remaining:  decoded.Remaining,
+		ResetTime:  decoded.ResetTime,
+		RetryAfter: time.Duration(decoded.RetryAfterMs) * time.Millisecond,
+	}, nil
+}
+
+// Handler serves forwarded operations from other peers at /grant, /preview
+// and /clear. It always decides with the local limiter, so requests are
+// never forwarded twice even while peers disagree about membership. Mount it
+// under the path used in the peer URLs, e.g.
+//
+//	mux.Handle("/throttle/", http.StripPrefix("/throttle", limiter.Handler()))
+func (l *Limiter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /"+opGrant, l.serve(l.local.Grant))
+	mux.HandleFunc("POST /"+opPreview, l.serve(l.local.Preview))
+	mux.HandleFunc("POST /"+opClear, l.serve(func(ctx context.Context, key string) (core.Decision, error) {
+		return core.Decision{}, l.local.Clear(ctx, key)
+	}))
+	return mux
+}
+
+// serve adapts a local operation to an HTTP handler
+func (l *Limiter) serve(op func(ctx context.Context, key string) (core.Decision, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody)).Decode(&req); err != nil {
+			writeResponse(w, http.StatusBadRequest, response{Error: "invalid request body"})
+			return
+		}
+
+		decision, err := op(r.Context(), req.Key)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, response{Error: err.Error(), Failed: true})
+			return
+		}
+		l.served.Add(1)
+
+		writeResponse(w, http.StatusOK, response{
+			Allowed:      decision.Allowed,
+			Remaining:    decision.Remaining,
+			ResetTime:    decision.ResetTime,
+			RetryAfterMs: core.CeilMillis(decision.RetryAfter),
+		})
+	}
+}
+
+func writeResponse(w http.ResponseWriter, code int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
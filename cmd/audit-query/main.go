@@ -0,0 +1,120 @@
+// Command audit-query searches the JSON Lines files written by an audit
+// FileSink, including their rotated backups:
+//
+//	audit-query -key 'user:42*' -since 2h /var/log/throttle/audit.jsonl
+//	audit-query -policy login -since 2026-01-02T15:00:00Z -until 2026-01-02T16:00:00Z -table audit.jsonl
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/throttle/audit"
+)
+
+func main() {
+	var (
+		query audit.Query
+		since string
+		until string
+		limit int
+		table bool
+	)
+	flag.StringVar(&query.Key, "key", "", "Glob the key must match, such as 'user:*'")
+	flag.StringVar(&query.Policy, "policy", "", "Policy the record must have")
+	flag.StringVar(&since, "since", "", "Earliest time, RFC 3339 or a duration ago such as 2h")
+	flag.StringVar(&until, "until", "", "Time before which records are shown, RFC 3339 or a duration ago")
+	flag.BoolVar(&query.DeniedOnly, "denied", false, "Only show denials")
+	flag.IntVar(&limit, "limit", 0, "Most records shown (0: all)")
+	flag.BoolVar(&table, "table", false, "Print a table instead of JSON Lines")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] audit.jsonl...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	var err error
+	if query.Since, err = parseTime(since, now); err != nil {
+		fatal(fmt.Errorf("invalid -since: %w", err))
+	}
+	if query.Until, err = parseTime(until, now); err != nil {
+		fatal(fmt.Errorf("invalid -until: %w", err))
+	}
+
+	var paths []string
+	for _, arg := range flag.Args() {
+		files, err := audit.Files(arg)
+		if err != nil {
+			fatal(err)
+		}
+		if len(files) == 0 {
+			fatal(fmt.Errorf("no audit files found for %s", arg))
+		}
+		paths = append(paths, files...)
+	}
+
+	var print func(audit.Record) error
+	var tw *tabwriter.Writer
+	if table {
+		tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tKEY\tPOLICY\tALLOWED\tREMAINING\tRETRY AFTER")
+		print = func(r audit.Record) error {
+			_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%d\t%s\n",
+				r.Time.Format(time.RFC3339Nano), r.Key, r.Policy, r.Allowed, r.Remaining, r.RetryAfter)
+			return err
+		}
+	} else {
+		encoder := json.NewEncoder(os.Stdout)
+		print = func(r audit.Record) error { return encoder.Encode(r) }
+	}
+
+	shown := 0
+	err = audit.ReadFiles(paths, query, func(r audit.Record) error {
+		if err := print(r); err != nil {
+			return err
+		}
+		shown++
+		if limit > 0 && shown >= limit {
+			return audit.ErrStop
+		}
+		return nil
+	})
+	if tw != nil {
+		tw.Flush()
+	}
+	var malformed *audit.MalformedError
+	if errors.As(err, &malformed) {
+		// The records around the skipped lines were still shown
+		fmt.Fprintln(os.Stderr, "audit-query: warning:", err)
+	} else if err != nil {
+		fatal(err)
+	}
+}
+
+// parseTime parses an RFC 3339 time or a duration before now; empty is the
+// zero time
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "audit-query:", err)
+	os.Exit(1)
+}
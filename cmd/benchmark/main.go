@@ -4,23 +4,29 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/throttle/backend/memory"
+	"github.com/throttle/backend/redis"
 	"github.com/throttle/core"
 	"github.com/throttle/metrics"
 	"github.com/throttle/strategy/tokenbucket"
 )
 
 type BenchmarkConfig struct {
-	Duration    time.Duration
-	Concurrency int
-	KeyCount    int
-	Limit       int64
-	Interval    time.Duration
-	Burst       int64
+	Duration       time.Duration
+	Concurrency    int
+	KeyCount       int
+	Limit          int64
+	Interval       time.Duration
+	Burst          int64
+	Backend        string
+	RedisURL       string
+	BatchWindow    time.Duration
+	KeysPerRequest int
 }
 
 type BenchmarkResult struct {
@@ -43,6 +49,10 @@ func main() {
 	flag.Int64Var(&config.Limit, "limit", 1000, "Rate limit")
 	flag.DurationVar(&config.Interval, "interval", time.Minute, "Rate limit interval")
 	flag.Int64Var(&config.Burst, "burst", 1500, "Burst capacity")
+	flag.StringVar(&config.Backend, "backend", "memory", "Backend to benchmark: memory or redis")
+	flag.StringVar(&config.RedisURL, "redis-url", "redis://localhost:6379/0", "Redis URL for -backend=redis")
+	flag.DurationVar(&config.BatchWindow, "batch-window", 0, "Coalesce concurrent Redis calls within this window (0 disables)")
+	flag.IntVar(&config.KeysPerRequest, "keys-per-request", 4, "Keys checked per request in the multi-key benchmark")
 	flag.Parse()
 
 	fmt.Printf("🚀 Throttle Benchmark\n")
@@ -52,10 +62,19 @@ func main() {
 	fmt.Printf("Keys: %d unique keys\n", config.KeyCount)
 	fmt.Printf("Rate Limit: %d requests per %v\n", config.Limit, config.Interval)
 	fmt.Printf("Burst: %d\n", config.Burst)
+	fmt.Printf("Backend: %s\n", config.Backend)
+	if config.BatchWindow > 0 {
+		fmt.Printf("Batch Window: %v\n", config.BatchWindow)
+	}
 	fmt.Println()
 
 	// Create rate limiter
-	backend := memory.NewBackend()
+	backend, err := newBackend(config)
+	if err != nil {
+		log.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+
 	strategy := tokenbucket.NewStrategy(core.Config{
 		Limit:    config.Limit,
 		Interval: config.Interval,
@@ -88,6 +107,16 @@ func main() {
 	result3 := runMixedBenchmark(limiter, config)
 	printBenchmarkResult("Mixed Workload", result3)
 
+	// Benchmark 4: several keys per request, one Grant per key
+	fmt.Printf("📊 Benchmark 4: %d Keys per Request, Sequential Grants\n", config.KeysPerRequest)
+	result4 := runMultiKeyBenchmark(limiter, config, false)
+	printBenchmarkResult("Sequential Grants", result4)
+
+	// Benchmark 5: several keys per request, one batched GrantMulti
+	fmt.Printf("📊 Benchmark 5: %d Keys per Request, GrantMulti\n", config.KeysPerRequest)
+	result5 := runMultiKeyBenchmark(limiter, config, true)
+	printBenchmarkResult("GrantMulti", result5)
+
 	fmt.Println("🎉 Benchmark complete!")
 }
 
@@ -284,6 +313,137 @@ func runMixedBenchmark(limiter core.RateLimiter, config BenchmarkConfig) Benchma
 	}
 }
 
+// newBackend creates the backend selected on the command line
+func newBackend(config BenchmarkConfig) (core.Backend, error) {
+	switch config.Backend {
+	case "memory":
+		return memory.NewBackend(), nil
+	case "redis":
+		backend, err := redis.NewBackendFromURL(config.RedisURL, "throttle-benchmark")
+		if err != nil {
+			return nil, err
+		}
+		if config.BatchWindow > 0 {
+			return redis.NewBatcher(backend, redis.BatcherOptions{Window: config.BatchWindow}), nil
+		}
+		return backend, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", config.Backend)
+	}
+}
+
+// runMultiKeyBenchmark simulates requests that check several keys (IP, user,
+// API key, route...) either with one Grant per key or with a single GrantMulti
+func runMultiKeyBenchmark(limiter *core.Limiter, config BenchmarkConfig, batched bool) BenchmarkResult {
+	var (
+		totalRequests   int64
+		allowedRequests int64
+		deniedRequests  int64
+		totalLatency    int64
+		minLatency      int64 = 1<<63 - 1
+		maxLatency      int64
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	startTime := time.Now()
+
+	// Start workers
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+
+			keys := make([]string, config.KeysPerRequest)
+			for j := range keys {
+				keys[j] = fmt.Sprintf("multi-%d-key-%d", j, workerID%config.KeyCount)
+			}
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					requestStart := time.Now()
+
+					// A request is allowed only if every key allows it
+					allowed := true
+					var err error
+					if batched {
+						var decisions []core.Decision
+						decisions, err = limiter.GrantMulti(ctx, keys)
+						for _, decision := range decisions {
+							allowed = allowed && decision.Allowed
+						}
+					} else {
+						for _, key := range keys {
+							var decision core.Decision
+							if decision, err = limiter.Grant(ctx, key); err != nil {
+								break
+							}
+							allowed = allowed && decision.Allowed
+						}
+					}
+
+					latency := time.Since(requestStart)
+					atomic.AddInt64(&totalRequests, 1)
+
+					if err != nil {
+						continue
+					}
+
+					if allowed {
+						atomic.AddInt64(&allowedRequests, 1)
+					} else {
+						atomic.AddInt64(&deniedRequests, 1)
+					}
+
+					// Update latency stats
+					latencyNs := latency.Nanoseconds()
+					atomic.AddInt64(&totalLatency, latencyNs)
+
+					// Update min/max
+					for {
+						currentMin := atomic.LoadInt64(&minLatency)
+						if latencyNs >= currentMin {
+							break
+						}
+						if atomic.CompareAndSwapInt64(&minLatency, currentMin, latencyNs) {
+							break
+						}
+					}
+
+					for {
+						currentMax := atomic.LoadInt64(&maxLatency)
+						if latencyNs <= currentMax {
+							break
+						}
+						if atomic.CompareAndSwapInt64(&maxLatency, currentMax, latencyNs) {
+							break
+						}
+					}
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	duration := time.Since(startTime)
+
+	return BenchmarkResult{
+		TotalRequests:   atomic.LoadInt64(&totalRequests),
+		AllowedRequests: atomic.LoadInt64(&allowedRequests),
+		DeniedRequests:  atomic.LoadInt64(&deniedRequests),
+		TotalLatency:    time.Duration(atomic.LoadInt64(&totalLatency)),
+		MinLatency:      time.Duration(atomic.LoadInt64(&minLatency)),
+		MaxLatency:      time.Duration(atomic.LoadInt64(&maxLatency)),
+		AverageLatency:  time.Duration(atomic.LoadInt64(&totalLatency)) / time.Duration(atomic.LoadInt64(&totalRequests)),
+		Throughput:      float64(atomic.LoadInt64(&totalRequests)) / duration.Seconds(),
+	}
+}
+
 func printBenchmarkResult(name string, result BenchmarkResult) {
 	fmt.Printf("Results for %s:\n", name)
 	fmt.Printf("  Total Requests: %d\n", result.TotalRequests)
@@ -92,11 +92,14 @@ func main() {
 	fmt.Println("🔍 Specific Metrics:")
 	fmt.Println("===================")
 
-	grantMetrics := collector.GetMetrics("throttle_grant_total")
-	fmt.Printf("Grant requests: %d\n", len(grantMetrics))
+	grants := 0.0
+	for _, metric := range collector.GetMetrics("throttle_grant_total") {
+		grants += metric.Value
+	}
+	fmt.Printf("Grant requests: %g\n", grants)
 
 	remainingMetrics := collector.GetMetrics("throttle_remaining_tokens")
-	fmt.Printf("Remaining tokens metrics: %d\n", len(remainingMetrics))
+	fmt.Printf("Remaining tokens series: %d\n", len(remainingMetrics))
 
 	// Export as JSON (for monitoring systems)
 	fmt.Println()
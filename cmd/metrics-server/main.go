@@ -10,6 +10,8 @@ import (
 
 	"github.com/throttle/backend/memory"
 	"github.com/throttle/core"
+	"github.com/throttle/health"
+	"github.com/throttle/hotkeys"
 	"github.com/throttle/metrics"
 	"github.com/throttle/strategy/tokenbucket"
 )
@@ -28,12 +30,16 @@ func main() {
 		Burst:    150,
 	})
 	reporter := metrics.NewGenericReporter()
+	tracker := hotkeys.NewTracker(hotkeys.Options{})
 
-	limiter := core.NewLimiter(backend, strategy, core.Config{
+	limiter := core.NewLimiterWithOptions(backend, strategy, core.Config{
 		Limit:    100,
 		Interval: time.Minute,
 		Burst:    150,
-	}, reporter)
+	}, core.LimiterOptions{
+		Policy:    "api",
+		Observers: []core.Observer{core.ReporterObserver(reporter), tracker},
+	})
 
 	server := &MetricsServer{
 		limiter:  limiter,
@@ -42,17 +48,25 @@ func main() {
 
 	// Set up HTTP routes
 	http.HandleFunc("/api/resource", server.handleResource)
-	http.HandleFunc("/metrics", server.handleMetrics)
+	http.Handle("/metrics", metrics.NewHandler(reporter.GetCollector()))
 	http.HandleFunc("/metrics/json", server.handleMetricsJSON)
-	http.HandleFunc("/health", server.handleHealth)
+	http.Handle("/debug/hotkeys", tracker.Handler())
+
+	// Readiness pings the backend; liveness only shows the server is up
+	checks := health.NewHandler(limiter, health.Options{Timeout: time.Second})
+	http.HandleFunc("/health", checks.Ready)
+	http.Handle("/health/", http.StripPrefix("/health", checks))
 
 	fmt.Println("🚀 Throttle Metrics Server")
 	fmt.Println("==========================")
 	fmt.Println("Endpoints:")
 	fmt.Println("  GET /api/resource    - Make a request (generates metrics)")
-	fmt.Println("  GET /metrics         - Prometheus-style metrics")
+	fmt.Println("  GET /metrics         - Prometheus text or OpenMetrics")
 	fmt.Println("  GET /metrics/json    - JSON metrics (for Datadog, etc.)")
-	fmt.Println("  GET /health          - Health check")
+	fmt.Println("  GET /debug/hotkeys   - Most granted and denied keys")
+	fmt.Println("  GET /health          - Readiness check (pings the backend)")
+	fmt.Println("  GET /health/live     - Liveness check")
+	fmt.Println("  GET /health/ready    - Readiness check")
 	fmt.Println()
 	fmt.Println("Starting server on :8080...")
 
@@ -90,29 +104,6 @@ func (s *MetricsServer) handleResource(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Request processed successfully"))
 }
 
-func (s *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	collector := s.reporter.GetCollector()
-	metrics := collector.Collect()
-
-	w.Header().Set("Content-Type", "text/plain")
-
-	for _, metric := range metrics {
-		// Format as Prometheus-style metrics
-		labels := ""
-		if len(metric.Labels) > 0 {
-			var labelPairs []string
-			for k, v := range metric.Labels {
-				labelPairs = append(labelPairs, fmt.Sprintf(`%s="%s"`, k, v))
-			}
-			labels = "{" + fmt.Sprintf("%s", labelPairs) + "}"
-		}
-
-		fmt.Fprintf(w, "# HELP %s %s\n", metric.Name, metric.Help)
-		fmt.Fprintf(w, "# TYPE %s %s\n", metric.Name, metric.Type)
-		fmt.Fprintf(w, "%s%s %g\n", metric.Name, labels, metric.Value)
-	}
-}
-
 func (s *MetricsServer) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
 	collector := s.reporter.GetCollector()
 	metrics := collector.Collect()
@@ -127,11 +118,3 @@ func (s *MetricsServer) handleMetricsJSON(w http.ResponseWriter, r *http.Request
 
 	json.NewEncoder(w).Encode(response)
 }
-
-func (s *MetricsServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "healthy",
-		"time":   time.Now().Format(time.RFC3339),
-	})
-}
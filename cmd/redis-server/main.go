@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 
 	redisclient "github.com/redis/go-redis/v9"
 	"github.com/throttle/backend/redis"
+	"github.com/throttle/backend/redis/redistest"
 	"github.com/throttle/core"
 	"github.com/throttle/metrics"
 	"github.com/throttle/strategy/tokenbucket"
@@ -17,11 +19,26 @@ import (
 func main() {
 	fmt.Println("🚀 Throttle Redis Backend Server")
 	fmt.Println("================================")
+	addr := flag.String("redis-addr", "localhost:6379", "Redis server address")
+	inProcess := flag.Bool("in-process", false, "Serve Redis from an in-process stand-in instead of connecting to a server")
+	flag.Parse()
+
 	fmt.Println()
 
+	// Start the stand-in for demos without a Redis server
+	if *inProcess {
+		srv, err := redistest.NewServer("127.0.0.1:0")
+		if err != nil {
+			log.Fatalf("Failed to start in-process Redis: %v", err)
+		}
+		defer srv.Close()
+		*addr = srv.Addr()
+		fmt.Printf("🧪 Started in-process Redis on %s (data is lost on exit)\n", *addr)
+	}
+
 	// Create Redis client
 	rdb := redisclient.NewClient(&redisclient.Options{
-		Addr:     "localhost:6379",
+		Addr:     *addr,
 		Password: "", // no password set
 		DB:       0,  // use default DB
 	})
@@ -33,13 +50,6 @@ func main() {
 	}
 	fmt.Println("✅ Connected to Redis")
 
-	// Create Redis backend
-	backend, err := redis.NewBackendFromURL("redis://localhost:6379/0", "throttle-server")
-	if err != nil {
-		log.Fatalf("Failed to create Redis backend: %v", err)
-	}
-	defer backend.Close()
-
 	// Create rate limiter configuration
 	config := core.Config{
 		Limit:    10,          // 10 requests per minute
@@ -51,6 +61,13 @@ func main() {
 	strategy := tokenbucket.NewStrategy(config)
 	reporter := metrics.NewGenericReporter()
 
+	// Create Redis backend, expiring keys once their bucket has refilled
+	backend, err := redis.NewBackendFromURL("redis://"+*addr+"/0", "throttle-server", redis.WithExpirer(strategy))
+	if err != nil {
+		log.Fatalf("Failed to create Redis backend: %v", err)
+	}
+	defer backend.Close()
+
 	// Create limiter with Redis backend
 	limiter := core.NewLimiter(backend, strategy, config, reporter)
 
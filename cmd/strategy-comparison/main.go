@@ -136,31 +136,34 @@ func main() {
 	tbMetrics := tbCollector.Collect()
 	lbMetrics := lbCollector.Collect()
 
-	fmt.Printf("Token Bucket - Total Requests: %d\n", len(tbMetrics))
-	fmt.Printf("Leaky Bucket - Total Requests: %d\n", len(lbMetrics))
-
-	// Count allowed vs denied
-	tbAllowed := 0
-	tbDenied := 0
-	lbAllowed := 0
-	lbDenied := 0
+	// Counters are aggregated per key, so sum them across keys
+	tbTotal, tbAllowed, tbDenied := 0, 0, 0
+	lbTotal, lbAllowed, lbDenied := 0, 0, 0
 
 	for _, metric := range tbMetrics {
-		if metric.Name == "throttle_grant_allowed_total" {
-			tbAllowed++
-		} else if metric.Name == "throttle_grant_denied_total" {
-			tbDenied++
+		switch metric.Name {
+		case "throttle_grant_total":
+			tbTotal += int(metric.Value)
+		case "throttle_grant_allowed_total":
+			tbAllowed += int(metric.Value)
+		case "throttle_grant_denied_total":
+			tbDenied += int(metric.Value)
 		}
 	}
 
 	for _, metric := range lbMetrics {
-		if metric.Name == "throttle_grant_allowed_total" {
-			lbAllowed++
-		} else if metric.Name == "throttle_grant_denied_total" {
-			lbDenied++
+		switch metric.Name {
+		case "throttle_grant_total":
+			lbTotal += int(metric.Value)
+		case "throttle_grant_allowed_total":
+			lbAllowed += int(metric.Value)
+		case "throttle_grant_denied_total":
+			lbDenied += int(metric.Value)
 		}
 	}
 
+	fmt.Printf("Token Bucket - Total Requests: %d\n", tbTotal)
+	fmt.Printf("Leaky Bucket - Total Requests: %d\n", lbTotal)
 	fmt.Printf("Token Bucket - Allowed: %d, Denied: %d\n", tbAllowed, tbDenied)
 	fmt.Printf("Leaky Bucket - Allowed: %d, Denied: %d\n", lbAllowed, lbDenied)
 
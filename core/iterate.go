@@ -0,0 +1,292 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotIterable is returned when enumerating the keys of a backend that
+// doesn't implement Iterator
+var ErrNotIterable = errors.New("backend does not support iterating keys")
+
+// Filter selects keys when iterating a backend. The zero Filter matches
+// every key.
+type Filter struct {
+	Prefix  string // Only keys starting with Prefix
+	Pattern string // Only keys matching this glob pattern, see Match
+	Count   int    // Keys examined per page, a hint (0 uses the backend's default)
+}
+
+// Matches reports whether key passes the filter
+func (f Filter) Matches(key string) bool {
+	if !strings.HasPrefix(key, f.Prefix) {
+		return false
+	}
+	return f.Pattern == "" || Match(f.Pattern, key)
+}
+
+// Entry is a key and its stored state
+type Entry struct {
+	Key   string
+	State *State
+}
+
+// Scanner walks the entries of an Iterator page by page
+type Scanner struct {
+	it     Iterator
+	filter Filter
+	cursor string
+	page   []Entry
+	done   bool
+	err    error
+}
+
+// NewScanner creates a scanner over the entries of it that match filter,
+// resuming at cursor if it is not empty
+func NewScanner(it Iterator, filter Filter, cursor string) *Scanner {
+	return &Scanner{
+		it:     it,
+		filter: filter,
+		cursor: cursor,
+	}
+}
+
+// Next fetches the next non-empty page and reports whether there is one
+func (s *Scanner) Next(ctx context.Context) bool {
+	for !s.done && s.err == nil {
+		page, next, err := s.it.Scan(ctx, s.filter, s.cursor)
+		if err != nil {
+			s.err = err
+			break
+		}
+
+		s.cursor = next
+		s.done = next == ""
+		if len(page) > 0 {
+			s.page = page
+			return true
+		}
+	}
+	s.page = nil
+	return false
+}
+
+// Page returns the entries fetched by the last call to Next
+func (s *Scanner) Page() []Entry {
+	return s.page
+}
+
+// Cursor returns the cursor to resume after the current page, "" once the
+// scan is complete
+func (s *Scanner) Cursor() string {
+	return s.cursor
+}
+
+// Err returns the error that stopped the scan, if any
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// All returns an iterator over the remaining keys and states. Check Err
+// once it is exhausted.
+func (s *Scanner) All(ctx context.Context) iter.Seq2[string, *State] {
+	return func(yield func(string, *State) bool) {
+		for s.Next(ctx) {
+			for _, entry := range s.page {
+				if !yield(entry.Key, entry.State) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ScanIndex pages through the keys of an in-process backend in sorted
+// order for its Scan. The keys are snapshotted and sorted when a scan
+// starts, and later pages find their cursor in the snapshot by binary
+// search, so a full scan sorts once and the backend's lock is only held to
+// copy the keys. As with Redis SCAN, keys created after the scan started
+// may be missed. The zero ScanIndex is ready to use and safe for concurrent
+// use.
+type ScanIndex struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+// Page returns up to count keys after cursor, all of them if count is not
+// positive, and the cursor of the next page ("" after the last one). keys
+// lists the backend's current keys when a snapshot is needed; the caller
+// must check that the returned keys still exist.
+func (x *ScanIndex) Page(cursor string, count int, keys func() []string) ([]string, string) {
+	x.mu.Lock()
+	snapshot := x.keys
+	x.mu.Unlock()
+
+	if cursor == "" || snapshot == nil {
+		snapshot = keys()
+		slices.Sort(snapshot)
+		x.mu.Lock()
+		x.keys = snapshot
+		x.mu.Unlock()
+	}
+
+	start, found := slices.BinarySearch(snapshot, cursor)
+	if found {
+		start++
+	}
+	page := snapshot[start:]
+	if count > 0 && len(page) > count {
+		page = page[:count]
+		return page, page[len(page)-1]
+	}
+
+	// The scan is complete; release the snapshot unless another one
+	// replaced it meanwhile
+	x.mu.Lock()
+	if len(x.keys) > 0 && len(snapshot) > 0 && &x.keys[0] == &snapshot[0] {
+		x.keys = nil
+	}
+	x.mu.Unlock()
+	return page, ""
+}
+
+// defaultClearBatch is the number of keys cleared between pauses
+const defaultClearBatch = 100
+
+// ClearOption configures a bulk clear
+type ClearOption func(*clearOptions)
+
+type clearOptions struct {
+	batch int
+	rate  float64
+}
+
+// WithClearBatch sets the number of keys deleted between pauses
+func WithClearBatch(n int) ClearOption {
+	return func(o *clearOptions) {
+		if n > 0 {
+			o.batch = n
+		}
+	}
+}
+
+// WithClearRate limits a bulk clear to about keysPerSecond deletes, so a
+// large keyspace doesn't monopolize the backend. Zero means no limit.
+func WithClearRate(keysPerSecond float64) ClearOption {
+	return func(o *clearOptions) {
+		o.rate = keysPerSecond
+	}
+}
+
+// pace waits until clearing another batch keeps to the rate, given that
+// cleared keys were deleted since started
+func (o clearOptions) pace(ctx context.Context, started time.Time, cleared int) error {
+	if o.rate <= 0 {
+		return ctx.Err()
+	}
+
+	due := started.Add(time.Duration(float64(cleared) / o.rate * float64(time.Second)))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Match reports whether key matches a glob pattern with the syntax of
+// Redis: * matches any sequence, ? any single byte, [abc], [a-z] and [^a]
+// match classes of bytes and \ escapes the next byte. It runs in
+// O(len(pattern)·len(key)) time: on a mismatch only the last * is widened,
+// since any match found by widening an earlier one is also found that way.
+func Match(pattern, key string) bool {
+	p, k := 0, 0
+	star, starKey := -1, 0
+
+	for k < len(key) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starKey = p, k
+				p++
+				continue
+			}
+			if width, ok := matchByte(pattern[p:], key[k]); ok {
+				p += width
+				k++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last * absorb one more byte and retry from there
+		starKey++
+		p, k = star+1, starKey
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte matches c against the single-byte token at the start of
+// pattern, which is not *, and returns the token's width
+func matchByte(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// Unterminated class, '[' is literal
+			return 1, c == '['
+		}
+		return end + 2, matchClass(pattern[1:end+1], c)
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// matchClass reports whether c is in a [...] class without its brackets
+func matchClass(class string, c byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(class); i++ {
+		switch {
+		case class[i] == '\\' && i+1 < len(class):
+			i++
+			matched = matched || class[i] == c
+		case i+2 < len(class) && class[i+1] == '-':
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			i += 2
+		default:
+			matched = matched || class[i] == c
+		}
+	}
+	return matched != negate
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pagedIterator serves fixed pages, with cursors "1", "2"... between them
+type pagedIterator struct {
+	pages [][]Entry
+	err   error
+}
+
+func (p *pagedIterator) Scan(ctx context.Context, filter Filter, cursor string) ([]Entry, string, error) {
+	i := 0
+	if cursor != "" {
+		i = int(cursor[0] - '0')
+	}
+	if i == len(p.pages)-1 && p.err != nil {
+		return nil, "", p.err
+	}
+
+	next := ""
+	if i+1 < len(p.pages) {
+		next = string(rune('0' + i + 1))
+	}
+	return p.pages[i], next, nil
+}
+
+func TestScanner_Pages(t *testing.T) {
+	it := &pagedIterator{pages: [][]Entry{
+		{{Key: "a"}, {Key: "b"}},
+		nil, // Empty pages are skipped
+		{{Key: "c"}},
+	}}
+	ctx := context.Background()
+
+	scanner := NewScanner(it, Filter{}, "")
+	assert.True(t, scanner.Next(ctx))
+	assert.Len(t, scanner.Page(), 2)
+	assert.Equal(t, "1", scanner.Cursor())
+
+	// A scan resumes from a saved cursor
+	resumed := NewScanner(it, Filter{}, scanner.Cursor())
+	var keys []string
+	for key := range resumed.All(ctx) {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"c"}, keys)
+	assert.Equal(t, "", resumed.Cursor())
+	assert.False(t, resumed.Next(ctx))
+	assert.NoError(t, resumed.Err())
+}
+
+func TestScanner_Error(t *testing.T) {
+	errScan := errors.New("scan failed")
+	it := &pagedIterator{pages: [][]Entry{{{Key: "a"}}, nil}, err: errScan}
+
+	scanner := NewScanner(it, Filter{}, "")
+	var keys []string
+	for key := range scanner.All(context.Background()) {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"a"}, keys)
+	assert.ErrorIs(t, scanner.Err(), errScan)
+}
+
+func TestFilter_Matches(t *testing.T) {
+	assert.True(t, Filter{}.Matches("anything"))
+	assert.True(t, Filter{Prefix: "user:"}.Matches("user:1"))
+	assert.False(t, Filter{Prefix: "user:"}.Matches("admin:1"))
+	assert.True(t, Filter{Prefix: "user:", Pattern: "*:login"}.Matches("user:1:login"))
+	assert.False(t, Filter{Prefix: "user:", Pattern: "*:login"}.Matches("admin:1:login"))
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a[bc]d", "acd", true},
+		{"a[^bc]d", "acd", false},
+		{"a[a-z]d", "amd", true},
+		{"a[b", "a[b", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"user:*:login", "user:42:login", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a**", "a", true},
+		{"*[0-9]", "id-7", true},
+		{`*\`, `a\`, true},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Match(tt.pattern, tt.key), "%q ~ %q", tt.pattern, tt.key)
+	}
+}
+
+func TestMatch_NoBacktrackingBlowup(t *testing.T) {
+	// Exponential with naive recursion, instant in linear time
+	pattern := strings.Repeat("a*", 30) + "b"
+	key := strings.Repeat("a", 1000)
+
+	start := time.Now()
+	assert.False(t, Match(pattern, key))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestScanIndex_Page(t *testing.T) {
+	var index ScanIndex
+	listed := 0
+	keys := func() []string {
+		listed++
+		return []string{"d", "b", "e", "a", "c"}
+	}
+
+	var got []string
+	cursor := ""
+	for {
+		page, next := index.Page(cursor, 2, keys)
+		got = append(got, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	// A full scan lists and sorts the keys once
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, got)
+	assert.Equal(t, 1, listed)
+
+	// The snapshot is released when the scan completes, and a page can
+	// resume from a cursor without one
+	page, next := index.Page("b", 0, keys)
+	assert.Equal(t, []string{"c", "d", "e"}, page)
+	assert.Equal(t, "", next)
+	assert.Equal(t, 2, listed)
+
+	// A cursor that isn't a key resumes after where it would sort
+	page, _ = index.Page("bb", 1, keys)
+	assert.Equal(t, []string{"c"}, page)
+}
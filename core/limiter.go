@@ -2,122 +2,470 @@ package core
 
 import (
 	"context"
-	"sync"
+	"fmt"
 	"time"
 )
 
+// LimiterOptions configures a Limiter
+type LimiterOptions struct {
+	Policy    string     // Name of the limit, reported in events
+	Observers []Observer // Receive an event per operation; those that are also TimingReporters get timings
+}
+
 // Limiter implements the RateLimiter interface
 type Limiter struct {
-	backend  Backend
-	strategy Strategy
-	config   Config
-	metrics  MetricsReporter
-	mu       sync.RWMutex
+	backend   Backend
+	strategy  Strategy
+	config    Config
+	policy    string
+	observers []Observer
+	timers    []TimingReporter
+	locks     keyLocks
 }
 
-// NewLimiter creates a new rate limiter with the given components
+// NewLimiter creates a new rate limiter with the given components. metrics
+// may be nil; otherwise it is adapted with ReporterObserver.
 func NewLimiter(backend Backend, strategy Strategy, config Config, metrics MetricsReporter) *Limiter {
+	var opts LimiterOptions
+	if metrics != nil {
+		opts.Observers = []Observer{ReporterObserver(metrics)}
+	}
+	return NewLimiterWithOptions(backend, strategy, config, opts)
+}
+
+// NewLimiterWithOptions creates a rate limiter reporting to opts.Observers
+func NewLimiterWithOptions(backend Backend, strategy Strategy, config Config, opts LimiterOptions) *Limiter {
 	return &Limiter{
-		backend:  backend,
-		strategy: strategy,
-		config:   config,
-		metrics:  metrics,
+		backend:   backend,
+		strategy:  strategy,
+		config:    config,
+		policy:    opts.Policy,
+		observers: opts.Observers,
+		timers:    TimersOf(opts.Observers),
 	}
 }
 
 // Grant determines whether a request should be allowed now
-func (l *Limiter) Grant(ctx context.Context, key string) (Decision, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+func (l *Limiter) Grant(ctx context.Context, key string) (decision Decision, err error) {
+	s := l.begin(OpGrant)
+	defer func() { l.finish(ctx, s, key, decision, err) }()
+
+	// Keys known to be denied don't need the lock or the backend
+	decision, denied := l.cachedDenial(key)
+	if !denied {
+		lock := l.locks.of(key)
+		lock.Lock()
+		defer lock.Unlock()
+
+		if decision, err = l.grantLocked(ctx, s, key); err != nil {
+			return Decision{}, err
+		}
+		l.remember(key, decision)
+	}
+
+	return decision, nil
+}
+
+// GrantMulti determines for each key whether a request should be allowed
+// now. Keys are decided independently, as if Grant were called for each in
+// order. With a BatchBackend all states are read in one round-trip and
+// written in another, instead of two round-trips per key.
+func (l *Limiter) GrantMulti(ctx context.Context, keys []string) (decisions []Decision, err error) {
+	s := l.begin(OpGrantMulti)
+	defer func() {
+		s.end(l)
+		for i, key := range keys {
+			var decision Decision
+			if err == nil {
+				decision = decisions[i]
+			}
+			l.emit(ctx, s, key, decision, err)
+		}
+	}()
+
+	decisions = make([]Decision, len(keys))
+
+	// Keys known to be denied are answered from the cache
+	var pending []string
+	var slots []int
+	for i, key := range keys {
+		if decision, denied := l.cachedDenial(key); denied {
+			decisions[i] = decision
+			continue
+		}
+		pending = append(pending, key)
+		slots = append(slots, i)
+	}
+
+	if len(pending) > 0 {
+		unlock := l.locks.lockAll(pending)
+		defer unlock()
+
+		var decided []Decision
+
+		if batch, ok := l.backend.(BatchBackend); ok {
+			decided, err = l.grantBatch(ctx, s, batch, pending)
+		} else {
+			decided = make([]Decision, len(pending))
+			for i, key := range pending {
+				if decided[i], err = l.grantLocked(ctx, s, key); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i, slot := range slots {
+			decisions[slot] = decided[i]
+			l.remember(pending[i], decided[i])
+		}
+	}
+
+	return decisions, nil
+}
+
+// cachedDenial returns the denial a DenyCache backend remembers for key
+func (l *Limiter) cachedDenial(key string) (Decision, bool) {
+	if cache, ok := l.backend.(DenyCache); ok {
+		return cache.Denied(key, time.Now())
+	}
+	return Decision{}, false
+}
+
+// remember passes a fresh decision to a DenyCache backend
+func (l *Limiter) remember(key string, decision Decision) {
+	if cache, ok := l.backend.(DenyCache); ok {
+		cache.RecordDecision(key, decision, time.Now())
+	}
+}
+
+// span follows one call of a limiter method
+type span struct {
+	op        Operation
+	start     time.Time
+	duration  time.Duration
+	durations map[Phase]time.Duration // Only kept when there are observers
+}
+
+// begin starts the span of an op call
+func (l *Limiter) begin(op Operation) *span {
+	s := &span{op: op, start: time.Now()}
+	if len(l.observers) > 0 {
+		s.durations = make(map[Phase]time.Duration)
+	}
+	return s
+}
+
+// end records the total duration of the call
+func (s *span) end(l *Limiter) {
+	s.duration = time.Since(s.start)
+	l.record(s, PhaseTotal, s.duration)
+}
+
+// observe records the time since start as phase of the call
+func (l *Limiter) observe(s *span, phase Phase, start time.Time) {
+	l.record(s, phase, time.Since(start))
+}
+
+// record passes the duration of a phase to the timers and adds it to the
+// span's durations
+func (l *Limiter) record(s *span, phase Phase, d time.Duration) {
+	for _, timer := range l.timers {
+		timer.RecordTiming(s.op, phase, d)
+	}
+	if s.durations != nil {
+		s.durations[phase] += d
+	}
+}
+
+// finish ends the span of a single-key call and reports its event
+func (l *Limiter) finish(ctx context.Context, s *span, key string, decision Decision, err error) {
+	s.end(l)
+	l.emit(ctx, s, key, decision, err)
+}
+
+// emit passes the event for key to the observers
+func (l *Limiter) emit(ctx context.Context, s *span, key string, decision Decision, err error) {
+	if len(l.observers) == 0 {
+		return
+	}
+
+	event := Event{
+		Operation: s.op,
+		Key:       key,
+		Policy:    l.policy,
+		Decision:  decision,
+		Err:       err,
+		Time:      s.start,
+		Duration:  s.duration,
+		Durations: s.durations,
+		Fallback:  isFallback(ctx),
+	}
+	if s.op == OpGrant || s.op == OpGrantMulti {
+		event.Cost = 1
+	}
+
+	for _, o := range l.observers {
+		o.Observe(ctx, event)
+	}
+}
+
+// grantLocked decides a single key as part of the call s; the caller holds
+// the key's lock
+func (l *Limiter) grantLocked(ctx context.Context, s *span, key string) (Decision, error) {
+	// Prefer an atomic read-modify-write when the backend supports one
+	if updater, ok := l.backend.(Updater); ok {
+		var decision Decision
+		start := time.Now()
+		err := updater.Update(ctx, key, func(state *State) (*State, error) {
+			var err error
+			state, decision, err = l.calculate(ctx, s, state)
+			return state, err
+		})
+		l.observe(s, PhaseBackendUpdate, start)
+		return decision, err
+	}
+
+	return l.grant(ctx, s, key)
+}
+
+// grantBatch decides all keys with one GetMulti and one SetMulti. Repeated
+// keys see the state left by their previous occurrence.
+func (l *Limiter) grantBatch(ctx context.Context, s *span, batch BatchBackend, keys []string) ([]Decision, error) {
+	start := time.Now()
+	states, err := batch.GetMulti(ctx, keys)
+	l.observe(s, PhaseBackendGet, start)
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := make([]Decision, len(keys))
+	latest := make(map[string]int, len(keys))
+	var writeKeys []string
+	var writeStates []*State
+
+	for i, key := range keys {
+		state := states[i]
+		slot, seen := latest[key]
+		if seen {
+			state = writeStates[slot]
+		}
+
+		state, decisions[i], err = l.calculate(ctx, s, state)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen {
+			writeStates[slot] = state
+		} else {
+			latest[key] = len(writeKeys)
+			writeKeys = append(writeKeys, key)
+			writeStates = append(writeStates, state)
+		}
+	}
+
+	start = time.Now()
+	err = batch.SetMulti(ctx, writeKeys, writeStates)
+	l.observe(s, PhaseBackendSet, start)
+	if err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
 
+// grant performs a non-atomic Get, Calculate, Set cycle against the backend
+func (l *Limiter) grant(ctx context.Context, s *span, key string) (Decision, error) {
 	// Get current state
+	start := time.Now()
 	state, err := l.backend.Get(ctx, key)
+	l.observe(s, PhaseBackendGet, start)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	state, decision, err := l.calculate(ctx, s, state)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	// Update state in backend
+	start = time.Now()
+	err = l.backend.Set(ctx, key, state)
+	l.observe(s, PhaseBackendSet, start)
 	if err != nil {
 		return Decision{}, err
 	}
 
+	return decision, nil
+}
+
+// calculate runs the strategy against state, creating a fresh state if none exists
+func (l *Limiter) calculate(ctx context.Context, s *span, state *State) (*State, Decision, error) {
 	// If no state exists, create a new one
 	if state == nil {
-		now := time.Now()
-		state = &State{
-			Tokens:     float64(l.config.Burst),
-			LastUpdate: now,
-			Created:    now,
-		}
+		state = l.newState(time.Now())
 	}
 
 	// Calculate decision
 	now := time.Now()
 	decision, err := l.strategy.Calculate(ctx, state, now)
+	l.observe(s, PhaseStrategy, now)
 	if err != nil {
-		return Decision{}, err
+		return nil, Decision{}, err
 	}
 
-	// Update state in backend
-	if err := l.backend.Set(ctx, key, state); err != nil {
-		return Decision{}, err
-	}
+	return state, decision, nil
+}
 
-	// Record metrics if available
-	if l.metrics != nil {
-		l.metrics.RecordGrant(key, decision.Allowed, decision.Remaining)
+// newState returns the state of a key that has never been seen
+func (l *Limiter) newState(now time.Time) *State {
+	if init, ok := l.strategy.(Initializer); ok {
+		return init.NewState(now)
+	}
+	return &State{
+		Tokens:     float64(l.config.Burst),
+		LastUpdate: now,
+		Created:    now,
 	}
-
-	return decision, nil
 }
 
 // Preview returns the current usage state without modifying anything
-func (l *Limiter) Preview(ctx context.Context, key string) (Decision, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+func (l *Limiter) Preview(ctx context.Context, key string) (decision Decision, err error) {
+	s := l.begin(OpPreview)
+	defer func() { l.finish(ctx, s, key, decision, err) }()
+
+	lock := l.locks.of(key)
+	lock.RLock()
+	defer lock.RUnlock()
 
 	// Get current state
+	start := time.Now()
 	state, err := l.backend.Get(ctx, key)
+	l.observe(s, PhaseBackendGet, start)
 	if err != nil {
 		return Decision{}, err
 	}
 
 	// If no state exists, return default state
 	if state == nil {
-		now := time.Now()
-		state = &State{
-			Tokens:     float64(l.config.Burst),
-			LastUpdate: now,
-			Created:    now,
-		}
+		state = l.newState(time.Now())
 	}
 
 	// Calculate preview decision
 	now := time.Now()
-	decision, err := l.strategy.Preview(ctx, state, now)
+	decision, err = l.strategy.Preview(ctx, state, now)
+	l.observe(s, PhaseStrategy, now)
 	if err != nil {
 		return Decision{}, err
 	}
 
-	// Record metrics if available
-	if l.metrics != nil {
-		l.metrics.RecordPreview(key, decision.Remaining)
-	}
-
 	return decision, nil
 }
 
 // Clear resets internal counters for the key
-func (l *Limiter) Clear(ctx context.Context, key string) error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+func (l *Limiter) Clear(ctx context.Context, key string) (err error) {
+	s := l.begin(OpClear)
+	defer func() { l.finish(ctx, s, key, Decision{}, err) }()
+
+	lock := l.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	start := time.Now()
+	err = l.backend.Delete(ctx, key)
+	l.observe(s, PhaseBackendDelete, start)
+	return err
+}
+
+// Scan returns a scanner over the keys of the backend that match filter.
+// It fails with ErrNotIterable if the backend can't enumerate its keys.
+func (l *Limiter) Scan(filter Filter) (*Scanner, error) {
+	it, ok := l.backend.(Iterator)
+	if !ok {
+		return nil, ErrNotIterable
+	}
+	return NewScanner(it, filter, ""), nil
+}
+
+// ClearPrefix resets the counters of every key starting with prefix and
+// returns how many keys were cleared, even if it stops on an error
+func (l *Limiter) ClearPrefix(ctx context.Context, prefix string, opts ...ClearOption) (int, error) {
+	return l.clearMatching(ctx, Filter{Prefix: prefix}, opts)
+}
+
+// ClearMatching resets the counters of every key matching a glob pattern
+// (see Match) and returns how many keys were cleared, even if it stops on
+// an error
+func (l *Limiter) ClearMatching(ctx context.Context, pattern string, opts ...ClearOption) (int, error) {
+	return l.clearMatching(ctx, Filter{Pattern: pattern}, opts)
+}
 
-	err := l.backend.Delete(ctx, key)
+// clearMatching deletes the keys passing filter in batches, pausing between
+// batches to keep to the configured rate
+func (l *Limiter) clearMatching(ctx context.Context, filter Filter, opts []ClearOption) (int, error) {
+	options := clearOptions{batch: defaultClearBatch}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	scanner, err := l.Scan(filter)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	cleared, inBatch := 0, 0
+	started := time.Now()
+	for scanner.Next(ctx) {
+		for _, entry := range scanner.Page() {
+			if inBatch == options.batch {
+				if err := options.pace(ctx, started, cleared); err != nil {
+					return cleared, err
+				}
+				inBatch = 0
+			}
+
+			if err := l.Clear(ctx, entry.Key); err != nil {
+				return cleared, fmt.Errorf("failed to clear key %s: %w", entry.Key, err)
+			}
+			cleared++
+			inBatch++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cleared, fmt.Errorf("failed to scan keys: %w", err)
+	}
+
+	return cleared, nil
+}
+
+// Health checks the limiter's backend, see CheckBackend
+func (l *Limiter) Health(ctx context.Context) Health {
+	return CheckBackend(ctx, l.backend)
+}
+
+// CheckBackend pings backend if it is a Pinger, timing the round-trip, and
+// collects its statistics if it is a StatsProvider
+func CheckBackend(ctx context.Context, backend Backend) Health {
+	health := Health{Healthy: true}
+
+	if pinger, ok := backend.(Pinger); ok {
+		start := time.Now()
+		err := pinger.Ping(ctx)
+		health.Latency = time.Since(start)
+		if err != nil {
+			health.Healthy = false
+			health.Err = err
+		}
 	}
 
-	// Record metrics if available
-	if l.metrics != nil {
-		l.metrics.RecordClear(key)
+	if provider, ok := backend.(StatsProvider); ok {
+		health.Stats = provider.Stats()
 	}
 
-	return nil
+	return health
 }
 
 // Config returns the current configuration
@@ -2,10 +2,14 @@ package core
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // MockBackend implements Backend for testing
@@ -154,3 +158,447 @@ func TestLimiter_Clear(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, metrics.clearCalls)
 }
+
+// MockUpdaterBackend adds an atomic Update to MockBackend
+type MockUpdaterBackend struct {
+	*MockBackend
+	updateCalls int
+}
+
+func (m *MockUpdaterBackend) Update(ctx context.Context, key string, fn func(state *State) (*State, error)) error {
+	m.updateCalls++
+	state, err := fn(m.store[key])
+	if err != nil {
+		return err
+	}
+	m.store[key] = state
+	return nil
+}
+
+func TestLimiter_GrantUsesUpdater(t *testing.T) {
+	backend := &MockUpdaterBackend{MockBackend: NewMockBackend()}
+	strategy := NewMockStrategy(true, 5)
+	config := Config{Limit: 10, Interval: time.Minute, Burst: 15}
+
+	limiter := NewLimiter(backend, strategy, config, nil)
+
+	ctx := context.Background()
+	decision, err := limiter.Grant(ctx, "test-key")
+
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, backend.updateCalls)
+	assert.Equal(t, float64(15), backend.store["test-key"].Tokens)
+}
+
+// MockBatchBackend adds GetMulti/SetMulti to MockBackend
+type MockBatchBackend struct {
+	*MockBackend
+	getMultiCalls int
+	setMultiCalls int
+}
+
+func (m *MockBatchBackend) GetMulti(ctx context.Context, keys []string) ([]*State, error) {
+	m.getMultiCalls++
+	states := make([]*State, len(keys))
+	for i, key := range keys {
+		states[i], _ = m.Get(ctx, key)
+	}
+	return states, nil
+}
+
+func (m *MockBatchBackend) SetMulti(ctx context.Context, keys []string, states []*State) error {
+	m.setMultiCalls++
+	for i, key := range keys {
+		m.Set(ctx, key, states[i])
+	}
+	return nil
+}
+
+// countingStrategy consumes one token per call and denies at zero
+type countingStrategy struct{}
+
+func (countingStrategy) Calculate(ctx context.Context, state *State, now time.Time) (Decision, error) {
+	if state.Tokens < 1 {
+		return Decision{Allowed: false}, nil
+	}
+	state.Tokens--
+	return Decision{Allowed: true, Remaining: int64(state.Tokens)}, nil
+}
+
+func (countingStrategy) Preview(ctx context.Context, state *State, now time.Time) (Decision, error) {
+	return Decision{Allowed: state.Tokens >= 1, Remaining: int64(state.Tokens)}, nil
+}
+
+func TestLimiter_GrantMulti(t *testing.T) {
+	backend := &MockBatchBackend{MockBackend: NewMockBackend()}
+	metrics := NewMockMetricsReporter()
+	config := Config{Limit: 2, Interval: time.Minute, Burst: 2}
+
+	limiter := NewLimiter(backend, countingStrategy{}, config, metrics)
+
+	ctx := context.Background()
+	decisions, err := limiter.GrantMulti(ctx, []string{"a", "b", "a", "a"})
+
+	assert.NoError(t, err)
+	assert.Len(t, decisions, 4)
+	assert.True(t, decisions[0].Allowed)
+	assert.True(t, decisions[1].Allowed)
+	assert.True(t, decisions[2].Allowed)
+	assert.False(t, decisions[3].Allowed)
+	assert.Equal(t, int64(0), decisions[2].Remaining)
+	assert.Equal(t, 1, backend.getMultiCalls)
+	assert.Equal(t, 1, backend.setMultiCalls)
+	assert.Equal(t, 4, metrics.grantCalls)
+	assert.Equal(t, float64(0), backend.store["a"].Tokens)
+	assert.Equal(t, float64(1), backend.store["b"].Tokens)
+}
+
+func TestLimiter_GrantMultiWithoutBatchBackend(t *testing.T) {
+	backend := NewMockBackend()
+	config := Config{Limit: 1, Interval: time.Minute, Burst: 1}
+
+	limiter := NewLimiter(backend, countingStrategy{}, config, nil)
+
+	ctx := context.Background()
+	decisions, err := limiter.GrantMulti(ctx, []string{"a", "a", "b"})
+
+	assert.NoError(t, err)
+	assert.True(t, decisions[0].Allowed)
+	assert.False(t, decisions[1].Allowed)
+	assert.True(t, decisions[2].Allowed)
+}
+
+// MockDenyCacheBackend denies "blocked" without touching the store
+type MockDenyCacheBackend struct {
+	*MockBackend
+	recorded []Decision
+}
+
+func (m *MockDenyCacheBackend) Denied(key string, now time.Time) (Decision, bool) {
+	if key == "blocked" {
+		return Decision{Allowed: false, RetryAfter: time.Second}, true
+	}
+	return Decision{}, false
+}
+
+func (m *MockDenyCacheBackend) RecordDecision(key string, decision Decision, now time.Time) {
+	m.recorded = append(m.recorded, decision)
+}
+
+func TestLimiter_GrantUsesDenyCache(t *testing.T) {
+	backend := &MockDenyCacheBackend{MockBackend: NewMockBackend()}
+	metrics := NewMockMetricsReporter()
+	limiter := NewLimiter(backend, NewMockStrategy(true, 5), Config{Limit: 10, Interval: time.Second, Burst: 10}, metrics)
+	ctx := context.Background()
+
+	decision, err := limiter.Grant(ctx, "blocked")
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+	assert.Empty(t, backend.store)
+	assert.Empty(t, backend.recorded)
+	assert.Equal(t, 1, metrics.grantCalls)
+
+	decision, err = limiter.Grant(ctx, "open")
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Len(t, backend.recorded, 1)
+}
+
+// MockIteratorBackend adds key iteration to MockBackend, Count keys per page
+type MockIteratorBackend struct {
+	*MockBackend
+}
+
+func (m *MockIteratorBackend) Scan(ctx context.Context, filter Filter, cursor string) ([]Entry, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var keys []string
+	for key := range m.store {
+		if key > cursor {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	next := ""
+	if filter.Count > 0 && len(keys) > filter.Count {
+		keys = keys[:filter.Count]
+		next = keys[len(keys)-1]
+	}
+
+	var entries []Entry
+	for _, key := range keys {
+		if filter.Matches(key) {
+			entries = append(entries, Entry{Key: key, State: m.store[key]})
+		}
+	}
+	return entries, next, nil
+}
+
+func newIteratorLimiter(keys ...string) (*Limiter, *MockIteratorBackend, *MockMetricsReporter) {
+	backend := &MockIteratorBackend{MockBackend: NewMockBackend()}
+	for _, key := range keys {
+		backend.store[key] = &State{Tokens: 1}
+	}
+	metrics := NewMockMetricsReporter()
+	limiter := NewLimiter(backend, NewMockStrategy(true, 5), Config{Limit: 10, Interval: time.Minute, Burst: 10}, metrics)
+	return limiter, backend, metrics
+}
+
+func TestLimiter_Scan(t *testing.T) {
+	limiter, _, _ := newIteratorLimiter("a:1", "a:2", "b:1")
+
+	scanner, err := limiter.Scan(Filter{Prefix: "a:"})
+	require.NoError(t, err)
+
+	var keys []string
+	for key, state := range scanner.All(context.Background()) {
+		keys = append(keys, key)
+		assert.Equal(t, 1.0, state.Tokens)
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"a:1", "a:2"}, keys)
+
+	plain := NewLimiter(NewMockBackend(), NewMockStrategy(true, 5), Config{}, nil)
+	_, err = plain.Scan(Filter{})
+	assert.ErrorIs(t, err, ErrNotIterable)
+	_, err = plain.ClearPrefix(context.Background(), "a:")
+	assert.ErrorIs(t, err, ErrNotIterable)
+}
+
+func TestLimiter_ClearPrefix(t *testing.T) {
+	limiter, backend, metrics := newIteratorLimiter("tenant-a:1", "tenant-a:2", "tenant-a:3", "tenant-b:1")
+
+	cleared, err := limiter.ClearPrefix(context.Background(), "tenant-a:", WithClearBatch(2))
+	require.NoError(t, err)
+	assert.Equal(t, 3, cleared)
+	assert.Equal(t, 3, metrics.clearCalls)
+	assert.Len(t, backend.store, 1)
+	assert.Contains(t, backend.store, "tenant-b:1")
+}
+
+func TestLimiter_ClearMatching(t *testing.T) {
+	limiter, backend, _ := newIteratorLimiter("user:1:login", "user:2:login", "user:1:api")
+
+	cleared, err := limiter.ClearMatching(context.Background(), "user:*:login")
+	require.NoError(t, err)
+	assert.Equal(t, 2, cleared)
+	assert.Len(t, backend.store, 1)
+	assert.Contains(t, backend.store, "user:1:api")
+}
+
+func TestLimiter_ClearRate(t *testing.T) {
+	var keys []string
+	for i := 0; i < 30; i++ {
+		keys = append(keys, fmt.Sprintf("key-%02d", i))
+	}
+	limiter, backend, _ := newIteratorLimiter(keys...)
+
+	// 30 keys in batches of 10 at 200 keys/s wait 50ms before the second
+	// batch and 100ms before the third
+	start := time.Now()
+	cleared, err := limiter.ClearPrefix(context.Background(), "key-", WithClearBatch(10), WithClearRate(200))
+	require.NoError(t, err)
+	assert.Equal(t, 30, cleared)
+	assert.Empty(t, backend.store)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// Cancelling while paused reports the keys cleared so far
+	limiter, backend, _ = newIteratorLimiter(keys...)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	cleared, err = limiter.ClearPrefix(ctx, "key-", WithClearBatch(10), WithClearRate(10))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 10, cleared)
+	assert.Len(t, backend.store, 20)
+}
+
+// MockPingerBackend adds a Ping failing with err and Stats to MockBackend
+type MockPingerBackend struct {
+	*MockBackend
+	err error
+}
+
+func (m *MockPingerBackend) Ping(ctx context.Context) error {
+	return m.err
+}
+
+func (m *MockPingerBackend) Stats() map[string]interface{} {
+	return map[string]interface{}{"keys_count": len(m.store)}
+}
+
+func TestLimiter_Health(t *testing.T) {
+	backend := &MockPingerBackend{MockBackend: NewMockBackend()}
+	limiter := NewLimiter(backend, NewMockStrategy(true, 5), Config{}, nil)
+	ctx := context.Background()
+
+	health := limiter.Health(ctx)
+	assert.True(t, health.Healthy)
+	assert.NoError(t, health.Err)
+	assert.Equal(t, map[string]interface{}{"keys_count": 0}, health.Stats)
+
+	backend.err = errors.New("connection refused")
+	health = limiter.Health(ctx)
+	assert.False(t, health.Healthy)
+	assert.Equal(t, backend.err, health.Err)
+
+	// Backends that can't be pinged are assumed healthy
+	health = NewLimiter(NewMockBackend(), NewMockStrategy(true, 5), Config{}, nil).Health(ctx)
+	assert.True(t, health.Healthy)
+	assert.Nil(t, health.Stats)
+}
+
+// MockTimingReporter adds RecordTiming to MockMetricsReporter
+type MockTimingReporter struct {
+	*MockMetricsReporter
+	timings map[Operation][]Phase
+}
+
+func (m *MockTimingReporter) RecordTiming(op Operation, phase Phase, d time.Duration) {
+	m.timings[op] = append(m.timings[op], phase)
+}
+
+func newTimingReporter() *MockTimingReporter {
+	return &MockTimingReporter{MockMetricsReporter: NewMockMetricsReporter(), timings: make(map[Operation][]Phase)}
+}
+
+func TestLimiter_Timing(t *testing.T) {
+	ctx := context.Background()
+	config := Config{Limit: 10, Interval: time.Minute, Burst: 15}
+
+	// Plain backend: Get, Calculate, Set
+	timing := newTimingReporter()
+	limiter := NewLimiter(NewMockBackend(), NewMockStrategy(true, 5), config, timing)
+	_, err := limiter.Grant(ctx, "test-key")
+	require.NoError(t, err)
+	_, err = limiter.Preview(ctx, "test-key")
+	require.NoError(t, err)
+	require.NoError(t, limiter.Clear(ctx, "test-key"))
+
+	assert.Equal(t, map[Operation][]Phase{
+		OpGrant:   {PhaseBackendGet, PhaseStrategy, PhaseBackendSet, PhaseTotal},
+		OpPreview: {PhaseBackendGet, PhaseStrategy, PhaseTotal},
+		OpClear:   {PhaseBackendDelete, PhaseTotal},
+	}, timing.timings)
+
+	// Updater: the strategy runs inside the update
+	timing = newTimingReporter()
+	limiter = NewLimiter(&MockUpdaterBackend{MockBackend: NewMockBackend()}, NewMockStrategy(true, 5), config, timing)
+	_, err = limiter.Grant(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []Phase{PhaseStrategy, PhaseBackendUpdate, PhaseTotal}, timing.timings[OpGrant])
+
+	// Batch backend: one GetMulti and SetMulti for all keys
+	timing = newTimingReporter()
+	limiter = NewLimiter(&MockBatchBackend{MockBackend: NewMockBackend()}, countingStrategy{}, config, timing)
+	_, err = limiter.GrantMulti(ctx, []string{"a", "b"})
+	require.NoError(t, err)
+	assert.Equal(t, []Phase{PhaseBackendGet, PhaseStrategy, PhaseStrategy, PhaseBackendSet, PhaseTotal}, timing.timings[OpGrantMulti])
+
+	// Reporters without RecordTiming aren't timed
+	assert.Nil(t, NewLimiter(NewMockBackend(), NewMockStrategy(true, 5), config, NewMockMetricsReporter()).timers)
+}
+
+// recordingObserver keeps the events it observes
+type recordingObserver struct {
+	events []Event
+}
+
+func (r *recordingObserver) Observe(ctx context.Context, event Event) {
+	r.events = append(r.events, event)
+}
+
+func TestLimiter_Observers(t *testing.T) {
+	ctx := context.Background()
+	config := Config{Limit: 1, Interval: time.Minute, Burst: 1}
+	first, second := &recordingObserver{}, &recordingObserver{}
+	metrics := newTimingReporter()
+
+	limiter := NewLimiterWithOptions(NewMockBackend(), countingStrategy{}, config, LimiterOptions{
+		Policy:    "login",
+		Observers: []Observer{MultiObserver{first, second}, ReporterObserver(metrics)},
+	})
+
+	_, err := limiter.Grant(ctx, "a")
+	require.NoError(t, err)
+	_, err = limiter.GrantMulti(WithFallback(ctx), []string{"a", "b"})
+	require.NoError(t, err)
+	_, err = limiter.Preview(ctx, "a")
+	require.NoError(t, err)
+
+	require.Len(t, first.events, 4)
+	assert.Equal(t, first.events, second.events)
+
+	grant := first.events[0]
+	assert.Equal(t, OpGrant, grant.Operation)
+	assert.Equal(t, "a", grant.Key)
+	assert.Equal(t, "login", grant.Policy)
+	assert.Equal(t, int64(1), grant.Cost)
+	assert.True(t, grant.Decision.Allowed)
+	assert.False(t, grant.Fallback)
+	assert.Positive(t, grant.Duration)
+	assert.Contains(t, grant.Durations, PhaseBackendGet)
+	assert.Contains(t, grant.Durations, PhaseStrategy)
+	assert.Equal(t, grant.Duration, grant.Durations[PhaseTotal])
+
+	denied, allowed := first.events[1], first.events[2]
+	assert.Equal(t, OpGrantMulti, denied.Operation)
+	assert.False(t, denied.Decision.Allowed)
+	assert.True(t, denied.Fallback)
+	assert.Equal(t, "b", allowed.Key)
+	assert.True(t, allowed.Decision.Allowed)
+
+	assert.Equal(t, OpPreview, first.events[3].Operation)
+	assert.Zero(t, first.events[3].Cost)
+
+	// The adapted reporter sees the same operations and their timings
+	assert.Equal(t, 3, metrics.grantCalls)
+	assert.Equal(t, 1, metrics.previewCalls)
+	assert.Contains(t, metrics.timings[OpGrantMulti], PhaseTotal)
+}
+
+func TestLimiter_ObserversSeeErrors(t *testing.T) {
+	observer := &recordingObserver{}
+	metrics := NewMockMetricsReporter()
+	limiter := NewLimiterWithOptions(&failingBackend{}, NewMockStrategy(true, 5), Config{Limit: 1, Interval: time.Minute, Burst: 1},
+		LimiterOptions{Observers: []Observer{observer, ReporterObserver(metrics)}})
+
+	_, err := limiter.Grant(context.Background(), "a")
+	require.Error(t, err)
+	require.Error(t, limiter.Clear(context.Background(), "a"))
+
+	require.Len(t, observer.events, 2)
+	assert.ErrorIs(t, observer.events[0].Err, errBackendDown)
+	assert.Equal(t, OpClear, observer.events[1].Operation)
+	assert.ErrorIs(t, observer.events[1].Err, errBackendDown)
+
+	// Reporters only count successful operations
+	assert.Zero(t, metrics.grantCalls)
+	assert.Zero(t, metrics.clearCalls)
+}
+
+var errBackendDown = errors.New("backend down")
+
+// failingBackend fails every operation
+type failingBackend struct{}
+
+func (failingBackend) Get(ctx context.Context, key string) (*State, error) {
+	return nil, errBackendDown
+}
+
+func (failingBackend) Set(ctx context.Context, key string, state *State) error {
+	return errBackendDown
+}
+
+func (failingBackend) Delete(ctx context.Context, key string) error {
+	return errBackendDown
+}
+
+func (failingBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"sort"
+	"sync"
+)
+
+// lockStripes is the number of mutexes keys are spread over
+const lockStripes = 256
+
+// keyLocks serialises operations on the same key without a global lock, so
+// decisions for different keys run in parallel and can be coalesced by the
+// backend
+type keyLocks [lockStripes]sync.RWMutex
+
+// of returns the lock guarding key
+func (k *keyLocks) of(key string) *sync.RWMutex {
+	return &k[stripe(key)]
+}
+
+// lockAll locks the stripes of all keys in ascending order, so concurrent
+// multi-key callers can't deadlock, and returns the matching unlock
+func (k *keyLocks) lockAll(keys []string) func() {
+	seen := make(map[uint32]bool, len(keys))
+	stripes := make([]uint32, 0, len(keys))
+	for _, key := range keys {
+		s := stripe(key)
+		if !seen[s] {
+			seen[s] = true
+			stripes = append(stripes, s)
+		}
+	}
+	sort.Slice(stripes, func(i, j int) bool { return stripes[i] < stripes[j] })
+
+	for _, s := range stripes {
+		k[s].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			k[stripes[i]].Unlock()
+		}
+	}
+}
+
+// stripe hashes key with FNV-1a onto a lock index
+func stripe(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h % lockStripes
+}
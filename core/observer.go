@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// Event describes one limiter operation on one key. GrantMulti produces
+// an event per key, all sharing the batch's durations.
+type Event struct {
+	Operation Operation
+	Key       string
+	Policy    string                  // LimiterOptions.Policy of the limiter
+	Decision  Decision                // Zero for Clear and when Err is set
+	Cost      int64                   // Tokens the operation asked for (0 for Preview and Clear)
+	Err       error                   // Why the operation failed
+	Time      time.Time               // When the operation started
+	Duration  time.Duration           // How long the whole operation took
+	Durations map[Phase]time.Duration // Time spent per phase, summed when a phase ran more than once
+	Fallback  bool                    // Decided locally because the usual decider was unreachable, see WithFallback
+}
+
+// Observer receives an event for every limiter operation. Observe is
+// called synchronously after the operation, so it should return quickly.
+type Observer interface {
+	// Observe handles event; ctx is the context the operation ran with
+	Observe(ctx context.Context, event Event)
+}
+
+// ObserverFunc adapts a function to an Observer
+type ObserverFunc func(ctx context.Context, event Event)
+
+// Observe calls f
+func (f ObserverFunc) Observe(ctx context.Context, event Event) {
+	f(ctx, event)
+}
+
+// MultiObserver passes every event to each of its observers in order
+type MultiObserver []Observer
+
+// Observe passes event to every observer
+func (m MultiObserver) Observe(ctx context.Context, event Event) {
+	for _, o := range m {
+		o.Observe(ctx, event)
+	}
+}
+
+// ReporterObserver adapts a MetricsReporter to an Observer: successful
+// grants, previews and clears are passed to RecordGrant, RecordPreview and
+// RecordClear, and failed operations are ignored. If r is also a
+// TimingReporter the adapter is one too, so the limiter keeps timing
+// operations for it.
+func ReporterObserver(r MetricsReporter) Observer {
+	if timing, ok := r.(TimingReporter); ok {
+		return timedReporterObserver{reporterObserver{r}, timing}
+	}
+	return reporterObserver{r}
+}
+
+// reporterObserver forwards events to a MetricsReporter
+type reporterObserver struct {
+	reporter MetricsReporter
+}
+
+func (r reporterObserver) Observe(ctx context.Context, event Event) {
+	if event.Err != nil {
+		return
+	}
+
+	switch event.Operation {
+	case OpGrant, OpGrantMulti:
+		r.reporter.RecordGrant(event.Key, event.Decision.Allowed, event.Decision.Remaining)
+	case OpPreview:
+		r.reporter.RecordPreview(event.Key, event.Decision.Remaining)
+	case OpClear:
+		r.reporter.RecordClear(event.Key)
+	}
+}
+
+// timedReporterObserver forwards events and timings to a reporter
+// implementing both interfaces
+type timedReporterObserver struct {
+	reporterObserver
+	TimingReporter
+}
+
+// fallbackKey marks a context with WithFallback
+type fallbackKey struct{}
+
+// WithFallback marks ctx so that the events of operations run with it have
+// Fallback set. Wrappers use it when deciding locally because the usual
+// decider, such as a cluster peer, can't be reached.
+func WithFallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fallbackKey{}, true)
+}
+
+// isFallback reports whether ctx was marked with WithFallback
+func isFallback(ctx context.Context) bool {
+	fallback, _ := ctx.Value(fallbackKey{}).(bool)
+	return fallback
+}
+
+// TimersOf returns the observers, including those inside a MultiObserver,
+// that also want timings. Limiters other than Limiter use it to pass their
+// phase durations to RecordTiming.
+func TimersOf(observers []Observer) []TimingReporter {
+	var timers []TimingReporter
+	for _, o := range observers {
+		switch o := o.(type) {
+		case MultiObserver:
+			timers = append(timers, TimersOf(o)...)
+		case TimingReporter:
+			timers = append(timers, o)
+		}
+	}
+	return timers
+}
@@ -13,6 +13,12 @@ type Decision struct {
 	RetryAfter time.Duration // How long to wait before retrying (if not allowed)
 }
 
+// CeilMillis returns d in whole milliseconds, rounded up so that a short wait
+// never becomes no wait
+func CeilMillis(d time.Duration) int64 {
+	return (d + time.Millisecond - 1).Milliseconds()
+}
+
 // RateLimiter defines the main interface for rate limiting operations
 type RateLimiter interface {
 	// Grant determines whether a request should be allowed now
@@ -40,6 +46,79 @@ type Backend interface {
 	Close() error
 }
 
+// Updater is implemented by backends that can perform an atomic
+// read-modify-write of a key's state, which matters when several processes
+// share the same storage
+type Updater interface {
+	// Update loads the state for key (nil if missing), passes it to fn and
+	// stores the state fn returns as a single atomic operation. fn may be
+	// called more than once if the backend retries on contention.
+	Update(ctx context.Context, key string, fn func(state *State) (*State, error)) error
+}
+
+// BatchBackend is implemented by backends that can read and write several
+// keys in a single round-trip
+type BatchBackend interface {
+	// GetMulti retrieves the states for keys, with nil for missing keys
+	GetMulti(ctx context.Context, keys []string) ([]*State, error)
+
+	// SetMulti stores states[i] for keys[i]
+	SetMulti(ctx context.Context, keys []string, states []*State) error
+}
+
+// DenyCache is implemented by backends that remember denials locally, so
+// requests for a key known to be denied are answered without touching the
+// underlying storage
+type DenyCache interface {
+	// Denied returns the cached denial for key if it is still in effect at now
+	Denied(key string, now time.Time) (Decision, bool)
+
+	// RecordDecision lets the cache remember a decision made at now
+	RecordDecision(key string, decision Decision, now time.Time)
+}
+
+// Iterator is implemented by backends that can enumerate their keys
+type Iterator interface {
+	// Scan returns a page of entries matching filter, starting at cursor
+	// ("" for the first page), and the cursor of the next page ("" after
+	// the last). Pages may be empty before the end. Keys that exist for the
+	// whole iteration are returned at least once, and callers must tolerate
+	// duplicates (Redis SCAN may repeat keys); keys added or removed
+	// meanwhile may or may not be returned.
+	Scan(ctx context.Context, filter Filter, cursor string) ([]Entry, string, error)
+}
+
+// Pinger is implemented by backends that can check they reach their
+// storage. Backends without a Pinger are assumed to be reachable.
+type Pinger interface {
+	// Ping returns an error if the storage can't be reached
+	Ping(ctx context.Context) error
+}
+
+// StatsProvider is implemented by backends and limiters that report
+// statistics. Keys are snake_case and values can be encoded as JSON.
+// Backends holding keys report them as "keys_count"; backends with a
+// connection pool report "total_connections" and "idle_connections";
+// wrapping backends report the wrapped backend's statistics as "backend".
+type StatsProvider interface {
+	// Stats returns a snapshot of the current statistics
+	Stats() map[string]interface{}
+}
+
+// Health describes whether a limiter can currently reach its backend
+type Health struct {
+	Healthy bool                   // Whether the backend answered
+	Latency time.Duration          // How long the ping took (0 without a Pinger)
+	Err     error                  // Why the backend is unhealthy
+	Stats   map[string]interface{} // The backend's statistics, if it reports any
+}
+
+// HealthChecker is implemented by limiters that can check their backend
+type HealthChecker interface {
+	// Health checks the backend, giving up when ctx is done
+	Health(ctx context.Context) Health
+}
+
 // State represents the internal state of a rate limiter for a key
 type State struct {
 	Tokens     float64   // Current number of tokens
@@ -56,6 +135,21 @@ type Strategy interface {
 	Preview(ctx context.Context, state *State, now time.Time) (Decision, error)
 }
 
+// Initializer is implemented by strategies whose state for a key that has
+// never been seen is not a bucket holding Burst tokens
+type Initializer interface {
+	// NewState returns the state of a key that has never been seen
+	NewState(now time.Time) *State
+}
+
+// Expirer is implemented by strategies that can tell when a stored state
+// has become equivalent to a fresh one, so backends can expire it
+type Expirer interface {
+	// TTL returns how long after state.LastUpdate the state still differs
+	// from the state of a key that has never been seen
+	TTL(state *State) time.Duration
+}
+
 // Config holds configuration for rate limiting strategies
 type Config struct {
 	Limit    int64         // Maximum number of requests/tokens
@@ -63,7 +157,9 @@ type Config struct {
 	Burst    int64         // Maximum burst capacity (for token bucket)
 }
 
-// MetricsReporter defines the interface for reporting metrics
+// MetricsReporter defines the interface for reporting metrics. Limiters
+// report to it through ReporterObserver; implement Observer instead to see
+// the policy, cost, errors and durations of each operation.
 type MetricsReporter interface {
 	// RecordGrant records a grant decision
 	RecordGrant(key string, allowed bool, remaining int64)
@@ -74,3 +170,36 @@ type MetricsReporter interface {
 	// RecordClear records a clear operation
 	RecordClear(key string)
 }
+
+// Operation names a limiter method in timings
+type Operation string
+
+const (
+	OpGrant      Operation = "grant"
+	OpGrantMulti Operation = "grant_multi"
+	OpPreview    Operation = "preview"
+	OpClear      Operation = "clear"
+
+	// OpReload is reported by wrappers reloading their configuration; the
+	// event's Key names what was reloaded, such as a file
+	OpReload Operation = "reload"
+)
+
+// Phase names the part of an operation a timing covers
+type Phase string
+
+const (
+	PhaseTotal         Phase = "total"          // The whole operation, including waiting for the key's lock
+	PhaseBackendGet    Phase = "backend_get"    // Backend Get or GetMulti
+	PhaseBackendSet    Phase = "backend_set"    // Backend Set or SetMulti
+	PhaseBackendUpdate Phase = "backend_update" // Atomic Update, including the strategy inside it
+	PhaseBackendDelete Phase = "backend_delete" // Backend Delete
+	PhaseStrategy      Phase = "strategy"       // Strategy Calculate or Preview
+)
+
+// TimingReporter is implemented by metrics reporters that record how long
+// limiter operations and their phases take
+type TimingReporter interface {
+	// RecordTiming records that phase of op took d
+	RecordTiming(op Operation, phase Phase, d time.Duration)
+}
@@ -0,0 +1,15 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCeilMillis(t *testing.T) {
+	assert.Equal(t, int64(0), CeilMillis(0))
+	assert.Equal(t, int64(1), CeilMillis(time.Nanosecond))
+	assert.Equal(t, int64(1), CeilMillis(time.Millisecond))
+	assert.Equal(t, int64(2), CeilMillis(time.Millisecond+300*time.Microsecond))
+}
@@ -0,0 +1,109 @@
+// Package health serves liveness and readiness probes for a limiter. The
+// liveness probe only shows the process is serving requests; the readiness
+// probe checks the backend and fails while it can't be reached, so a load
+// balancer or orchestrator stops routing traffic to the instance:
+//
+//	h := health.NewHandler(limiter, health.Options{})
+//	mux.Handle("/health/", http.StripPrefix("/health", h)) // /health/live, /health/ready
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// Status values reported in responses
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Options configures the handler
+type Options struct {
+	Timeout time.Duration // Bound on a readiness check (default 2s)
+}
+
+// Response is the JSON body of both probes
+type Response struct {
+	Status    string                 `json:"status"`
+	Time      time.Time              `json:"time"`
+	LatencyMS float64                `json:"latency_ms,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Stats     map[string]interface{} `json:"stats,omitempty"`
+}
+
+// Handler serves the liveness probe at /live and the readiness probe at
+// /ready
+type Handler struct {
+	checker core.HealthChecker
+	opts    Options
+	mux     *http.ServeMux
+	now     func() time.Time
+}
+
+// NewHandler creates a handler checking the backend of checker, usually a
+// *core.Limiter
+func NewHandler(checker core.HealthChecker, opts Options) *Handler {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	h := &Handler{
+		checker: checker,
+		opts:    opts,
+		mux:     http.NewServeMux(),
+		now:     time.Now,
+	}
+	h.mux.HandleFunc("GET /live", h.Live)
+	h.mux.HandleFunc("GET /ready", h.Ready)
+	return h
+}
+
+// ServeHTTP routes to Live and Ready
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Live always reports the process as alive
+func (h *Handler) Live(w http.ResponseWriter, r *http.Request) {
+	h.write(w, http.StatusOK, Response{Status: StatusOK, Time: h.now()})
+}
+
+// Ready checks the backend, answering 503 Service Unavailable if it can't
+// be reached within the timeout. The response includes the round-trip
+// latency and the backend's statistics.
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.opts.Timeout)
+	defer cancel()
+
+	health := h.checker.Health(ctx)
+
+	resp := Response{
+		Status:    StatusOK,
+		Time:      h.now(),
+		LatencyMS: float64(health.Latency) / float64(time.Millisecond),
+		Stats:     health.Stats,
+	}
+	code := http.StatusOK
+	if !health.Healthy {
+		resp.Status = StatusUnavailable
+		if health.Err != nil {
+			resp.Error = health.Err.Error()
+		}
+		code = http.StatusServiceUnavailable
+	}
+
+	h.write(w, code, resp)
+}
+
+// write sends resp as JSON; probes must never be cached
+func (h *Handler) write(w http.ResponseWriter, code int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
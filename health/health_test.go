@@ -0,0 +1,86 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// stubChecker returns a fixed health and records the context deadline
+type stubChecker struct {
+	health   core.Health
+	deadline time.Time
+}
+
+func (s *stubChecker) Health(ctx context.Context) core.Health {
+	s.deadline, _ = ctx.Deadline()
+	return s.health
+}
+
+func get(t *testing.T, h http.Handler, path string) (*httptest.ResponseRecorder, Response) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var resp Response
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return rec, resp
+}
+
+func TestHandler_Ready(t *testing.T) {
+	checker := &stubChecker{health: core.Health{
+		Healthy: true,
+		Latency: 1500 * time.Microsecond,
+		Stats:   map[string]interface{}{"idle_connections": 3},
+	}}
+	h := NewHandler(checker, Options{Timeout: time.Second})
+
+	rec, resp := get(t, h, "/ready")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, StatusOK, resp.Status)
+	assert.Equal(t, 1.5, resp.LatencyMS)
+	assert.Equal(t, float64(3), resp.Stats["idle_connections"])
+	assert.Empty(t, resp.Error)
+	assert.WithinDuration(t, time.Now().Add(time.Second), checker.deadline, 100*time.Millisecond)
+}
+
+func TestHandler_NotReady(t *testing.T) {
+	checker := &stubChecker{health: core.Health{Err: errors.New("connection refused")}}
+	h := NewHandler(checker, Options{})
+
+	rec, resp := get(t, h, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, StatusUnavailable, resp.Status)
+	assert.Equal(t, "connection refused", resp.Error)
+
+	// Liveness doesn't depend on the backend
+	rec, resp = get(t, h, "/live")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, StatusOK, resp.Status)
+}
+
+func TestHandler_WithLimiter(t *testing.T) {
+	config := core.Config{Limit: 10, Interval: time.Minute, Burst: 10}
+	limiter := core.NewLimiter(memory.NewBackend(), tokenbucket.NewStrategy(config), config, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/health/", http.StripPrefix("/health", NewHandler(limiter, Options{})))
+
+	rec, resp := get(t, mux, "/health/ready")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, float64(0), resp.Stats["keys_count"])
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/health/ready", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
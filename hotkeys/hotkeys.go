@@ -0,0 +1,234 @@
+// Package hotkeys finds the keys granted and denied most often, in bounded
+// memory, so an incident can be traced to its clients without labelling
+// metrics by key. A Tracker is a core.Observer:
+//
+//	tracker := hotkeys.NewTracker(hotkeys.Options{})
+//	limiter := core.NewLimiterWithOptions(backend, strategy, config, core.LimiterOptions{
+//		Observers: []core.Observer{tracker},
+//	})
+//	mux.Handle("/debug/hotkeys", tracker.Handler())
+//
+// Counts cover a sliding window made of Buckets sub-windows, each counted
+// with the Space-Saving algorithm over at most Capacity keys. Counts can be
+// overestimated by the returned Error, never underestimated, and any key
+// making up more than 1/Capacity of a sub-window's events is found.
+package hotkeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// Tracker defaults
+const (
+	defaultCapacity = 1000
+	defaultWindow   = 5 * time.Minute
+	defaultBuckets  = 5
+	defaultTop      = 10
+)
+
+// Options configures a Tracker
+type Options struct {
+	Capacity int           // Keys counted per sub-window and kind (default 1000)
+	Window   time.Duration // How far back counts go (default 5m)
+	Buckets  int           // Sub-windows the window slides by (default 5)
+}
+
+// Entry is a key and how often it was seen
+type Entry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"` // At least the true count
+	Error uint64 `json:"error"` // By how much Count may exceed the true count
+}
+
+// Tracker implements core.Observer by counting the keys of grants and
+// denials
+type Tracker struct {
+	opts  Options
+	width time.Duration // Of a sub-window
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets []bucket
+}
+
+// bucket counts the events of one sub-window
+type bucket struct {
+	epoch   int64 // Sub-windows since the Unix epoch
+	grants  *summary
+	denials *summary
+}
+
+// NewTracker creates a tracker
+func NewTracker(opts Options) *Tracker {
+	if opts.Capacity <= 0 {
+		opts.Capacity = defaultCapacity
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaultWindow
+	}
+	if opts.Buckets <= 0 {
+		opts.Buckets = defaultBuckets
+	}
+
+	t := &Tracker{
+		opts:    opts,
+		width:   max(opts.Window/time.Duration(opts.Buckets), 1),
+		now:     time.Now,
+		buckets: make([]bucket, opts.Buckets),
+	}
+	for i := range t.buckets {
+		t.buckets[i] = bucket{epoch: -1, grants: newSummary(opts.Capacity), denials: newSummary(opts.Capacity)}
+	}
+	return t
+}
+
+// Observe counts grant requests by key, and the denied ones separately
+func (t *Tracker) Observe(ctx context.Context, event core.Event) {
+	if event.Err != nil || (event.Operation != core.OpGrant && event.Operation != core.OpGrantMulti) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.current()
+	b.grants.add(event.Key)
+	if !event.Decision.Allowed {
+		b.denials.add(event.Key)
+	}
+}
+
+// TopGrants returns the n keys with the most grant requests, allowed or
+// not, within the window, most first. A negative n returns every key
+// counted.
+func (t *Tracker) TopGrants(n int) []Entry {
+	return t.top(n, func(b *bucket) *summary { return b.grants })
+}
+
+// TopDenials returns the n keys denied most within the window, most first
+func (t *Tracker) TopDenials(n int) []Entry {
+	return t.top(n, func(b *bucket) *summary { return b.denials })
+}
+
+// Reset forgets all counts
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.buckets {
+		t.buckets[i].epoch = -1
+		t.buckets[i].grants.reset()
+		t.buckets[i].denials.reset()
+	}
+}
+
+// current returns the bucket of the sub-window now is in, emptying it if
+// it last held an older sub-window; the caller holds mu
+func (t *Tracker) current() *bucket {
+	epoch := t.epoch()
+	b := &t.buckets[epoch%int64(len(t.buckets))]
+	if b.epoch != epoch {
+		b.epoch = epoch
+		b.grants.reset()
+		b.denials.reset()
+	}
+	return b
+}
+
+// epoch numbers the sub-window now is in
+func (t *Tracker) epoch() int64 {
+	return t.now().UnixNano() / int64(t.width)
+}
+
+// top merges the summaries of the sub-windows still in the window. A key
+// missing from a full summary may have been evicted from it, so that
+// summary's smallest count is added to the key's error.
+func (t *Tracker) top(n int, of func(b *bucket) *summary) []Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldest := t.epoch() - int64(len(t.buckets)) + 1
+	var live []*summary
+	for i := range t.buckets {
+		if t.buckets[i].epoch >= oldest {
+			live = append(live, of(&t.buckets[i]))
+		}
+	}
+
+	merged := make(map[string]*Entry)
+	for _, s := range live {
+		for key, c := range s.counters {
+			e, ok := merged[key]
+			if !ok {
+				e = &Entry{Key: key}
+				merged[key] = e
+			}
+			e.Count += c.count
+			e.Error += c.err
+		}
+	}
+	for _, s := range live {
+		if bound := s.min(); bound > 0 {
+			for key, e := range merged {
+				if _, ok := s.counters[key]; !ok {
+					e.Count += bound
+					e.Error += bound
+				}
+			}
+		}
+	}
+
+	entries := make([]Entry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if n >= 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// Response is the JSON body served by Handler
+type Response struct {
+	Window  string  `json:"window"`
+	Grants  []Entry `json:"grants"`
+	Denials []Entry `json:"denials"`
+}
+
+// Handler serves the top keys as JSON; the n query parameter sets how many
+// (default 10). Keys are shown as they are, so keep the endpoint internal.
+func (t *Tracker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := defaultTop
+		if value := r.URL.Query().Get("n"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			n = parsed
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(Response{
+			Window:  t.opts.Window.String(),
+			Grants:  t.TopGrants(n),
+			Denials: t.TopDenials(n),
+		})
+	})
+}
@@ -0,0 +1,139 @@
+package hotkeys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// fakeNow returns a clock for t that tests move by hand
+func fakeNow(t *Tracker) *time.Time {
+	now := time.Unix(1700000000, 0)
+	t.now = func() time.Time { return now }
+	return &now
+}
+
+// grant returns a grant event for key
+func grant(key string, allowed bool) core.Event {
+	return core.Event{Operation: core.OpGrant, Key: key, Decision: core.Decision{Allowed: allowed}}
+}
+
+func TestTracker_WithLimiter(t *testing.T) {
+	tracker := NewTracker(Options{})
+	config := core.Config{Limit: 2, Interval: time.Hour, Burst: 2}
+	limiter := core.NewLimiterWithOptions(memory.NewBackend(), tokenbucket.NewStrategy(config), config, core.LimiterOptions{
+		Observers: []core.Observer{tracker},
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := limiter.Grant(ctx, "noisy")
+		require.NoError(t, err)
+	}
+	_, err := limiter.GrantMulti(ctx, []string{"quiet", "noisy"})
+	require.NoError(t, err)
+	_, err = limiter.Preview(ctx, "quiet")
+	require.NoError(t, err)
+
+	assert.Equal(t, []Entry{{Key: "noisy", Count: 6}, {Key: "quiet", Count: 1}}, tracker.TopGrants(10))
+	assert.Equal(t, []Entry{{Key: "noisy", Count: 4}}, tracker.TopDenials(10))
+	assert.Len(t, tracker.TopGrants(1), 1)
+}
+
+func TestTracker_IgnoresFailures(t *testing.T) {
+	tracker := NewTracker(Options{})
+	tracker.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "k", Err: errors.New("down")})
+	tracker.Observe(context.Background(), core.Event{Operation: core.OpClear, Key: "k"})
+	assert.Empty(t, tracker.TopGrants(10))
+}
+
+func TestTracker_SlidingWindow(t *testing.T) {
+	tracker := NewTracker(Options{Window: time.Minute, Buckets: 3})
+	now := fakeNow(tracker)
+	ctx := context.Background()
+
+	tracker.Observe(ctx, grant("old", false))
+	*now = now.Add(20 * time.Second)
+	tracker.Observe(ctx, grant("old", false))
+	tracker.Observe(ctx, grant("new", false))
+	assert.Equal(t, []Entry{{Key: "old", Count: 2}, {Key: "new", Count: 1}}, tracker.TopDenials(10))
+
+	// The first sub-window slides out
+	*now = now.Add(40 * time.Second)
+	assert.Equal(t, []Entry{{Key: "new", Count: 1}, {Key: "old", Count: 1}}, tracker.TopDenials(10))
+
+	*now = now.Add(time.Minute)
+	assert.Empty(t, tracker.TopDenials(10))
+
+	tracker.Observe(ctx, grant("k", true))
+	tracker.Reset()
+	assert.Empty(t, tracker.TopGrants(10))
+}
+
+func TestTracker_BoundedMemory(t *testing.T) {
+	tracker := NewTracker(Options{Capacity: 20, Buckets: 2})
+	now := fakeNow(tracker)
+	ctx := context.Background()
+
+	for i := 0; i < 100000; i++ {
+		if i == 50000 {
+			*now = now.Add(tracker.width)
+		}
+		key := fmt.Sprint("client-", i)
+		if i%4 == 0 {
+			key = "attacker"
+		}
+		tracker.Observe(ctx, grant(key, false))
+	}
+
+	for _, b := range tracker.buckets {
+		assert.LessOrEqual(t, len(b.denials.counters), 20)
+	}
+	top := tracker.TopDenials(3)
+	require.NotEmpty(t, top)
+	assert.Equal(t, "attacker", top[0].Key)
+	assert.GreaterOrEqual(t, top[0].Count, uint64(25000))
+	assert.LessOrEqual(t, top[0].Count-top[0].Error, uint64(25000))
+
+	// Keys evicted from a sub-window carry its smallest count as error
+	for _, e := range tracker.TopDenials(-1) {
+		assert.LessOrEqual(t, e.Error, e.Count)
+	}
+}
+
+func TestTracker_Handler(t *testing.T) {
+	tracker := NewTracker(Options{Window: time.Minute})
+	for i := 0; i < 3; i++ {
+		tracker.Observe(context.Background(), grant("a", i > 0))
+	}
+	tracker.Observe(context.Background(), grant("b", false))
+	h := tracker.Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/hotkeys?n=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var resp Response
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, Response{
+		Window:  "1m0s",
+		Grants:  []Entry{{Key: "a", Count: 3}},
+		Denials: []Entry{{Key: "a", Count: 1}},
+	}, resp)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/hotkeys?n=zero", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
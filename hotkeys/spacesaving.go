@@ -0,0 +1,95 @@
+package hotkeys
+
+import "container/heap"
+
+// summary counts keys with the Space-Saving algorithm: at most capacity
+// keys are tracked, and a new key replaces the least counted one, taking
+// over its count as the bound on its own overestimate. Any key counted more
+// than total/capacity times is guaranteed to be tracked.
+type summary struct {
+	capacity int
+	counters map[string]*counter
+	heap     counterHeap // Min-heap on count
+}
+
+// counter is a tracked key
+type counter struct {
+	key   string
+	count uint64 // Occurrences counted, possibly overestimated
+	err   uint64 // By how much count may overestimate
+	index int    // Position in the heap
+}
+
+// newSummary creates a summary tracking up to capacity keys
+func newSummary(capacity int) *summary {
+	return &summary{
+		capacity: capacity,
+		counters: make(map[string]*counter, capacity),
+		heap:     make(counterHeap, 0, capacity),
+	}
+}
+
+// add counts one occurrence of key
+func (s *summary) add(key string) {
+	if c, ok := s.counters[key]; ok {
+		c.count++
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+
+	if len(s.heap) < s.capacity {
+		c := &counter{key: key, count: 1}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+
+	// Replace the least counted key
+	c := s.heap[0]
+	delete(s.counters, c.key)
+	c.key = key
+	c.err = c.count
+	c.count++
+	s.counters[key] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// min returns the smallest count when the summary is full: the most an
+// untracked key may have occurred. It is 0 while keys are still exact.
+func (s *summary) min() uint64 {
+	if len(s.heap) < s.capacity {
+		return 0
+	}
+	return s.heap[0].count
+}
+
+// reset forgets every key
+func (s *summary) reset() {
+	clear(s.counters)
+	s.heap = s.heap[:0]
+}
+
+// counterHeap orders counters by ascending count
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,57 @@
+package hotkeys
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummary_Exact(t *testing.T) {
+	s := newSummary(3)
+	for _, key := range []string{"a", "b", "a", "c", "a"} {
+		s.add(key)
+	}
+
+	assert.Equal(t, uint64(3), s.counters["a"].count)
+	assert.Equal(t, uint64(0), s.counters["a"].err)
+	assert.Equal(t, uint64(1), s.min())
+}
+
+func TestSummary_Eviction(t *testing.T) {
+	s := newSummary(2)
+	s.add("a")
+	s.add("a")
+	s.add("b")
+	s.add("c") // Replaces b, inheriting its count as error
+
+	assert.Len(t, s.counters, 2)
+	assert.NotContains(t, s.counters, "b")
+	assert.Equal(t, uint64(2), s.counters["c"].count)
+	assert.Equal(t, uint64(1), s.counters["c"].err)
+	assert.Equal(t, uint64(2), s.counters["a"].count)
+}
+
+func TestSummary_FindsHeavyHitters(t *testing.T) {
+	s := newSummary(10)
+
+	// One key makes up a fifth of a long tail of distinct keys
+	for i := 0; i < 10000; i++ {
+		if i%5 == 0 {
+			s.add("hot")
+		} else {
+			s.add(fmt.Sprint("cold-", i))
+		}
+	}
+
+	hot := s.counters["hot"]
+	if assert.NotNil(t, hot) {
+		assert.GreaterOrEqual(t, hot.count, uint64(2000))
+		assert.LessOrEqual(t, hot.count-hot.err, uint64(2000))
+	}
+	assert.Len(t, s.counters, 10)
+
+	s.reset()
+	assert.Empty(t, s.counters)
+	assert.Equal(t, uint64(0), s.min())
+}
@@ -0,0 +1,544 @@
+// Package lease implements a rate limiter that keeps a local token bucket
+// per key and refills it by leasing batches of tokens from a shared backend,
+// so most decisions are made without a round-trip to that backend.
+//
+// The shared backend holds a token bucket per key in the same layout as
+// strategy/tokenbucket, so leasing limiters can share keys with a
+// core.Limiter using that strategy. Leases are taken atomically when the
+// backend implements core.Updater (SQL, memcached) or an UpdateTx method
+// (Redis); with plain Get/Set only limiters within one process are
+// coordinated.
+//
+// Error bounds, for N instances sharing a key:
+//
+//   - Tokens are taken from the shared bucket before they are spent locally,
+//     so over any window of length T all instances together admit at most
+//     Burst + Limit·(T+LeaseTTL)/Interval requests: the usual token bucket
+//     bound, widened by one LeaseTTL because a leased token may be spent up
+//     to LeaseTTL after it was taken.
+//   - A request is only denied when its instance holds no leased tokens and
+//     the shared bucket holds less than one. At that moment at most
+//     (N−1)·MaxLease tokens sit unused in other instances' leases; they are
+//     returned to the shared bucket within LeaseTTL.
+//   - After a denial an instance keeps denying locally until the shared
+//     bucket is due to hold a token again, so tokens returned by other
+//     instances in the meantime are only seen after that.
+//
+// Lease size follows local demand: it is the number of requests the key is
+// expected to receive within LeaseTTL, from a moving average of its request
+// rate, clamped to [MinLease, MaxLease]. Quiet keys lease a single token and
+// are as accurate as an unleased limiter; hot keys lease up to MaxLease and
+// trade accuracy for fewer round-trips. Smaller MaxLease and LeaseTTL tighten
+// the bounds above.
+package lease
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+)
+
+// Options configures a leasing Limiter
+type Options struct {
+	MinLease  int64         // Smallest number of tokens leased at once (default 1)
+	MaxLease  int64         // Largest number of tokens leased at once (default Burst/10, at least 1)
+	LeaseTTL  time.Duration // How long leased tokens may be spent before being returned (default 1s)
+	Smoothing float64       // Weight of the latest demand sample in the moving average (default 0.5)
+
+	Policy    string          // Name of the limit, reported in events
+	Observers []core.Observer // Receive an event per Grant, Preview and Clear
+}
+
+// txUpdater is implemented by backends whose atomic update core.Limiter
+// doesn't use, such as the Redis backend
+type txUpdater interface {
+	UpdateTx(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error
+}
+
+// Limiter implements core.RateLimiter on top of leased tokens
+type Limiter struct {
+	shared core.Backend
+	local  *memory.Backend
+	config core.Config
+	opts   Options
+	timers []core.TimingReporter // Observers that also want timings
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*entry
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// entry tracks demand for one key on this instance
+type entry struct {
+	mu          sync.Mutex
+	requests    int64     // Requests since the last lease
+	leasedAt    time.Time // When the last lease was requested
+	rate        float64   // Moving average of requests per second
+	shared      float64   // Tokens left in the shared bucket after the last lease
+	deniedUntil time.Time // Deny locally until the shared bucket refills
+	removed     bool
+}
+
+// NewLimiter creates a leasing rate limiter backed by shared. metrics may
+// be nil; otherwise it is adapted with core.ReporterObserver and added to
+// opts.Observers.
+func NewLimiter(shared core.Backend, config core.Config, opts Options, metrics core.MetricsReporter) *Limiter {
+	return newLimiter(shared, config, opts, metrics, time.Now)
+}
+
+func newLimiter(shared core.Backend, config core.Config, opts Options, metrics core.MetricsReporter, now func() time.Time) *Limiter {
+	if opts.MinLease <= 0 {
+		opts.MinLease = 1
+	}
+	if opts.MaxLease <= 0 {
+		opts.MaxLease = config.Burst / 10
+	}
+	if opts.MaxLease < opts.MinLease {
+		opts.MaxLease = opts.MinLease
+	}
+	if opts.LeaseTTL <= 0 {
+		opts.LeaseTTL = time.Second
+	}
+	if opts.Smoothing <= 0 || opts.Smoothing > 1 {
+		opts.Smoothing = 0.5
+	}
+	if metrics != nil {
+		opts.Observers = append(opts.Observers[:len(opts.Observers):len(opts.Observers)], core.ReporterObserver(metrics))
+	}
+
+	l := &Limiter{
+		shared:  shared,
+		local:   memory.NewBackend(),
+		config:  config,
+		opts:    opts,
+		timers:  core.TimersOf(opts.Observers),
+		now:     now,
+		entries: make(map[string]*entry),
+		done:    make(chan struct{}),
+	}
+
+	// Return leases of keys that went quiet
+	l.wg.Add(1)
+	go l.reapLoop()
+
+	return l
+}
+
+// Grant determines whether a request should be allowed now, spending a
+// leased token and leasing more from the shared backend when none are left
+func (l *Limiter) Grant(ctx context.Context, key string) (decision core.Decision, err error) {
+	s := l.begin(core.OpGrant)
+	defer func() { l.finish(ctx, s, key, decision, err) }()
+
+	e := l.lock(key)
+	defer e.mu.Unlock()
+
+	now := l.now()
+	e.requests++
+
+	local, err := l.current(ctx, s, key, now)
+	if err != nil {
+		return core.Decision{}, err
+	}
+
+	if local == nil || local.Tokens < 1 {
+		if now.Before(e.deniedUntil) {
+			return l.deny(e, now), nil
+		}
+
+		// Lease a new batch; the previous lease is exhausted
+		granted, err := l.acquire(ctx, s, key, e, l.leaseSize(e, now), now)
+		if err != nil {
+			return core.Decision{}, err
+		}
+		if granted == 0 {
+			e.deniedUntil = now.Add(l.refillTime(1 - e.shared))
+			if err := l.local.Delete(ctx, key); err != nil {
+				return core.Decision{}, err
+			}
+			return l.deny(e, now), nil
+		}
+
+		local = &core.State{Tokens: float64(granted), Created: now}
+	}
+
+	local.Tokens--
+	local.LastUpdate = now
+	if err := l.local.Set(ctx, key, local); err != nil {
+		return core.Decision{}, err
+	}
+
+	return l.decision(true, local.Tokens+e.shared, now), nil
+}
+
+// Preview estimates the current usage state from the local lease and the
+// shared bucket without modifying anything
+func (l *Limiter) Preview(ctx context.Context, key string) (decision core.Decision, err error) {
+	s := l.begin(core.OpPreview)
+	defer func() { l.finish(ctx, s, key, decision, err) }()
+
+	e := l.lock(key)
+	defer e.mu.Unlock()
+
+	now := l.now()
+	var tokens float64
+
+	local, err := l.local.Get(ctx, key)
+	if err != nil {
+		return core.Decision{}, err
+	}
+	if local != nil && now.Sub(local.Created) < l.opts.LeaseTTL {
+		tokens += local.Tokens
+	}
+
+	start := time.Now()
+	state, err := l.shared.Get(ctx, key)
+	s.record(core.PhaseBackendGet, start)
+	if err != nil {
+		return core.Decision{}, err
+	}
+	tokens += l.refill(state, now).Tokens
+
+	decision = l.decision(tokens >= 1, tokens, now)
+	if !decision.Allowed {
+		decision.RetryAfter = l.refillTime(1 - tokens)
+	}
+	return decision, nil
+}
+
+// Clear resets the key in the shared backend and drops this instance's
+// lease. Leases held by other instances stay valid until they expire.
+func (l *Limiter) Clear(ctx context.Context, key string) (err error) {
+	s := l.begin(core.OpClear)
+	defer func() { l.finish(ctx, s, key, core.Decision{}, err) }()
+
+	e := l.lock(key)
+	defer e.mu.Unlock()
+
+	if err := l.local.Delete(ctx, key); err != nil {
+		return err
+	}
+	start := time.Now()
+	err = l.shared.Delete(ctx, key)
+	s.record(core.PhaseBackendDelete, start)
+	if err != nil {
+		return err
+	}
+	e.deniedUntil = time.Time{}
+	e.shared = 0
+	return nil
+}
+
+// Close stops the background reaper and returns every unused leased token
+// to the shared backend. The shared backend itself is left open.
+func (l *Limiter) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	l.wg.Wait()
+
+	l.mu.Lock()
+	keys := make([]string, 0, len(l.entries))
+	for key := range l.entries {
+		keys = append(keys, key)
+	}
+	l.mu.Unlock()
+
+	ctx := context.Background()
+	var errs []error
+	for _, key := range keys {
+		e := l.lock(key)
+		local, err := l.local.Get(ctx, key)
+		if err == nil && local != nil {
+			err = l.release(ctx, nil, key, local, l.now())
+		}
+		e.mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Health checks the shared backend, see core.CheckBackend
+func (l *Limiter) Health(ctx context.Context) core.Health {
+	return core.CheckBackend(ctx, l.shared)
+}
+
+// Config returns the current configuration
+func (l *Limiter) Config() core.Config {
+	return l.config
+}
+
+// lock returns the locked entry for key, creating it if needed
+func (l *Limiter) lock(key string) *entry {
+	for {
+		l.mu.Lock()
+		e, ok := l.entries[key]
+		if !ok {
+			e = &entry{}
+			l.entries[key] = e
+		}
+		l.mu.Unlock()
+
+		e.mu.Lock()
+		if !e.removed {
+			return e
+		}
+		// The reaper dropped it in between, start over
+		e.mu.Unlock()
+	}
+}
+
+// current returns the local lease for key, returning it to the shared
+// backend first if it has expired
+func (l *Limiter) current(ctx context.Context, s *span, key string, now time.Time) (*core.State, error) {
+	local, err := l.local.Get(ctx, key)
+	if err != nil || local == nil {
+		return nil, err
+	}
+	if now.Sub(local.Created) >= l.opts.LeaseTTL {
+		return nil, l.release(ctx, s, key, local, now)
+	}
+	return local, nil
+}
+
+// leaseSize updates the demand estimate and returns how many tokens to lease
+func (l *Limiter) leaseSize(e *entry, now time.Time) int64 {
+	if !e.leasedAt.IsZero() {
+		if elapsed := now.Sub(e.leasedAt); elapsed > 0 {
+			sample := float64(e.requests) / elapsed.Seconds()
+			e.rate = l.opts.Smoothing*sample + (1-l.opts.Smoothing)*e.rate
+		}
+	}
+	e.requests = 0
+	e.leasedAt = now
+
+	size := int64(math.Ceil(e.rate * l.opts.LeaseTTL.Seconds()))
+	if size < l.opts.MinLease {
+		size = l.opts.MinLease
+	}
+	if size > l.opts.MaxLease {
+		size = l.opts.MaxLease
+	}
+	return size
+}
+
+// acquire takes up to want whole tokens from the shared bucket
+func (l *Limiter) acquire(ctx context.Context, s *span, key string, e *entry, want int64, now time.Time) (int64, error) {
+	var granted int64
+	err := l.update(ctx, s, key, func(state *core.State) (*core.State, error) {
+		state = l.refill(state, now)
+		granted = min(want, int64(state.Tokens))
+		state.Tokens -= float64(granted)
+		e.shared = state.Tokens
+		return state, nil
+	})
+	return granted, err
+}
+
+// release returns the unused tokens of a lease to the shared bucket. The
+// lease is only dropped once the shared bucket took them back, so a failed
+// release is retried by the next Grant, the reaper or Close.
+func (l *Limiter) release(ctx context.Context, s *span, key string, local *core.State, now time.Time) error {
+	if local.Tokens >= 1 {
+		err := l.update(ctx, s, key, func(state *core.State) (*core.State, error) {
+			state = l.refill(state, now)
+			state.Tokens = math.Min(state.Tokens+math.Floor(local.Tokens), float64(l.config.Burst))
+			return state, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return l.local.Delete(ctx, key)
+}
+
+// update applies fn to the shared state for key, atomically if possible,
+// timing it as part of s (which may be nil)
+func (l *Limiter) update(ctx context.Context, s *span, key string, fn func(state *core.State) (*core.State, error)) error {
+	start := time.Now()
+	if updater, ok := l.shared.(core.Updater); ok {
+		defer s.record(core.PhaseBackendUpdate, start)
+		return updater.Update(ctx, key, fn)
+	}
+	if updater, ok := l.shared.(txUpdater); ok {
+		defer s.record(core.PhaseBackendUpdate, start)
+		return updater.UpdateTx(ctx, key, fn)
+	}
+
+	state, err := l.shared.Get(ctx, key)
+	s.record(core.PhaseBackendGet, start)
+	if err != nil {
+		return err
+	}
+	if state, err = fn(state); err != nil {
+		return err
+	}
+	start = time.Now()
+	defer s.record(core.PhaseBackendSet, start)
+	return l.shared.Set(ctx, key, state)
+}
+
+// refill returns a copy of the shared state with tokens added for the time
+// elapsed since its last update, or a full bucket if there is no state
+func (l *Limiter) refill(state *core.State, now time.Time) *core.State {
+	if state == nil {
+		return &core.State{Tokens: float64(l.config.Burst), LastUpdate: now, Created: now}
+	}
+
+	refilled := *state
+	if elapsed := now.Sub(state.LastUpdate); elapsed > 0 && l.refills() {
+		tokens := state.Tokens + float64(elapsed)/float64(l.config.Interval)*float64(l.config.Limit)
+		refilled.Tokens = math.Min(tokens, float64(l.config.Burst))
+		refilled.LastUpdate = now
+	}
+	return &refilled
+}
+
+// refills reports whether the shared bucket gains tokens over time; with a
+// zero Limit or Interval only Burst tokens are ever handed out
+func (l *Limiter) refills() bool {
+	return l.config.Limit > 0 && l.config.Interval > 0
+}
+
+// refillTime returns how long the shared bucket takes to gain tokens, or
+// zero if it never refills, so denials are then checked against the shared
+// bucket every time
+func (l *Limiter) refillTime(tokens float64) time.Duration {
+	if tokens <= 0 || !l.refills() {
+		return 0
+	}
+	return time.Duration(tokens / float64(l.config.Limit) * float64(l.config.Interval))
+}
+
+// deny builds a denial for a key whose lease and shared bucket are empty
+func (l *Limiter) deny(e *entry, now time.Time) core.Decision {
+	decision := l.decision(false, e.shared, now)
+	decision.RetryAfter = e.deniedUntil.Sub(now)
+	return decision
+}
+
+// decision builds a decision from the tokens known to be available
+func (l *Limiter) decision(allowed bool, tokens float64, now time.Time) core.Decision {
+	return core.Decision{
+		Allowed:   allowed,
+		Remaining: int64(tokens),
+		ResetTime: now.Add(l.refillTime(float64(l.config.Burst) - tokens)),
+	}
+}
+
+// span collects the timings of one operation for its event
+type span struct {
+	op        core.Operation
+	start     time.Time
+	timers    []core.TimingReporter
+	durations map[core.Phase]time.Duration
+}
+
+// begin starts timing an operation
+func (l *Limiter) begin(op core.Operation) *span {
+	s := &span{op: op, start: time.Now(), timers: l.timers}
+	if len(l.opts.Observers) > 0 {
+		s.durations = make(map[core.Phase]time.Duration)
+	}
+	return s
+}
+
+// record adds the time since start to phase; s may be nil
+func (s *span) record(phase core.Phase, start time.Time) {
+	if s != nil {
+		s.add(phase, time.Since(start))
+	}
+}
+
+// add passes the duration of a phase to the timers and adds it to the
+// span's durations
+func (s *span) add(phase core.Phase, d time.Duration) {
+	for _, timer := range s.timers {
+		timer.RecordTiming(s.op, phase, d)
+	}
+	if s.durations != nil {
+		s.durations[phase] += d
+	}
+}
+
+// finish passes the event of an operation to the observers
+func (l *Limiter) finish(ctx context.Context, s *span, key string, decision core.Decision, err error) {
+	if len(l.opts.Observers) == 0 {
+		return
+	}
+
+	duration := time.Since(s.start)
+	s.add(core.PhaseTotal, duration)
+	event := core.Event{
+		Operation: s.op,
+		Key:       key,
+		Policy:    l.opts.Policy,
+		Decision:  decision,
+		Err:       err,
+		Time:      s.start,
+		Duration:  duration,
+		Durations: s.durations,
+	}
+	if err != nil {
+		event.Decision = core.Decision{}
+	}
+	if s.op == core.OpGrant {
+		event.Cost = 1
+	}
+
+	for _, o := range l.opts.Observers {
+		o.Observe(ctx, event)
+	}
+}
+
+// reapLoop periodically returns expired leases
+func (l *Limiter) reapLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.opts.LeaseTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.reap(context.Background())
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// reap returns expired leases and forgets keys that have been idle for a
+// whole LeaseTTL
+func (l *Limiter) reap(ctx context.Context) {
+	l.mu.Lock()
+	keys := make([]string, 0, len(l.entries))
+	for key := range l.entries {
+		keys = append(keys, key)
+	}
+	l.mu.Unlock()
+
+	for _, key := range keys {
+		e := l.lock(key)
+		now := l.now()
+
+		// Errors are retried on the next tick or at Close
+		local, err := l.current(ctx, nil, key, now)
+		if err == nil && local == nil && now.Sub(e.leasedAt) >= l.opts.LeaseTTL && !now.Before(e.deniedUntil) {
+			l.mu.Lock()
+			delete(l.entries, key)
+			l.mu.Unlock()
+			e.removed = true
+		}
+		e.mu.Unlock()
+	}
+}
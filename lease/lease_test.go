@@ -0,0 +1,471 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// sharedBackend is an in-process stand-in for Redis: a memory backend with
+// atomic updates that counts round-trips
+type sharedBackend struct {
+	*memory.Backend
+	mu      sync.Mutex
+	updates int
+	err     error // Returned by Update when set
+}
+
+func newSharedBackend() *sharedBackend {
+	return &sharedBackend{Backend: memory.NewBackend()}
+}
+
+func (b *sharedBackend) Update(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updates++
+	if b.err != nil {
+		return b.err
+	}
+
+	state, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if state, err = fn(state); err != nil {
+		return err
+	}
+	return b.Set(ctx, key, state)
+}
+
+func (b *sharedBackend) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *sharedBackend) tokens(t *testing.T, key string) float64 {
+	state, err := b.Get(context.Background(), key)
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	return state.Tokens
+}
+
+// fakeClock is a manually advanced clock shared by several limiters
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(t *testing.T, shared core.Backend, clock *fakeClock, config core.Config, opts Options) *Limiter {
+	l := newLimiter(shared, config, opts, nil, clock.Now)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestLimiter_GrantLeasesFromShared(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 10, Interval: time.Hour, Burst: 10}
+	limiter := newTestLimiter(t, shared, clock, config, Options{MaxLease: 5, LeaseTTL: time.Minute})
+	ctx := context.Background()
+
+	// A quiet key leases one token at a time
+	decision, err := limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 9.0, shared.tokens(t, "key"))
+	assert.Equal(t, int64(9), decision.Remaining)
+
+	for i := 0; i < 9; i++ {
+		clock.Advance(time.Millisecond)
+		decision, err = limiter.Grant(ctx, "key")
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+	}
+
+	clock.Advance(time.Millisecond)
+	decision, err = limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Greater(t, decision.RetryAfter, time.Duration(0))
+}
+
+func TestLimiter_LeaseAdaptsToDemand(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 100000, Interval: time.Second, Burst: 100000}
+	limiter := newTestLimiter(t, shared, clock, config, Options{MaxLease: 100, LeaseTTL: time.Second})
+	ctx := context.Background()
+
+	// 1000 requests per second at 1ms spacing
+	for i := 0; i < 1000; i++ {
+		decision, err := limiter.Grant(ctx, "hot")
+		require.NoError(t, err)
+		require.True(t, decision.Allowed)
+		clock.Advance(time.Millisecond)
+	}
+
+	// Leases grow to MaxLease, so far fewer round-trips than requests
+	assert.Less(t, shared.updates, 50)
+
+	// A quiet key keeps leasing single tokens
+	shared.updates = 0
+	for i := 0; i < 5; i++ {
+		_, err := limiter.Grant(ctx, "quiet")
+		require.NoError(t, err)
+		clock.Advance(10 * time.Second)
+	}
+	assert.Equal(t, 5, shared.updates)
+}
+
+func TestLimiter_ExpiredLeaseReturned(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 100, Interval: 24 * time.Hour, Burst: 100}
+	limiter := newTestLimiter(t, shared, clock, config, Options{MinLease: 10, MaxLease: 10, LeaseTTL: time.Minute})
+	ctx := context.Background()
+
+	_, err := limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, 90.0, shared.tokens(t, "key"))
+
+	// The reaper returns the 9 unused tokens once the lease expires
+	clock.Advance(time.Minute)
+	limiter.reap(ctx)
+	assert.InDelta(t, 99.0+100.0/(24*60), shared.tokens(t, "key"), 0.001)
+
+	// Another minute of inactivity forgets the key altogether
+	clock.Advance(time.Minute)
+	limiter.reap(ctx)
+	limiter.mu.Lock()
+	assert.Empty(t, limiter.entries)
+	limiter.mu.Unlock()
+}
+
+func TestLimiter_FailedReleaseRetried(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 100, Interval: 24 * time.Hour, Burst: 100}
+	limiter := newTestLimiter(t, shared, clock, config, Options{MinLease: 10, MaxLease: 10, LeaseTTL: time.Minute})
+	ctx := context.Background()
+
+	_, err := limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+
+	// The lease is kept while the shared backend is unavailable
+	clock.Advance(time.Minute)
+	shared.fail(errors.New("connection refused"))
+	limiter.reap(ctx)
+	local, err := limiter.local.Get(ctx, "key")
+	require.NoError(t, err)
+	require.NotNil(t, local)
+	assert.Equal(t, 9.0, local.Tokens)
+
+	// and its tokens are returned once it is back
+	shared.fail(nil)
+	limiter.reap(ctx)
+	assert.InDelta(t, 99.0+100.0/(24*60), shared.tokens(t, "key"), 0.001)
+	local, err = limiter.local.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Nil(t, local)
+}
+
+// txBackend exposes its atomic update as UpdateTx, like the Redis backend
+type txBackend struct {
+	*memory.Backend
+	mu      sync.Mutex
+	updates int
+}
+
+func (b *txBackend) UpdateTx(ctx context.Context, key string, fn func(state *core.State) (*core.State, error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updates++
+
+	state, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if state, err = fn(state); err != nil {
+		return err
+	}
+	return b.Set(ctx, key, state)
+}
+
+func TestLimiter_UsesUpdateTx(t *testing.T) {
+	shared := &txBackend{Backend: memory.NewBackend()}
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 10, Interval: time.Second, Burst: 10}
+	limiter := newTestLimiter(t, shared, clock, config, Options{MinLease: 5, MaxLease: 5})
+
+	_, err := limiter.Grant(context.Background(), "key")
+	require.NoError(t, err)
+	assert.Equal(t, 1, shared.updates)
+}
+
+func TestLimiter_ZeroLimit(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 0, Interval: time.Second, Burst: 2}
+	limiter := newTestLimiter(t, shared, clock, config, Options{MinLease: 1, MaxLease: 1})
+	ctx := context.Background()
+
+	// Only the burst is ever granted, and denials don't overflow
+	for i := 0; i < 2; i++ {
+		decision, err := limiter.Grant(ctx, "key")
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+	}
+	clock.Advance(time.Hour)
+	decision, err := limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.GreaterOrEqual(t, decision.RetryAfter, time.Duration(0))
+	assert.False(t, decision.ResetTime.Before(clock.Now()))
+}
+
+func TestLimiter_CloseReturnsUnusedTokens(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 100, Interval: time.Hour, Burst: 100}
+	limiter := newLimiter(shared, config, Options{MinLease: 10, MaxLease: 10, LeaseTTL: time.Minute}, nil, clock.Now)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := limiter.Grant(ctx, fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 90.0, shared.tokens(t, "key-0"))
+
+	require.NoError(t, limiter.Close())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 99.0, shared.tokens(t, fmt.Sprintf("key-%d", i)))
+	}
+}
+
+// TestLimiter_ErrorBounds checks the documented bounds with several
+// instances competing for one key under uneven load
+func TestLimiter_ErrorBounds(t *testing.T) {
+	const (
+		instances = 4
+		maxLease  = 20
+		requests  = 20000
+	)
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 600, Interval: time.Minute, Burst: 100}
+	opts := Options{MaxLease: maxLease, LeaseTTL: time.Second}
+	ctx := context.Background()
+
+	limiters := make([]*Limiter, instances)
+	for i := range limiters {
+		limiters[i] = newTestLimiter(t, shared, clock, config, opts)
+	}
+
+	// Instance i receives i+1 out of every 10 requests, one every 1ms
+	owner := [10]int{0, 1, 1, 2, 2, 2, 3, 3, 3, 3}
+	start := clock.Now()
+	var allowed, falseDenials int
+	for n := 0; n < requests; n++ {
+		i := owner[n%10]
+
+		decision, err := limiters[i].Grant(ctx, "key")
+		require.NoError(t, err)
+		if decision.Allowed {
+			allowed++
+		} else {
+			// A denial while others hold leases is bounded by what they hold
+			var leased float64
+			for j, other := range limiters {
+				if j == i {
+					continue
+				}
+				if local, _ := other.local.Get(ctx, "key"); local != nil {
+					leased += local.Tokens
+				}
+			}
+			assert.LessOrEqual(t, leased, float64((instances-1)*maxLease))
+			if leased >= 1 {
+				falseDenials++
+			}
+		}
+		clock.Advance(time.Millisecond)
+	}
+
+	// Never more than the token bucket bound widened by one LeaseTTL
+	elapsed := clock.Now().Sub(start)
+	bound := float64(config.Burst) + float64(config.Limit)*(elapsed+opts.LeaseTTL).Seconds()/config.Interval.Seconds()
+	assert.LessOrEqual(t, float64(allowed), bound)
+
+	// And close to what a single shared limiter admits
+	exact := float64(config.Burst) + float64(config.Limit)*elapsed.Seconds()/config.Interval.Seconds()
+	assert.InDelta(t, exact, float64(allowed), float64((instances-1)*maxLease)+1)
+	t.Logf("allowed %d of %d (exact %.0f), %d denials while tokens were leased elsewhere", allowed, requests, exact, falseDenials)
+}
+
+func TestLimiter_SharesKeysWithCoreLimiter(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 10, Interval: time.Hour, Burst: 10}
+	leasing := newTestLimiter(t, shared, clock, config, Options{MaxLease: 1})
+	direct := core.NewLimiter(shared, tokenbucket.NewStrategy(config), config, nil)
+	ctx := context.Background()
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		d1, err := leasing.Grant(ctx, "key")
+		require.NoError(t, err)
+		d2, err := direct.Grant(ctx, "key")
+		require.NoError(t, err)
+		for _, d := range []core.Decision{d1, d2} {
+			if d.Allowed {
+				allowed++
+			}
+		}
+	}
+	assert.Equal(t, 10, allowed)
+}
+
+func TestLimiter_PreviewAndClear(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 100, Interval: time.Hour, Burst: 100}
+	limiter := newTestLimiter(t, shared, clock, config, Options{MinLease: 10, MaxLease: 10, LeaseTTL: time.Minute})
+	ctx := context.Background()
+
+	decision, err := limiter.Preview(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, int64(100), decision.Remaining)
+
+	_, err = limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+
+	// Leased but unused tokens still count as available
+	decision, err = limiter.Preview(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, int64(99), decision.Remaining)
+
+	require.NoError(t, limiter.Clear(ctx, "key"))
+	state, err := shared.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	decision, err = limiter.Preview(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), decision.Remaining)
+}
+
+func TestLimiter_Observers(t *testing.T) {
+	shared := newSharedBackend()
+	clock := &fakeClock{now: time.Now()}
+	config := core.Config{Limit: 1, Interval: time.Hour, Burst: 1}
+
+	var events []core.Event
+	observer := core.ObserverFunc(func(ctx context.Context, event core.Event) {
+		events = append(events, event)
+	})
+	limiter := newLimiter(shared, config, Options{Policy: "api", Observers: []core.Observer{observer}}, nil, clock.Now)
+	defer limiter.Close()
+	ctx := context.Background()
+
+	_, err := limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+	_, err = limiter.Grant(ctx, "key")
+	require.NoError(t, err)
+	_, err = limiter.Preview(ctx, "key")
+	require.NoError(t, err)
+	require.NoError(t, limiter.Clear(ctx, "key"))
+
+	require.Len(t, events, 4)
+	assert.Equal(t, core.OpGrant, events[0].Operation)
+	assert.True(t, events[0].Decision.Allowed)
+	assert.Equal(t, int64(1), events[0].Cost)
+	assert.Equal(t, "api", events[0].Policy)
+	assert.Contains(t, events[0].Durations, core.PhaseBackendUpdate)
+	assert.False(t, events[1].Decision.Allowed)
+	assert.Equal(t, core.OpPreview, events[2].Operation)
+	assert.Contains(t, events[2].Durations, core.PhaseBackendGet)
+	assert.Equal(t, core.OpClear, events[3].Operation)
+	assert.Contains(t, events[3].Durations, core.PhaseBackendDelete)
+
+	// Failures are reported too
+	shared.fail(errors.New("connection refused"))
+	clock.Advance(time.Hour)
+	_, err = limiter.Grant(ctx, "key")
+	assert.Error(t, err)
+	assert.ErrorContains(t, events[4].Err, "connection refused")
+}
+
+// timingReporter counts grants and collects the timings it is given
+type timingReporter struct {
+	mu      sync.Mutex
+	grants  int
+	timings map[core.Phase]int
+}
+
+func (r *timingReporter) RecordGrant(key string, allowed bool, remaining int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.grants++
+}
+
+func (r *timingReporter) RecordPreview(key string, remaining int64) {}
+
+func (r *timingReporter) RecordClear(key string) {}
+
+func (r *timingReporter) RecordTiming(op core.Operation, phase core.Phase, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timings == nil {
+		r.timings = make(map[core.Phase]int)
+	}
+	r.timings[phase]++
+}
+
+func TestLimiter_Timings(t *testing.T) {
+	shared := newSharedBackend()
+	config := core.Config{Limit: 10, Interval: time.Hour, Burst: 10}
+
+	// A reporter passed as metrics receives timings as well as counters
+	reporter := &timingReporter{}
+	limiter := newLimiter(shared, config, Options{}, reporter, (&fakeClock{now: time.Now()}).Now)
+	defer limiter.Close()
+
+	_, err := limiter.Grant(context.Background(), "key")
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, reporter.grants)
+	assert.Equal(t, 1, reporter.timings[core.PhaseTotal])
+	assert.Equal(t, 1, reporter.timings[core.PhaseBackendUpdate])
+}
+
+func TestLimiter_Health(t *testing.T) {
+	shared := newSharedBackend()
+	l := newTestLimiter(t, shared, &fakeClock{now: time.Now()}, core.Config{Limit: 10, Interval: time.Second, Burst: 10}, Options{})
+
+	health := l.Health(context.Background())
+	assert.True(t, health.Healthy)
+	assert.Equal(t, 0, health.Stats["keys_count"])
+}
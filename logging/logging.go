@@ -0,0 +1,140 @@
+// Package logging writes structured log records for limiter events with
+// log/slog. It is an ordinary core.Observer, so limiters only depend on it
+// when it is passed to them:
+//
+//	logger := logging.NewObserver(slog.Default(), logging.Options{})
+//	limiter := core.NewLimiterWithOptions(backend, strategy, config, core.LimiterOptions{
+//		Policy:    "login",
+//		Observers: []core.Observer{logger},
+//	})
+//
+// Denials are logged at Info, fallback decisions at Warn and failed
+// operations at Error. Allowed grants are logged at Debug, sampled by
+// AllowSampleRate. Keys are redacted unless Keys says otherwise.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math/rand/v2"
+
+	"github.com/throttle/core"
+)
+
+// KeyMode selects how keys appear in records
+type KeyMode int
+
+const (
+	// KeyRedacted leaves keys out of records
+	KeyRedacted KeyMode = iota
+
+	// KeyHashed logs a truncated SHA-256 of the salted key, so records for
+	// the same key can be correlated without revealing it
+	KeyHashed
+
+	// KeyPlain logs keys as they are
+	KeyPlain
+)
+
+// Options configures an Observer
+type Options struct {
+	Keys            KeyMode // How keys are logged (default KeyRedacted)
+	Salt            string  // Prepended to keys before hashing with KeyHashed
+	AllowSampleRate float64 // Share of allowed grants logged, in [0, 1] (default 0: none)
+}
+
+// Observer implements core.Observer by logging events to a slog.Logger
+type Observer struct {
+	logger *slog.Logger
+	opts   Options
+	random func() float64
+}
+
+// NewObserver creates an observer logging to logger, or to slog.Default()
+// if it is nil
+func NewObserver(logger *slog.Logger, opts Options) *Observer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Observer{
+		logger: logger,
+		opts:   opts,
+		random: rand.Float64,
+	}
+}
+
+// Observe logs event if it is worth a record
+func (o *Observer) Observe(ctx context.Context, event core.Event) {
+	level, msg, ok := o.classify(event)
+	if !ok || !o.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.String("operation", string(event.Operation))}
+	if event.Operation == core.OpReload {
+		// Reloads name a file or similar rather than a client's key
+		attrs = append(attrs, slog.String("source", event.Key))
+	} else if key, ok := o.key(event.Key); ok {
+		attrs = append(attrs, slog.String("key", key))
+	}
+	if event.Policy != "" {
+		attrs = append(attrs, slog.String("policy", event.Policy))
+	}
+
+	switch {
+	case event.Err != nil:
+		attrs = append(attrs, slog.Any("error", event.Err))
+	case event.Operation == core.OpGrant || event.Operation == core.OpGrantMulti || event.Operation == core.OpPreview:
+		attrs = append(attrs, slog.Bool("allowed", event.Decision.Allowed), slog.Int64("remaining", event.Decision.Remaining))
+		if !event.Decision.Allowed {
+			attrs = append(attrs, slog.Duration("retry_after", event.Decision.RetryAfter))
+		}
+	}
+	if event.Fallback {
+		attrs = append(attrs, slog.Bool("fallback", true))
+	}
+	attrs = append(attrs, slog.Duration("duration", event.Duration))
+
+	o.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// classify picks the level and message of the record for event, if any
+func (o *Observer) classify(event core.Event) (slog.Level, string, bool) {
+	switch {
+	case event.Operation == core.OpReload && event.Err != nil:
+		return slog.LevelError, "rate limit configuration reload failed", true
+	case event.Operation == core.OpReload:
+		return slog.LevelInfo, "rate limit configuration reloaded", true
+	case event.Err != nil:
+		return slog.LevelError, "rate limit operation failed", true
+	case event.Fallback:
+		return slog.LevelWarn, "rate limit decided by fallback", true
+	case event.Operation == core.OpClear, event.Operation == core.OpPreview:
+		return 0, "", false
+	case !event.Decision.Allowed:
+		return slog.LevelInfo, "rate limit exceeded", true
+	case o.opts.AllowSampleRate > 0 && o.random() < o.opts.AllowSampleRate:
+		return slog.LevelDebug, "rate limit allowed", true
+	}
+	return 0, "", false
+}
+
+// key returns how key is logged, and false if it isn't
+func (o *Observer) key(key string) (string, bool) {
+	switch o.opts.Keys {
+	case KeyPlain:
+		return key, true
+	case KeyHashed:
+		return HashKey(o.opts.Salt, key), true
+	}
+	return "", false
+}
+
+// HashKey returns the value logged for key with KeyHashed: the first 16 hex
+// digits of the SHA-256 of salt and key
+func HashKey(salt, key string) string {
+	sum := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(sum[:8])
+}
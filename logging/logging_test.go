@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// newObserver returns an observer logging JSON at level into a buffer
+func newObserver(level slog.Level, opts Options) (*Observer, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+	return NewObserver(logger, opts), &buf
+}
+
+// records decodes the JSON records in buf
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var result []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestObserver_LogsDenials(t *testing.T) {
+	observer, buf := newObserver(slog.LevelInfo, Options{})
+	config := core.Config{Limit: 1, Interval: time.Minute, Burst: 1}
+	limiter := core.NewLimiterWithOptions(memory.NewBackend(), tokenbucket.NewStrategy(config), config, core.LimiterOptions{
+		Policy:    "login",
+		Observers: []core.Observer{observer},
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := limiter.Grant(ctx, "user@example.com")
+		require.NoError(t, err)
+	}
+	_, err := limiter.Preview(ctx, "user@example.com")
+	require.NoError(t, err)
+
+	// Only the denial is logged, and the key is redacted
+	logged := records(t, buf)
+	require.Len(t, logged, 1)
+	assert.Equal(t, "INFO", logged[0]["level"])
+	assert.Equal(t, "rate limit exceeded", logged[0]["msg"])
+	assert.Equal(t, "grant", logged[0]["operation"])
+	assert.Equal(t, "login", logged[0]["policy"])
+	assert.Equal(t, false, logged[0]["allowed"])
+	assert.Equal(t, float64(0), logged[0]["remaining"])
+	assert.Positive(t, logged[0]["retry_after"])
+	assert.NotContains(t, logged[0], "key")
+	assert.NotContains(t, buf.String(), "user@example.com")
+}
+
+func TestObserver_Keys(t *testing.T) {
+	denied := core.Event{Operation: core.OpGrant, Key: "10.0.0.1"}
+
+	observer, buf := newObserver(slog.LevelInfo, Options{Keys: KeyHashed, Salt: "pepper"})
+	observer.Observe(context.Background(), denied)
+	assert.Equal(t, HashKey("pepper", "10.0.0.1"), records(t, buf)[0]["key"])
+	assert.Len(t, HashKey("pepper", "10.0.0.1"), 16)
+	assert.NotEqual(t, HashKey("", "10.0.0.1"), HashKey("pepper", "10.0.0.1"))
+
+	observer, buf = newObserver(slog.LevelInfo, Options{Keys: KeyPlain})
+	observer.Observe(context.Background(), denied)
+	assert.Equal(t, "10.0.0.1", records(t, buf)[0]["key"])
+}
+
+func TestObserver_ErrorsFallbacksAndReloads(t *testing.T) {
+	observer, buf := newObserver(slog.LevelInfo, Options{})
+	ctx := context.Background()
+
+	observer.Observe(ctx, core.Event{Operation: core.OpGrant, Key: "k", Err: errors.New("connection refused")})
+	observer.Observe(ctx, core.Event{Operation: core.OpGrant, Key: "k", Decision: core.Decision{Allowed: true, Remaining: 3}, Fallback: true})
+	observer.Observe(ctx, core.Event{Operation: core.OpReload, Key: "/etc/peers"})
+	observer.Observe(ctx, core.Event{Operation: core.OpReload, Key: "/etc/peers", Err: errors.New("no peers")})
+	observer.Observe(ctx, core.Event{Operation: core.OpClear, Key: "k"})
+
+	logged := records(t, buf)
+	require.Len(t, logged, 4)
+
+	assert.Equal(t, "ERROR", logged[0]["level"])
+	assert.Equal(t, "connection refused", logged[0]["error"])
+	assert.NotContains(t, logged[0], "remaining")
+
+	assert.Equal(t, "WARN", logged[1]["level"])
+	assert.Equal(t, true, logged[1]["fallback"])
+	assert.Equal(t, float64(3), logged[1]["remaining"])
+
+	assert.Equal(t, "rate limit configuration reloaded", logged[2]["msg"])
+	assert.Equal(t, "/etc/peers", logged[2]["source"])
+	assert.Equal(t, "ERROR", logged[3]["level"])
+}
+
+func TestObserver_SamplesAllows(t *testing.T) {
+	allowed := core.Event{Operation: core.OpGrant, Decision: core.Decision{Allowed: true}}
+
+	// Allows are off by default, even at debug level
+	observer, buf := newObserver(slog.LevelDebug, Options{})
+	observer.Observe(context.Background(), allowed)
+	assert.Empty(t, buf.String())
+
+	observer, buf = newObserver(slog.LevelDebug, Options{AllowSampleRate: 0.5})
+	rolls := []float64{0.1, 0.7, 0.4, 0.5}
+	observer.random = func() float64 {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		return roll
+	}
+	for i := 0; i < 4; i++ {
+		observer.Observe(context.Background(), allowed)
+	}
+	logged := records(t, buf)
+	require.Len(t, logged, 2)
+	assert.Equal(t, "DEBUG", logged[0]["level"])
+	assert.Equal(t, "rate limit allowed", logged[0]["msg"])
+
+	// Disabled levels cost nothing
+	observer, buf = newObserver(slog.LevelWarn, Options{AllowSampleRate: 1})
+	observer.Observe(context.Background(), allowed)
+	observer.Observe(context.Background(), core.Event{Operation: core.OpGrant})
+	assert.Empty(t, buf.String())
+}
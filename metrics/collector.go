@@ -1,57 +1,158 @@
 package metrics
 
 import (
+	"container/list"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-// Collector implements MetricsCollector with thread-safe metric storage
+// defaultMaxSeries bounds the collector when no cap is configured
+const defaultMaxSeries = 10000
+
+// DefaultBuckets are the histogram bucket upper bounds used by default,
+// suited to latencies in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// CollectorOptions configures a Collector
+type CollectorOptions struct {
+	MaxSeries int           // Series kept; the least recently updated are evicted beyond it (default 10000, negative for no cap)
+	Retention time.Duration // Series not updated for this long are dropped (0 keeps them)
+	Buckets   []float64     // Ascending upper bounds of histogram buckets (default DefaultBuckets)
+}
+
+// Collector implements MetricsCollector by aggregating metrics in place.
+// Each distinct name and label set is one series: counters are summed,
+// gauges keep the last value and histograms count observations per bucket.
+// Memory is bounded by MaxSeries and Retention rather than traffic.
 type Collector struct {
-	mu      sync.RWMutex
-	metrics map[string][]Metric
+	opts CollectorOptions
+	now  func() time.Time
+
+	mu      sync.Mutex
+	series  map[string]*series
+	recency *list.List // Of *series, most recently updated first
 }
 
-// NewCollector creates a new metrics collector
+// series is the aggregated state of one name and label set
+type series struct {
+	id      string
+	metric  Metric
+	counts  []uint64 // Histogram observations per bucket, the last one +Inf
+	updated time.Time
+	elem    *list.Element
+}
+
+// NewCollector creates a new metrics collector with the default options
 func NewCollector() *Collector {
+	return NewCollectorWithOptions(CollectorOptions{})
+}
+
+// NewCollectorWithOptions creates a metrics collector
+func NewCollectorWithOptions(opts CollectorOptions) *Collector {
+	if opts.MaxSeries == 0 {
+		opts.MaxSeries = defaultMaxSeries
+	}
+	if len(opts.Buckets) == 0 {
+		opts.Buckets = DefaultBuckets
+	}
+
 	return &Collector{
-		metrics: make(map[string][]Metric),
+		opts:    opts,
+		now:     time.Now,
+		series:  make(map[string]*series),
+		recency: list.New(),
 	}
 }
 
-// AddMetric adds a metric to the collector
+// AddMetric folds a metric into its series. A counter's Value is added, a
+// gauge's replaces the last one and a histogram's is an observation.
 func (c *Collector) AddMetric(metric Metric) {
+	id := seriesID(metric.Name, metric.Labels)
+	now := c.now()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.metrics[metric.Name] == nil {
-		c.metrics[metric.Name] = make([]Metric, 0)
+	c.expire(now)
+
+	s, exists := c.series[id]
+	if !exists {
+		s = &series{
+			id: id,
+			metric: Metric{
+				Name:   metric.Name,
+				Type:   metric.Type,
+				Labels: copyLabels(metric.Labels),
+			},
+		}
+		if s.metric.Type == Histogram {
+			s.counts = make([]uint64, len(c.opts.Buckets)+1)
+		}
+		s.elem = c.recency.PushFront(s)
+		c.series[id] = s
+		c.evict()
+	} else {
+		c.recency.MoveToFront(s.elem)
+	}
+
+	s.updated = now
+	s.metric.Timestamp = metric.Timestamp
+	if s.metric.Timestamp.IsZero() {
+		s.metric.Timestamp = now
+	}
+	if metric.Help != "" {
+		s.metric.Help = metric.Help
+	}
+
+	switch s.metric.Type {
+	case Counter:
+		s.metric.Value += metric.Value
+	case Histogram:
+		s.metric.Value += metric.Value
+		s.metric.Count++
+		s.counts[sort.SearchFloat64s(c.opts.Buckets, metric.Value)]++
+	default:
+		s.metric.Value = metric.Value
 	}
-	c.metrics[metric.Name] = append(c.metrics[metric.Name], metric)
 }
 
-// Collect returns all current metrics
-func (c *Collector) Collect() []Metric {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Snapshot returns the current value of every series, ordered by name and
+// labels
+func (c *Collector) Snapshot() []Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	var allMetrics []Metric
-	for _, metrics := range c.metrics {
-		allMetrics = append(allMetrics, metrics...)
+	c.expire(c.now())
+
+	ids := make([]string, 0, len(c.series))
+	for id := range c.series {
+		ids = append(ids, id)
 	}
-	return allMetrics
+	sort.Strings(ids)
+
+	metrics := make([]Metric, len(ids))
+	for i, id := range ids {
+		metrics[i] = c.snapshot(c.series[id])
+	}
+	return metrics
 }
 
-// GetMetrics returns metrics for a specific name
-func (c *Collector) GetMetrics(name string) []Metric {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Collect returns all current series, like Snapshot
+func (c *Collector) Collect() []Metric {
+	return c.Snapshot()
+}
 
-	if metrics, exists := c.metrics[name]; exists {
-		// Return a copy to prevent external modifications
-		result := make([]Metric, len(metrics))
-		copy(result, metrics)
-		return result
+// GetMetrics returns the series with a specific name
+func (c *Collector) GetMetrics(name string) []Metric {
+	var result []Metric
+	for _, metric := range c.Snapshot() {
+		if metric.Name == name {
+			result = append(result, metric)
+		}
 	}
-	return nil
+	return result
 }
 
 // Reset clears all metrics
@@ -59,38 +160,118 @@ func (c *Collector) Reset() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.metrics = make(map[string][]Metric)
+	c.series = make(map[string]*series)
+	c.recency.Init()
 }
 
-// GetMetricsByType returns all metrics of a specific type
-func (c *Collector) GetMetricsByType(metricType MetricType) []Metric {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Len returns the number of series held
+func (c *Collector) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.series)
+}
 
+// GetMetricsByType returns all series of a specific type
+func (c *Collector) GetMetricsByType(metricType MetricType) []Metric {
 	var result []Metric
-	for _, metrics := range c.metrics {
-		for _, metric := range metrics {
-			if metric.Type == metricType {
-				result = append(result, metric)
-			}
+	for _, metric := range c.Snapshot() {
+		if metric.Type == metricType {
+			result = append(result, metric)
 		}
 	}
 	return result
 }
 
-// GetMetricsSummary returns a summary of metrics by name and type
+// GetMetricsSummary returns the number of series by name and type
 func (c *Collector) GetMetricsSummary() map[string]map[MetricType]int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
 	summary := make(map[string]map[MetricType]int)
+	for _, metric := range c.Snapshot() {
+		if summary[metric.Name] == nil {
+			summary[metric.Name] = make(map[MetricType]int)
+		}
+		summary[metric.Name][metric.Type]++
+	}
+	return summary
+}
 
-	for name, metrics := range c.metrics {
-		summary[name] = make(map[MetricType]int)
-		for _, metric := range metrics {
-			summary[name][metric.Type]++
+// snapshot copies a series, with cumulative histogram buckets; the caller
+// holds mu
+func (c *Collector) snapshot(s *series) Metric {
+	metric := s.metric
+	metric.Labels = copyLabels(s.metric.Labels)
+
+	if s.counts != nil {
+		metric.Buckets = make([]Bucket, len(c.opts.Buckets))
+		var cumulative uint64
+		for i, upper := range c.opts.Buckets {
+			cumulative += s.counts[i]
+			metric.Buckets[i] = Bucket{UpperBound: upper, Count: cumulative}
 		}
 	}
+	return metric
+}
+
+// expire drops series not updated within the retention; the caller holds mu
+func (c *Collector) expire(now time.Time) {
+	if c.opts.Retention <= 0 {
+		return
+	}
 
-	return summary
+	cutoff := now.Add(-c.opts.Retention)
+	for elem := c.recency.Back(); elem != nil; elem = c.recency.Back() {
+		s := elem.Value.(*series)
+		if !s.updated.Before(cutoff) {
+			return
+		}
+		c.remove(s)
+	}
+}
+
+// evict drops the least recently updated series beyond MaxSeries; the
+// caller holds mu
+func (c *Collector) evict() {
+	if c.opts.MaxSeries < 0 {
+		return
+	}
+	for len(c.series) > c.opts.MaxSeries {
+		c.remove(c.recency.Back().Value.(*series))
+	}
+}
+
+// remove forgets a series; the caller holds mu
+func (c *Collector) remove(s *series) {
+	c.recency.Remove(s.elem)
+	delete(c.series, s.id)
+}
+
+// seriesID identifies a series by its name and sorted labels
+func seriesID(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, k := range keys {
+		sb.WriteByte(0)
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(labels[k])
+	}
+	return sb.String()
+}
+
+// copyLabels returns a copy of labels, nil if there are none
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
 }
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNow returns a clock for c that tests move by hand
+func fakeNow(c *Collector) *time.Time {
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+	return &now
+}
+
+func TestCollector_Aggregates(t *testing.T) {
+	c := NewCollector()
+	labels := map[string]string{"key": "user-1"}
+
+	for i := 0; i < 1000; i++ {
+		c.AddMetric(Metric{Name: "grants", Type: Counter, Value: 1, Labels: labels, Help: "Grants"})
+		c.AddMetric(Metric{Name: "remaining", Type: Gauge, Value: float64(i), Labels: labels})
+	}
+	c.AddMetric(Metric{Name: "grants", Type: Counter, Value: 1, Labels: map[string]string{"key": "user-2"}})
+
+	// One series per name and label set, however many events
+	assert.Equal(t, 3, c.Len())
+
+	grants := c.GetMetrics("grants")
+	require.Len(t, grants, 2)
+	assert.Equal(t, 1000.0, grants[0].Value)
+	assert.Equal(t, "user-1", grants[0].Labels["key"])
+	assert.Equal(t, "Grants", grants[0].Help)
+	assert.Equal(t, 1.0, grants[1].Value)
+
+	remaining := c.GetMetrics("remaining")
+	require.Len(t, remaining, 1)
+	assert.Equal(t, 999.0, remaining[0].Value)
+
+	assert.Equal(t, map[string]map[MetricType]int{
+		"grants":    {Counter: 2},
+		"remaining": {Gauge: 1},
+	}, c.GetMetricsSummary())
+	assert.Len(t, c.GetMetricsByType(Gauge), 1)
+
+	// Label order doesn't matter and snapshots are copies
+	c.AddMetric(Metric{Name: "multi", Type: Counter, Value: 1, Labels: map[string]string{"a": "1", "b": "2"}})
+	c.AddMetric(Metric{Name: "multi", Type: Counter, Value: 1, Labels: map[string]string{"b": "2", "a": "1"}})
+	multi := c.GetMetrics("multi")
+	require.Len(t, multi, 1)
+	assert.Equal(t, 2.0, multi[0].Value)
+	multi[0].Labels["a"] = "changed"
+	assert.Equal(t, "1", c.GetMetrics("multi")[0].Labels["a"])
+
+	c.Reset()
+	assert.Empty(t, c.Collect())
+}
+
+func TestCollector_Histogram(t *testing.T) {
+	c := NewCollectorWithOptions(CollectorOptions{Buckets: []float64{0.1, 1}})
+
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		c.AddMetric(Metric{Name: "latency", Type: Histogram, Value: v})
+	}
+
+	latency := c.GetMetrics("latency")
+	require.Len(t, latency, 1)
+	assert.Equal(t, uint64(4), latency[0].Count)
+	assert.InDelta(t, 2.65, latency[0].Value, 1e-9)
+	assert.Equal(t, []Bucket{{UpperBound: 0.1, Count: 2}, {UpperBound: 1, Count: 3}}, latency[0].Buckets)
+}
+
+func TestCollector_MaxSeries(t *testing.T) {
+	c := NewCollectorWithOptions(CollectorOptions{MaxSeries: 100})
+	now := fakeNow(c)
+
+	for i := 0; i < 1000; i++ {
+		*now = now.Add(time.Millisecond)
+		c.AddMetric(Metric{Name: "grants", Type: Counter, Value: 1, Labels: map[string]string{"key": fmt.Sprint(i)}})
+		// Keep one series hot so it is never the least recently updated
+		c.AddMetric(Metric{Name: "grants", Type: Counter, Value: 1, Labels: map[string]string{"key": "hot"}})
+	}
+
+	assert.Equal(t, 100, c.Len())
+	var hot, newest bool
+	for _, metric := range c.Snapshot() {
+		hot = hot || metric.Labels["key"] == "hot"
+		newest = newest || metric.Labels["key"] == "999"
+		assert.NotEqual(t, "0", metric.Labels["key"])
+	}
+	assert.True(t, hot)
+	assert.True(t, newest)
+}
+
+func TestCollector_Retention(t *testing.T) {
+	c := NewCollectorWithOptions(CollectorOptions{Retention: time.Minute})
+	now := fakeNow(c)
+
+	c.AddMetric(Metric{Name: "old", Type: Counter, Value: 1})
+	*now = now.Add(30 * time.Second)
+	c.AddMetric(Metric{Name: "recent", Type: Counter, Value: 1})
+	*now = now.Add(31 * time.Second)
+
+	snapshot := c.Snapshot()
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, "recent", snapshot[0].Name)
+
+	// An update keeps a series alive
+	c.AddMetric(Metric{Name: "recent", Type: Counter, Value: 1})
+	*now = now.Add(59 * time.Second)
+	assert.Equal(t, 2.0, c.GetMetrics("recent")[0].Value)
+}
+
+func TestCollector_JSONCompatible(t *testing.T) {
+	c := NewCollector()
+	ts := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	c.AddMetric(Metric{Name: "throttle_grant_total", Type: Counter, Value: 1, Labels: map[string]string{"key": "k"}, Timestamp: ts, Help: "Total"})
+
+	data, err := json.Marshal(c.Collect())
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"name":"throttle_grant_total","type":"counter","value":1,"labels":{"key":"k"},"timestamp":"2024-01-15T10:30:00Z","help":"Total"}]`, string(data))
+}
+
+func TestCollector_Concurrent(t *testing.T) {
+	c := NewCollectorWithOptions(CollectorOptions{MaxSeries: 10})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				c.AddMetric(Metric{Name: "grants", Type: Counter, Value: 1, Labels: map[string]string{"key": fmt.Sprint(i % 20)}})
+				if i%50 == 0 {
+					c.Snapshot()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, c.Len(), 10)
+}
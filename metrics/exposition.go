@@ -0,0 +1,263 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content types of the exposition formats
+const (
+	TextContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Handler serves the metrics of a MetricsCollector for scraping, in the
+// Prometheus text format or, when the scraper asks for it, in OpenMetrics
+type Handler struct {
+	collector MetricsCollector
+}
+
+// NewHandler creates a handler exposing collector
+func NewHandler(collector MetricsCollector) *Handler {
+	return &Handler{collector: collector}
+}
+
+// ServeHTTP writes the current metrics in the format negotiated from the
+// Accept header
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics := h.collector.Collect()
+
+	if acceptsOpenMetrics(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+		WriteOpenMetrics(w, metrics)
+		return
+	}
+
+	w.Header().Set("Content-Type", TextContentType)
+	WriteText(w, metrics)
+}
+
+// acceptsOpenMetrics reports whether an Accept header prefers OpenMetrics
+// to the text format
+func acceptsOpenMetrics(accept string) bool {
+	openMetrics, text := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/openmetrics-text":
+			openMetrics = math.Max(openMetrics, q)
+		case "text/plain", "text/*", "*/*":
+			text = math.Max(text, q)
+		}
+	}
+	return openMetrics > 0 && openMetrics >= text
+}
+
+// WriteText writes metrics in the Prometheus text exposition format
+func WriteText(w io.Writer, metrics []Metric) error {
+	return write(w, metrics, false)
+}
+
+// WriteOpenMetrics writes metrics in the OpenMetrics text format
+func WriteOpenMetrics(w io.Writer, metrics []Metric) error {
+	return write(w, metrics, true)
+}
+
+// family is the metrics sharing a name
+type family struct {
+	name    string
+	kind    MetricType
+	help    string
+	metrics []Metric
+}
+
+// write renders metrics grouped into families, ordered by name
+func write(w io.Writer, metrics []Metric, openMetrics bool) error {
+	bw := bufio.NewWriter(w)
+
+	for _, f := range families(metrics) {
+		name := sanitizeMetricName(f.name)
+		// OpenMetrics names a counter family without its _total suffix
+		if openMetrics && f.kind == Counter {
+			name = strings.TrimSuffix(name, "_total")
+		}
+
+		if f.help != "" {
+			bw.WriteString("# HELP " + name + " " + escapeHelp(f.help, openMetrics) + "\n")
+		}
+		bw.WriteString("# TYPE " + name + " " + typeName(f.kind, openMetrics) + "\n")
+
+		for _, metric := range f.metrics {
+			switch f.kind {
+			case Counter:
+				sample := name
+				if openMetrics {
+					sample = name + "_total"
+				}
+				writeSample(bw, sample, metric.Labels, "", "", metric.Value, openMetrics)
+			case Histogram:
+				for _, bucket := range metric.Buckets {
+					writeSample(bw, name+"_bucket", metric.Labels, "le", formatFloat(bucket.UpperBound, openMetrics), float64(bucket.Count), openMetrics)
+				}
+				writeSample(bw, name+"_bucket", metric.Labels, "le", "+Inf", float64(metric.Count), openMetrics)
+				writeSample(bw, name+"_sum", metric.Labels, "", "", metric.Value, openMetrics)
+				writeSample(bw, name+"_count", metric.Labels, "", "", float64(metric.Count), openMetrics)
+			default:
+				writeSample(bw, name, metric.Labels, "", "", metric.Value, openMetrics)
+			}
+		}
+	}
+
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// families groups metrics by name, taking the type and help of the first
+// metric of each name
+func families(metrics []Metric) []*family {
+	byName := make(map[string]*family)
+	var result []*family
+	for _, metric := range metrics {
+		f, ok := byName[metric.Name]
+		if !ok {
+			f = &family{name: metric.Name, kind: metric.Type}
+			byName[metric.Name] = f
+			result = append(result, f)
+		}
+		if f.help == "" {
+			f.help = metric.Help
+		}
+		f.metrics = append(f.metrics, metric)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+// writeSample writes one sample line, adding an extra label such as le
+func writeSample(w *bufio.Writer, name string, labels map[string]string, extraName, extraValue string, value float64, openMetrics bool) {
+	w.WriteString(name)
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(sanitizeLabelName(k) + `="` + escapeLabelValue(labels[k]) + `"`)
+		}
+		if extraName != "" {
+			if len(keys) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value, openMetrics))
+	w.WriteByte('\n')
+}
+
+// typeName is the TYPE of a family in either format
+func typeName(kind MetricType, openMetrics bool) string {
+	switch kind {
+	case Counter, Gauge, Histogram:
+		return string(kind)
+	}
+	if openMetrics {
+		return "unknown"
+	}
+	return "untyped"
+}
+
+// formatFloat formats a sample value or bucket bound. OpenMetrics wants
+// integral floats written with a fraction, such as 1.0.
+func formatFloat(v float64, openMetrics bool) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if openMetrics && !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return s
+}
+
+// escapeHelp escapes backslashes and newlines, and in OpenMetrics quotes
+func escapeHelp(help string, openMetrics bool) string {
+	if openMetrics {
+		return labelValueEscaper.Replace(help)
+	}
+	return helpEscaper.Replace(help)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeLabelValue escapes backslashes, quotes and newlines
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// sanitizeMetricName replaces characters not allowed in metric names
+func sanitizeMetricName(name string) string {
+	return sanitize(name, true)
+}
+
+// sanitizeLabelName replaces characters not allowed in label names
+func sanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+// sanitize maps a name to [a-zA-Z_][a-zA-Z0-9_]*, also allowing colons in
+// metric names
+func sanitize(name string, colons bool) string {
+	if name == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', colons && r == ':':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			r = '_'
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
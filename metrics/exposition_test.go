@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exampleCollector holds a counter, a gauge and a histogram
+func exampleCollector() *Collector {
+	c := NewCollectorWithOptions(CollectorOptions{Buckets: []float64{0.01, 1}})
+	c.AddMetric(Metric{Name: "throttle_grant_total", Type: Counter, Value: 3, Labels: map[string]string{"key": `a "quoted"\key` + "\n"}, Help: "Total number of grant requests"})
+	c.AddMetric(Metric{Name: "throttle_remaining_tokens", Type: Gauge, Value: 4, Labels: map[string]string{"key": "k", "decision": "allowed"}, Help: "Remaining\ntokens"})
+	c.AddMetric(Metric{Name: "throttle_operation_duration_seconds", Type: Histogram, Value: 0.005, Labels: map[string]string{"phase": "total"}})
+	c.AddMetric(Metric{Name: "throttle_operation_duration_seconds", Type: Histogram, Value: 2})
+	return c
+}
+
+func TestWriteText(t *testing.T) {
+	var sb strings.Builder
+	require.NoError(t, WriteText(&sb, exampleCollector().Collect()))
+
+	assert.Equal(t, `# HELP throttle_grant_total Total number of grant requests
+# TYPE throttle_grant_total counter
+throttle_grant_total{key="a \"quoted\"\\key\n"} 3
+# TYPE throttle_operation_duration_seconds histogram
+throttle_operation_duration_seconds_bucket{le="0.01"} 0
+throttle_operation_duration_seconds_bucket{le="1"} 0
+throttle_operation_duration_seconds_bucket{le="+Inf"} 1
+throttle_operation_duration_seconds_sum 2
+throttle_operation_duration_seconds_count 1
+throttle_operation_duration_seconds_bucket{phase="total",le="0.01"} 1
+throttle_operation_duration_seconds_bucket{phase="total",le="1"} 1
+throttle_operation_duration_seconds_bucket{phase="total",le="+Inf"} 1
+throttle_operation_duration_seconds_sum{phase="total"} 0.005
+throttle_operation_duration_seconds_count{phase="total"} 1
+# HELP throttle_remaining_tokens Remaining\ntokens
+# TYPE throttle_remaining_tokens gauge
+throttle_remaining_tokens{decision="allowed",key="k"} 4
+`, sb.String())
+
+	// The Prometheus parser accepts it
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(sb.String()))
+	require.NoError(t, err)
+	require.Contains(t, families, "throttle_grant_total")
+	assert.Equal(t, `a "quoted"\key`+"\n", families["throttle_grant_total"].Metric[0].Label[0].GetValue())
+	assert.Equal(t, uint64(1), families["throttle_operation_duration_seconds"].Metric[0].Histogram.GetSampleCount())
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	var sb strings.Builder
+	require.NoError(t, WriteOpenMetrics(&sb, exampleCollector().Collect()))
+
+	text := sb.String()
+	assert.Contains(t, text, "# HELP throttle_grant Total number of grant requests\n# TYPE throttle_grant counter\nthrottle_grant_total{")
+	assert.Contains(t, text, `throttle_operation_duration_seconds_bucket{phase="total",le="1.0"} 1.0`)
+	assert.Contains(t, text, "# HELP throttle_remaining_tokens Remaining\\ntokens\n")
+	assert.True(t, strings.HasSuffix(text, "# EOF\n"))
+}
+
+func TestWriteText_Untyped(t *testing.T) {
+	var sb strings.Builder
+	require.NoError(t, WriteText(&sb, []Metric{{Name: "queue-depth", Type: "summary", Value: 1}}))
+	assert.Equal(t, "# TYPE queue_depth untyped\nqueue_depth 1\n", sb.String())
+}
+
+func TestHandler_ContentNegotiation(t *testing.T) {
+	h := NewHandler(exampleCollector())
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"", TextContentType},
+		{"text/plain;version=0.0.4", TextContentType},
+		{"application/openmetrics-text;version=1.0.0", OpenMetricsContentType},
+		// What Prometheus sends by default
+		{"application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", OpenMetricsContentType},
+		{"application/openmetrics-text;q=0.2,text/plain;q=0.9", TextContentType},
+		{"application/json", TextContentType},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", tt.accept)
+		h.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code, tt.accept)
+		assert.Equal(t, tt.contentType, rec.Header().Get("Content-Type"), tt.accept)
+		assert.Equal(t, tt.contentType == OpenMetricsContentType, strings.HasSuffix(rec.Body.String(), "# EOF\n"), tt.accept)
+	}
+}
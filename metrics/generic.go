@@ -3,6 +3,8 @@ package metrics
 import (
 	"sync"
 	"time"
+
+	"github.com/throttle/core"
 )
 
 // GenericReporter implements MetricsReporter with actual metric collection
@@ -125,6 +127,22 @@ func (g *GenericReporter) RecordClear(key string) {
 	})
 }
 
+// RecordTiming records the duration of an operation phase as a histogram
+// observation in seconds
+func (g *GenericReporter) RecordTiming(op core.Operation, phase core.Phase, d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.collector.AddMetric(Metric{
+		Name:      "throttle_operation_duration_seconds",
+		Type:      Histogram,
+		Value:     d.Seconds(),
+		Labels:    map[string]string{"operation": string(op), "phase": string(phase)},
+		Timestamp: time.Now(),
+		Help:      "Duration of limiter operations and of their backend and strategy phases",
+	})
+}
+
 // GetCollector returns the metrics collector
 func (g *GenericReporter) GetCollector() MetricsCollector {
 	return g.collector
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/core"
+)
+
+func TestGenericReporter_BoundedMemory(t *testing.T) {
+	reporter := NewGenericReporter()
+	for i := 0; i < 10000; i++ {
+		reporter.RecordGrant("same-key", i%2 == 0, 1)
+	}
+
+	// Grant total, allowed, denied and remaining per decision
+	collector := reporter.GetCollector()
+	assert.Len(t, collector.Collect(), 5)
+	assert.Equal(t, 10000.0, collector.GetMetrics("throttle_grant_total")[0].Value)
+}
+
+func TestGenericReporter_RecordTiming(t *testing.T) {
+	reporter := NewGenericReporter()
+	reporter.RecordTiming(core.OpGrant, core.PhaseTotal, 2*time.Millisecond)
+	reporter.RecordTiming(core.OpGrant, core.PhaseTotal, 3*time.Millisecond)
+	reporter.RecordTiming(core.OpGrant, core.PhaseStrategy, time.Microsecond)
+
+	durations := reporter.GetCollector().GetMetrics("throttle_operation_duration_seconds")
+	require.Len(t, durations, 2)
+	assert.Equal(t, Histogram, durations[0].Type)
+	assert.Equal(t, map[string]string{"operation": "grant", "phase": "strategy"}, durations[0].Labels)
+	assert.Equal(t, map[string]string{"operation": "grant", "phase": "total"}, durations[1].Labels)
+	assert.Equal(t, uint64(2), durations[1].Count)
+	assert.InDelta(t, 0.005, durations[1].Value, 1e-9)
+}
@@ -1,15 +1,52 @@
 package metrics
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/throttle/core"
 )
 
-// PrometheusReporter implements MetricsReporter with Prometheus metrics
+// OtherLabel is the key label of series for keys beyond MaxLabelValues
+const OtherLabel = "other"
+
+// defaultMaxLabelValues bounds the key label when no cap is configured
+const defaultMaxLabelValues = 1000
+
+// labelSets holds the label values given their own series, per shared
+// grant_total collector, so reporters sharing metrics share the cap
+var labelSets sync.Map // *prometheus.CounterVec -> *labelSet
+
+// labelSet is the key label values of a group of shared metrics
+type labelSet struct {
+	mu     sync.Mutex
+	values map[string]struct{}
+}
+
+// PrometheusOptions configures a PrometheusReporter
+type PrometheusOptions struct {
+	Registerer     prometheus.Registerer   // Where metrics are registered (default prometheus.DefaultRegisterer)
+	Namespace      string                  // Metric name prefix (default "throttle")
+	Subsystem      string                  // Optional second name component
+	ConstLabels    prometheus.Labels       // Labels added to every series
+	KeyLabel       func(key string) string // Maps a key to its "key" label value (default: the key itself)
+	MaxLabelValues int                     // Distinct label values before the rest go to OtherLabel (default 1000, negative for no cap)
+	Buckets        []float64               // Upper bounds of the duration histogram in seconds (default DefaultBuckets)
+}
+
+// PrometheusReporter implements MetricsReporter with Prometheus metrics.
+// Series are labelled with the key, or with what KeyLabel maps it to, and
+// the number of label values is capped so keys such as client IPs can't
+// create unbounded series. Reporters sharing metrics on one registry share
+// the label values counted against the cap.
 type PrometheusReporter struct {
-	mu sync.RWMutex
+	keyLabel       func(key string) string
+	maxLabelValues int
+	labels         *labelSet // Label values given their own series
 
 	// Metrics
 	grantTotal     *prometheus.CounterVec
@@ -18,86 +55,198 @@ type PrometheusReporter struct {
 	previewTotal   *prometheus.CounterVec
 	clearTotal     *prometheus.CounterVec
 	remainingGauge *prometheus.GaugeVec
+	labelOverflow  prometheus.Counter
+	duration       *prometheus.HistogramVec
 }
 
-// NewPrometheusReporter creates a new Prometheus metrics reporter
+// NewPrometheusReporter creates a reporter on the default registry with the
+// default options. Creating it again reuses the metrics already registered.
+// It panics if registration fails otherwise.
 func NewPrometheusReporter() *PrometheusReporter {
-	return &PrometheusReporter{
-		grantTotal: promauto.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "throttle_grant_total",
-				Help: "Total number of grant requests",
-			},
-			[]string{"key"},
-		),
-		grantAllowed: promauto.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "throttle_grant_allowed_total",
-				Help: "Total number of allowed grant requests",
-			},
-			[]string{"key"},
-		),
-		grantDenied: promauto.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "throttle_grant_denied_total",
-				Help: "Total number of denied grant requests",
-			},
-			[]string{"key"},
-		),
-		previewTotal: promauto.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "throttle_preview_total",
-				Help: "Total number of preview requests",
-			},
-			[]string{"key"},
-		),
-		clearTotal: promauto.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "throttle_clear_total",
-				Help: "Total number of clear operations",
-			},
-			[]string{"key"},
-		),
-		remainingGauge: promauto.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "throttle_remaining_tokens",
-				Help: "Current number of remaining tokens",
-			},
-			[]string{"key"},
-		),
+	p, err := NewPrometheusReporterWithOptions(PrometheusOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// NewPrometheusReporterWithOptions creates a reporter registering its
+// metrics with opts.Registerer. Metrics already registered there by a
+// reporter with the same names and labels are shared rather than failing.
+func NewPrometheusReporterWithOptions(opts PrometheusOptions) (*PrometheusReporter, error) {
+	if opts.Registerer == nil {
+		opts.Registerer = prometheus.DefaultRegisterer
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = "throttle"
+	}
+	if opts.KeyLabel == nil {
+		opts.KeyLabel = func(key string) string { return key }
+	}
+	if opts.MaxLabelValues == 0 {
+		opts.MaxLabelValues = defaultMaxLabelValues
+	}
+	if len(opts.Buckets) == 0 {
+		opts.Buckets = DefaultBuckets
+	}
+
+	counter := func(name, help string) (*prometheus.CounterVec, error) {
+		return register(opts.Registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: opts.ConstLabels,
+		}, []string{"key"}))
+	}
+
+	p := &PrometheusReporter{
+		keyLabel:       opts.KeyLabel,
+		maxLabelValues: opts.MaxLabelValues,
+	}
+
+	var err error
+	if p.grantTotal, err = counter("grant_total", "Total number of grant requests"); err != nil {
+		return nil, err
+	}
+	labels, _ := labelSets.LoadOrStore(p.grantTotal, &labelSet{values: make(map[string]struct{})})
+	p.labels = labels.(*labelSet)
+	if p.grantAllowed, err = counter("grant_allowed_total", "Total number of allowed grant requests"); err != nil {
+		return nil, err
+	}
+	if p.grantDenied, err = counter("grant_denied_total", "Total number of denied grant requests"); err != nil {
+		return nil, err
+	}
+	if p.previewTotal, err = counter("preview_total", "Total number of preview requests"); err != nil {
+		return nil, err
+	}
+	if p.clearTotal, err = counter("clear_total", "Total number of clear operations"); err != nil {
+		return nil, err
+	}
+
+	p.remainingGauge, err = register(opts.Registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "remaining_tokens",
+		Help:        "Current number of remaining tokens",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"key"}))
+	if err != nil {
+		return nil, err
+	}
+
+	p.labelOverflow, err = register(opts.Registerer, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "label_overflow_total",
+		Help:        "Total number of operations recorded under the \"other\" key label because the label cap was reached",
+		ConstLabels: opts.ConstLabels,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	p.duration, err = register(opts.Registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "operation_duration_seconds",
+		Help:        "Duration of limiter operations and of their backend and strategy phases",
+		ConstLabels: opts.ConstLabels,
+		Buckets:     opts.Buckets,
+	}, []string{"operation", "phase"}))
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// HashKeyLabel returns a KeyLabel function spreading keys over n buckets
+// labelled "00", "01"... so the key label has at most n values
+func HashKeyLabel(n int) func(key string) string {
+	if n < 1 {
+		n = 1
+	}
+	width := len(fmt.Sprint(n - 1))
+	return func(key string) string {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return fmt.Sprintf("%0*d", width, h.Sum32()%uint32(n))
 	}
 }
 
 // RecordGrant records a grant decision
 func (p *PrometheusReporter) RecordGrant(key string, allowed bool, remaining int64) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	label := p.label(key)
 
-	p.grantTotal.WithLabelValues(key).Inc()
+	p.grantTotal.WithLabelValues(label).Inc()
 
 	if allowed {
-		p.grantAllowed.WithLabelValues(key).Inc()
+		p.grantAllowed.WithLabelValues(label).Inc()
 	} else {
-		p.grantDenied.WithLabelValues(key).Inc()
+		p.grantDenied.WithLabelValues(label).Inc()
 	}
 
-	p.remainingGauge.WithLabelValues(key).Set(float64(remaining))
+	p.remainingGauge.WithLabelValues(label).Set(float64(remaining))
 }
 
 // RecordPreview records a preview operation
 func (p *PrometheusReporter) RecordPreview(key string, remaining int64) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	label := p.label(key)
 
-	p.previewTotal.WithLabelValues(key).Inc()
-	p.remainingGauge.WithLabelValues(key).Set(float64(remaining))
+	p.previewTotal.WithLabelValues(label).Inc()
+	p.remainingGauge.WithLabelValues(label).Set(float64(remaining))
 }
 
 // RecordClear records a clear operation
 func (p *PrometheusReporter) RecordClear(key string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	label := p.label(key)
+
+	p.clearTotal.WithLabelValues(label).Inc()
+	p.remainingGauge.WithLabelValues(label).Set(0)
+}
+
+// RecordTiming records the duration of an operation phase. Durations are
+// labelled by operation and phase only, never by key.
+func (p *PrometheusReporter) RecordTiming(op core.Operation, phase core.Phase, d time.Duration) {
+	p.duration.WithLabelValues(string(op), string(phase)).Observe(d.Seconds())
+}
+
+// label maps key to its label value. The first MaxLabelValues distinct
+// values, counted across the reporters sharing the metrics, keep their own
+// series; later ones are recorded as OtherLabel.
+func (p *PrometheusReporter) label(key string) string {
+	label := p.keyLabel(key)
+	if p.maxLabelValues < 0 {
+		return label
+	}
+
+	p.labels.mu.Lock()
+	defer p.labels.mu.Unlock()
 
-	p.clearTotal.WithLabelValues(key).Inc()
-	p.remainingGauge.WithLabelValues(key).Set(0)
+	if _, ok := p.labels.values[label]; ok {
+		return label
+	}
+	if len(p.labels.values) < p.maxLabelValues {
+		p.labels.values[label] = struct{}{}
+		return label
+	}
+
+	p.labelOverflow.Inc()
+	return OtherLabel
+}
+
+// register registers c, or returns the identical collector registered
+// before it
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	if err := reg.Register(c); err != nil {
+		var already prometheus.AlreadyRegisteredError
+		if errors.As(err, &already) {
+			if existing, ok := already.ExistingCollector.(C); ok {
+				return existing, nil
+			}
+		}
+		return c, fmt.Errorf("failed to register metric: %w", err)
+	}
+	return c, nil
 }
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/core"
+)
+
+func TestPrometheusReporter_Registry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p, err := NewPrometheusReporterWithOptions(PrometheusOptions{
+		Registerer:  reg,
+		Namespace:   "api",
+		Subsystem:   "limits",
+		ConstLabels: prometheus.Labels{"service": "checkout"},
+	})
+	require.NoError(t, err)
+
+	p.RecordGrant("user-1", true, 4)
+	p.RecordGrant("user-1", false, 0)
+	p.RecordPreview("user-1", 0)
+	p.RecordClear("user-1")
+
+	expected := `
+# HELP api_limits_grant_total Total number of grant requests
+# TYPE api_limits_grant_total counter
+api_limits_grant_total{key="user-1",service="checkout"} 2
+# HELP api_limits_grant_denied_total Total number of denied grant requests
+# TYPE api_limits_grant_denied_total counter
+api_limits_grant_denied_total{key="user-1",service="checkout"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"api_limits_grant_total", "api_limits_grant_denied_total"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.clearTotal.WithLabelValues("user-1")))
+
+	// A second reporter on the same registry shares the metrics
+	other, err := NewPrometheusReporterWithOptions(PrometheusOptions{
+		Registerer:  reg,
+		Namespace:   "api",
+		Subsystem:   "limits",
+		ConstLabels: prometheus.Labels{"service": "checkout"},
+	})
+	require.NoError(t, err)
+	other.RecordGrant("user-1", true, 3)
+	assert.Equal(t, 3.0, testutil.ToFloat64(p.grantTotal.WithLabelValues("user-1")))
+
+	// Conflicting definitions are reported instead of panicking
+	_, err = NewPrometheusReporterWithOptions(PrometheusOptions{Registerer: reg, Namespace: "api", Subsystem: "limits"})
+	assert.Error(t, err)
+}
+
+func TestPrometheusReporter_LabelCap(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p, err := NewPrometheusReporterWithOptions(PrometheusOptions{Registerer: reg, MaxLabelValues: 3})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		p.RecordGrant(fmt.Sprintf("10.0.0.%d", i), true, 1)
+	}
+	// Keys seen before the cap keep their series
+	p.RecordGrant("10.0.0.0", true, 1)
+
+	assert.Equal(t, 4, testutil.CollectAndCount(p.grantTotal), "3 keys plus other")
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.grantTotal.WithLabelValues("10.0.0.0")))
+	assert.Equal(t, 7.0, testutil.ToFloat64(p.grantTotal.WithLabelValues(OtherLabel)))
+	assert.Equal(t, 7.0, testutil.ToFloat64(p.labelOverflow))
+}
+
+func TestPrometheusReporter_LabelCapShared(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	first, err := NewPrometheusReporterWithOptions(PrometheusOptions{Registerer: reg, MaxLabelValues: 3})
+	require.NoError(t, err)
+	second, err := NewPrometheusReporterWithOptions(PrometheusOptions{Registerer: reg, MaxLabelValues: 3})
+	require.NoError(t, err)
+
+	// Reporters sharing the metrics share the cap too
+	for i := 0; i < 5; i++ {
+		first.RecordGrant(fmt.Sprintf("a-%d", i), true, 1)
+		second.RecordGrant(fmt.Sprintf("b-%d", i), true, 1)
+	}
+	second.RecordGrant("a-0", true, 1)
+
+	assert.Equal(t, 4, testutil.CollectAndCount(first.grantTotal), "3 keys plus other")
+	assert.Equal(t, 2.0, testutil.ToFloat64(first.grantTotal.WithLabelValues("a-0")))
+	assert.Equal(t, 7.0, testutil.ToFloat64(first.grantTotal.WithLabelValues(OtherLabel)))
+	assert.Equal(t, 7.0, testutil.ToFloat64(first.labelOverflow))
+}
+
+func TestPrometheusReporter_KeyLabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p, err := NewPrometheusReporterWithOptions(PrometheusOptions{
+		Registerer: reg,
+		KeyLabel: func(key string) string {
+			policy, _, _ := strings.Cut(key, ":")
+			return policy
+		},
+	})
+	require.NoError(t, err)
+
+	p.RecordGrant("login:10.0.0.1", true, 1)
+	p.RecordGrant("login:10.0.0.2", false, 0)
+	p.RecordGrant("api:10.0.0.1", true, 1)
+
+	assert.Equal(t, 2, testutil.CollectAndCount(p.grantTotal))
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.grantTotal.WithLabelValues("login")))
+}
+
+func TestHashKeyLabel(t *testing.T) {
+	label := HashKeyLabel(16)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		value := label(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		assert.Len(t, value, 2)
+		seen[value] = true
+	}
+	assert.Len(t, seen, 16)
+	assert.Equal(t, label("10.0.0.1"), label("10.0.0.1"))
+}
+
+func TestNewPrometheusReporter_Twice(t *testing.T) {
+	assert.NotPanics(t, func() {
+		NewPrometheusReporter()
+		NewPrometheusReporter()
+	})
+}
+
+func TestPrometheusReporter_RecordTiming(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p, err := NewPrometheusReporterWithOptions(PrometheusOptions{Registerer: reg, Buckets: []float64{0.001, 0.01}})
+	require.NoError(t, err)
+
+	p.RecordTiming(core.OpGrant, core.PhaseTotal, 500*time.Microsecond)
+	p.RecordTiming(core.OpGrant, core.PhaseTotal, 5*time.Millisecond)
+	p.RecordTiming(core.OpGrant, core.PhaseBackendGet, 2*time.Millisecond)
+
+	expected := `
+# HELP throttle_operation_duration_seconds Duration of limiter operations and of their backend and strategy phases
+# TYPE throttle_operation_duration_seconds histogram
+throttle_operation_duration_seconds_bucket{operation="grant",phase="backend_get",le="0.001"} 0
+throttle_operation_duration_seconds_bucket{operation="grant",phase="backend_get",le="0.01"} 1
+throttle_operation_duration_seconds_bucket{operation="grant",phase="backend_get",le="+Inf"} 1
+throttle_operation_duration_seconds_sum{operation="grant",phase="backend_get"} 0.002
+throttle_operation_duration_seconds_count{operation="grant",phase="backend_get"} 1
+throttle_operation_duration_seconds_bucket{operation="grant",phase="total",le="0.001"} 1
+throttle_operation_duration_seconds_bucket{operation="grant",phase="total",le="0.01"} 2
+throttle_operation_duration_seconds_bucket{operation="grant",phase="total",le="+Inf"} 2
+throttle_operation_duration_seconds_sum{operation="grant",phase="total"} 0.0055
+throttle_operation_duration_seconds_count{operation="grant",phase="total"} 2
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "throttle_operation_duration_seconds"))
+}
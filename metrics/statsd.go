@@ -0,0 +1,365 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// StatsD reporter defaults
+const (
+	defaultStatsDAddr        = "127.0.0.1:8125"
+	defaultStatsDPrefix      = "throttle."
+	defaultFlushInterval     = time.Second
+	defaultMaxPacketSize     = 1432 // Fits an Ethernet MTU with IP and UDP headers
+	defaultMaxBufferedValues = 1000
+)
+
+// StatsDFormat selects the line format a StatsDReporter writes
+type StatsDFormat int
+
+const (
+	// DogStatsD writes tags as |#key:value and histograms as |h
+	DogStatsD StatsDFormat = iota
+
+	// StatsD has no tags: tag values are appended to the metric name
+	// instead, constant tags are dropped and histograms are sent as |ms
+	StatsD
+)
+
+// StatsDOptions configures a StatsDReporter
+type StatsDOptions struct {
+	Addr              string                  // host:port for UDP or unix:///path for a unix datagram socket (default 127.0.0.1:8125)
+	Format            StatsDFormat            // Line format (default DogStatsD)
+	Prefix            string                  // Metric name prefix (default "throttle.")
+	Tags              []string                // Constant key:value tags added to every metric (DogStatsD only)
+	KeyTag            func(key string) string // Maps a key to its "key" tag value; keys aren't tagged when nil
+	SampleRate        float64                 // Share of histogram observations sent, in (0, 1] (default 1)
+	FlushInterval     time.Duration           // How often aggregated metrics are sent (default 1s)
+	MaxPacketSize     int                     // Largest datagram written (default 1432 bytes)
+	MaxBufferedValues int                     // Histogram observations buffered before an early flush (default 1000)
+}
+
+// StatsDReporter implements core.MetricsReporter and core.TimingReporter by
+// pushing metrics to a StatsD or DogStatsD agent. Counters are summed and
+// gauges keep their last value between flushes, so each series costs one
+// line per flush however many operations it counts; histogram observations
+// are buffered and sent individually, optionally sampled.
+type StatsDReporter struct {
+	opts   StatsDOptions
+	conn   net.Conn
+	tags   string // Rendered constant tags
+	random func() float64
+
+	mu         sync.Mutex
+	counters   map[statsdSeries]int64
+	gauges     map[statsdSeries]float64
+	histograms map[statsdSeries][]float64
+	buffered   int
+
+	flushNow  chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// statsdSeries is a metric name and its rendered tags
+type statsdSeries struct {
+	name string
+	tags string
+}
+
+// NewStatsDReporter creates a reporter sending to the default agent address
+func NewStatsDReporter() (*StatsDReporter, error) {
+	return NewStatsDReporterWithOptions(StatsDOptions{})
+}
+
+// NewStatsDReporterWithOptions creates a reporter and starts flushing
+// periodically. Close it to send what is left and release the socket.
+func NewStatsDReporterWithOptions(opts StatsDOptions) (*StatsDReporter, error) {
+	if opts.Addr == "" {
+		opts.Addr = defaultStatsDAddr
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = defaultStatsDPrefix
+	}
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = defaultMaxPacketSize
+	}
+	if opts.MaxBufferedValues <= 0 {
+		opts.MaxBufferedValues = defaultMaxBufferedValues
+	}
+
+	network, addr := "udp", opts.Addr
+	for _, scheme := range []string{"unix://", "unixgram://"} {
+		if strings.HasPrefix(addr, scheme) {
+			network, addr = "unixgram", strings.TrimPrefix(addr, scheme)
+		}
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd at %s: %w", opts.Addr, err)
+	}
+
+	s := &StatsDReporter{
+		opts:       opts,
+		conn:       conn,
+		random:     rand.Float64,
+		counters:   make(map[statsdSeries]int64),
+		gauges:     make(map[statsdSeries]float64),
+		histograms: make(map[statsdSeries][]float64),
+		flushNow:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if opts.Format == DogStatsD {
+		s.tags = strings.Join(sanitizeTags(opts.Tags), ",")
+	}
+
+	s.wg.Add(1)
+	go s.flushLoop()
+	return s, nil
+}
+
+// RecordGrant records a grant decision
+func (s *StatsDReporter) RecordGrant(key string, allowed bool, remaining int64) {
+	decision := "denied"
+	if allowed {
+		decision = "allowed"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[s.series("grant", append(s.keyTag(key), "decision", decision)...)]++
+	s.gauges[s.series("remaining_tokens", s.keyTag(key)...)] = float64(remaining)
+}
+
+// RecordPreview records a preview operation
+func (s *StatsDReporter) RecordPreview(key string, remaining int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[s.series("preview", s.keyTag(key)...)]++
+	s.gauges[s.series("remaining_tokens", s.keyTag(key)...)] = float64(remaining)
+}
+
+// RecordClear records a clear operation
+func (s *StatsDReporter) RecordClear(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[s.series("clear", s.keyTag(key)...)]++
+	s.gauges[s.series("remaining_tokens", s.keyTag(key)...)] = 0
+}
+
+// RecordTiming records the duration of an operation phase in milliseconds,
+// keeping only SampleRate of the observations
+func (s *StatsDReporter) RecordTiming(op core.Operation, phase core.Phase, d time.Duration) {
+	if s.opts.SampleRate < 1 && s.random() >= s.opts.SampleRate {
+		return
+	}
+
+	s.mu.Lock()
+	series := s.series("operation.duration", "operation", string(op), "phase", string(phase))
+	s.histograms[series] = append(s.histograms[series], float64(d)/float64(time.Millisecond))
+	s.buffered++
+	full := s.buffered >= s.opts.MaxBufferedValues
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush sends everything aggregated since the last flush
+func (s *StatsDReporter) Flush() error {
+	s.mu.Lock()
+	lines := s.lines()
+	s.counters = make(map[statsdSeries]int64)
+	s.gauges = make(map[statsdSeries]float64)
+	s.histograms = make(map[statsdSeries][]float64)
+	s.buffered = 0
+	s.mu.Unlock()
+
+	var errs []error
+	for _, packet := range pack(lines, s.opts.MaxPacketSize) {
+		if _, err := s.conn.Write(packet); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to send metrics to statsd: %w", err)
+	}
+	return nil
+}
+
+// Close stops the periodic flush, sends what is left and closes the socket
+func (s *StatsDReporter) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+		err = errors.Join(s.Flush(), s.conn.Close())
+	})
+	return err
+}
+
+// flushLoop flushes every FlushInterval, and early when the histogram
+// buffer fills up. Errors are dropped: metrics are best effort.
+func (s *StatsDReporter) flushLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.flushNow:
+			s.Flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// keyTag returns the key tag pair for key, or nothing without KeyTag
+func (s *StatsDReporter) keyTag(key string) []string {
+	if s.opts.KeyTag == nil {
+		return nil
+	}
+	return []string{"key", s.opts.KeyTag(key)}
+}
+
+// series names a metric with tags given as alternating names and values
+func (s *StatsDReporter) series(name string, pairs ...string) statsdSeries {
+	if s.opts.Format == StatsD {
+		for i := 1; i < len(pairs); i += 2 {
+			name += "." + sanitizeName(pairs[i])
+		}
+		return statsdSeries{name: name}
+	}
+
+	rendered := make([]string, 0, len(pairs)/2)
+	for i := 1; i < len(pairs); i += 2 {
+		rendered = append(rendered, sanitizeTag(pairs[i-1]+":"+pairs[i]))
+	}
+	return statsdSeries{name: name, tags: strings.Join(rendered, ",")}
+}
+
+// lines renders every aggregated series, in a stable order; the caller
+// holds mu
+func (s *StatsDReporter) lines() []string {
+	var lines []string
+	for series, value := range s.counters {
+		lines = append(lines, s.line(series, strconv.FormatInt(value, 10), "c", 1))
+	}
+	for series, value := range s.gauges {
+		lines = append(lines, s.line(series, strconv.FormatFloat(value, 'f', -1, 64), "g", 1))
+	}
+
+	histogram := "h"
+	if s.opts.Format == StatsD {
+		histogram = "ms"
+	}
+	for series, values := range s.histograms {
+		for _, value := range values {
+			lines = append(lines, s.line(series, strconv.FormatFloat(value, 'f', -1, 64), histogram, s.opts.SampleRate))
+		}
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+// line renders one metric line
+func (s *StatsDReporter) line(series statsdSeries, value, kind string, rate float64) string {
+	var sb strings.Builder
+	sb.WriteString(s.opts.Prefix)
+	sb.WriteString(series.name)
+	sb.WriteByte(':')
+	sb.WriteString(value)
+	sb.WriteByte('|')
+	sb.WriteString(kind)
+	if rate < 1 {
+		sb.WriteString("|@")
+		sb.WriteString(strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+
+	tags := series.tags
+	if s.tags != "" {
+		if tags != "" {
+			tags = s.tags + "," + tags
+		} else {
+			tags = s.tags
+		}
+	}
+	if tags != "" {
+		sb.WriteString("|#")
+		sb.WriteString(tags)
+	}
+	return sb.String()
+}
+
+// pack joins lines with newlines into packets of at most size bytes. A line
+// longer than size gets a packet of its own.
+func pack(lines []string, size int) [][]byte {
+	var packets [][]byte
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > size {
+			packets = append(packets, bytes.Clone(buf.Bytes()))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
+
+// sanitizeTags cleans up constant tags
+func sanitizeTags(tags []string) []string {
+	sanitized := make([]string, len(tags))
+	for i, tag := range tags {
+		sanitized[i] = sanitizeTag(tag)
+	}
+	return sanitized
+}
+
+// sanitizeTag replaces the characters that delimit DogStatsD fields
+var sanitizeTag = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_").Replace
+
+// sanitizeName replaces what StatsD doesn't allow in a name component
+func sanitizeName(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, value)
+}
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/core"
+)
+
+// listen opens a datagram socket and returns it with its address
+func listen(t *testing.T, network, addr string) net.PacketConn {
+	conn, err := net.ListenPacket(network, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receive reads datagrams until none arrives for a moment
+func receive(t *testing.T, conn net.PacketConn) []string {
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+// receiveLines returns the lines of all datagrams received
+func receiveLines(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	for _, packet := range receive(t, conn) {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	return lines
+}
+
+func TestStatsDReporter_DogStatsD(t *testing.T) {
+	conn := listen(t, "udp", "127.0.0.1:0")
+	s, err := NewStatsDReporterWithOptions(StatsDOptions{
+		Addr:          conn.LocalAddr().String(),
+		Tags:          []string{"env:prod"},
+		KeyTag:        func(key string) string { return strings.SplitN(key, ":", 2)[0] },
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.RecordGrant("user:1", true, 4)
+	}
+	s.RecordGrant("user:2", false, 0)
+	s.RecordPreview("user:1", 3)
+	s.RecordClear("ip:10.0.0.1")
+	s.RecordTiming(core.OpGrant, core.PhaseTotal, 1500*time.Microsecond)
+	require.NoError(t, s.Flush())
+
+	// Counters and gauges are aggregated to one line per series
+	assert.ElementsMatch(t, []string{
+		"throttle.grant:100|c|#env:prod,key:user,decision:allowed",
+		"throttle.grant:1|c|#env:prod,key:user,decision:denied",
+		"throttle.preview:1|c|#env:prod,key:user",
+		"throttle.clear:1|c|#env:prod,key:ip",
+		"throttle.remaining_tokens:3|g|#env:prod,key:user",
+		"throttle.remaining_tokens:0|g|#env:prod,key:ip",
+		"throttle.operation.duration:1.5|h|#env:prod,operation:grant,phase:total",
+	}, receiveLines(t, conn))
+
+	// Nothing is sent twice
+	require.NoError(t, s.Flush())
+	assert.Empty(t, receive(t, conn))
+}
+
+func TestStatsDReporter_StatsD(t *testing.T) {
+	conn := listen(t, "udp", "127.0.0.1:0")
+	s, err := NewStatsDReporterWithOptions(StatsDOptions{
+		Addr:          conn.LocalAddr().String(),
+		Format:        StatsD,
+		Prefix:        "api.",
+		Tags:          []string{"env:prod"},
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.RecordGrant("user:1", true, 4)
+	s.RecordTiming(core.OpGrantMulti, core.PhaseBackendGet, 2*time.Millisecond)
+	require.NoError(t, s.Flush())
+
+	assert.ElementsMatch(t, []string{
+		"api.grant.allowed:1|c",
+		"api.remaining_tokens:4|g",
+		"api.operation.duration.grant_multi.backend_get:2|ms",
+	}, receiveLines(t, conn))
+}
+
+func TestStatsDReporter_SampleRate(t *testing.T) {
+	conn := listen(t, "udp", "127.0.0.1:0")
+	s, err := NewStatsDReporterWithOptions(StatsDOptions{
+		Addr:          conn.LocalAddr().String(),
+		SampleRate:    0.25,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	rolls := []float64{0.1, 0.5, 0.2, 0.9}
+	s.random = func() float64 {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		return roll
+	}
+	for i := 0; i < 4; i++ {
+		s.RecordTiming(core.OpPreview, core.PhaseStrategy, time.Duration(i+1)*time.Millisecond)
+	}
+	require.NoError(t, s.Flush())
+
+	assert.ElementsMatch(t, []string{
+		"throttle.operation.duration:1|h|@0.25|#operation:preview,phase:strategy",
+		"throttle.operation.duration:3|h|@0.25|#operation:preview,phase:strategy",
+	}, receiveLines(t, conn))
+}
+
+func TestStatsDReporter_Buffering(t *testing.T) {
+	conn := listen(t, "udp", "127.0.0.1:0")
+	s, err := NewStatsDReporterWithOptions(StatsDOptions{
+		Addr:              conn.LocalAddr().String(),
+		FlushInterval:     time.Hour,
+		MaxPacketSize:     200,
+		MaxBufferedValues: 50,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// A full buffer is flushed without waiting for the interval
+	for i := 0; i < 50; i++ {
+		s.RecordTiming(core.OpGrant, core.PhaseTotal, time.Millisecond)
+	}
+
+	packets := receive(t, conn)
+	require.Greater(t, len(packets), 1)
+	lines := 0
+	for _, packet := range packets {
+		assert.LessOrEqual(t, len(packet), 200)
+		lines += strings.Count(packet, "\n") + 1
+	}
+	assert.Equal(t, 50, lines)
+}
+
+func TestStatsDReporter_PeriodicFlushAndClose(t *testing.T) {
+	conn := listen(t, "udp", "127.0.0.1:0")
+	s, err := NewStatsDReporterWithOptions(StatsDOptions{
+		Addr:          conn.LocalAddr().String(),
+		FlushInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	s.RecordClear("k")
+	assert.Contains(t, receiveLines(t, conn), "throttle.clear:1|c")
+
+	// Close sends what is left
+	s.RecordClear("k")
+	require.NoError(t, s.Close())
+	assert.Contains(t, receiveLines(t, conn), "throttle.clear:1|c")
+	assert.NoError(t, s.Close())
+}
+
+func TestStatsDReporter_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsd.socket")
+	conn := listen(t, "unixgram", path)
+
+	s, err := NewStatsDReporterWithOptions(StatsDOptions{Addr: "unix://" + path, FlushInterval: time.Hour})
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.RecordGrant("k", false, 0)
+	require.NoError(t, s.Flush())
+	assert.ElementsMatch(t, []string{
+		"throttle.grant:1|c|#decision:denied",
+		"throttle.remaining_tokens:0|g",
+	}, receiveLines(t, conn))
+}
+
+func TestNewStatsDReporter_MissingSocket(t *testing.T) {
+	_, err := NewStatsDReporterWithOptions(StatsDOptions{Addr: "unix://" + filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
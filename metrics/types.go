@@ -1,6 +1,10 @@
 package metrics
 
-import "time"
+import (
+	"time"
+
+	"github.com/throttle/core"
+)
 
 // MetricType represents the type of metric
 type MetricType string
@@ -11,7 +15,10 @@ const (
 	Histogram MetricType = "histogram"
 )
 
-// Metric represents a generic metric that can be consumed by any monitoring system
+// Metric represents a generic metric that can be consumed by any monitoring
+// system. Aggregated histograms have the sum of their observations as Value,
+// their number as Count and cumulative Buckets; observations above the last
+// bound are only included in Count.
 type Metric struct {
 	Name      string            `json:"name"`
 	Type      MetricType        `json:"type"`
@@ -19,6 +26,15 @@ type Metric struct {
 	Labels    map[string]string `json:"labels,omitempty"`
 	Timestamp time.Time         `json:"timestamp"`
 	Help      string            `json:"help,omitempty"`
+	Count     uint64            `json:"count,omitempty"`
+	Buckets   []Bucket          `json:"buckets,omitempty"`
+}
+
+// Bucket is a cumulative histogram bucket: the number of observations less
+// than or equal to UpperBound
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
 }
 
 // MetricsCollector defines the interface for collecting metrics
@@ -39,16 +55,11 @@ type MetricsCollector interface {
 	GetMetricsSummary() map[string]map[MetricType]int
 }
 
-// MetricsReporter defines the interface for reporting metrics
+// MetricsReporter is a core.MetricsReporter exposing what it collected.
+// Pass it to core.NewLimiter or adapt it with core.ReporterObserver to
+// combine it with other observers.
 type MetricsReporter interface {
-	// RecordGrant records a grant decision
-	RecordGrant(key string, allowed bool, remaining int64)
-
-	// RecordPreview records a preview operation
-	RecordPreview(key string, remaining int64)
-
-	// RecordClear records a clear operation
-	RecordClear(key string)
+	core.MetricsReporter
 
 	// GetCollector returns the metrics collector
 	GetCollector() MetricsCollector
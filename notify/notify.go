@@ -0,0 +1,159 @@
+// Package notify warns when keys use up given shares of their quota. A
+// Notifier is a core.Observer: when a grant leaves a key with less than a
+// threshold's share of Burst remaining, it calls OnThreshold once, and not
+// again for that key and threshold until Window has passed.
+//
+//	webhook, err := notify.NewWebhook(notify.WebhookOptions{URL: url, Secret: secret})
+//	notifier := notify.NewNotifier(config, notify.Options{OnThreshold: webhook.Notify})
+//	limiter := core.NewLimiterWithOptions(backend, strategy, config, core.LimiterOptions{
+//		Observers: []core.Observer{notifier},
+//	})
+package notify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// DefaultThresholds warn at 80% and 100% of the quota
+var DefaultThresholds = []float64{0.8, 1}
+
+// Options configures a Notifier
+type Options struct {
+	Thresholds  []float64                                 // Shares of Burst used that trigger a notification (default DefaultThresholds)
+	Window      time.Duration                             // How long a key isn't notified again for the same threshold (default config.Interval)
+	OnThreshold func(ctx context.Context, n Notification) // Called synchronously on the limiter's path; keep it quick
+}
+
+// Notification says a key crossed a threshold
+type Notification struct {
+	ID        string    `json:"id"` // Unique, for receivers to drop duplicates
+	Key       string    `json:"key"`
+	Policy    string    `json:"policy,omitempty"`
+	Threshold float64   `json:"threshold"` // The share of the quota reached
+	Used      float64   `json:"used"`      // The share actually used
+	Remaining int64     `json:"remaining"`
+	Limit     int64     `json:"limit"`
+	Time      time.Time `json:"time"`
+}
+
+// Notifier implements core.Observer by calling OnThreshold when keys cross
+// quota thresholds
+type Notifier struct {
+	burst int64
+	opts  Options
+	now   func() time.Time
+
+	mu        sync.Mutex
+	fired     map[string][]time.Time // Per key, when each threshold last fired
+	nextSweep int
+}
+
+// NewNotifier creates a notifier for keys limited by config
+func NewNotifier(config core.Config, opts Options) *Notifier {
+	if len(opts.Thresholds) == 0 {
+		opts.Thresholds = DefaultThresholds
+	}
+	opts.Thresholds = append([]float64(nil), opts.Thresholds...)
+	sort.Float64s(opts.Thresholds)
+	if opts.Window <= 0 {
+		opts.Window = config.Interval
+	}
+
+	return &Notifier{
+		burst:     config.Burst,
+		opts:      opts,
+		now:       time.Now,
+		fired:     make(map[string][]time.Time),
+		nextSweep: 1024,
+	}
+}
+
+// Observe checks the decision of a grant against the thresholds. A denial
+// counts as the whole quota used. Only the highest threshold crossed is
+// notified, so a key jumping from 50% to 100% gets one notification.
+func (n *Notifier) Observe(ctx context.Context, event core.Event) {
+	if event.Err != nil || (event.Operation != core.OpGrant && event.Operation != core.OpGrantMulti) || n.burst <= 0 {
+		return
+	}
+
+	used := 1.0
+	if event.Decision.Allowed {
+		used = float64(n.burst-event.Decision.Remaining) / float64(n.burst)
+	}
+
+	crossed := -1
+	for i, threshold := range n.opts.Thresholds {
+		if used >= threshold {
+			crossed = i
+		}
+	}
+	if crossed < 0 || n.opts.OnThreshold == nil {
+		return
+	}
+
+	now := n.now()
+	if !n.due(event.Key, crossed, now) {
+		return
+	}
+
+	n.opts.OnThreshold(ctx, Notification{
+		ID:        newID(),
+		Key:       event.Key,
+		Policy:    event.Policy,
+		Threshold: n.opts.Thresholds[crossed],
+		Used:      used,
+		Remaining: event.Decision.Remaining,
+		Limit:     n.burst,
+		Time:      now,
+	})
+}
+
+// due reports whether threshold i should fire for key, marking it and the
+// lower thresholds fired if so
+func (n *Notifier) due(key string, i int, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fired, ok := n.fired[key]
+	if !ok {
+		n.sweep(now)
+		fired = make([]time.Time, len(n.opts.Thresholds))
+		n.fired[key] = fired
+	}
+	if !fired[i].IsZero() && now.Sub(fired[i]) < n.opts.Window {
+		return false
+	}
+
+	for j := 0; j <= i; j++ {
+		fired[j] = now
+	}
+	return true
+}
+
+// sweep forgets keys whose thresholds have all expired once the map has
+// doubled since the last sweep; the caller holds mu
+func (n *Notifier) sweep(now time.Time) {
+	if len(n.fired) < n.nextSweep {
+		return
+	}
+	for key, fired := range n.fired {
+		if now.Sub(fired[0]) >= n.opts.Window {
+			delete(n.fired, key)
+		}
+	}
+	n.nextSweep = max(2*len(n.fired), 1024)
+}
+
+// newID returns a random notification ID
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+	"github.com/throttle/strategy/tokenbucket"
+)
+
+// recorder collects notifications
+type recorder struct {
+	notifications []Notification
+}
+
+func (r *recorder) notify(ctx context.Context, n Notification) {
+	r.notifications = append(r.notifications, n)
+}
+
+// thresholds returns the thresholds notified so far
+func (r *recorder) thresholds() []float64 {
+	var result []float64
+	for _, n := range r.notifications {
+		result = append(result, n.Threshold)
+	}
+	return result
+}
+
+func TestNotifier_WithLimiter(t *testing.T) {
+	config := core.Config{Limit: 10, Interval: time.Hour, Burst: 10}
+	rec := &recorder{}
+	notifier := NewNotifier(config, Options{OnThreshold: rec.notify})
+	limiter := core.NewLimiterWithOptions(memory.NewBackend(), tokenbucket.NewStrategy(config), config, core.LimiterOptions{
+		Policy:    "api",
+		Observers: []core.Observer{notifier},
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		_, err := limiter.Grant(ctx, "customer-1")
+		require.NoError(t, err)
+	}
+
+	// One notification per threshold, not one per request past it
+	require.Equal(t, []float64{0.8, 1}, rec.thresholds())
+	assert.Equal(t, "customer-1", rec.notifications[0].Key)
+	assert.Equal(t, "api", rec.notifications[0].Policy)
+	assert.Equal(t, int64(2), rec.notifications[0].Remaining)
+	assert.Equal(t, int64(10), rec.notifications[0].Limit)
+	assert.InDelta(t, 0.8, rec.notifications[0].Used, 1e-9)
+	assert.NotEqual(t, rec.notifications[0].ID, rec.notifications[1].ID)
+}
+
+func TestNotifier_OncePerWindow(t *testing.T) {
+	config := core.Config{Limit: 10, Interval: time.Minute, Burst: 10}
+	rec := &recorder{}
+	notifier := NewNotifier(config, Options{Thresholds: []float64{1, 0.5}, OnThreshold: rec.notify})
+	now := time.Unix(1700000000, 0)
+	notifier.now = func() time.Time { return now }
+
+	grant := func(key string, remaining int64) {
+		notifier.Observe(context.Background(), core.Event{
+			Operation: core.OpGrant,
+			Key:       key,
+			Decision:  core.Decision{Allowed: remaining >= 0, Remaining: max(remaining, 0)},
+		})
+	}
+
+	grant("a", 6) // 40% used
+	grant("a", 5) // 50%
+	grant("a", 4)
+	assert.Equal(t, []float64{0.5}, rec.thresholds())
+
+	// Jumping straight to a denial only notifies the highest threshold
+	grant("b", -1)
+	assert.Equal(t, []float64{0.5, 1}, rec.thresholds())
+	grant("b", 4)
+	assert.Len(t, rec.notifications, 2)
+
+	// After the window the key is notified again
+	now = now.Add(time.Minute)
+	grant("a", 3)
+	assert.Equal(t, []float64{0.5, 1, 0.5}, rec.thresholds())
+
+	// Errors and other operations are ignored
+	notifier.Observe(context.Background(), core.Event{Operation: core.OpPreview, Key: "c"})
+	notifier.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: "c", Err: fmt.Errorf("down")})
+	assert.Len(t, rec.notifications, 3)
+}
+
+func TestNotifier_ForgetsExpiredKeys(t *testing.T) {
+	config := core.Config{Limit: 1, Interval: time.Minute, Burst: 1}
+	notifier := NewNotifier(config, Options{OnThreshold: func(ctx context.Context, n Notification) {}})
+	now := time.Unix(1700000000, 0)
+	notifier.now = func() time.Time { return now }
+
+	for i := 0; i < 5000; i++ {
+		if i%1000 == 0 {
+			now = now.Add(time.Minute)
+		}
+		notifier.Observe(context.Background(), core.Event{Operation: core.OpGrant, Key: fmt.Sprint(i)})
+	}
+
+	assert.Less(t, len(notifier.fired), 3000)
+}
@@ -0,0 +1,358 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of webhook deliveries
+const (
+	DeliveryHeader  = "X-Throttle-Delivery"  // The notification ID
+	TimestampHeader = "X-Throttle-Timestamp" // Unix seconds when the request was signed
+	SignatureHeader = "X-Throttle-Signature" // "sha256=" and the hex HMAC, see Sign
+)
+
+// Webhook defaults
+const (
+	defaultMaxAttempts = 5
+	defaultBackoff     = 500 * time.Millisecond
+	defaultQueueSize   = 1000
+)
+
+// ErrQueueFull is returned by Send when notifications arrive faster than
+// they can be delivered
+var ErrQueueFull = errors.New("notify: webhook queue is full")
+
+// ErrClosed is returned by Send after Close
+var ErrClosed = errors.New("notify: webhook is closed")
+
+// WebhookOptions configures a Webhook
+type WebhookOptions struct {
+	URL         string        // Where notifications are POSTed as JSON
+	Secret      string        // Key deliveries are signed with, if set
+	Client      *http.Client  // Sends deliveries (default: 5s timeout)
+	MaxAttempts int           // Deliveries tried per notification (default 5)
+	Backoff     time.Duration // Wait before the first retry, doubled after each (default 500ms)
+	QueueSize   int           // Notifications waiting for delivery (default 1000)
+
+	// Outbox, if set, is a directory notifications are written to until
+	// they are delivered, so they survive a restart. Writing happens in the
+	// background, so Send never waits for the disk; notifications sent in
+	// the moments before a crash may be lost. Notifications given up on are
+	// kept there with a .failed extension.
+	Outbox string
+
+	// OnError is called with a notification that couldn't be queued or was
+	// given up on
+	OnError func(n Notification, err error)
+}
+
+// Webhook delivers notifications to an HTTP endpoint in the background,
+// retrying failures with exponential backoff
+type Webhook struct {
+	opts     WebhookOptions
+	client   *http.Client
+	incoming chan Notification // Sent but not written to the outbox yet
+	queue    chan pending
+
+	ctx    context.Context // Canceled by Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// pending is a notification waiting for delivery
+type pending struct {
+	n    Notification
+	file string // Its file in the outbox, if any
+}
+
+// NewWebhook creates a webhook and starts delivering, beginning with the
+// notifications left in the outbox
+func NewWebhook(opts WebhookOptions) (*Webhook, error) {
+	if u, err := url.Parse(opts.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("notify: invalid webhook URL %q", opts.URL)
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	var backlog []pending
+	if opts.Outbox != "" {
+		var err error
+		if backlog, err = loadOutbox(opts.Outbox); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Webhook{
+		opts:   opts,
+		client: client,
+		queue:  make(chan pending, max(opts.QueueSize, len(backlog))),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, p := range backlog {
+		w.queue <- p
+	}
+
+	if opts.Outbox != "" {
+		w.incoming = make(chan Notification, opts.QueueSize)
+		w.wg.Add(1)
+		go w.persist()
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Notify queues n, reporting a failure to OnError. It can be used as
+// Options.OnThreshold.
+func (w *Webhook) Notify(ctx context.Context, n Notification) {
+	if err := w.Send(n); err != nil && w.opts.OnError != nil {
+		w.opts.OnError(n, err)
+	}
+}
+
+// Send queues n for delivery without blocking. With an outbox, n is
+// written there in the background before it is delivered.
+func (w *Webhook) Send(n Notification) error {
+	if w.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	if w.incoming != nil {
+		select {
+		case w.incoming <- n:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case w.queue <- pending{n: n}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops delivering, abandoning a delivery in progress. Notifications
+// not delivered yet stay in the outbox, including those sent but not
+// written to it yet.
+func (w *Webhook) Close() error {
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
+
+// persist writes sent notifications to the outbox and queues them for
+// delivery. One that can't be written is reported to OnError and delivered
+// anyway.
+func (w *Webhook) persist() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case n := <-w.incoming:
+			p := pending{n: n}
+			var err error
+			if p.file, err = writeOutbox(w.opts.Outbox, n); err != nil && w.opts.OnError != nil {
+				w.opts.OnError(n, err)
+			}
+			select {
+			case w.queue <- p:
+			case <-w.ctx.Done():
+				// Written, so delivered after the next restart
+			}
+		case <-w.ctx.Done():
+			// Keep what is still waiting for the next start
+			for {
+				select {
+				case n := <-w.incoming:
+					if _, err := writeOutbox(w.opts.Outbox, n); err != nil && w.opts.OnError != nil {
+						w.opts.OnError(n, err)
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// run delivers queued notifications one at a time
+func (w *Webhook) run() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case p := <-w.queue:
+			w.deliver(p)
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver tries to deliver p until it succeeds, fails permanently, runs
+// out of attempts or the webhook is closed
+func (w *Webhook) deliver(p pending) {
+	backoff := w.opts.Backoff
+	var err error
+
+	for attempt := 1; attempt <= w.opts.MaxAttempts; attempt++ {
+		var permanent bool
+		if permanent, err = w.post(p.n); err == nil {
+			if p.file != "" {
+				os.Remove(p.file)
+			}
+			return
+		}
+		if permanent || attempt == w.opts.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-w.ctx.Done():
+			return
+		}
+	}
+	if w.ctx.Err() != nil {
+		// Closed mid-delivery; the outbox keeps it for next time
+		return
+	}
+
+	if p.file != "" {
+		os.Rename(p.file, strings.TrimSuffix(p.file, ".json")+".failed")
+	}
+	if w.opts.OnError != nil {
+		w.opts.OnError(p.n, fmt.Errorf("failed to deliver notification %s: %w", p.n.ID, err))
+	}
+}
+
+// post sends n once. Client errors other than 429 Too Many Requests are
+// permanent: retrying the same request won't help.
+func (w *Webhook) post(n Notification) (permanent bool, err error) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return true, fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return true, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, n.ID)
+	if w.opts.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(SignatureHeader, "sha256="+Sign(w.opts.Secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256, keyed with secret, of the timestamp in
+// decimal, a dot and the body. Receivers recompute it to authenticate a
+// delivery, and reject old timestamps to prevent replays.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeOutbox stores n in dir atomically and returns its file
+func writeOutbox(dir string, n Notification) (string, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%020d-%s.json", n.Time.UnixNano(), n.ID))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write outbox: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return path, nil
+}
+
+// loadOutbox creates dir if needed and returns the notifications waiting
+// in it, oldest first
+func loadOutbox(dir string) ([]pending, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox: %w", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	sort.Strings(paths)
+
+	backlog := make([]pending, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbox: %w", err)
+		}
+		var n Notification
+		if err := json.Unmarshal(data, &n); err != nil {
+			// Leave a corrupt entry for inspection rather than failing
+			os.Rename(path, strings.TrimSuffix(path, ".json")+".failed")
+			continue
+		}
+		backlog = append(backlog, pending{n: n, file: path})
+	}
+	return backlog, nil
+}
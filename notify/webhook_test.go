@@ -0,0 +1,231 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// endpoint is a test webhook receiver answering with the statuses given,
+// then 200 OK
+type endpoint struct {
+	*httptest.Server
+	mu         sync.Mutex
+	statuses   []int
+	deliveries []*http.Request
+	bodies     [][]byte
+	received   chan Notification
+}
+
+func newEndpoint(t *testing.T, statuses ...int) *endpoint {
+	e := &endpoint{statuses: statuses, received: make(chan Notification, 10)}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		e.mu.Lock()
+		e.deliveries = append(e.deliveries, r)
+		e.bodies = append(e.bodies, body)
+		status := http.StatusOK
+		if len(e.statuses) > 0 {
+			status, e.statuses = e.statuses[0], e.statuses[1:]
+		}
+		e.mu.Unlock()
+
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			var n Notification
+			json.Unmarshal(body, &n)
+			e.received <- n
+		}
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// attempts returns how many requests the endpoint got
+func (e *endpoint) attempts() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.deliveries)
+}
+
+func notification(id string) Notification {
+	return Notification{ID: id, Key: "customer-1", Threshold: 0.8, Used: 0.8, Remaining: 2, Limit: 10, Time: time.Now()}
+}
+
+func TestWebhook_DeliversSigned(t *testing.T) {
+	e := newEndpoint(t)
+	w, err := NewWebhook(WebhookOptions{URL: e.URL, Secret: "s3cret"})
+	require.NoError(t, err)
+	defer w.Close()
+
+	w.Notify(context.Background(), notification("n1"))
+
+	select {
+	case n := <-e.received:
+		assert.Equal(t, "n1", n.ID)
+		assert.Equal(t, "customer-1", n.Key)
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification not delivered")
+	}
+
+	req := e.deliveries[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "n1", req.Header.Get(DeliveryHeader))
+	timestamp, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256="+Sign("s3cret", timestamp, e.bodies[0]), req.Header.Get(SignatureHeader))
+	assert.NotEqual(t, Sign("other", timestamp, e.bodies[0]), Sign("s3cret", timestamp, e.bodies[0]))
+}
+
+func TestWebhook_Retries(t *testing.T) {
+	e := newEndpoint(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	w, err := NewWebhook(WebhookOptions{URL: e.URL, Backoff: time.Millisecond})
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Send(notification("n1")))
+
+	select {
+	case n := <-e.received:
+		assert.Equal(t, "n1", n.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification not delivered")
+	}
+	assert.Equal(t, 3, e.attempts())
+	assert.Empty(t, e.deliveries[0].Header.Get(SignatureHeader))
+}
+
+func TestWebhook_GivesUp(t *testing.T) {
+	var failures atomic.Int32
+	failed := make(chan error, 2)
+	onError := func(n Notification, err error) {
+		failures.Add(1)
+		failed <- err
+	}
+
+	// A client error isn't retried
+	e := newEndpoint(t, http.StatusBadRequest)
+	w, err := NewWebhook(WebhookOptions{URL: e.URL, Backoff: time.Millisecond, OnError: onError})
+	require.NoError(t, err)
+	require.NoError(t, w.Send(notification("n1")))
+	assert.ErrorContains(t, <-failed, "400")
+	assert.Equal(t, 1, e.attempts())
+	w.Close()
+
+	// Server errors are retried up to MaxAttempts
+	e = newEndpoint(t, 500, 500, 500, 500)
+	w, err = NewWebhook(WebhookOptions{URL: e.URL, Backoff: time.Millisecond, MaxAttempts: 3, OnError: onError})
+	require.NoError(t, err)
+	require.NoError(t, w.Send(notification("n2")))
+	assert.ErrorContains(t, <-failed, "500")
+	assert.Equal(t, 3, e.attempts())
+	w.Close()
+}
+
+func TestWebhook_Outbox(t *testing.T) {
+	outbox := filepath.Join(t.TempDir(), "outbox")
+
+	// The endpoint is down while the notification is sent
+	down := newEndpoint(t, 503, 503, 503, 503, 503)
+	w, err := NewWebhook(WebhookOptions{URL: down.URL, Backoff: time.Hour, Outbox: outbox})
+	require.NoError(t, err)
+	require.NoError(t, w.Send(notification("n1")))
+	assert.Eventually(t, func() bool { return down.attempts() == 1 }, 2*time.Second, 5*time.Millisecond)
+	require.NoError(t, w.Close())
+
+	files, _ := filepath.Glob(filepath.Join(outbox, "*.json"))
+	require.Len(t, files, 1)
+
+	// A restarted webhook delivers it and empties the outbox
+	up := newEndpoint(t)
+	w, err = NewWebhook(WebhookOptions{URL: up.URL, Outbox: outbox})
+	require.NoError(t, err)
+	defer w.Close()
+
+	select {
+	case n := <-up.received:
+		assert.Equal(t, "n1", n.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("outbox not delivered")
+	}
+	assert.Eventually(t, func() bool {
+		files, _ := filepath.Glob(filepath.Join(outbox, "*"))
+		return len(files) == 0
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestWebhook_OutboxKeepsFailures(t *testing.T) {
+	outbox := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outbox, "corrupt.json"), []byte("{"), 0o600))
+
+	failed := make(chan struct{})
+	e := newEndpoint(t, http.StatusGone)
+	w, err := NewWebhook(WebhookOptions{URL: e.URL, Outbox: outbox, OnError: func(Notification, error) { close(failed) }})
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Send(notification("n1")))
+	<-failed
+
+	kept, _ := filepath.Glob(filepath.Join(outbox, "*.failed"))
+	assert.Len(t, kept, 2)
+	pending, _ := filepath.Glob(filepath.Join(outbox, "*.json"))
+	assert.Empty(t, pending)
+}
+
+func TestWebhook_CloseKeepsUnwrittenNotifications(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-block }))
+	defer server.Close()
+	defer close(block)
+
+	outbox := t.TempDir()
+	w, err := NewWebhook(WebhookOptions{URL: server.URL, Outbox: outbox, QueueSize: 10})
+	require.NoError(t, err)
+
+	// Sending doesn't wait for the outbox; closing writes what is pending
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Send(notification(strconv.Itoa(i))))
+	}
+	require.NoError(t, w.Close())
+	assert.ErrorIs(t, w.Send(notification("late")), ErrClosed)
+
+	files, _ := filepath.Glob(filepath.Join(outbox, "*.json"))
+	assert.Len(t, files, 5)
+}
+
+func TestWebhook_QueueFull(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-block }))
+	defer server.Close()
+	defer close(block)
+
+	w, err := NewWebhook(WebhookOptions{URL: server.URL, QueueSize: 1})
+	require.NoError(t, err)
+	defer w.Close()
+
+	var errs []error
+	for i := 0; i < 3; i++ {
+		errs = append(errs, w.Send(notification(strconv.Itoa(i))))
+	}
+	assert.Contains(t, errs, ErrQueueFull)
+}
+
+func TestNewWebhook_InvalidURL(t *testing.T) {
+	_, err := NewWebhook(WebhookOptions{URL: "ftp://example.com"})
+	assert.Error(t, err)
+}
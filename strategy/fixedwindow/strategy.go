@@ -0,0 +1,100 @@
+package fixedwindow
+
+import (
+	"context"
+	"time"
+
+	"github.com/throttle/core"
+)
+
+// Strategy implements the fixed window rate limiting algorithm: at most
+// Limit requests per Interval, with windows aligned to the Unix epoch so
+// every process agrees on where a window starts. State.Tokens counts the
+// requests admitted in the window containing State.LastUpdate; Burst is not
+// used.
+type Strategy struct {
+	config core.Config
+}
+
+// NewStrategy creates a new fixed window strategy
+func NewStrategy(config core.Config) *Strategy {
+	return &Strategy{
+		config: config,
+	}
+}
+
+// Calculate determines if a request should be allowed and updates state
+func (s *Strategy) Calculate(ctx context.Context, state *core.State, now time.Time) (core.Decision, error) {
+	count := s.count(state, now)
+	end := s.WindowStart(now).Add(s.config.Interval)
+
+	// Check if the window still has room for this request
+	allowed := count < float64(s.config.Limit)
+	if allowed {
+		count++
+	}
+
+	state.Tokens = count
+	state.LastUpdate = now
+
+	return s.decision(allowed, count, now, end), nil
+}
+
+// Preview calculates the decision without modifying state
+func (s *Strategy) Preview(ctx context.Context, state *core.State, now time.Time) (core.Decision, error) {
+	count := s.count(state, now)
+	end := s.WindowStart(now).Add(s.config.Interval)
+
+	return s.decision(count < float64(s.config.Limit), count, now, end), nil
+}
+
+// NewState returns an empty window for a key that has never been seen
+func (s *Strategy) NewState(now time.Time) *core.State {
+	return &core.State{
+		Tokens:     0,
+		LastUpdate: now,
+		Created:    now,
+	}
+}
+
+// TTL returns how long after the last update the state's window lasts
+func (s *Strategy) TTL(state *core.State) time.Duration {
+	return s.WindowStart(state.LastUpdate).Add(s.config.Interval).Sub(state.LastUpdate)
+}
+
+// WindowStart returns the start of the window containing t. The monotonic
+// clock reading is dropped so windows compare by wall clock, like the
+// windows of other processes.
+func (s *Strategy) WindowStart(t time.Time) time.Time {
+	t = t.Round(0)
+	return t.Add(-time.Duration(t.UnixNano() % int64(s.config.Interval)))
+}
+
+// count returns the requests counted in the window containing now
+func (s *Strategy) count(state *core.State, now time.Time) float64 {
+	if s.WindowStart(state.LastUpdate).Before(s.WindowStart(now)) {
+		return 0
+	}
+	return state.Tokens
+}
+
+// decision builds a decision for count requests in the window ending at end
+func (s *Strategy) decision(allowed bool, count float64, now, end time.Time) core.Decision {
+	remaining := s.config.Limit - int64(count)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	var retryAfter time.Duration
+	if !allowed {
+		// The next window starts empty
+		retryAfter = end.Sub(now)
+	}
+
+	return core.Decision{
+		Allowed:    allowed,
+		Remaining:  remaining,
+		ResetTime:  end,
+		RetryAfter: retryAfter,
+	}
+}
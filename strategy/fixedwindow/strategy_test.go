@@ -0,0 +1,91 @@
+package fixedwindow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/throttle/backend/memory"
+	"github.com/throttle/core"
+)
+
+// windowStart is an instant aligned to a minute
+var windowStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestStrategy_Calculate_WindowLimit(t *testing.T) {
+	config := core.Config{Limit: 3, Interval: time.Minute}
+	strategy := NewStrategy(config)
+	ctx := context.Background()
+
+	state := strategy.NewState(windowStart)
+	for i := 0; i < 3; i++ {
+		decision, err := strategy.Calculate(ctx, state, windowStart.Add(time.Duration(i)*time.Second))
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(2-i), decision.Remaining)
+		assert.Equal(t, windowStart.Add(time.Minute), decision.ResetTime)
+	}
+
+	now := windowStart.Add(20 * time.Second)
+	decision, err := strategy.Calculate(ctx, state, now)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, int64(0), decision.Remaining)
+	assert.Equal(t, 40*time.Second, decision.RetryAfter)
+	assert.Equal(t, 3.0, state.Tokens)
+}
+
+func TestStrategy_Calculate_NewWindowResets(t *testing.T) {
+	config := core.Config{Limit: 3, Interval: time.Minute}
+	strategy := NewStrategy(config)
+	ctx := context.Background()
+
+	state := &core.State{Tokens: 3, LastUpdate: windowStart.Add(59 * time.Second), Created: windowStart}
+
+	// Windows are aligned, so one second later is already the next window
+	decision, err := strategy.Calculate(ctx, state, windowStart.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, int64(2), decision.Remaining)
+	assert.Equal(t, 1.0, state.Tokens)
+}
+
+func TestStrategy_Preview_NoStateChange(t *testing.T) {
+	config := core.Config{Limit: 3, Interval: time.Minute}
+	strategy := NewStrategy(config)
+	ctx := context.Background()
+
+	state := &core.State{Tokens: 2, LastUpdate: windowStart, Created: windowStart}
+	original := *state
+
+	decision, err := strategy.Preview(ctx, state, windowStart.Add(time.Second))
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, int64(1), decision.Remaining)
+	assert.Equal(t, original, *state)
+}
+
+func TestStrategy_TTL(t *testing.T) {
+	strategy := NewStrategy(core.Config{Limit: 3, Interval: time.Minute})
+
+	state := &core.State{Tokens: 1, LastUpdate: windowStart.Add(45 * time.Second)}
+	assert.Equal(t, 15*time.Second, strategy.TTL(state))
+}
+
+func TestStrategy_WithLimiter(t *testing.T) {
+	config := core.Config{Limit: 2, Interval: time.Hour, Burst: 100}
+	limiter := core.NewLimiter(memory.NewBackend(), NewStrategy(config), config, nil)
+	ctx := context.Background()
+
+	// Fresh keys start with an empty window, not with Burst requests counted
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		decision, err := limiter.Grant(ctx, "key")
+		assert.NoError(t, err)
+		if decision.Allowed {
+			allowed++
+		}
+	}
+	assert.Equal(t, 2, allowed)
+}
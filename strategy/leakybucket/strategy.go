@@ -108,3 +108,12 @@ func (s *Strategy) Preview(ctx context.Context, state *core.State, now time.Time
 		RetryAfter: retryAfter,
 	}, nil
 }
+
+// TTL returns how long after the last update the bucket takes to drain
+// completely, at which point the state is the same as a fresh key's
+func (s *Strategy) TTL(state *core.State) time.Duration {
+	if state.Tokens <= 0 {
+		return 0
+	}
+	return time.Duration(state.Tokens / float64(s.config.Limit) * float64(s.config.Interval))
+}
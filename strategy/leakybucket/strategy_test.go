@@ -215,6 +215,21 @@ func TestStrategy_Calculate_ZeroBurst(t *testing.T) {
 	assert.Equal(t, int64(0), decision.Remaining)
 }
 
+func TestStrategy_TTL(t *testing.T) {
+	config := core.Config{
+		Limit:    10,
+		Interval: time.Minute,
+		Burst:    15,
+	}
+	strategy := NewStrategy(config)
+
+	// 5 requests in the bucket leak out at 10/min in 30 seconds
+	assert.Equal(t, 30*time.Second, strategy.TTL(&core.State{Tokens: 5}))
+	assert.Equal(t, time.Duration(0), strategy.TTL(&core.State{Tokens: 0}))
+
+	var _ core.Expirer = strategy
+}
+
 func BenchmarkStrategy_Calculate(b *testing.B) {
 	config := core.Config{
 		Limit:    1000,
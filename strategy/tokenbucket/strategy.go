@@ -99,3 +99,13 @@ func (s *Strategy) Preview(ctx context.Context, state *core.State, now time.Time
 		RetryAfter: retryAfter,
 	}, nil
 }
+
+// TTL returns how long after the last update the bucket takes to refill to
+// burst capacity, at which point the state is the same as a fresh key's
+func (s *Strategy) TTL(state *core.State) time.Duration {
+	missing := float64(s.config.Burst) - state.Tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(s.config.Limit) * float64(s.config.Interval))
+}
@@ -136,6 +136,22 @@ func TestStrategy_BurstLimit(t *testing.T) {
 	assert.Equal(t, int64(4), decision.Remaining) // 5 burst - 1 consumed = 4 remaining
 }
 
+func TestStrategy_TTL(t *testing.T) {
+	config := core.Config{
+		Limit:    10,
+		Interval: time.Minute,
+		Burst:    15,
+	}
+	strategy := NewStrategy(config)
+
+	// An empty bucket refills 15 tokens at 10/min in 90 seconds
+	assert.Equal(t, 90*time.Second, strategy.TTL(&core.State{Tokens: 0}))
+	assert.Equal(t, 30*time.Second, strategy.TTL(&core.State{Tokens: 10}))
+	assert.Equal(t, time.Duration(0), strategy.TTL(&core.State{Tokens: 15}))
+
+	var _ core.Expirer = strategy
+}
+
 func BenchmarkStrategy_Calculate(b *testing.B) {
 	config := core.Config{
 		Limit:    1000,